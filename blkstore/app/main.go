@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/shaladdle/goaaw/blkstore"
+)
+
+// This tool moves the blocks of a diskstore from one layout to another, for
+// example to convert a store that keeps every block directly under its root
+// to the sharded layout.
+
+var (
+	root       = flag.String("root", "", "root directory of the diskstore")
+	fromFanout = flag.Int("from-fanout", 0, "levels of directories in the current layout")
+	fromWidth  = flag.Int("from-width", 2, "characters per directory in the current layout")
+	toFanout   = flag.Int("fanout", blkstore.ShardedLayout.Fanout, "levels of directories in the new layout")
+	toWidth    = flag.Int("width", blkstore.ShardedLayout.Width, "characters per directory in the new layout")
+)
+
+func main() {
+	flag.Parse()
+
+	if *root == "" {
+		fmt.Fprintln(os.Stderr, "usage: app -root dir [-from-fanout n -from-width n] [-fanout n -width n]")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	from := blkstore.Layout{Fanout: *fromFanout, Width: *fromWidth}
+	to := blkstore.Layout{Fanout: *toFanout, Width: *toWidth}
+
+	moved, err := blkstore.MigrateDiskStore(*root, from, to)
+	fmt.Printf("Moved %v blocks\n", moved)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,189 @@
+package blkstore
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	anet "github.com/shaladdle/goaaw/net"
+	"github.com/shaladdle/goaaw/rpc"
+)
+
+// BlockClient is a block store kept on a BlockServer. Every operation,
+// including the batch ones, is a single rpc.
+type BlockClient struct {
+	rpc *rpc.Client
+}
+
+func NewBlockClient(d anet.Dialer) (*BlockClient, error) {
+	cli, err := rpc.NewClient(d)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BlockClient{cli}, nil
+}
+
+func NewTCPBlockClient(hostport string) (*BlockClient, error) {
+	return NewBlockClient(anet.TCPDialer(hostport))
+}
+
+// call makes a normal rpc whose last return value is the server's error.
+func (c *BlockClient) call(method string, args ...interface{}) error {
+	var cErr rpc.StrError
+
+	if err := c.rpc.Call("BlockStore."+method, append(args, &cErr)...); err != nil {
+		return fmt.Errorf("rpc error: %v", err)
+	}
+
+	if !cErr.IsNil() {
+		return cErr
+	}
+
+	return nil
+}
+
+func (c *BlockClient) Has(key string) (bool, error) {
+	var has bool
+
+	err := c.call("Has", key, &has)
+	return has, err
+}
+
+// HasMany reports whether there is a block stored under each of keys.
+func (c *BlockClient) HasMany(keys []string) ([]bool, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	var has []bool
+
+	err := c.call("HasMany", keys, &has)
+	return has, err
+}
+
+func (c *BlockClient) Size(key string) (int64, error) {
+	var size int64
+
+	err := c.call("Size", key, &size)
+	return size, err
+}
+
+func (c *BlockClient) Keys(prefix string) ([]string, error) {
+	var keys []string
+
+	err := c.call("Keys", prefix, &keys)
+	return keys, err
+}
+
+func (c *BlockClient) Get(key string) ([]byte, error) {
+	r, err := c.GetReader(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// GetReader streams a block from the server. Reading it fails if the stream
+// doesn't have the size the server said the block has, which also happens
+// if the block is replaced while it is being read.
+func (c *BlockClient) GetReader(key string) (io.ReadCloser, error) {
+	var (
+		cErr rpc.StrError
+		size int64
+	)
+
+	r, err := c.rpc.CallRead("BlockStore.Get", key, &size, &cErr)
+	if err != nil {
+		return nil, fmt.Errorf("rpc error: %v", err)
+	}
+
+	rc, ok := r.(io.ReadCloser)
+	if !ok {
+		rc = ioutil.NopCloser(r)
+	}
+
+	if !cErr.IsNil() {
+		rc.Close()
+		return nil, cErr
+	}
+
+	return &sizedReader{rc, key, size}, nil
+}
+
+// sizedReader checks that a stream is exactly left bytes long.
+type sizedReader struct {
+	r    io.ReadCloser
+	key  string
+	left int64
+}
+
+func (s *sizedReader) Read(b []byte) (int, error) {
+	n, err := s.r.Read(b)
+	s.left -= int64(n)
+
+	switch {
+	case s.left < 0:
+		return n, fmt.Errorf("block %v is longer than the server said", s.key)
+	case err == io.EOF && s.left > 0:
+		return n, fmt.Errorf("block %v: %w", s.key, io.ErrUnexpectedEOF)
+	}
+
+	return n, err
+}
+
+func (s *sizedReader) Close() error {
+	return s.r.Close()
+}
+
+func (c *BlockClient) GetMany(keys []string) ([][]byte, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	var blks [][]byte
+
+	err := c.call("GetMany", keys, &blks)
+	return blks, err
+}
+
+// Put sends a block along with its hash, which the server checks before
+// storing it.
+func (c *BlockClient) Put(key string, blk []byte) error {
+	sum := sha256.Sum256(blk)
+	return c.call("Put", key, blk, sum[:])
+}
+
+// PutMany sends all of blks in one rpc. Nothing is stored if any of them
+// arrives damaged.
+func (c *BlockClient) PutMany(keys []string, blks [][]byte) error {
+	if len(keys) != len(blks) {
+		return errMismatch
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	sums := make([][]byte, len(blks))
+	for i, blk := range blks {
+		sum := sha256.Sum256(blk)
+		sums[i] = sum[:]
+	}
+
+	return c.call("PutMany", keys, blks, sums)
+}
+
+func (c *BlockClient) Delete(key string) error {
+	return c.call("Delete", key)
+}
+
+func (c *BlockClient) DeleteMany(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	return c.call("DeleteMany", keys)
+}
@@ -0,0 +1,150 @@
+package blkstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/shaladdle/goaaw/rpc"
+)
+
+func init() {
+	// Arguments to rpcs are sent as interface values, and gob only knows
+	// about the basic types.
+	gob.Register([][]byte(nil))
+}
+
+// BlockServer serves a block store to BlockClients over the rpc package.
+// Unlike a remote store, which maps every block to a file on a filestore
+// server, it speaks in blocks: it can answer whether blocks exist, take and
+// return many at once, and checks every block it is sent against the hash
+// the client computed before storing it.
+//
+// Errors reach the client as rpc.StrErrors that errors.Is still matches
+// against ErrNotExist, ErrCorrupted and ErrStoreFull, since those are
+// filestore errors that the filestore remote package registers with rpc.
+type BlockServer struct {
+	store  ExtBlkStore
+	rpcSrv *rpc.Server
+}
+
+// NewBlockServer serves store to clients connecting through l.
+func NewBlockServer(store ExtBlkStore, l net.Listener) *BlockServer {
+	srv := newBlockServer(store)
+	go srv.rpcSrv.Accept(l)
+
+	return srv
+}
+
+func NewTCPBlockServer(store ExtBlkStore, hostport string) (*BlockServer, error) {
+	srv := newBlockServer(store)
+	if err := srv.rpcSrv.TCPListen(hostport); err != nil {
+		return nil, err
+	}
+
+	return srv, nil
+}
+
+func newBlockServer(store ExtBlkStore) *BlockServer {
+	srv := &BlockServer{store: store, rpcSrv: rpc.NewServer()}
+	srv.rpcSrv.Register("BlockStore", srv)
+
+	return srv
+}
+
+func (s *BlockServer) Close() {
+	s.rpcSrv.Close()
+}
+
+// verifyBlock checks that blk has the SHA-256 hash sum.
+func verifyBlock(key string, blk, sum []byte) error {
+	if h := sha256.Sum256(blk); !bytes.Equal(h[:], sum) {
+		return fmt.Errorf("block %v: %w", key, ErrCorrupted)
+	}
+
+	return nil
+}
+
+func (s *BlockServer) RPCNorm_Has(key string) (bool, rpc.StrError) {
+	has, err := s.store.Has(key)
+	return has, rpc.NewError(err)
+}
+
+func (s *BlockServer) RPCNorm_HasMany(keys []string) ([]bool, rpc.StrError) {
+	has := make([]bool, len(keys))
+	for i, key := range keys {
+		var err error
+		if has[i], err = s.store.Has(key); err != nil {
+			return nil, rpc.NewError(err)
+		}
+	}
+
+	return has, rpc.ErrNil
+}
+
+func (s *BlockServer) RPCNorm_Size(key string) (int64, rpc.StrError) {
+	size, err := s.store.Size(key)
+	return size, rpc.NewError(err)
+}
+
+func (s *BlockServer) RPCNorm_Keys(prefix string) ([]string, rpc.StrError) {
+	keys, err := s.store.Keys(prefix)
+	return keys, rpc.NewError(err)
+}
+
+// RPCRead_Get streams a block, after sending its size so that the client can
+// tell a stream that was cut off from the end of the block.
+func (s *BlockServer) RPCRead_Get(key string) (io.Reader, int64, rpc.StrError) {
+	size, err := s.store.Size(key)
+	if err != nil {
+		return nil, 0, rpc.NewError(err)
+	}
+
+	r, err := GetReader(s.store, key)
+	if err != nil {
+		return nil, 0, rpc.NewError(err)
+	}
+
+	return r, size, rpc.ErrNil
+}
+
+func (s *BlockServer) RPCNorm_GetMany(keys []string) ([][]byte, rpc.StrError) {
+	blks, err := s.store.GetMany(keys)
+	return blks, rpc.NewError(err)
+}
+
+// RPCNorm_Put stores a block, if it has the hash the client sent with it.
+func (s *BlockServer) RPCNorm_Put(key string, blk, sum []byte) rpc.StrError {
+	if err := verifyBlock(key, blk, sum); err != nil {
+		return rpc.NewError(err)
+	}
+
+	return rpc.NewError(s.store.Put(key, blk))
+}
+
+// RPCNorm_PutMany stores many blocks. If any of them doesn't have the hash
+// the client sent with it, none are stored.
+func (s *BlockServer) RPCNorm_PutMany(keys []string, blks, sums [][]byte) rpc.StrError {
+	if len(keys) != len(blks) || len(keys) != len(sums) {
+		return rpc.NewError(errMismatch)
+	}
+
+	for i, key := range keys {
+		if err := verifyBlock(key, blks[i], sums[i]); err != nil {
+			return rpc.NewError(err)
+		}
+	}
+
+	return rpc.NewError(s.store.PutMany(keys, blks))
+}
+
+func (s *BlockServer) RPCNorm_Delete(key string) rpc.StrError {
+	return rpc.NewError(s.store.Delete(key))
+}
+
+func (s *BlockServer) RPCNorm_DeleteMany(keys []string) rpc.StrError {
+	return rpc.NewError(s.store.DeleteMany(keys))
+}
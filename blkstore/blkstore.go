@@ -1,5 +1,31 @@
 package blkstore
 
+import (
+	"fmt"
+	"io"
+
+	"github.com/shaladdle/goaaw/filestore"
+)
+
+// Errors returned by block stores, wrapped with the key they are about. They
+// are the filestore errors, so stores kept on a filestore return the same
+// ones, and they survive the trip to a BlockClient.
+var (
+	ErrNotExist = fs.ErrNotExist
+
+	// ErrCorrupted is returned when a block's contents don't match the
+	// hash it is stored under or was sent with.
+	ErrCorrupted = fs.ErrIntegrity
+
+	// ErrStoreFull is returned when a block doesn't fit in a store that
+	// has a capacity.
+	ErrStoreFull = fs.ErrFull
+)
+
+func notExist(key string) error {
+	return fmt.Errorf("block %v: %w", key, ErrNotExist)
+}
+
 // BlkStore represents a simple key value store.
 type BlkStore interface {
 	Get(key string) ([]byte, error)
@@ -7,9 +33,57 @@ type BlkStore interface {
 	Delete(key string) error
 }
 
+// ExtBlkStore is a BlkStore that can also answer questions about blocks
+// without fetching them, and work on many blocks at once.
+type ExtBlkStore interface {
+	BlkStore
+
+	// Has reports whether there is a block stored under key.
+	Has(key string) (bool, error)
+
+	// Size returns the size of the block stored under key.
+	Size(key string) (int64, error)
+
+	// Keys returns the keys of all the blocks whose keys start with
+	// prefix, in sorted order.
+	Keys(prefix string) ([]string, error)
+
+	// GetMany returns the blocks stored under each of keys, failing if
+	// any of them is missing.
+	GetMany(keys []string) ([][]byte, error)
+
+	// PutMany stores each of blks under the matching entry of keys.
+	PutMany(keys []string, blks [][]byte) error
+
+	// DeleteMany deletes the blocks stored under each of keys. It deletes
+	// as many as it can, and returns the first error it ran into.
+	DeleteMany(keys []string) error
+}
+
+// UsageBlkStore is implemented by block stores that keep count of how much
+// they hold, such as the one returned by NewMemStore. Callers should type
+// assert an ExtBlkStore to find out whether it is supported.
+type UsageBlkStore interface {
+	ExtBlkStore
+
+	// Usage returns the total size of the blocks in the store.
+	Usage() int64
+}
+
 // BlkCache represents a cache with automatic eviction.
 type BlkCache interface {
 	Get(key string) ([]byte, error)
 	Put(key string, blk []byte) error
 	Has(key string) bool
+
+	// Delete drops a block from the cache, if it is there.
+	Delete(key string) error
+
+	// GetReader and PutReader stream blocks through the cache, as
+	// StreamBlkStore does.
+	GetReader(key string) (io.ReadCloser, error)
+	PutReader(key string, r io.Reader) (int64, error)
+
+	// Stats returns counts of the cache's hits, misses and evictions.
+	Stats() CacheStats
 }
@@ -1,9 +1,21 @@
 package blkstore
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
 	"testing"
 
-	"github.com/shaladdle/goaaw/fs/remote"
+	"github.com/shaladdle/goaaw/filestore/compress"
+	"github.com/shaladdle/goaaw/filestore/crypt"
+	"github.com/shaladdle/goaaw/filestore/remote"
 	anet "github.com/shaladdle/goaaw/net"
 	"github.com/shaladdle/goaaw/testutil"
 )
@@ -21,6 +33,17 @@ var tests = []testCase{
 		te := testutil.NewTestEnv("disk", t)
 		return NewDiskStore(te.Root()), func() { te.Teardown() }
 	}},
+	{"sharded", func(t *testing.T) (BlkStore, func()) {
+		te := testutil.NewTestEnv("sharded", t)
+		return NewDiskStoreWithOptions(te.Root(), DiskOptions{Layout: ShardedLayout, Sync: true}), func() { te.Teardown() }
+	}},
+	{"compressed", func(t *testing.T) (BlkStore, func()) {
+		return NewCompressedStore(NewMemStore(), compress.Gzip), func() {}
+	}},
+	{"encrypted", func(t *testing.T) (BlkStore, func()) {
+		var key crypt.Key
+		return NewEncryptedStore(NewMemStore(), key), func() {}
+	}},
 	{"remote", func(t *testing.T) (BlkStore, func()) {
 		const hostport = "localhost:9000"
 		te := testutil.NewTestEnv("remote", t)
@@ -40,6 +63,31 @@ var tests = []testCase{
 			te.Teardown()
 		}
 	}},
+	{"pack", func(t *testing.T) (BlkStore, func()) {
+		te := testutil.NewTestEnv("pack", t)
+
+		// Small packs, so that the tests fill more than one.
+		bs, err := OpenPackStore(te.Root(), PackOptions{MaxPackSize: 64})
+		if err != nil {
+			t.Errorf("setup error: %v", err)
+		}
+
+		return bs, func() {
+			bs.Close()
+			te.Teardown()
+		}
+	}},
+	{"block", func(t *testing.T) (BlkStore, func()) {
+		pnet := anet.NewPipeNet()
+		srv := NewBlockServer(NewMemStore(), pnet)
+
+		bs, err := NewBlockClient(pnet)
+		if err != nil {
+			t.Errorf("setup error: %v", err)
+		}
+
+		return bs, func() { srv.Close() }
+	}},
 }
 
 func testPutGet(t *testing.T, test testCase) {
@@ -82,8 +130,8 @@ func testDelete(t *testing.T, test testCase) {
 		want = "value"
 	)
 
-	if _, err := bs.Get(key); err == nil {
-		t.Errorf("%v: get didn't return an error, but it should", test.name)
+	if _, err := bs.Get(key); !errors.Is(err, ErrNotExist) {
+		t.Errorf("%v: get of a missing block got %v, want ErrNotExist", test.name, err)
 	}
 
 	if err := bs.Put(key, []byte(want)); err != nil {
@@ -98,8 +146,12 @@ func testDelete(t *testing.T, test testCase) {
 		t.Errorf("%v: get error after putting: %v", test.name, err)
 	}
 
-	if _, err := bs.Get(key); err == nil {
-		t.Errorf("%v: get didn't return an error, but it should", test.name)
+	if err := bs.Delete(key); !errors.Is(err, ErrNotExist) {
+		t.Errorf("%v: delete of a missing block got %v, want ErrNotExist", test.name, err)
+	}
+
+	if _, err := bs.Get(key); !errors.Is(err, ErrNotExist) {
+		t.Errorf("%v: get of a missing block got %v, want ErrNotExist", test.name, err)
 	}
 }
 
@@ -108,3 +160,440 @@ func TestDelete(t *testing.T) {
 		testDelete(t, test)
 	}
 }
+
+func TestEncryptedTamper(t *testing.T) {
+	var key crypt.Key
+
+	mem := NewMemStore()
+	bs := NewEncryptedStore(mem, key)
+
+	if err := bs.Put("key", []byte("value")); err != nil {
+		t.Fatalf("put error: %v", err)
+	}
+
+	b, err := mem.Get("key")
+	if err != nil {
+		t.Fatalf("get error: %v", err)
+	}
+	b[len(b)-1] ^= 1
+	if err := mem.Put("key", b); err != nil {
+		t.Fatalf("put error: %v", err)
+	}
+
+	if _, err := bs.Get("key"); err != crypt.ErrTampered {
+		t.Errorf("got error %v, want %v", err, crypt.ErrTampered)
+	}
+
+	// A block that is intact, but under another key, is caught too.
+	if err := bs.Put("other", []byte("other value")); err != nil {
+		t.Fatalf("put error: %v", err)
+	}
+	if b, err = mem.Get("other"); err != nil {
+		t.Fatalf("get error: %v", err)
+	}
+	if err := mem.Put("key", b); err != nil {
+		t.Fatalf("put error: %v", err)
+	}
+
+	if _, err := bs.Get("key"); err != crypt.ErrTampered {
+		t.Errorf("moved block: got error %v, want %v", err, crypt.ErrTampered)
+	}
+}
+
+func testExtended(t *testing.T, test testCase) {
+	store, cleanup := test.setup(t)
+	defer cleanup()
+
+	bs, ok := store.(ExtBlkStore)
+	if !ok {
+		return
+	}
+
+	keys := []string{"blk-b", "blk-a", "other", "blk-c"}
+	blks := [][]byte{[]byte("b"), []byte("aa"), []byte("other"), []byte("cccc")}
+
+	if err := bs.PutMany(keys, blks); err != nil {
+		t.Fatalf("%v: put many: %v", test.name, err)
+	}
+
+	got, err := bs.GetMany(keys)
+	if err != nil {
+		t.Fatalf("%v: get many: %v", test.name, err)
+	}
+	for i := range keys {
+		if string(got[i]) != string(blks[i]) {
+			t.Errorf("%v: get many got %q for %v, want %q", test.name, got[i], keys[i], blks[i])
+		}
+	}
+
+	if _, err := bs.GetMany([]string{"blk-a", "missing"}); err == nil {
+		t.Errorf("%v: get many of a missing key didn't return an error", test.name)
+	}
+
+	if has, err := bs.Has("blk-a"); err != nil || !has {
+		t.Errorf("%v: has blk-a got %v, %v, want true", test.name, has, err)
+	}
+	if has, err := bs.Has("missing"); err != nil || has {
+		t.Errorf("%v: has missing got %v, %v, want false", test.name, has, err)
+	}
+
+	if size, err := bs.Size("blk-c"); err != nil || size != 4 {
+		t.Errorf("%v: size got %v, %v, want 4", test.name, size, err)
+	}
+	if _, err := bs.Size("missing"); err == nil {
+		t.Errorf("%v: size of a missing key didn't return an error", test.name)
+	}
+
+	if got, err := bs.Keys("blk-"); err != nil || strings.Join(got, ",") != "blk-a,blk-b,blk-c" {
+		t.Errorf("%v: keys got %v, %v, want blk-a, blk-b and blk-c", test.name, got, err)
+	}
+
+	if err := bs.DeleteMany([]string{"blk-a", "blk-b"}); err != nil {
+		t.Errorf("%v: delete many: %v", test.name, err)
+	}
+	if got, err := bs.Keys(""); err != nil || strings.Join(got, ",") != "blk-c,other" {
+		t.Errorf("%v: keys after deleting got %v, %v, want blk-c and other", test.name, got, err)
+	}
+}
+
+func TestExtended(t *testing.T) {
+	for _, test := range tests {
+		testExtended(t, test)
+	}
+}
+
+// failingReader returns some data and then an error, like a connection that
+// drops part way through.
+type failingReader struct {
+	data []byte
+}
+
+var errFailingReader = errors.New("read failed")
+
+func (r *failingReader) Read(b []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, errFailingReader
+	}
+
+	n := copy(b, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func testStream(t *testing.T, test testCase) {
+	bs, cleanup := test.setup(t)
+	defer cleanup()
+
+	var buf bytes.Buffer
+	if err := testutil.WriteRandFile(&buf, 256*testutil.KB); err != nil {
+		t.Fatal(err)
+	}
+	want := buf.Bytes()
+
+	if n, err := PutReader(bs, "big", bytes.NewReader(want)); err != nil {
+		t.Fatalf("%v: put reader: %v", test.name, err)
+	} else if n != int64(len(want)) {
+		t.Errorf("%v: put reader stored %v bytes, want %v", test.name, n, len(want))
+	}
+
+	r, err := GetReader(bs, "big")
+	if err != nil {
+		t.Fatalf("%v: get reader: %v", test.name, err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("%v: get reader returned different bytes (%v)", test.name, err)
+	}
+
+	// A block whose source fails part way isn't stored.
+	if _, err := PutReader(bs, "partial", &failingReader{want[:1000]}); err != errFailingReader {
+		t.Errorf("%v: put reader of a failing reader got %v, want %v", test.name, err, errFailingReader)
+	}
+	if _, err := bs.Get("partial"); err == nil {
+		t.Errorf("%v: partial block was stored", test.name)
+	}
+}
+
+func TestStream(t *testing.T) {
+	for _, test := range tests {
+		testStream(t, test)
+	}
+}
+
+func testConcurrent(t *testing.T, test testCase) {
+	bs, cleanup := test.setup(t)
+	defer cleanup()
+
+	const (
+		numWorkers = 8
+		numOps     = 50
+	)
+
+	shared := []byte("shared value")
+
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < numOps; i++ {
+				// Each worker has its own keys, which must always
+				// read back exactly.
+				key := fmt.Sprintf("w%v-%v", w, i%5)
+				want := []byte(fmt.Sprintf("worker %v op %v", w, i))
+
+				if err := bs.Put(key, want); err != nil {
+					t.Errorf("%v: put error: %v", test.name, err)
+					return
+				}
+				if got, err := bs.Get(key); err != nil || !bytes.Equal(got, want) {
+					t.Errorf("%v: get %v got %q, %v, want %q", test.name, key, got, err, want)
+					return
+				}
+
+				// Everyone also writes the same key with the same
+				// contents, so whatever is read must be whole.
+				bs.Put("shared", shared)
+				if got, err := bs.Get("shared"); err == nil && !bytes.Equal(got, shared) {
+					t.Errorf("%v: shared key got %q", test.name, got)
+				}
+
+				if i%5 == 4 {
+					bs.Delete(key)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func TestConcurrent(t *testing.T) {
+	for _, test := range tests {
+		testConcurrent(t, test)
+	}
+}
+
+// TestDiskLayout checks where a sharded diskstore puts its blocks, and that a
+// flat store can be migrated to it.
+func TestDiskLayout(t *testing.T) {
+	te := testutil.NewTestEnv("layout", t)
+	defer te.Teardown()
+
+	keys := []string{"abcdef", "abxyz", "q", "dir/key"}
+
+	flat := NewDiskStore(te.Root())
+	for _, key := range keys {
+		if err := flat.Put(key, []byte("value of "+key)); err != nil {
+			t.Fatalf("put %v: %v", key, err)
+		}
+	}
+
+	moved, err := MigrateDiskStore(te.Root(), Layout{}, ShardedLayout)
+	if err != nil || moved != len(keys) {
+		t.Fatalf("migrate got %v, %v, want %v blocks moved", moved, err, len(keys))
+	}
+
+	for p, want := range map[string]bool{"ab/cd/abcdef": true, "ab/xy/abxyz": true, "q_/__/q": true, "di/r_/dir/key": true, "abcdef": false, "dir": false} {
+		if _, err := os.Stat(te.PathFor(p)); (err == nil) != want {
+			t.Errorf("%v exists: %v, want %v", p, err == nil, want)
+		}
+	}
+
+	sharded := NewDiskStoreWithOptions(te.Root(), DiskOptions{Layout: ShardedLayout})
+	for _, key := range keys {
+		if got, err := sharded.Get(key); err != nil || string(got) != "value of "+key {
+			t.Errorf("get %v after migrating got %q, %v", key, got, err)
+		}
+	}
+	if got, err := sharded.Keys(""); err != nil || strings.Join(got, ",") != "abcdef,abxyz,dir/key,q" {
+		t.Errorf("keys after migrating got %v, %v", got, err)
+	}
+
+	// Migrating again has nothing left to do.
+	if moved, err := MigrateDiskStore(te.Root(), Layout{}, ShardedLayout); err != nil || moved != 0 {
+		t.Errorf("second migrate got %v, %v, want nothing moved", moved, err)
+	}
+
+	// And the migration can be undone.
+	if moved, err := MigrateDiskStore(te.Root(), ShardedLayout, Layout{}); err != nil || moved != len(keys) {
+		t.Errorf("migrate back got %v, %v, want %v blocks moved", moved, err, len(keys))
+	}
+	if got, err := flat.Keys(""); err != nil || strings.Join(got, ",") != "abcdef,abxyz,dir/key,q" {
+		t.Errorf("keys after migrating back got %v, %v", got, err)
+	}
+}
+
+func TestCAS(t *testing.T) {
+	mem := NewMemStore()
+	cas := NewCASStore(mem, nil)
+
+	blks := []string{"first block", "second block", "third block"}
+	keys := make([]string, len(blks))
+	for i, blk := range blks {
+		key, err := cas.Put([]byte(blk))
+		if err != nil {
+			t.Fatalf("put error: %v", err)
+		}
+
+		if sum := sha256.Sum256([]byte(blk)); key != hex.EncodeToString(sum[:]) {
+			t.Errorf("put returned key %v, want the SHA-256 of the block", key)
+		}
+		keys[i] = key
+	}
+
+	// Putting the same block again gives the same key.
+	if key, err := cas.Put([]byte(blks[0])); err != nil || key != keys[0] {
+		t.Errorf("second put got %v, %v, want %v", key, err, keys[0])
+	}
+
+	for i, key := range keys {
+		if got, err := cas.Get(key); err != nil || string(got) != blks[i] {
+			t.Errorf("get %v got %q, %v, want %q", key, got, err, blks[i])
+		}
+	}
+
+	if bad, err := cas.Verify(); err != nil || len(bad) != 0 {
+		t.Errorf("verify of an intact store got %v, %v", bad, err)
+	}
+
+	// Damage a block behind the store's back.
+	mem.Put(keys[1], []byte("something else"))
+
+	if _, err := cas.Get(keys[1]); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("get of a damaged block got %v, want ErrCorrupted", err)
+	}
+
+	bad, err := cas.Verify()
+	if err != nil {
+		t.Fatalf("verify error: %v", err)
+	}
+	if len(bad) != 1 || bad[0].Key != keys[1] || !errors.Is(bad[0].Err, ErrCorrupted) {
+		t.Errorf("verify got %v, want only %v to be corrupted", bad, keys[1])
+	}
+
+	// Putting the block again doesn't notice the damage, but repairing it
+	// does fix it.
+	if key, err := cas.Put([]byte(blks[1])); err != nil || key != keys[1] {
+		t.Errorf("put of a damaged block got %v, %v, want %v", key, err, keys[1])
+	}
+	if key, err := cas.Repair([]byte(blks[1])); err != nil || key != keys[1] {
+		t.Errorf("repair got %v, %v, want %v", key, err, keys[1])
+	}
+	if got, err := cas.Get(keys[1]); err != nil || string(got) != blks[1] {
+		t.Errorf("get of a repaired block got %q, %v, want %q", got, err, blks[1])
+	}
+	if bad, err := cas.Verify(); err != nil || len(bad) != 0 {
+		t.Errorf("verify after repair got %v, %v", bad, err)
+	}
+}
+
+func TestCASHash(t *testing.T) {
+	cas := NewCASStore(NewMemStore(), sha1.New)
+
+	key, err := cas.Put([]byte("block"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha1.Sum([]byte("block")); key != hex.EncodeToString(sum[:]) {
+		t.Errorf("got key %v, want the SHA-1 of the block", key)
+	}
+	if got, err := cas.Get(key); err != nil || string(got) != "block" {
+		t.Errorf("get got %q, %v", got, err)
+	}
+}
+
+func TestBlockServer(t *testing.T) {
+	pnet := anet.NewPipeNet()
+	store := NewMemStore()
+	srv := NewBlockServer(store, pnet)
+	defer srv.Close()
+
+	cli, err := NewBlockClient(pnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{"a", "b", "c"}
+	blks := [][]byte{[]byte("block a"), []byte("block b"), {}}
+	if err := cli.PutMany(keys, blks); err != nil {
+		t.Fatalf("put many: %v", err)
+	}
+
+	has, err := cli.HasMany([]string{"a", "x", "c"})
+	if err != nil {
+		t.Fatalf("has many: %v", err)
+	}
+	if want := []bool{true, false, true}; fmt.Sprint(has) != fmt.Sprint(want) {
+		t.Errorf("has many got %v, want %v", has, want)
+	}
+
+	if err := cli.Put("empty", nil); err != nil {
+		t.Errorf("put of an empty block: %v", err)
+	} else if b, err := cli.Get("empty"); err != nil || len(b) != 0 {
+		t.Errorf("get of an empty block got %q, %v", b, err)
+	}
+
+	r, err := cli.GetReader("b")
+	if err != nil {
+		t.Fatalf("get reader: %v", err)
+	}
+	if b, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(b, blks[1]) {
+		t.Errorf("streamed get got %q, %v, want %q", b, err, blks[1])
+	}
+	r.Close()
+
+	// The server refuses blocks that don't match the hash sent with them.
+	sum := sha256.Sum256([]byte("something else"))
+	if err := cli.call("Put", "d", []byte("block d"), sum[:]); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("put with the wrong hash got %v, want ErrCorrupted", err)
+	}
+	good := sha256.Sum256([]byte("block e"))
+	err = cli.call("PutMany", []string{"e", "d"}, [][]byte{[]byte("block e"), []byte("block d")}, [][]byte{good[:], sum[:]})
+	if !errors.Is(err, ErrCorrupted) {
+		t.Errorf("put many with a wrong hash got %v, want ErrCorrupted", err)
+	}
+	for _, key := range []string{"d", "e"} {
+		if has, _ := store.Has(key); has {
+			t.Errorf("block %v was stored even though a block sent with it was damaged", key)
+		}
+	}
+}
+
+// TestBlockServerFull checks that a client can tell a full store from other
+// failures.
+func TestBlockServerFull(t *testing.T) {
+	pnet := anet.NewPipeNet()
+	srv := NewBlockServer(NewMemStoreWithOptions(MemOptions{Capacity: 4}), pnet)
+	defer srv.Close()
+
+	cli, err := NewBlockClient(pnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cli.Put("a", []byte("too big")); !errors.Is(err, ErrStoreFull) {
+		t.Errorf("put over capacity got %v, want ErrStoreFull", err)
+	}
+	if _, err := cli.Size("a"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("size of a missing block got %v, want ErrNotExist", err)
+	}
+}
+
+func TestSizedReader(t *testing.T) {
+	for _, test := range []struct {
+		data string
+		size int64
+		ok   bool
+	}{
+		{"block", 5, true},
+		{"blo", 5, false},
+		{"block and more", 5, false},
+	} {
+		r := &sizedReader{ioutil.NopCloser(strings.NewReader(test.data)), "key", test.size}
+		if _, err := ioutil.ReadAll(r); (err == nil) != test.ok {
+			t.Errorf("reading %q as a block of size %v got error %v", test.data, test.size, err)
+		}
+	}
+}
@@ -1,35 +1,202 @@
 package blkstore
 
 import (
-	"container/list"
+	"errors"
 	"fmt"
+	"io"
+	"sync"
 )
 
+// CacheStats counts what a cache has done since it was created.
+type CacheStats struct {
+	Hits         int64
+	Misses       int64
+	Evictions    int64
+	EvictedBytes int64
+}
+
+// HitRate returns the fraction of reads that were hits, or 0 if there
+// haven't been any.
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// blkcache is safe for concurrent use. mu protects the eviction bookkeeping,
+// and is only held for short stretches. Reading and writing blocks in the
+// store happens under the key's stripe of locks instead, so operations on
+// one key are serialized without getting in the way of other keys.
 type blkcache struct {
 	store   BlkStore
-	lruList *list.List
-	lruMap  map[string]*list.Element
 	maxSize int64
+	locks   stripedLock
+
+	mu      sync.Mutex
+	policy  Policy
+	sizes   map[string]int64
 	curSize int64
+	stats   CacheStats
+	journal *cacheJournal
 }
 
-type blkcacheListEl struct {
-	key  string
-	size int64
+// NewCache returns a cache that evicts the least recently used blocks once
+// it holds more than maxSize bytes.
+func NewCache(store BlkStore, maxSize int64) BlkCache {
+	return NewCacheWithPolicy(store, maxSize, NewLRU())
 }
 
-func NewCache(store BlkStore, maxSize int64) BlkCache {
+// NewCacheWithPolicy returns a cache that chooses which blocks to evict
+// using policy. A policy must not be shared between caches.
+func NewCacheWithPolicy(store BlkStore, maxSize int64, policy Policy) BlkCache {
 	return &blkcache{
 		store:   store,
-		lruList: list.New(),
-		lruMap:  make(map[string]*list.Element),
 		maxSize: maxSize,
+		policy:  policy,
+		sizes:   make(map[string]int64),
+	}
+}
+
+// CacheOptions controls a cache opened with OpenCache.
+type CacheOptions struct {
+	// Policy chooses which blocks to evict. If it is nil, the least
+	// recently used ones are.
+	Policy Policy
+
+	// Journal is the path of a file that the cache records its eviction
+	// order in, so that the order is kept across restarts. Without one, the
+	// blocks found in the store when the cache is opened are all treated as
+	// equally old, and evicted in key order.
+	Journal string
+}
+
+// PersistentCache is a cache whose blocks outlive it.
+type PersistentCache interface {
+	BlkCache
+
+	// Close writes out the cache's journal. The cache can't be used after
+	// it is closed.
+	Close() error
+}
+
+// OpenCache returns a cache over the blocks already in store, as an earlier
+// cache over the same store left them. If they don't all fit in maxSize, the
+// ones the policy picks are evicted straight away.
+func OpenCache(store ExtBlkStore, maxSize int64, opts CacheOptions) (PersistentCache, error) {
+	policy := opts.Policy
+	if policy == nil {
+		policy = NewLRU()
+	}
+
+	c := NewCacheWithPolicy(store, maxSize, policy).(*blkcache)
+
+	keys, err := store.Keys("")
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := make(map[string]int64, len(keys))
+	for _, key := range keys {
+		if sizes[key], err = store.Size(key); err != nil {
+			return nil, err
+		}
+	}
+
+	// Replay the journal to find the order of the blocks it knows about.
+	old := newCacheJournal(opts.Journal)
+	if opts.Journal != "" {
+		recs, err := readJournal(opts.Journal)
+		if err != nil {
+			return nil, err
+		}
+		for _, rec := range recs {
+			old.apply(rec)
+		}
 	}
+
+	// The store is the authority on which blocks there are and how big
+	// they are. Blocks the journal doesn't know about were most likely put
+	// just before a crash, so they go last, as the most recently used.
+	j := newCacheJournal(opts.Journal)
+	for _, rec := range old.live() {
+		if size, ok := sizes[rec.key]; ok {
+			rec.size = size
+			j.apply(rec)
+		}
+	}
+	for _, key := range keys {
+		if _, ok := j.entries[key]; !ok {
+			j.apply(journalRecord{journalAdd, key, sizes[key]})
+		}
+	}
+
+	for _, rec := range j.live() {
+		if rec.op == journalAdd {
+			c.sizes[rec.key] = rec.size
+			c.curSize += rec.size
+			c.policy.Add(rec.key, rec.size)
+		} else {
+			c.policy.Access(rec.key)
+		}
+	}
+
+	if opts.Journal != "" {
+		if err := j.compact(); err != nil {
+			return nil, err
+		}
+		c.journal = j
+	}
+
+	c.mu.Lock()
+	victims := c.overflow()
+	c.mu.Unlock()
+
+	for _, victim := range victims {
+		if err := c.evict(victim); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Close closes the cache's journal, if it has one.
+func (c *blkcache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	j := c.journal
+	if j == nil {
+		return nil
+	}
+
+	err := j.err
+	if j.f != nil {
+		if cerr := j.close(); err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// Stats returns the cache's hit, miss and eviction counts.
+func (c *blkcache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stats
 }
 
 func (c *blkcache) Get(key string) ([]byte, error) {
-	if _, ok := c.lruMap[key]; !ok {
-		return nil, fmt.Errorf("key '%v' is not in the blkcache")
+	l := c.locks.get(key)
+	l.RLock()
+	defer l.RUnlock()
+
+	if !c.lookup(key) {
+		return nil, fmt.Errorf("key '%v' is not in the blkcache: %w", key, ErrNotExist)
 	}
 
 	b, err := c.store.Get(key)
@@ -37,7 +204,7 @@ func (c *blkcache) Get(key string) ([]byte, error) {
 		return nil, err
 	}
 
-	c.moveToFront(key)
+	c.access(key)
 
 	return b, nil
 }
@@ -45,56 +212,209 @@ func (c *blkcache) Get(key string) ([]byte, error) {
 func (c *blkcache) Put(key string, value []byte) error {
 	size := int64(len(value))
 	if size > c.maxSize {
+		return fmt.Errorf("block of size %v is larger than the blkcache", size)
+	}
+
+	_, err := c.put(key, func() (int64, error) {
+		return size, c.store.Put(key, value)
+	})
+
+	return err
+}
+
+func (c *blkcache) Delete(key string) error {
+	l := c.locks.get(key)
+	l.Lock()
+	defer l.Unlock()
+
+	c.mu.Lock()
+	ok := c.forget(key)
+	c.mu.Unlock()
+
+	if !ok {
 		return nil
 	}
 
-	// If the item is already in the blkcache, evict it since we will replace it
-	// with the new one.
-	if el, ok := c.lruMap[key]; ok {
-		if err := c.evictEl(el); err != nil {
-			return err
-		}
+	return c.store.Delete(key)
+}
+
+// GetReader streams a block out of the cache, if the cache's store supports
+// streaming.
+func (c *blkcache) GetReader(key string) (io.ReadCloser, error) {
+	l := c.locks.get(key)
+	l.RLock()
+	defer l.RUnlock()
+
+	if !c.lookup(key) {
+		return nil, fmt.Errorf("key '%v' is not in the blkcache: %w", key, ErrNotExist)
 	}
 
-	// Evict down to the size limit.
-	for size+c.curSize > c.maxSize {
-		if err := c.evictEl(c.lruList.Back()); err != nil {
-			return err
-		}
+	r, err := GetReader(c.store, key)
+	if err != nil {
+		return nil, err
 	}
 
-	// Actually put the item in the blkcache.
-	if err := c.store.Put(key, value); err != nil {
-		return err
+	c.access(key)
+
+	return r, nil
+}
+
+// PutReader streams a block into the cache.
+func (c *blkcache) PutReader(key string, r io.Reader) (int64, error) {
+	size, err := c.put(key, func() (int64, error) {
+		return PutReader(c.store, key, &limitReader{r: r, left: c.maxSize})
+	})
+	if err == errTooBig {
+		err = fmt.Errorf("block is larger than the blkcache")
+	}
+
+	return size, err
+}
+
+// put stores a block using store, which returns the block's size, then
+// evicts other blocks until the cache fits in maxSize again. Blocks are
+// evicted after the new one is stored, because a streamed block's size isn't
+// known until then, and so that the key's stripe isn't held while locking
+// the stripes of the blocks being evicted. This means the store can briefly
+// hold up to one block more than maxSize.
+func (c *blkcache) put(key string, store func() (int64, error)) (int64, error) {
+	l := c.locks.get(key)
+	l.Lock()
+
+	// The old block, if any, is replaced by the new one.
+	c.mu.Lock()
+	c.forget(key)
+	c.mu.Unlock()
+
+	size, err := store()
+	if err != nil {
+		// Don't leave a partial or stale block behind that the cache
+		// doesn't know about.
+		c.store.Delete(key)
+		l.Unlock()
+		return 0, err
 	}
 
-	// Add the item to the blkcache data structures.
+	c.mu.Lock()
+	c.sizes[key] = size
 	c.curSize += size
-	c.lruMap[key] = c.lruList.PushFront(blkcacheListEl{key, size})
+	c.policy.Add(key, size)
+	c.journal.add(key, size)
+
+	victims := c.overflow()
+	c.mu.Unlock()
+
+	l.Unlock()
+
+	var first error
+	for _, victim := range victims {
+		if err := c.evict(victim); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return size, first
+}
+
+// overflow picks blocks to evict until the cache fits in maxSize again, and
+// removes them from the bookkeeping. They still have to be deleted from the
+// store with evict. c.mu must be held.
+func (c *blkcache) overflow() []string {
+	var victims []string
+	for c.curSize > c.maxSize {
+		victim := c.policy.Evict()
+		c.stats.Evictions++
+		c.stats.EvictedBytes += c.sizes[victim]
+		c.remove(victim)
+		c.journal.remove(victim)
+		victims = append(victims, victim)
+	}
+
+	return victims
+}
+
+// evict deletes a block that has already been removed from the eviction
+// bookkeeping from the store, unless it was put again in the meantime.
+func (c *blkcache) evict(key string) error {
+	l := c.locks.get(key)
+	l.Lock()
+	defer l.Unlock()
+
+	if c.Has(key) {
+		return nil
+	}
+
+	return c.store.Delete(key)
+}
 
-	return nil
+var errTooBig = errors.New("block is too big")
+
+// limitReader reads from r, failing with errTooBig if more than left bytes
+// are read.
+type limitReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (l *limitReader) Read(b []byte) (int, error) {
+	n, err := l.r.Read(b)
+	l.left -= int64(n)
+	if l.left < 0 {
+		return n, errTooBig
+	}
+
+	return n, err
 }
 
 func (c *blkcache) Has(key string) bool {
-	_, has := c.lruMap[key]
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, has := c.sizes[key]
 	return has
 }
 
-func (c *blkcache) moveToFront(key string) {
-	el := c.lruMap[key]
-	c.lruList.MoveToFront(el)
+// lookup is Has for reads, which also counts the hit or miss.
+func (c *blkcache) lookup(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, has := c.sizes[key]
+	if !has {
+		c.stats.Misses++
+	}
+	return has
 }
 
-func (c *blkcache) evictEl(el *list.Element) error {
-	info := el.Value.(blkcacheListEl)
+// access tells the policy about a successful read.
+func (c *blkcache) access(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	if err := c.store.Delete(info.key); err != nil {
-		return err
+	c.stats.Hits++
+
+	// The block may have been evicted since it was read.
+	if _, ok := c.sizes[key]; ok {
+		c.policy.Access(key)
+		c.journal.hit(key)
 	}
+}
 
-	c.lruList.Remove(el)
-	delete(c.lruMap, info.key)
-	c.curSize -= info.size
+// forget drops a block that is being replaced or deleted from the
+// bookkeeping, and reports whether it was there. c.mu must be held.
+func (c *blkcache) forget(key string) bool {
+	if _, ok := c.sizes[key]; !ok {
+		return false
+	}
+
+	c.policy.Remove(key)
+	c.remove(key)
+	c.journal.remove(key)
+	return true
+}
 
-	return nil
+// remove drops an entry from the size bookkeeping. c.mu must be held.
+func (c *blkcache) remove(key string) {
+	c.curSize -= c.sizes[key]
+	delete(c.sizes, key)
 }
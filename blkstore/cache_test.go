@@ -2,7 +2,11 @@ package blkstore
 
 import (
 	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
 	"strconv"
+	"sync"
 	"testing"
 
 	"github.com/shaladdle/goaaw/testutil"
@@ -81,7 +85,7 @@ func TestCacheSizeLimit(t *testing.T) {
 	if curSize := cache.(*blkcache).curSize; curSize > maxSize {
 		t.Fatalf("cache size is greater than maxSize: %v > %v", curSize, maxSize)
 	}
-	if curSize := cache.(*blkcache).store.(*memstore).Size(); curSize > maxSize {
+	if curSize := cache.(*blkcache).store.(*memstore).Usage(); curSize > maxSize {
 		t.Fatalf("actual memstore size is greater than maxSize: %v > %v", curSize, maxSize)
 	}
 }
@@ -91,6 +95,380 @@ func TestCachePutTooBig(t *testing.T) {
 
 	cache := newMemCache(maxSize)
 	if err := cache.Put("testitem", make([]byte, maxSize+1)); err == nil {
-		t.Errorf("put should error, but did not", err)
+		t.Errorf("put should error, but did not")
+	}
+}
+
+func TestCacheStream(t *testing.T) {
+	const (
+		numItems = 4
+		itemSize = testutil.KB
+		maxSize  = 3 * itemSize
+	)
+
+	items := genRandItems(t, numItems, itemSize)
+	cache := newMemCache(maxSize)
+
+	for _, item := range items {
+		if n, err := cache.PutReader(item.key, bytes.NewReader(item.value)); err != nil {
+			t.Fatalf("put reader error: %v", err)
+		} else if n != itemSize {
+			t.Errorf("put reader stored %v bytes, want %v", n, itemSize)
+		}
+	}
+
+	// Only the last three fit, so the first was evicted.
+	if cache.Has(items[0].key) {
+		t.Errorf("item 0 wasn't evicted")
+	}
+	if curSize := cache.(*blkcache).store.(*memstore).Usage(); curSize > maxSize {
+		t.Errorf("actual memstore size is greater than maxSize: %v > %v", curSize, maxSize)
+	}
+
+	for _, item := range items[1:] {
+		r, err := cache.GetReader(item.key)
+		if err != nil {
+			t.Fatalf("get reader error: %v", err)
+		}
+		b, _ := ioutil.ReadAll(r)
+		r.Close()
+
+		if !bytes.Equal(b, item.value) {
+			t.Errorf("bytes for item %v not equal", item.key)
+		}
+	}
+
+	if _, err := cache.PutReader("big", bytes.NewReader(make([]byte, maxSize+1))); err == nil {
+		t.Errorf("put reader of a block bigger than the cache should error, but did not")
+	}
+	if has, _ := cache.(*blkcache).store.(*memstore).Has("big"); has {
+		t.Errorf("block that was too big was left in the store")
+	}
+}
+
+var policies = []struct {
+	name      string
+	newPolicy func() Policy
+}{
+	{"lru", NewLRU},
+	{"lfu", NewLFU},
+	{"arc", NewARC},
+	{"2q", New2Q},
+}
+
+// TestCacheConcurrent hammers a small cache from many goroutines, so that
+// puts, gets and evictions of the same keys overlap. It is most useful under
+// the race detector.
+func TestCacheConcurrent(t *testing.T) {
+	for _, p := range policies {
+		testCacheConcurrent(t, p.name, p.newPolicy())
+	}
+}
+
+func testCacheConcurrent(t *testing.T, name string, policy Policy) {
+	const (
+		numWorkers = 16
+		numOps     = 200
+		numKeys    = 32
+		maxSize    = 8 * testutil.KB
+	)
+
+	cache := NewCacheWithPolicy(NewMemStore(), maxSize, policy)
+
+	// Every key always has the same contents, so any successful read can
+	// be checked.
+	value := func(key string) []byte {
+		return bytes.Repeat([]byte(key), int(testutil.KB)/len(key))
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < numOps; i++ {
+				key := strconv.Itoa((w*numOps + i*7) % numKeys)
+
+				switch i % 4 {
+				case 0:
+					if err := cache.Put(key, value(key)); err != nil {
+						t.Errorf("%v: put error: %v", name, err)
+					}
+				case 1:
+					if _, err := cache.PutReader(key, bytes.NewReader(value(key))); err != nil {
+						t.Errorf("%v: put reader error: %v", name, err)
+					}
+				case 2:
+					// The block may be evicted at any time, so
+					// misses are fine but wrong data isn't.
+					if b, err := cache.Get(key); err == nil && !bytes.Equal(b, value(key)) {
+						t.Errorf("%v: got wrong data for key %v", name, key)
+					}
+				case 3:
+					if r, err := cache.GetReader(key); err == nil {
+						b, _ := ioutil.ReadAll(r)
+						r.Close()
+						if !bytes.Equal(b, value(key)) {
+							t.Errorf("%v: got wrong data for key %v", name, key)
+						}
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	c := cache.(*blkcache)
+	if c.curSize > maxSize {
+		t.Errorf("%v: cache size is greater than maxSize: %v > %v", name, c.curSize, maxSize)
+	}
+	if usage := c.store.(*memstore).Usage(); usage != c.curSize {
+		t.Errorf("%v: memstore holds %v bytes, but the cache thinks it holds %v", name, usage, c.curSize)
+	}
+	for key := range c.sizes {
+		if b, err := cache.Get(key); err != nil || !bytes.Equal(b, value(key)) {
+			t.Errorf("%v: key %v is in the cache but can't be read back: %v", name, key, err)
+		}
+	}
+}
+
+// TestCachePolicySizeLimit checks that every policy keeps the cache within
+// its size, with blocks of varying sizes being put and read in a mixed order.
+func TestCachePolicySizeLimit(t *testing.T) {
+	const maxSize = 16 * testutil.KB
+
+	for _, p := range policies {
+		cache := NewCacheWithPolicy(NewMemStore(), maxSize, p.newPolicy())
+		c := cache.(*blkcache)
+
+		for i := 0; i < 500; i++ {
+			key := strconv.Itoa((i * 7) % 40)
+			if i%3 == 0 {
+				cache.Get(key)
+				continue
+			}
+
+			size := int(testutil.KB) * (1 + i%4)
+			if err := cache.Put(key, make([]byte, size)); err != nil {
+				t.Fatalf("%v: put error: %v", p.name, err)
+			}
+
+			if c.curSize > maxSize {
+				t.Fatalf("%v: cache size is greater than maxSize: %v > %v", p.name, c.curSize, maxSize)
+			}
+			if usage := c.store.(*memstore).Usage(); usage != c.curSize {
+				t.Fatalf("%v: memstore holds %v bytes, but the cache thinks it holds %v", p.name, usage, c.curSize)
+			}
+		}
+	}
+}
+
+// TestCacheScan warms a cache up with a small hot set of blocks, then keeps
+// reading it with a scan of blocks that are only read once in between each
+// pass over it. The scans are too long for LRU to keep the hot set, but the
+// other policies should.
+func TestCacheScan(t *testing.T) {
+	const (
+		numRounds = 50
+		numHot    = 4
+		scanLen   = 8
+		blockSize = testutil.KB
+		maxSize   = 10 * blockSize
+	)
+
+	block := make([]byte, blockSize)
+	hits := make(map[string]int64)
+
+	for _, p := range policies {
+		cache := NewCacheWithPolicy(NewMemStore(), maxSize, p.newPolicy())
+
+		read := func(key string) {
+			if _, err := cache.Get(key); err != nil {
+				if err := cache.Put(key, block); err != nil {
+					t.Fatalf("%v: put error: %v", p.name, err)
+				}
+			}
+		}
+
+		for r := 0; r < 3; r++ {
+			for i := 0; i < numHot; i++ {
+				read("hot" + strconv.Itoa(i))
+			}
+		}
+
+		for r := 0; r < numRounds; r++ {
+			for i := 0; i < numHot; i++ {
+				read("hot" + strconv.Itoa(i))
+			}
+			for i := 0; i < scanLen; i++ {
+				read("scan" + strconv.Itoa(r*scanLen+i))
+			}
+		}
+
+		stats := cache.Stats()
+		if want := int64(3*numHot + numRounds*(numHot+scanLen)); stats.Hits+stats.Misses != want {
+			t.Errorf("%v: stats count %v reads, want %v", p.name, stats.Hits+stats.Misses, want)
+		}
+		if stats.Evictions == 0 || stats.EvictedBytes != stats.Evictions*blockSize {
+			t.Errorf("%v: stats count %v evictions of %v bytes", p.name, stats.Evictions, stats.EvictedBytes)
+		}
+
+		hits[p.name] = stats.Hits
+		t.Logf("%v: %+v, hit rate %.2f", p.name, stats, stats.HitRate())
+	}
+
+	for _, name := range []string{"lfu", "arc", "2q"} {
+		if hits[name] < numRounds*numHot/2 {
+			t.Errorf("%v only had %v hits, which is no better than lru's %v", name, hits[name], hits["lru"])
+		}
+	}
+}
+
+func TestCachePersistent(t *testing.T) {
+	te := testutil.NewTestEnv("cache", t)
+	defer te.Teardown()
+
+	const blockSize = testutil.KB
+
+	os.Mkdir(te.PathFor("blocks"), 0755)
+	store := NewDiskStore(te.PathFor("blocks"))
+	opts := CacheOptions{Journal: te.PathFor("journal")}
+
+	open := func(maxSize int64) PersistentCache {
+		cache, err := OpenCache(store, maxSize, opts)
+		if err != nil {
+			t.Fatalf("open cache: %v", err)
+		}
+		return cache
+	}
+
+	// wantKeys checks which blocks are in both the cache and its store.
+	wantKeys := func(when string, cache PersistentCache, want ...string) {
+		keys, err := store.Keys("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, want) {
+			t.Errorf("%v: store has %v, want %v", when, keys, want)
+		}
+		for _, key := range want {
+			if !cache.Has(key) {
+				t.Errorf("%v: %v is in the store but not the cache", when, key)
+			}
+		}
+		if c := cache.(*blkcache); c.curSize != int64(len(want))*blockSize {
+			t.Errorf("%v: cache thinks it holds %v bytes, want %v", when, c.curSize, int64(len(want))*blockSize)
+		}
+	}
+
+	cache := open(4 * blockSize)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := cache.Put(key, make([]byte, blockSize)); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+	if _, err := cache.Get("a"); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if err := cache.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// The access order survives, so b is the least recently used.
+	cache = open(4 * blockSize)
+	wantKeys("reopened", cache, "a", "b", "c", "d")
+	if err := cache.Put("e", make([]byte, blockSize)); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	wantKeys("put after reopening", cache, "a", "c", "d", "e")
+	if err := cache.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// Shrinking the cache evicts blocks as soon as it is opened.
+	cache = open(2 * blockSize)
+	wantKeys("shrunk", cache, "a", "e")
+	cache.Close()
+
+	// A block the journal doesn't know about, as a crash can leave, is
+	// picked up as the most recently used, and a torn record at the end of
+	// the journal is ignored.
+	if err := store.Put("f", make([]byte, blockSize)); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(opts.Journal, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{journalAdd, 10, 'x'})
+	f.Close()
+
+	cache = open(2 * blockSize)
+	wantKeys("crashed", cache, "e", "f")
+	cache.Close()
+
+	// Without a journal, the blocks in the store are still found.
+	cache, err = OpenCache(store, 2*blockSize, CacheOptions{})
+	if err != nil {
+		t.Fatalf("open cache without a journal: %v", err)
+	}
+	wantKeys("no journal", cache, "e", "f")
+}
+
+func TestCacheJournalCompact(t *testing.T) {
+	te := testutil.NewTestEnv("cache", t)
+	defer te.Teardown()
+
+	opts := CacheOptions{Journal: te.PathFor("journal"), Policy: NewLFU()}
+	cache, err := OpenCache(NewMemStore(), 4*testutil.KB, opts)
+	if err != nil {
+		t.Fatalf("open cache: %v", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := cache.Put(strconv.Itoa(i), make([]byte, testutil.KB)); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+
+	// Block 0 is read far more than the others.
+	for i := 0; i < 10*minJournalCompact; i++ {
+		key := "0"
+		if i%10 == 0 {
+			key = strconv.Itoa(1 + i%3)
+		}
+		if _, err := cache.Get(key); err != nil {
+			t.Fatalf("get: %v", err)
+		}
+	}
+
+	j := cache.(*blkcache).journal
+	if j.records > 4*minJournalCompact {
+		t.Errorf("journal has %v records after compaction", j.records)
+	}
+	if err := cache.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	recs, err := readJournal(opts.Journal)
+	if err != nil {
+		t.Fatalf("read journal: %v", err)
+	}
+	if len(recs) > 4*minJournalCompact {
+		t.Errorf("journal file has %v records after compaction", len(recs))
+	}
+
+	// The hot block is still the one kept after the compacted journal is
+	// replayed.
+	opts.Policy = NewLFU()
+	cache, err = OpenCache(cache.(*blkcache).store.(ExtBlkStore), testutil.KB, opts)
+	if err != nil {
+		t.Fatalf("reopen cache: %v", err)
+	}
+	defer cache.Close()
+
+	if !cache.Has("0") {
+		t.Errorf("hot block was evicted after reopening")
 	}
 }
@@ -0,0 +1,324 @@
+package blkstore
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// CachedOptions controls how a CachedStore writes blocks.
+type CachedOptions struct {
+	// WriteBack makes Put return as soon as a block is in the cache and
+	// queued, instead of waiting for it to be written to the backing store.
+	// Queued blocks are written to the backing store by Flush.
+	WriteBack bool
+
+	// Queue holds blocks that haven't been written to the backing store
+	// yet. It is required for write-back, and should be durable, such as a
+	// diskstore, so that queued blocks survive a crash; a CachedStore
+	// flushes whatever it finds in its queue.
+	Queue ExtBlkStore
+
+	// FlushInterval is how often queued blocks are flushed in the
+	// background. If it is 0 there is no background flusher, and Flush has
+	// to be called directly.
+	FlushInterval time.Duration
+}
+
+// CachedStore is a BlkStore that keeps copies of the blocks of a slower
+// backing store, such as a remote one, in a cache. Reads of blocks that
+// aren't in the cache fetch them from the backing store and add them to the
+// cache, with concurrent reads of the same block sharing a single fetch.
+//
+// Writes go to the cache and the backing store. With write-back, they are
+// queued for the backing store instead, and reads look in the queue before
+// the backing store, since a queued block may already have been evicted
+// from the cache.
+type CachedStore struct {
+	cache   BlkCache
+	backing BlkStore
+	opts    CachedOptions
+	locks   stripedLock
+	fetches flightGroup
+
+	// flushMu keeps flushes from running concurrently.
+	flushMu sync.Mutex
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewCachedStore returns a store that caches the blocks of backing in
+// cache. With write-back, the queue must be set, and if opts.FlushInterval
+// is, a background flusher runs until Close is called.
+func NewCachedStore(cache BlkCache, backing BlkStore, opts CachedOptions) (*CachedStore, error) {
+	if opts.WriteBack && opts.Queue == nil {
+		return nil, errors.New("write-back needs a queue")
+	}
+
+	s := &CachedStore{
+		cache:   cache,
+		backing: backing,
+		opts:    opts,
+		done:    make(chan struct{}),
+	}
+
+	if opts.WriteBack && opts.FlushInterval > 0 {
+		s.wg.Add(1)
+		go s.flusher()
+	}
+
+	return s, nil
+}
+
+// Close stops the background flusher, then flushes the queue one last time.
+func (s *CachedStore) Close() error {
+	close(s.done)
+	s.wg.Wait()
+
+	if !s.opts.WriteBack {
+		return nil
+	}
+
+	return s.Flush()
+}
+
+func (s *CachedStore) flusher() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				log.Println("blkstore: flush:", err)
+			}
+		}
+	}
+}
+
+func (s *CachedStore) Get(key string) ([]byte, error) {
+	if blk, err := s.cache.Get(key); err == nil {
+		return blk, nil
+	}
+
+	blk, shared, err := s.fetches.do(key, func() ([]byte, error) {
+		return s.fetch(key)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Callers that shared a fetch each get their own copy, so that one of
+	// them changing it doesn't affect the others.
+	if shared {
+		blk = append([]byte(nil), blk...)
+	}
+
+	return blk, nil
+}
+
+// fetch reads a block that isn't in the cache from the queue or the backing
+// store, and adds it to the cache. The key's stripe is held throughout, so
+// that a Put of the key can't be overwritten in the cache by an older block
+// fetched before it.
+func (s *CachedStore) fetch(key string) ([]byte, error) {
+	l := s.locks.get(key)
+	l.RLock()
+	defer l.RUnlock()
+
+	blk, err := s.fetchLocked(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Failing to cache the block, such as because it is bigger than the
+	// whole cache, doesn't stop it being read.
+	s.cache.Put(key, blk)
+
+	return blk, nil
+}
+
+func (s *CachedStore) fetchLocked(key string) ([]byte, error) {
+	if s.opts.WriteBack {
+		if has, err := s.opts.Queue.Has(key); err != nil {
+			return nil, err
+		} else if has {
+			return s.opts.Queue.Get(key)
+		}
+	}
+
+	return s.backing.Get(key)
+}
+
+func (s *CachedStore) Put(key string, blk []byte) error {
+	l := s.locks.get(key)
+	l.Lock()
+	defer l.Unlock()
+
+	if s.opts.WriteBack {
+		if err := s.opts.Queue.Put(key, blk); err != nil {
+			return err
+		}
+
+		// The queue has the block, so it can still be read if it
+		// doesn't fit in the cache.
+		s.cache.Put(key, blk)
+		return nil
+	}
+
+	if err := s.backing.Put(key, blk); err != nil {
+		return err
+	}
+
+	// A block that doesn't fit isn't cached, and since the cache drops the
+	// old block before storing a new one, nothing stale is left behind.
+	s.cache.Put(key, blk)
+	return nil
+}
+
+// Delete removes a block from the cache, the queue and the backing store.
+func (s *CachedStore) Delete(key string) error {
+	l := s.locks.get(key)
+	l.Lock()
+	defer l.Unlock()
+
+	if err := s.cache.Delete(key); err != nil {
+		return err
+	}
+
+	queued := false
+	if s.opts.WriteBack {
+		var err error
+		if queued, err = s.opts.Queue.Has(key); err != nil {
+			return err
+		}
+
+		if queued {
+			if err := s.opts.Queue.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	// A queued block may never have reached the backing store, so it not
+	// being there isn't an error.
+	if err := s.backing.Delete(key); err != nil && !queued {
+		return err
+	}
+
+	return nil
+}
+
+// Queued returns the number of blocks waiting to be written to the backing
+// store.
+func (s *CachedStore) Queued() (int, error) {
+	if !s.opts.WriteBack {
+		return 0, nil
+	}
+
+	keys, err := s.opts.Queue.Keys("")
+	return len(keys), err
+}
+
+// Flush writes every queued block to the backing store. Blocks that fail to
+// be written stay queued, and Flush returns the first error.
+func (s *CachedStore) Flush() error {
+	if !s.opts.WriteBack {
+		return nil
+	}
+
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	keys, err := s.opts.Queue.Keys("")
+	if err != nil {
+		return err
+	}
+
+	var first error
+	for _, key := range keys {
+		if err := s.flushKey(key); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// flushKey writes a queued block to the backing store and removes it from
+// the queue. The key's stripe is held, so the block can't be replaced or
+// deleted in between.
+func (s *CachedStore) flushKey(key string) error {
+	l := s.locks.get(key)
+	l.Lock()
+	defer l.Unlock()
+
+	// It may have been deleted since the queue was listed.
+	if has, err := s.opts.Queue.Has(key); err != nil || !has {
+		return err
+	}
+
+	blk, err := s.opts.Queue.Get(key)
+	if err != nil {
+		return err
+	}
+
+	if err := s.backing.Put(key, blk); err != nil {
+		return err
+	}
+
+	return s.opts.Queue.Delete(key)
+}
+
+// flightGroup makes concurrent calls for the same key share one call.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+type flight struct {
+	wg     sync.WaitGroup
+	blk    []byte
+	err    error
+	shared bool
+}
+
+// do calls fn, unless a call for key is already running, in which case it
+// waits for that call and returns its results. shared reports whether the
+// results went to more than one caller.
+func (g *flightGroup) do(key string, fn func() ([]byte, error)) ([]byte, bool, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flight)
+	}
+
+	if f, ok := g.calls[key]; ok {
+		f.shared = true
+		g.mu.Unlock()
+
+		f.wg.Wait()
+		return f.blk, true, f.err
+	}
+
+	f := &flight{}
+	f.wg.Add(1)
+	g.calls[key] = f
+	g.mu.Unlock()
+
+	f.blk, f.err = fn()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	shared := f.shared
+	g.mu.Unlock()
+
+	f.wg.Done()
+
+	return f.blk, shared, f.err
+}
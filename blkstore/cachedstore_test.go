@@ -0,0 +1,211 @@
+package blkstore
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+// countingStore counts the reads that reach a store, can be made slow so
+// that reads overlap, and can be made to fail writes.
+type countingStore struct {
+	ExtBlkStore
+
+	mu       sync.Mutex
+	gets     int
+	delay    time.Duration
+	failPuts bool
+}
+
+func (s *countingStore) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	s.gets++
+	delay := s.delay
+	s.mu.Unlock()
+
+	time.Sleep(delay)
+	return s.ExtBlkStore.Get(key)
+}
+
+func (s *countingStore) Put(key string, blk []byte) error {
+	s.mu.Lock()
+	fail := s.failPuts
+	s.mu.Unlock()
+
+	if fail {
+		return errors.New("backing store is down")
+	}
+	return s.ExtBlkStore.Put(key, blk)
+}
+
+func (s *countingStore) numGets() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.gets
+}
+
+func TestCachedStoreReadThrough(t *testing.T) {
+	backing := &countingStore{ExtBlkStore: NewMemStore(), delay: 50 * time.Millisecond}
+	backing.ExtBlkStore.Put("key", []byte("value"))
+
+	s, err := NewCachedStore(newMemCache(testutil.KB), backing, CachedOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Concurrent misses share one fetch.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if b, err := s.Get("key"); err != nil || string(b) != "value" {
+				t.Errorf("get got %q, %v, want %q", b, err, "value")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := backing.numGets(); n != 1 {
+		t.Errorf("backing store was read %v times, want 1", n)
+	}
+
+	// Now it is cached.
+	if _, err := s.Get("key"); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if n := backing.numGets(); n != 1 {
+		t.Errorf("backing store was read %v times after a hit, want 1", n)
+	}
+
+	// Writes go through to the backing store, and replace the cached block.
+	if err := s.Put("key", []byte("new value")); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if b, err := backing.ExtBlkStore.Get("key"); err != nil || string(b) != "new value" {
+		t.Errorf("backing store has %q, %v, want %q", b, err, "new value")
+	}
+	if b, err := s.Get("key"); err != nil || string(b) != "new value" {
+		t.Errorf("get after put got %q, %v, want %q", b, err, "new value")
+	}
+
+	if err := s.Delete("key"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := s.Get("key"); err == nil {
+		t.Errorf("get after delete should error, but did not")
+	}
+}
+
+func TestCachedStoreWriteBack(t *testing.T) {
+	te := testutil.NewTestEnv("cachedstore", t)
+	defer te.Teardown()
+
+	os.Mkdir(te.PathFor("queue"), 0755)
+	queue := NewDiskStore(te.PathFor("queue"))
+	backing := &countingStore{ExtBlkStore: NewMemStore()}
+
+	// The cache only has room for one block, so queued blocks get evicted
+	// from it before they are flushed.
+	opts := CachedOptions{WriteBack: true, Queue: queue}
+	s, err := NewCachedStore(newMemCache(testutil.KB), backing, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := map[string][]byte{
+		"a": bytes.Repeat([]byte("a"), int(testutil.KB)),
+		"b": bytes.Repeat([]byte("b"), int(testutil.KB)),
+		"c": bytes.Repeat([]byte("c"), int(testutil.KB)),
+	}
+	for key, blk := range blocks {
+		if err := s.Put(key, blk); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+
+	if has, _ := backing.Has("a"); has {
+		t.Errorf("block reached the backing store before it was flushed")
+	}
+	for key, blk := range blocks {
+		if b, err := s.Get(key); err != nil || !bytes.Equal(b, blk) {
+			t.Errorf("queued block %v can't be read back: %v", key, err)
+		}
+	}
+	if n := backing.numGets(); n != 0 {
+		t.Errorf("backing store was read %v times, want 0", n)
+	}
+
+	// Deleting a block that was never flushed only removes it from the
+	// queue.
+	if err := s.Delete("c"); err != nil {
+		t.Fatalf("delete of a queued block: %v", err)
+	}
+
+	// The queue survives a crash, so a new store over it flushes the
+	// blocks the old one didn't get to.
+	s, err = NewCachedStore(newMemCache(testutil.KB), backing, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backing.failPuts = true
+	if err := s.Flush(); err == nil {
+		t.Errorf("flush to a failing backing store should error, but did not")
+	}
+	if n, err := s.Queued(); err != nil || n != 2 {
+		t.Errorf("%v, %v blocks queued after a failed flush, want 2", n, err)
+	}
+
+	backing.failPuts = false
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if n, err := s.Queued(); err != nil || n != 0 {
+		t.Errorf("%v, %v blocks queued after closing, want 0", n, err)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		if b, err := backing.ExtBlkStore.Get(key); err != nil || !bytes.Equal(b, blocks[key]) {
+			t.Errorf("block %v wasn't flushed: %v", key, err)
+		}
+	}
+	if has, _ := backing.Has("c"); has {
+		t.Errorf("deleted block was flushed")
+	}
+}
+
+func TestCachedStoreFlusher(t *testing.T) {
+	backing := NewMemStore()
+	opts := CachedOptions{
+		WriteBack:     true,
+		Queue:         NewMemStore(),
+		FlushInterval: 10 * time.Millisecond,
+	}
+
+	s, err := NewCachedStore(newMemCache(testutil.KB), backing, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Put("key", []byte("value")); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if has, _ := backing.Has("key"); has {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("background flusher didn't write the block to the backing store")
+}
@@ -0,0 +1,121 @@
+package blkstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+)
+
+// CASStore is a content addressed store: every block is kept under the hex
+// encoded hash of its contents, which is checked whenever the block is read.
+// Since a key can only ever hold one value, putting a block that is already
+// stored doesn't write it again.
+type CASStore struct {
+	store   ExtBlkStore
+	newHash func() hash.Hash
+}
+
+// NewCASStore returns a content addressed store that keeps its blocks in
+// store, hashed with newHash. If newHash is nil, SHA-256 is used.
+func NewCASStore(store ExtBlkStore, newHash func() hash.Hash) *CASStore {
+	if newHash == nil {
+		newHash = sha256.New
+	}
+
+	return &CASStore{store, newHash}
+}
+
+// Key returns the key blk is stored under.
+func (s *CASStore) Key(blk []byte) string {
+	h := s.newHash()
+	h.Write(blk)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// check returns an error wrapping ErrCorrupted if blk isn't what key names.
+func (s *CASStore) check(key string, blk []byte) error {
+	want, err := hex.DecodeString(key)
+	if err != nil {
+		return fmt.Errorf("%v is not a valid key: %v", key, err)
+	}
+
+	h := s.newHash()
+	h.Write(blk)
+	if !bytes.Equal(h.Sum(nil), want) {
+		return fmt.Errorf("block %v: %w", key, ErrCorrupted)
+	}
+
+	return nil
+}
+
+// Put stores blk and returns its key. A block that is already stored isn't
+// read back, so a damaged copy stays damaged; use Verify to find those, and
+// Repair to replace them.
+func (s *CASStore) Put(blk []byte) (string, error) {
+	key := s.Key(blk)
+
+	if has, err := s.store.Has(key); err != nil {
+		return "", err
+	} else if has {
+		return key, nil
+	}
+
+	return key, s.store.Put(key, blk)
+}
+
+// Get returns the block stored under key, or an error wrapping ErrCorrupted
+// if it has been damaged.
+func (s *CASStore) Get(key string) ([]byte, error) {
+	blk, err := s.store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.check(key, blk); err != nil {
+		return nil, err
+	}
+
+	return blk, nil
+}
+
+func (s *CASStore) Has(key string) (bool, error) {
+	return s.store.Has(key)
+}
+
+func (s *CASStore) Delete(key string) error {
+	return s.store.Delete(key)
+}
+
+// Repair stores blk under its key whether or not there is already a block
+// there, replacing a copy that Verify found to be damaged. It returns the key.
+func (s *CASStore) Repair(blk []byte) (string, error) {
+	key := s.Key(blk)
+	return key, s.store.Put(key, blk)
+}
+
+// BadBlock is a block that Verify couldn't read back intact.
+type BadBlock struct {
+	Key string
+	Err error
+}
+
+// Verify reads every block in the store and checks it against its key,
+// returning the ones that are damaged or can't be read. The error is only
+// set if the store couldn't be listed at all.
+func (s *CASStore) Verify() ([]BadBlock, error) {
+	keys, err := s.store.Keys("")
+	if err != nil {
+		return nil, err
+	}
+
+	var bad []BadBlock
+	for _, key := range keys {
+		if _, err := s.Get(key); err != nil {
+			bad = append(bad, BadBlock{key, err})
+		}
+	}
+
+	return bad, nil
+}
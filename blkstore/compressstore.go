@@ -0,0 +1,39 @@
+package blkstore
+
+import (
+	"github.com/shaladdle/goaaw/filestore/compress"
+)
+
+type compressstore struct {
+	store BlkStore
+	alg   compress.Algorithm
+}
+
+// NewCompressedStore returns a BlkStore that compresses blocks with alg before
+// putting them in store. Blocks compressed with any registered algorithm can
+// be read back.
+func NewCompressedStore(store BlkStore, alg compress.Algorithm) BlkStore {
+	return &compressstore{store, alg}
+}
+
+func (bs *compressstore) Get(key string) ([]byte, error) {
+	b, err := bs.store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return compress.Decompress(b)
+}
+
+func (bs *compressstore) Put(key string, blk []byte) error {
+	b, err := compress.Compress(blk, bs.alg)
+	if err != nil {
+		return err
+	}
+
+	return bs.store.Put(key, b)
+}
+
+func (bs *compressstore) Delete(key string) error {
+	return bs.store.Delete(key)
+}
@@ -0,0 +1,39 @@
+package blkstore
+
+import (
+	"github.com/shaladdle/goaaw/filestore/crypt"
+)
+
+type cryptstore struct {
+	store BlkStore
+	key   crypt.Key
+}
+
+// NewEncryptedStore returns a BlkStore that encrypts blocks with key before
+// putting them in store. Each block is bound to its key, so Get returns
+// crypt.ErrTampered if a block was modified or put under another key.
+func NewEncryptedStore(store BlkStore, key crypt.Key) BlkStore {
+	return &cryptstore{store, key}
+}
+
+func (bs *cryptstore) Get(key string) ([]byte, error) {
+	b, err := bs.store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return crypt.Decrypt(b, bs.key, []byte(key))
+}
+
+func (bs *cryptstore) Put(key string, blk []byte) error {
+	b, err := crypt.Encrypt(blk, bs.key, []byte(key))
+	if err != nil {
+		return err
+	}
+
+	return bs.store.Put(key, b)
+}
+
+func (bs *cryptstore) Delete(key string) error {
+	return bs.store.Delete(key)
+}
@@ -1,23 +1,83 @@
 package blkstore
 
 import (
-	"fmt"
+	"bytes"
+	"io"
 	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
 
 	"github.com/shaladdle/goaaw/filestore"
 	"github.com/shaladdle/goaaw/filestore/std"
 )
 
+// batchFileStore is a FileStore that can also work on many whole files at
+// once. std.FileSystem does this with a loop, and remote.Client does it in a
+// single round trip, which is what makes the batch operations of a remote
+// store cheap.
+type batchFileStore interface {
+	fs.FileStore
+	ReadFiles(paths []string) ([][]byte, error)
+	WriteFiles(paths []string, data [][]byte) error
+	RemoveFiles(paths []string) error
+	StatFiles(paths []string) ([]os.FileInfo, error)
+	ListFiles(dpath string) ([]string, error)
+}
+
+// DiskOptions controls how a diskstore lays out and writes its blocks.
+type DiskOptions struct {
+	Layout Layout
+
+	// Sync makes Put flush blocks to stable storage before returning, so
+	// that a block that was put survives a crash.
+	Sync bool
+}
+
+// diskstore keeps each block in its own file, placed according to its
+// layout. It is safe for concurrent use: writes to a block are serialized
+// with each other and with reads of the whole block through the same
+// diskstore.
 type diskstore struct {
-	disk fs.FileSystem
+	disk   batchFileStore
+	layout Layout
+	locks  stripedLock
+}
+
+func NewDiskStore(root string) ExtBlkStore {
+	return NewDiskStoreWithOptions(root, DiskOptions{})
 }
 
-func NewDiskStore(root string) BlkStore {
-	return &diskstore{std.New(root)}
+// NewDiskStoreWithOptions returns a diskstore using the given layout. Blocks
+// are written to a temporary file and renamed into place, so a crash never
+// leaves a half written block.
+func NewDiskStoreWithOptions(root string, opts DiskOptions) ExtBlkStore {
+	disk := std.NewWithOptions(root, std.Options{Atomic: true, Sync: opts.Sync})
+	return &diskstore{disk: disk, layout: opts.Layout}
+}
+
+// create opens the file for the block at p for writing, making the
+// directories above it the first time a block goes in them.
+func (bs *diskstore) create(p string) (io.WriteCloser, error) {
+	f, err := bs.disk.Create(p)
+	if err == nil || path.Dir(p) == "." {
+		return f, err
+	}
+
+	if err := bs.disk.Mkdir(path.Dir(p)); err != nil {
+		return nil, err
+	}
+
+	return bs.disk.Create(p)
 }
 
 func (bs *diskstore) Get(key string) ([]byte, error) {
-	f, err := bs.disk.Open(key)
+	l := bs.locks.get(key)
+	l.RLock()
+	defer l.RUnlock()
+
+	f, err := bs.disk.Open(bs.layout.path(key))
 	if err != nil {
 		return nil, err
 	}
@@ -27,21 +87,120 @@ func (bs *diskstore) Get(key string) ([]byte, error) {
 }
 
 func (bs *diskstore) Put(key string, blk []byte) error {
-	f, err := bs.disk.Create(key)
+	l := bs.locks.get(key)
+	l.Lock()
+	defer l.Unlock()
+
+	f, err := bs.create(bs.layout.path(key))
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	if n, err := f.Write(blk); err != nil {
-		return err
-	} else if n != len(blk) {
-		return fmt.Errorf("didn't write the entire block")
+	_, err = writeStream(f, bytes.NewReader(blk))
+	return err
+}
+
+// GetReader and PutReader stream blocks straight to and from the files that
+// hold them.
+func (bs *diskstore) GetReader(key string) (io.ReadCloser, error) {
+	l := bs.locks.get(key)
+	l.RLock()
+	defer l.RUnlock()
+
+	return bs.disk.Open(bs.layout.path(key))
+}
+
+func (bs *diskstore) PutReader(key string, r io.Reader) (int64, error) {
+	l := bs.locks.get(key)
+	l.Lock()
+	defer l.Unlock()
+
+	w, err := bs.create(bs.layout.path(key))
+	if err != nil {
+		return 0, err
 	}
 
-	return nil
+	return writeStream(w, r)
 }
 
 func (bs *diskstore) Delete(key string) error {
-	return bs.disk.Remove(key)
+	l := bs.locks.get(key)
+	l.Lock()
+	defer l.Unlock()
+
+	return bs.disk.Remove(bs.layout.path(key))
+}
+
+func (bs *diskstore) Has(key string) (bool, error) {
+	infos, err := bs.disk.StatFiles([]string{bs.layout.path(key)})
+	if err != nil {
+		return false, err
+	}
+
+	return infos[0] != nil && infos[0].Mode().IsRegular(), nil
+}
+
+func (bs *diskstore) Size(key string) (int64, error) {
+	info, err := bs.disk.Stat(bs.layout.path(key))
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+func (bs *diskstore) Keys(prefix string) ([]string, error) {
+	paths, err := bs.disk.ListFiles("")
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, p := range paths {
+		if key, ok := bs.layout.key(p); ok && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (bs *diskstore) GetMany(keys []string) ([][]byte, error) {
+	defer bs.locks.lockAll(keys, false)()
+
+	return bs.disk.ReadFiles(bs.layout.paths(keys))
+}
+
+func (bs *diskstore) PutMany(keys []string, blks [][]byte) error {
+	if len(keys) != len(blks) {
+		return errMismatch
+	}
+
+	defer bs.locks.lockAll(keys, true)()
+
+	paths := bs.layout.paths(keys)
+	err := bs.disk.WriteFiles(paths, blks)
+	if err == nil || bs.layout.Fanout <= 0 {
+		return err
+	}
+
+	// Some of the blocks go in directories that don't exist yet.
+	made := make(map[string]bool)
+	for _, p := range paths {
+		if dir := path.Dir(p); !made[dir] {
+			made[dir] = true
+			if err := bs.disk.Mkdir(dir); err != nil {
+				return err
+			}
+		}
+	}
+
+	return bs.disk.WriteFiles(paths, blks)
+}
+
+func (bs *diskstore) DeleteMany(keys []string) error {
+	defer bs.locks.lockAll(keys, true)()
+
+	return bs.disk.RemoveFiles(bs.layout.paths(keys))
 }
@@ -0,0 +1,304 @@
+package blkstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// The cache journal is a log of everything that changed a cache's eviction
+// order: blocks being added, read and removed. Each record is an op byte and
+// a uvarint length prefixed key, followed by a uvarint size for adds.
+const (
+	journalAdd byte = iota + 1
+	journalHit
+	journalRemove
+)
+
+const (
+	// maxJournalHits is how many reads of each block a compacted journal
+	// remembers. That is plenty to tell hot blocks from cold ones without
+	// the journal growing with every read of a hot block.
+	maxJournalHits = 16
+
+	// minJournalCompact is how many records the journal has to have before
+	// it is worth compacting.
+	minJournalCompact = 1024
+)
+
+type journalRecord struct {
+	op   byte
+	key  string
+	size int64
+}
+
+// readJournal reads the records in the journal at path. A missing journal
+// has no records, and a record cut short by a crash ends the journal.
+func readJournal(path string) ([]journalRecord, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	var recs []journalRecord
+	for {
+		rec, err := readJournalRecord(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return recs, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("cache journal %v: %v", path, err)
+		}
+
+		recs = append(recs, rec)
+	}
+}
+
+func readJournalRecord(r *bufio.Reader) (journalRecord, error) {
+	var rec journalRecord
+
+	op, err := r.ReadByte()
+	if err != nil {
+		return rec, err
+	}
+	if op < journalAdd || op > journalRemove {
+		return rec, fmt.Errorf("bad record type %v", op)
+	}
+	rec.op = op
+
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return rec, noEOF(err)
+	}
+
+	key := make([]byte, n)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return rec, noEOF(err)
+	}
+	rec.key = string(key)
+
+	if op == journalAdd {
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return rec, noEOF(err)
+		}
+		rec.size = int64(size)
+	}
+
+	return rec, nil
+}
+
+// noEOF turns an EOF in the middle of a record into an unexpected one.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func appendJournalRecord(b []byte, rec journalRecord) []byte {
+	var buf [binary.MaxVarintLen64]byte
+
+	b = append(b, rec.op)
+	b = append(b, buf[:binary.PutUvarint(buf[:], uint64(len(rec.key)))]...)
+	b = append(b, rec.key...)
+	if rec.op == journalAdd {
+		b = append(b, buf[:binary.PutUvarint(buf[:], uint64(rec.size))]...)
+	}
+
+	return b
+}
+
+// journalEntry is what the journal remembers about a block in the cache:
+// when it was added, and when it was last read, as positions in the journal.
+type journalEntry struct {
+	size  int64
+	added uint64
+	hits  []uint64
+}
+
+// cacheJournal appends to a cache's journal, and keeps track of which
+// records in it still matter so that it can be compacted. It isn't safe for
+// concurrent use; the cache serializes calls to it.
+//
+// Records are buffered, so the last few may be lost in a crash. That only
+// costs some accuracy in the eviction order, since the cache reconciles the
+// journal with the blocks actually in the store when it is opened.
+type cacheJournal struct {
+	path    string
+	f       *os.File
+	w       *bufio.Writer
+	seq     uint64
+	records int
+	entries map[string]*journalEntry
+	buf     []byte
+
+	// err is the first error writing to the journal. Once there is one,
+	// the journal stops being written, and Close reports it.
+	err error
+}
+
+func newCacheJournal(path string) *cacheJournal {
+	return &cacheJournal{path: path, entries: make(map[string]*journalEntry)}
+}
+
+// apply updates the entries with a record, without writing it.
+func (j *cacheJournal) apply(rec journalRecord) {
+	j.seq++
+
+	switch rec.op {
+	case journalAdd:
+		j.entries[rec.key] = &journalEntry{size: rec.size, added: j.seq}
+	case journalHit:
+		if e, ok := j.entries[rec.key]; ok {
+			if e.hits = append(e.hits, j.seq); len(e.hits) > maxJournalHits {
+				e.hits = e.hits[1:]
+			}
+		}
+	case journalRemove:
+		delete(j.entries, rec.key)
+	}
+}
+
+// live returns the records needed to rebuild the entries, in order.
+func (j *cacheJournal) live() []journalRecord {
+	type seqRecord struct {
+		seq uint64
+		rec journalRecord
+	}
+
+	var recs []seqRecord
+	for key, e := range j.entries {
+		recs = append(recs, seqRecord{e.added, journalRecord{journalAdd, key, e.size}})
+		for _, seq := range e.hits {
+			recs = append(recs, seqRecord{seq, journalRecord{op: journalHit, key: key}})
+		}
+	}
+
+	sort.Slice(recs, func(a, b int) bool { return recs[a].seq < recs[b].seq })
+
+	live := make([]journalRecord, len(recs))
+	for i, r := range recs {
+		live[i] = r.rec
+	}
+
+	return live
+}
+
+func (j *cacheJournal) add(key string, size int64) {
+	j.write(journalRecord{journalAdd, key, size})
+}
+
+func (j *cacheJournal) hit(key string) {
+	j.write(journalRecord{op: journalHit, key: key})
+}
+
+func (j *cacheJournal) remove(key string) {
+	j.write(journalRecord{op: journalRemove, key: key})
+}
+
+// write appends a record to the journal. A nil journal ignores it, which
+// is what a cache without one has.
+func (j *cacheJournal) write(rec journalRecord) {
+	if j == nil {
+		return
+	}
+
+	j.apply(rec)
+
+	if j.err != nil {
+		return
+	}
+
+	j.buf = appendJournalRecord(j.buf[:0], rec)
+	if _, j.err = j.w.Write(j.buf); j.err != nil {
+		return
+	}
+
+	j.records++
+	if j.records > minJournalCompact && j.records > 4*j.liveCount() {
+		j.err = j.compact()
+	}
+}
+
+func (j *cacheJournal) liveCount() int {
+	n := 0
+	for _, e := range j.entries {
+		n += 1 + len(e.hits)
+	}
+	return n
+}
+
+// compact replaces the journal with one holding just the live records, and
+// opens it for appending. The new journal is written to a temporary file and
+// renamed into place, so a crash leaves either the old one or the new one.
+func (j *cacheJournal) compact() error {
+	if j.f != nil {
+		if err := j.close(); err != nil {
+			return err
+		}
+	}
+
+	live := j.live()
+
+	tmp := j.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, rec := range live {
+		j.buf = appendJournalRecord(j.buf[:0], rec)
+		w.Write(j.buf)
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if j.f, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0); err != nil {
+		return err
+	}
+	j.w = bufio.NewWriter(j.f)
+	j.records = len(live)
+
+	return nil
+}
+
+// close flushes the journal and closes its file.
+func (j *cacheJournal) close() error {
+	if j.f == nil {
+		return errors.New("cache journal is not open")
+	}
+
+	err := j.w.Flush()
+	if serr := j.f.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := j.f.Close(); err == nil {
+		err = cerr
+	}
+
+	j.f, j.w = nil, nil
+	return err
+}
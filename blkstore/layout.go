@@ -0,0 +1,78 @@
+package blkstore
+
+import (
+	"path"
+	"strings"
+)
+
+// Layout describes where a diskstore keeps each block. Blocks are spread
+// over Fanout levels of directories, each named by the next Width characters
+// of the key, so that no directory ends up with millions of entries. With
+// Fanout 2 and Width 2, the block "abcdef" is kept in ab/cd/abcdef. The zero
+// Layout keeps every block directly under the root.
+type Layout struct {
+	Fanout int
+	Width  int
+}
+
+// ShardedLayout suits stores of hash named blocks.
+var ShardedLayout = Layout{Fanout: 2, Width: 2}
+
+func (l Layout) width() int {
+	if l.Width <= 0 {
+		return 2
+	}
+
+	return l.Width
+}
+
+// path returns the path of the file that holds key. Keys too short to name
+// every level, and characters that can't be part of a directory name, are
+// padded with '_'.
+func (l Layout) path(key string) string {
+	if l.Fanout <= 0 {
+		return key
+	}
+
+	w := l.width()
+	parts := make([]string, 0, l.Fanout+1)
+	for i := 0; i < l.Fanout; i++ {
+		part := make([]byte, w)
+		for j := range part {
+			k := i*w + j
+			if k < len(key) && key[k] != '/' && key[k] != '.' {
+				part[j] = key[k]
+			} else {
+				part[j] = '_'
+			}
+		}
+		parts = append(parts, string(part))
+	}
+
+	return path.Join(append(parts, key)...)
+}
+
+// key returns the key kept in the file at p, or false if p isn't where this
+// layout would put a block.
+func (l Layout) key(p string) (string, bool) {
+	if l.Fanout <= 0 {
+		return p, true
+	}
+
+	parts := strings.SplitN(p, "/", l.Fanout+1)
+	if len(parts) != l.Fanout+1 {
+		return "", false
+	}
+
+	key := parts[l.Fanout]
+	return key, l.path(key) == p
+}
+
+func (l Layout) paths(keys []string) []string {
+	ret := make([]string, len(keys))
+	for i, key := range keys {
+		ret[i] = l.path(key)
+	}
+
+	return ret
+}
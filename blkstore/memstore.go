@@ -1,45 +1,316 @@
 package blkstore
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+var errMismatch = errors.New("number of keys and blocks differ")
+
+// MemOptions bounds how much a memstore holds, and for how long.
+type MemOptions struct {
+	// Capacity is how many bytes of blocks the store may hold. Puts that
+	// would take it over fail with ErrStoreFull. If it is 0, there is no
+	// limit.
+	Capacity int64
+
+	// TTL is how long a block is kept after it was put. If it is 0, blocks
+	// are kept until they are deleted.
+	TTL time.Duration
+}
+
+type memEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+// memstore keeps blocks in a map. It is safe for concurrent use. Blocks are
+// copied on the way in and out, so callers are free to change the slices they
+// pass and get back.
+//
+// Expired blocks can't be read, but are only removed from the map by a put
+// that wouldn't fit otherwise, or by the first put once another TTL has
+// passed since they were last removed. Until then they count towards the
+// capacity.
 type memstore struct {
-	data map[string][]byte
+	opts MemOptions
+	now  func() time.Time
+
+	mu        sync.RWMutex
+	data      map[string]memEntry
+	used      int64
+	nextPurge time.Time
+}
+
+func NewMemStore() ExtBlkStore {
+	return NewMemStoreWithOptions(MemOptions{})
 }
 
-func NewMemStore() BlkStore {
-	return &memstore{make(map[string][]byte)}
+// NewMemStoreWithOptions returns a memstore with a capacity or TTL.
+func NewMemStoreWithOptions(opts MemOptions) ExtBlkStore {
+	return &memstore{
+		opts: opts,
+		now:  time.Now,
+		data: make(map[string]memEntry),
+	}
 }
 
 func (bs *memstore) Get(key string) ([]byte, error) {
-	val, ok := bs.data[key]
-	if !ok {
-		return nil, fmt.Errorf("data[%v] does not exist", key)
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	return bs.get(key)
+}
+
+// get returns a copy of a block. bs.mu must be held.
+func (bs *memstore) get(key string) ([]byte, error) {
+	val, err := bs.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(nil), val...), nil
+}
+
+// lookup returns a block without copying it. bs.mu must be held.
+func (bs *memstore) lookup(key string) ([]byte, error) {
+	e, ok := bs.data[key]
+	if !ok || bs.expired(e) {
+		return nil, notExist(key)
 	}
 
-	return val, nil
+	return e.data, nil
+}
+
+func (bs *memstore) expired(e memEntry) bool {
+	return !e.expires.IsZero() && !bs.now().Before(e.expires)
 }
 
 func (bs *memstore) Put(key string, blk []byte) error {
-	bs.data[key] = blk
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	return bs.put(key, append([]byte(nil), blk...))
+}
+
+// put stores blk, which the store now owns, if there is room for it. bs.mu
+// must be held.
+func (bs *memstore) put(key string, blk []byte) error {
+	delta := func() int64 {
+		return int64(len(blk)) - int64(len(bs.data[key].data))
+	}
+
+	if !bs.fits(delta) {
+		return fmt.Errorf("block %v of size %v: %w", key, len(blk), ErrStoreFull)
+	}
+
+	bs.store(key, blk)
 	return nil
 }
 
+// store stores blk without checking the capacity. bs.mu must be held.
+func (bs *memstore) store(key string, blk []byte) {
+	e := memEntry{data: blk}
+	if bs.opts.TTL > 0 {
+		e.expires = bs.now().Add(bs.opts.TTL)
+	}
+
+	bs.used += int64(len(blk)) - int64(len(bs.data[key].data))
+	bs.data[key] = e
+}
+
+// fits reports whether the store can take delta more bytes, removing
+// expired blocks to make room if it has to. delta is a function since
+// removing an expired block that is being replaced changes it. Expired
+// blocks are also removed every so often regardless, so that a store
+// without a capacity doesn't keep them forever. bs.mu must be held.
+func (bs *memstore) fits(delta func() int64) bool {
+	if bs.opts.TTL > 0 && !bs.now().Before(bs.nextPurge) {
+		bs.purge()
+	}
+
+	if bs.opts.Capacity == 0 || bs.used+delta() <= bs.opts.Capacity {
+		return true
+	}
+
+	if bs.opts.TTL > 0 {
+		bs.purge()
+	}
+
+	return bs.used+delta() <= bs.opts.Capacity
+}
+
+// purge removes expired blocks. bs.mu must be held.
+func (bs *memstore) purge() {
+	for key, e := range bs.data {
+		if bs.expired(e) {
+			bs.used -= int64(len(e.data))
+			delete(bs.data, key)
+		}
+	}
+
+	bs.nextPurge = bs.now().Add(bs.opts.TTL)
+}
+
+func (bs *memstore) GetReader(key string) (io.ReadCloser, error) {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	// Stored blocks are never changed, only replaced, so the reader can
+	// share this one.
+	val, err := bs.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(val)), nil
+}
+
+func (bs *memstore) PutReader(key string, r io.Reader) (int64, error) {
+	val, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if err := bs.put(key, val); err != nil {
+		return 0, err
+	}
+
+	return int64(len(val)), nil
+}
+
 func (bs *memstore) Delete(key string) error {
-	_, ok := bs.data[key]
-	if !ok {
-		return fmt.Errorf("data[%v] does not exist", key)
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	return bs.delete(key)
+}
+
+func (bs *memstore) delete(key string) error {
+	if _, err := bs.lookup(key); err != nil {
+		return err
 	}
 
+	bs.used -= int64(len(bs.data[key].data))
 	delete(bs.data, key)
 	return nil
 }
 
-func (bs *memstore) Size() int64 {
-	var sum int64
-	for _, v := range bs.data {
-		sum += int64(len(v))
+func (bs *memstore) Has(key string) (bool, error) {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	_, err := bs.lookup(key)
+	return err == nil, nil
+}
+
+func (bs *memstore) Size(key string) (int64, error) {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	val, err := bs.lookup(key)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(val)), nil
+}
+
+func (bs *memstore) Keys(prefix string) ([]string, error) {
+	var keys []string
+
+	bs.mu.RLock()
+	for k, e := range bs.data {
+		if strings.HasPrefix(k, prefix) && !bs.expired(e) {
+			keys = append(keys, k)
+		}
+	}
+	bs.mu.RUnlock()
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (bs *memstore) GetMany(keys []string) ([][]byte, error) {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	ret := make([][]byte, len(keys))
+	for i, key := range keys {
+		val, err := bs.get(key)
+		if err != nil {
+			return nil, err
+		}
+
+		ret[i] = val
 	}
-	return sum
+
+	return ret, nil
+}
+
+// PutMany stores all of blks, or none of them if they don't all fit.
+func (bs *memstore) PutMany(keys []string, blks [][]byte) error {
+	if len(keys) != len(blks) {
+		return errMismatch
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	// Work out the final size of each key, in case one is put twice.
+	sizes := make(map[string]int64, len(keys))
+	for i, key := range keys {
+		sizes[key] = int64(len(blks[i]))
+	}
+
+	delta := func() int64 {
+		var d int64
+		for key, size := range sizes {
+			d += size - int64(len(bs.data[key].data))
+		}
+		return d
+	}
+
+	if !bs.fits(delta) {
+		return fmt.Errorf("%v blocks: %w", len(keys), ErrStoreFull)
+	}
+
+	for i, key := range keys {
+		bs.store(key, append([]byte(nil), blks[i]...))
+	}
+
+	return nil
+}
+
+func (bs *memstore) DeleteMany(keys []string) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	var first error
+	for _, key := range keys {
+		if err := bs.delete(key); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// Usage returns the total size of all the blocks in the store, including
+// expired ones that haven't been removed yet.
+func (bs *memstore) Usage() int64 {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	return bs.used
 }
@@ -0,0 +1,106 @@
+package blkstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemStoreCapacity(t *testing.T) {
+	bs := NewMemStoreWithOptions(MemOptions{Capacity: 10})
+	mem := bs.(*memstore)
+
+	if err := bs.Put("a", make([]byte, 6)); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if err := bs.Put("b", make([]byte, 5)); !errors.Is(err, ErrStoreFull) {
+		t.Errorf("put over capacity got %v, want ErrStoreFull", err)
+	}
+
+	// Replacing a block only needs room for the difference.
+	if err := bs.Put("a", make([]byte, 10)); err != nil {
+		t.Errorf("put replacing a block: %v", err)
+	}
+	if used := mem.Usage(); used != 10 {
+		t.Errorf("store holds %v bytes, want 10", used)
+	}
+
+	// PutMany stores all or nothing.
+	err := bs.PutMany([]string{"a", "b"}, [][]byte{make([]byte, 2), make([]byte, 9)})
+	if !errors.Is(err, ErrStoreFull) {
+		t.Errorf("put many over capacity got %v, want ErrStoreFull", err)
+	}
+	if size, _ := bs.Size("a"); size != 10 {
+		t.Errorf("put many that didn't fit changed a block")
+	}
+
+	if err := bs.Delete("a"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := bs.PutMany([]string{"a", "b"}, [][]byte{make([]byte, 2), make([]byte, 8)}); err != nil {
+		t.Errorf("put many after delete: %v", err)
+	}
+	if used := mem.Usage(); used != 10 {
+		t.Errorf("store holds %v bytes, want 10", used)
+	}
+}
+
+func TestMemStoreCopies(t *testing.T) {
+	bs := NewMemStore()
+
+	blk := []byte("block")
+	if err := bs.Put("key", blk); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	blk[0] = 'X'
+
+	got, err := bs.Get("key")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if string(got) != "block" {
+		t.Errorf("changing a slice after putting it changed the block to %q", got)
+	}
+	got[0] = 'Y'
+
+	if got, _ := bs.Get("key"); string(got) != "block" {
+		t.Errorf("changing a slice returned by get changed the block to %q", got)
+	}
+}
+
+func TestMemStoreTTL(t *testing.T) {
+	const ttl = time.Minute
+
+	clock := &fakeClock{time.Now()}
+	bs := NewMemStoreWithOptions(MemOptions{Capacity: 10, TTL: ttl})
+	mem := bs.(*memstore)
+	mem.now = clock.now
+
+	if err := bs.Put("old", make([]byte, 8)); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	clock.t = clock.t.Add(ttl / 2)
+	if has, _ := bs.Has("old"); !has {
+		t.Errorf("block expired early")
+	}
+
+	clock.t = clock.t.Add(ttl / 2)
+	if has, _ := bs.Has("old"); has {
+		t.Errorf("block didn't expire")
+	}
+	if _, err := bs.Get("old"); err == nil {
+		t.Errorf("get of an expired block should error, but did not")
+	}
+	if keys, _ := bs.Keys(""); len(keys) != 0 {
+		t.Errorf("keys lists expired blocks: %v", keys)
+	}
+
+	// The expired block makes room for a new one.
+	if err := bs.Put("new", make([]byte, 8)); err != nil {
+		t.Errorf("put after expiry: %v", err)
+	}
+	if used := mem.Usage(); used != 8 {
+		t.Errorf("store holds %v bytes, want 8", used)
+	}
+}
@@ -0,0 +1,82 @@
+package blkstore
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/shaladdle/goaaw/filestore/std"
+)
+
+// MigrateDiskStore moves the blocks of the diskstore at root from one layout
+// to another, and returns how many it moved. Each block is moved with a
+// single rename, and blocks already where to puts them are left alone, so a
+// migration that was interrupted can simply be run again. Files that fit
+// neither layout are left where they are. The store must not be in use while
+// it is migrated.
+func MigrateDiskStore(root string, from, to Layout) (int, error) {
+	paths, err := std.New(root).ListFiles("")
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, p := range paths {
+		if _, ok := to.key(p); ok && to.Fanout > 0 {
+			continue
+		}
+
+		key, ok := from.key(p)
+		if !ok {
+			continue
+		}
+
+		newPath := to.path(key)
+		if newPath == p {
+			continue
+		}
+
+		dst := filepath.Join(root, filepath.FromSlash(newPath))
+		if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+			return moved, err
+		}
+
+		if err := os.Rename(filepath.Join(root, filepath.FromSlash(p)), dst); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+
+	return moved, removeEmptyDirs(root)
+}
+
+// removeEmptyDirs removes the directories under root, deepest first, that
+// the old layout left empty.
+func removeEmptyDirs(root string) error {
+	var dirs []string
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() && p != root {
+			dirs = append(dirs, p)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Children sort after their parents, so going backwards visits them
+	// first.
+	sort.Strings(dirs)
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if entries, err := os.ReadDir(dirs[i]); err == nil && len(entries) == 0 {
+			os.Remove(dirs[i])
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,845 @@
+package blkstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A pack is a file of records, each of them a block or a tombstone marking
+// the deletion of one. A record is a type byte, a uvarint length prefixed
+// key, a uvarint data length and the data, followed by a CRC-32 of all of
+// that. A tombstone's data is its entry's First, as a uvarint.
+const (
+	recBlock byte = iota + 1
+	recTombstone
+)
+
+const (
+	packPrefix         = "pack-"
+	packIndexName      = "index"
+	defaultMaxPackSize = 64 << 20
+)
+
+var errBadRecord = errors.New("bad pack record")
+
+// PackOptions controls how a PackStore writes its packs.
+type PackOptions struct {
+	// MaxPackSize is how big a pack gets before a new one is started. If
+	// it is 0, packs grow to 64MB.
+	MaxPackSize int64
+
+	// Sync makes Put and Delete flush their records to stable storage
+	// before returning.
+	Sync bool
+}
+
+// packLoc is where a record is: its pack, its offset in the pack, the length
+// of the header before its data, and the length of its data.
+type packLoc struct {
+	Pack   int
+	Offset int64
+	Header int64
+	Size   int64
+}
+
+// length returns the length of the whole record.
+func (l packLoc) length() int64 {
+	return l.Header + l.Size + crc32.Size
+}
+
+// packEntry is the newest record for a key. First is the oldest pack that
+// may still hold an older record for the key. A tombstone is only needed
+// while there is a pack from First on that is older than its own, since
+// otherwise there is no block left for it to hide when the packs are
+// scanned.
+type packEntry struct {
+	Loc   packLoc
+	First int
+}
+
+// packInfo is how many bytes of records a pack has, and how many of those
+// bytes are of records that are still needed.
+type packInfo struct {
+	Size int64
+	Live int64
+}
+
+// packIndex is everything a PackStore knows about its packs. It is saved to
+// disk from time to time, so that opening the store only has to scan the
+// records written since.
+type packIndex struct {
+	Blocks map[string]packEntry
+	Tombs  map[string]packEntry
+	Packs  map[int]*packInfo
+	Active int
+}
+
+// PackStore keeps blocks in large pack files, which are only ever appended
+// to, instead of a file per block. Deleting a block appends a tombstone for
+// it, and Compact reclaims the space taken up by deleted and replaced blocks
+// by copying the live ones out of mostly dead packs and removing them.
+//
+// The store keeps an index of where every block is in memory, and saves it
+// when it starts a new pack, compacts, or is closed. Opening the store loads
+// the index and scans the packs for anything written after it was saved, or
+// rebuilds it entirely from the packs if it is missing or out of date. A
+// record torn by a crash at the end of the last pack is cut off.
+//
+// PackStore is safe for concurrent use.
+type PackStore struct {
+	root string
+	opts PackOptions
+
+	mu    sync.RWMutex
+	index packIndex
+	files map[int]*os.File
+}
+
+// OpenPackStore opens the pack store in the directory root, creating it if
+// it is empty.
+func OpenPackStore(root string, opts PackOptions) (*PackStore, error) {
+	if opts.MaxPackSize <= 0 {
+		opts.MaxPackSize = defaultMaxPackSize
+	}
+
+	s := &PackStore{root: root, opts: opts, files: make(map[int]*os.File)}
+
+	packs, err := s.listPacks()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, n := range packs {
+		f, err := os.OpenFile(s.packPath(n), os.O_RDWR, 0)
+		if err != nil {
+			s.closeFiles()
+			return nil, err
+		}
+		s.files[n] = f
+	}
+
+	if err := s.load(packs); err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+
+	if _, ok := s.files[s.index.Active]; !ok {
+		if err := s.createPack(s.index.Active); err != nil {
+			s.closeFiles()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (s *PackStore) packPath(n int) string {
+	return filepath.Join(s.root, fmt.Sprintf("%v%08d", packPrefix, n))
+}
+
+// listPacks returns the numbers of the packs in the store, in order.
+func (s *PackStore) listPacks() ([]int, error) {
+	d, err := os.Open(s.root)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	var packs []int
+	for _, name := range names {
+		if !strings.HasPrefix(name, packPrefix) {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimPrefix(name, packPrefix)); err == nil {
+			packs = append(packs, n)
+		}
+	}
+
+	sort.Ints(packs)
+	return packs, nil
+}
+
+// load sets up the index, from the saved one if it matches the packs, and
+// otherwise by scanning them all.
+func (s *PackStore) load(packs []int) error {
+	if s.loadIndex(packs) {
+		// Only the active pack can have records the index doesn't.
+		return s.scanPack(s.index.Active, s.index.Packs[s.index.Active].Size, true)
+	}
+
+	s.index = packIndex{
+		Blocks: make(map[string]packEntry),
+		Tombs:  make(map[string]packEntry),
+		Packs:  make(map[int]*packInfo),
+	}
+
+	for i, n := range packs {
+		s.index.Packs[n] = &packInfo{}
+		if err := s.scanPack(n, 0, i == len(packs)-1); err != nil {
+			return err
+		}
+		s.index.Active = n
+	}
+
+	return nil
+}
+
+// loadIndex reads the saved index, and reports whether it can be used: it
+// has to know about exactly the packs there are, and they must be at least
+// as long as it thinks.
+func (s *PackStore) loadIndex(packs []int) bool {
+	f, err := os.Open(filepath.Join(s.root, packIndexName))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	var index packIndex
+	if err := gob.NewDecoder(bufio.NewReader(f)).Decode(&index); err != nil {
+		log.Printf("blkstore: pack index in %v is unreadable, rebuilding it: %v", s.root, err)
+		return false
+	}
+
+	if len(index.Packs) != len(packs) || index.Packs[index.Active] == nil {
+		return false
+	}
+	for _, n := range packs {
+		info, ok := index.Packs[n]
+		if !ok {
+			return false
+		}
+
+		fi, err := s.files[n].Stat()
+		if err != nil || fi.Size() < info.Size {
+			return false
+		}
+	}
+
+	if index.Blocks == nil {
+		index.Blocks = make(map[string]packEntry)
+	}
+	if index.Tombs == nil {
+		index.Tombs = make(map[string]packEntry)
+	}
+
+	s.index = index
+	return true
+}
+
+// scanPack adds the records in pack n from offset on to the index. If last
+// is set, a damaged record is taken to have been torn by a crash, and the
+// pack is cut off before it.
+func (s *PackStore) scanPack(n int, offset int64, last bool) error {
+	f := s.files[n]
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+	for {
+		key, typ, loc, first, err := readPackRecord(r, n, offset)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			if !last {
+				return fmt.Errorf("%v at offset %v: %v", s.packPath(n), offset, err)
+			}
+
+			log.Printf("blkstore: cutting off %v at offset %v: %v", s.packPath(n), offset, err)
+			return f.Truncate(offset)
+		}
+
+		s.apply(key, typ, loc, first)
+		offset += loc.length()
+	}
+}
+
+// readPackRecord reads the record at offset in pack n. For tombstones, it
+// also returns the First they were written with. It returns io.EOF if there
+// are no more records.
+func readPackRecord(r *bufio.Reader, n int, offset int64) (key string, typ byte, loc packLoc, first int, err error) {
+	cr := &crcReader{r: r, h: crc32.NewIEEE()}
+
+	if typ, err = cr.ReadByte(); err != nil {
+		return "", 0, loc, 0, err
+	}
+	if typ != recBlock && typ != recTombstone {
+		return "", 0, loc, 0, errBadRecord
+	}
+
+	keyLen, err := binary.ReadUvarint(cr)
+	if err != nil {
+		return "", 0, loc, 0, noEOF(err)
+	}
+	keyBuf := make([]byte, keyLen)
+	if _, err := io.ReadFull(cr, keyBuf); err != nil {
+		return "", 0, loc, 0, noEOF(err)
+	}
+
+	size, err := binary.ReadUvarint(cr)
+	if err != nil {
+		return "", 0, loc, 0, noEOF(err)
+	}
+
+	loc = packLoc{Pack: n, Offset: offset, Header: cr.n, Size: int64(size)}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(cr, data); err != nil {
+		return "", 0, loc, 0, noEOF(err)
+	}
+
+	var sum [crc32.Size]byte
+	if _, err := io.ReadFull(r, sum[:]); err != nil {
+		return "", 0, loc, 0, noEOF(err)
+	}
+	if binary.BigEndian.Uint32(sum[:]) != cr.h.Sum32() {
+		return "", 0, loc, 0, errBadRecord
+	}
+
+	first = n
+	if typ == recTombstone {
+		f, m := binary.Uvarint(data)
+		if m <= 0 {
+			return "", 0, loc, 0, errBadRecord
+		}
+		first = int(f)
+	}
+
+	return string(keyBuf), typ, loc, first, nil
+}
+
+// crcReader reads from r, adding what it reads to a CRC and counting it.
+type crcReader struct {
+	r *bufio.Reader
+	h hash.Hash32
+	n int64
+}
+
+func (c *crcReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.h.Write([]byte{b})
+		c.n++
+	}
+	return b, err
+}
+
+func (c *crcReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.h.Write(b[:n])
+	c.n += int64(n)
+	return n, err
+}
+
+// encodePackRecord returns a record, and the length of its header.
+func encodePackRecord(typ byte, key string, data []byte) ([]byte, int64) {
+	var buf [binary.MaxVarintLen64]byte
+
+	rec := []byte{typ}
+	rec = append(rec, buf[:binary.PutUvarint(buf[:], uint64(len(key)))]...)
+	rec = append(rec, key...)
+	rec = append(rec, buf[:binary.PutUvarint(buf[:], uint64(len(data)))]...)
+	header := int64(len(rec))
+
+	rec = append(rec, data...)
+	rec = append(rec, buf[:crc32.Size]...)
+	binary.BigEndian.PutUint32(rec[len(rec)-crc32.Size:], crc32.ChecksumIEEE(rec[:len(rec)-crc32.Size]))
+
+	return rec, header
+}
+
+func encodeTombstone(key string, first int) ([]byte, int64) {
+	var buf [binary.MaxVarintLen64]byte
+	return encodePackRecord(recTombstone, key, buf[:binary.PutUvarint(buf[:], uint64(first))])
+}
+
+// apply updates the index with a record that was written to a pack. first
+// is the oldest pack that may hold an earlier record for the key, as far as
+// the caller knows. s.mu must be held.
+func (s *PackStore) apply(key string, typ byte, loc packLoc, first int) {
+	info := s.index.Packs[loc.Pack]
+	if end := loc.Offset + loc.length(); end > info.Size {
+		info.Size = end
+	}
+
+	// Whatever was there before is dead now.
+	if old, ok := s.index.Blocks[key]; ok {
+		s.index.Packs[old.Loc.Pack].Live -= old.Loc.length()
+		delete(s.index.Blocks, key)
+		first = minInt(first, old.First)
+	}
+	if old, ok := s.index.Tombs[key]; ok {
+		s.index.Packs[old.Loc.Pack].Live -= old.Loc.length()
+		delete(s.index.Tombs, key)
+		first = minInt(first, old.First)
+	}
+
+	e := packEntry{loc, minInt(first, loc.Pack)}
+	if typ == recBlock {
+		s.index.Blocks[key] = e
+	} else if s.tombNeeded(e, nil) {
+		s.index.Tombs[key] = e
+	} else {
+		return
+	}
+
+	info.Live += loc.length()
+}
+
+// tombNeeded reports whether a tombstone still hides a record in one of the
+// packs, not counting the ones in gone. s.mu must be held.
+func (s *PackStore) tombNeeded(e packEntry, gone map[int]bool) bool {
+	for n := range s.index.Packs {
+		if n >= e.First && n < e.Loc.Pack && !gone[n] {
+			return true
+		}
+	}
+	return false
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (s *PackStore) createPack(n int) error {
+	f, err := os.OpenFile(s.packPath(n), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+
+	s.files[n] = f
+	s.index.Packs[n] = &packInfo{}
+	s.index.Active = n
+
+	if s.opts.Sync {
+		return syncPackDir(s.root)
+	}
+
+	return nil
+}
+
+func syncPackDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// write appends a record to the active pack, starting a new one first if it
+// would get too big, and returns where the record went. s.mu must be held.
+func (s *PackStore) write(rec []byte, header int64) (packLoc, error) {
+	info := s.index.Packs[s.index.Active]
+	if info.Size > 0 && info.Size+int64(len(rec)) > s.opts.MaxPackSize {
+		if err := s.rotate(); err != nil {
+			return packLoc{}, err
+		}
+		info = s.index.Packs[s.index.Active]
+	}
+
+	loc := packLoc{
+		Pack:   s.index.Active,
+		Offset: info.Size,
+		Header: header,
+		Size:   int64(len(rec)) - header - crc32.Size,
+	}
+
+	if _, err := s.files[loc.Pack].WriteAt(rec, loc.Offset); err != nil {
+		return packLoc{}, err
+	}
+
+	return loc, nil
+}
+
+// rotate finishes the active pack and starts a new one. The index is saved
+// at the same time, so that opening the store never has to scan more than
+// one pack. s.mu must be held.
+func (s *PackStore) rotate() error {
+	if err := s.files[s.index.Active].Sync(); err != nil {
+		return err
+	}
+
+	if err := s.createPack(s.index.Active + 1); err != nil {
+		return err
+	}
+
+	return s.saveIndex()
+}
+
+// saveIndex writes the index to a temporary file and renames it into place.
+// s.mu must be held.
+func (s *PackStore) saveIndex() error {
+	path := filepath.Join(s.root, packIndexName)
+	tmp := path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	err = gob.NewEncoder(w).Encode(&s.index)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return syncPackDir(s.root)
+}
+
+// sync flushes the active pack, if the options ask for it. s.mu must be held.
+func (s *PackStore) sync() error {
+	if !s.opts.Sync {
+		return nil
+	}
+
+	return s.files[s.index.Active].Sync()
+}
+
+// Close saves the index and closes the packs.
+func (s *PackStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.files[s.index.Active].Sync()
+	if err == nil {
+		err = s.saveIndex()
+	}
+	if cerr := s.closeFiles(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+func (s *PackStore) closeFiles() error {
+	var first error
+	for n, f := range s.files {
+		if err := f.Close(); err != nil && first == nil {
+			first = err
+		}
+		delete(s.files, n)
+	}
+
+	return first
+}
+
+func (s *PackStore) Get(key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.get(key)
+}
+
+// get reads a block and checks its record. s.mu must be held.
+func (s *PackStore) get(key string) ([]byte, error) {
+	e, ok := s.index.Blocks[key]
+	if !ok {
+		return nil, notExist(key)
+	}
+
+	rec, err := s.readRecord(e.Loc)
+	if err != nil {
+		return nil, err
+	}
+
+	return rec[e.Loc.Header : e.Loc.Header+e.Loc.Size], nil
+}
+
+// readRecord reads the whole record at loc, and checks its CRC.
+func (s *PackStore) readRecord(loc packLoc) ([]byte, error) {
+	rec := make([]byte, loc.length())
+	if _, err := s.files[loc.Pack].ReadAt(rec, loc.Offset); err != nil {
+		return nil, err
+	}
+
+	body := rec[:len(rec)-crc32.Size]
+	if binary.BigEndian.Uint32(rec[len(body):]) != crc32.ChecksumIEEE(body) {
+		return nil, fmt.Errorf("%v at offset %v: %w", s.packPath(loc.Pack), loc.Offset, ErrCorrupted)
+	}
+
+	return rec, nil
+}
+
+func (s *PackStore) Put(key string, blk []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.put(key, blk); err != nil {
+		return err
+	}
+
+	return s.sync()
+}
+
+func (s *PackStore) put(key string, blk []byte) error {
+	rec, header := encodePackRecord(recBlock, key, blk)
+	loc, err := s.write(rec, header)
+	if err != nil {
+		return err
+	}
+
+	s.apply(key, recBlock, loc, loc.Pack)
+	return nil
+}
+
+// Delete appends a tombstone for a block. The space the block takes up is
+// reclaimed by Compact.
+func (s *PackStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.delete(key); err != nil {
+		return err
+	}
+
+	return s.sync()
+}
+
+func (s *PackStore) delete(key string) error {
+	old, ok := s.index.Blocks[key]
+	if !ok {
+		return notExist(key)
+	}
+
+	rec, header := encodeTombstone(key, old.First)
+	loc, err := s.write(rec, header)
+	if err != nil {
+		return err
+	}
+
+	s.apply(key, recTombstone, loc, old.First)
+	return nil
+}
+
+func (s *PackStore) Has(key string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.index.Blocks[key]
+	return ok, nil
+}
+
+func (s *PackStore) Size(key string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.index.Blocks[key]
+	if !ok {
+		return 0, notExist(key)
+	}
+
+	return e.Loc.Size, nil
+}
+
+func (s *PackStore) Keys(prefix string) ([]string, error) {
+	s.mu.RLock()
+	var keys []string
+	for key := range s.index.Blocks {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *PackStore) GetMany(keys []string) ([][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	blks := make([][]byte, len(keys))
+	for i, key := range keys {
+		var err error
+		if blks[i], err = s.get(key); err != nil {
+			return nil, err
+		}
+	}
+
+	return blks, nil
+}
+
+// PutMany appends all of blks, and syncs once at the end.
+func (s *PackStore) PutMany(keys []string, blks [][]byte) error {
+	if len(keys) != len(blks) {
+		return errMismatch
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, key := range keys {
+		if err := s.put(key, blks[i]); err != nil {
+			return err
+		}
+	}
+
+	return s.sync()
+}
+
+func (s *PackStore) DeleteMany(keys []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var first error
+	for _, key := range keys {
+		if err := s.delete(key); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	if err := s.sync(); err != nil && first == nil {
+		first = err
+	}
+
+	return first
+}
+
+// CompactStats describes what a compaction did.
+type CompactStats struct {
+	// Packs is the number of packs that were removed.
+	Packs int
+
+	// Bytes is how much smaller the store got.
+	Bytes int64
+}
+
+// Compact rewrites the packs in which less than minLive of the bytes are of
+// blocks and tombstones that are still needed: the live records are copied
+// to the active pack, and the old pack is removed. The store can't be used
+// while it is being compacted.
+func (s *PackStore) Compact(minLive float64) (CompactStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stats CompactStats
+
+	var victims []int
+	for n, info := range s.index.Packs {
+		if n != s.index.Active && float64(info.Live) < minLive*float64(info.Size) {
+			victims = append(victims, n)
+		}
+	}
+	sort.Ints(victims)
+
+	if len(victims) == 0 {
+		return stats, nil
+	}
+
+	isVictim := make(map[int]bool)
+	for _, n := range victims {
+		isVictim[n] = true
+	}
+
+	var copied int64
+	for key, e := range s.index.Blocks {
+		if !isVictim[e.Loc.Pack] {
+			continue
+		}
+
+		rec, err := s.readRecord(e.Loc)
+		if err != nil {
+			return stats, err
+		}
+
+		loc, err := s.write(rec, e.Loc.Header)
+		if err != nil {
+			return stats, err
+		}
+
+		s.apply(key, recBlock, loc, e.First)
+		copied += loc.length()
+	}
+
+	for key, e := range s.index.Tombs {
+		if !isVictim[e.Loc.Pack] {
+			continue
+		}
+
+		if !s.tombNeeded(e, isVictim) {
+			s.index.Packs[e.Loc.Pack].Live -= e.Loc.length()
+			delete(s.index.Tombs, key)
+			continue
+		}
+
+		rec, err := s.readRecord(e.Loc)
+		if err != nil {
+			return stats, err
+		}
+
+		loc, err := s.write(rec, e.Loc.Header)
+		if err != nil {
+			return stats, err
+		}
+
+		s.apply(key, recTombstone, loc, e.First)
+		copied += loc.length()
+	}
+
+	// The copies have to be safely on disk before the originals go.
+	if err := s.files[s.index.Active].Sync(); err != nil {
+		return stats, err
+	}
+
+	for _, n := range victims {
+		stats.Bytes += s.index.Packs[n].Size
+
+		s.files[n].Close()
+		delete(s.files, n)
+		delete(s.index.Packs, n)
+
+		if err := os.Remove(s.packPath(n)); err != nil {
+			return stats, err
+		}
+		stats.Packs++
+	}
+	stats.Bytes -= copied
+
+	// Tombstones elsewhere may have been hiding blocks in the packs that
+	// were removed.
+	for key, e := range s.index.Tombs {
+		if !s.tombNeeded(e, nil) {
+			s.index.Packs[e.Loc.Pack].Live -= e.Loc.length()
+			delete(s.index.Tombs, key)
+		}
+	}
+
+	return stats, s.saveIndex()
+}
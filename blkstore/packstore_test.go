@@ -0,0 +1,230 @@
+package blkstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func openPackStore(t *testing.T, root string) *PackStore {
+	s, err := OpenPackStore(root, PackOptions{MaxPackSize: 256})
+	if err != nil {
+		t.Fatalf("open pack store: %v", err)
+	}
+	return s
+}
+
+// crash drops a pack store without saving its index, as a crash would.
+func (s *PackStore) crash() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closeFiles()
+}
+
+// checkPackStore checks that s holds exactly the blocks in want.
+func checkPackStore(t *testing.T, when string, s *PackStore, want map[string]string) {
+	keys, err := s.Keys("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != len(want) {
+		t.Errorf("%v: store has %v blocks, want %v", when, len(keys), len(want))
+	}
+
+	for key, value := range want {
+		if b, err := s.Get(key); err != nil || string(b) != value {
+			t.Errorf("%v: block %v is %q, %v, want %q", when, key, b, err, value)
+		}
+	}
+}
+
+func TestPackStoreRecovery(t *testing.T) {
+	te := testutil.NewTestEnv("pack", t)
+	defer te.Teardown()
+
+	s := openPackStore(t, te.Root())
+	want := make(map[string]string)
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprint(i % 30)
+		want[key] = fmt.Sprintf("block %v, version %v", key, i)
+		if err := s.Put(key, []byte(want[key])); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+	for i := 0; i < 30; i += 3 {
+		key := fmt.Sprint(i)
+		delete(want, key)
+		if err := s.Delete(key); err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+	}
+
+	// Everything since the last time the index was saved is recovered by
+	// scanning the active pack.
+	s.crash()
+	s = openPackStore(t, te.Root())
+	checkPackStore(t, "after a crash", s, want)
+
+	// A record torn by a crash is cut off.
+	active := s.packPath(s.index.Active)
+	s.crash()
+	f, err := os.OpenFile(active, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{recBlock, 3, 'a', 'b'})
+	f.Close()
+
+	s = openPackStore(t, te.Root())
+	checkPackStore(t, "after a torn write", s, want)
+	if err := s.Put("new", []byte("new block")); err != nil {
+		t.Fatalf("put after a torn write: %v", err)
+	}
+	want["new"] = "new block"
+	s.Close()
+
+	// Without an index, it is rebuilt from all the packs.
+	if err := os.Remove(filepath.Join(te.Root(), packIndexName)); err != nil {
+		t.Fatal(err)
+	}
+	s = openPackStore(t, te.Root())
+	checkPackStore(t, "without an index", s, want)
+	s.Close()
+}
+
+func TestPackStoreCompact(t *testing.T) {
+	te := testutil.NewTestEnv("pack", t)
+	defer te.Teardown()
+
+	s := openPackStore(t, te.Root())
+
+	want := make(map[string]string)
+	for i := 0; i < 60; i++ {
+		key := fmt.Sprint(i)
+		want[key] = "block " + key
+		if err := s.Put(key, []byte(want[key])); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+
+	// Replace some blocks and delete most of the rest, so that the old
+	// packs are mostly dead.
+	for i := 0; i < 60; i++ {
+		key := fmt.Sprint(i)
+		switch {
+		case i%10 == 0:
+			want[key] = "new block " + key
+			if err := s.Put(key, []byte(want[key])); err != nil {
+				t.Fatalf("put: %v", err)
+			}
+		case i%10 != 5:
+			delete(want, key)
+			if err := s.Delete(key); err != nil {
+				t.Fatalf("delete: %v", err)
+			}
+		}
+	}
+
+	before, _ := s.listPacks()
+	stats, err := s.Compact(0.5)
+	if err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	after, _ := s.listPacks()
+
+	if stats.Packs == 0 || stats.Bytes <= 0 {
+		t.Errorf("compaction reclaimed %v packs and %v bytes", stats.Packs, stats.Bytes)
+	}
+	if len(before)-len(after) > stats.Packs {
+		t.Errorf("%v packs went away, but compaction says it removed %v", len(before)-len(after), stats.Packs)
+	}
+	checkPackStore(t, "after compaction", s, want)
+
+	// Deleted blocks stay deleted when the index is rebuilt from the packs
+	// that are left.
+	s.Close()
+	if err := os.Remove(filepath.Join(te.Root(), packIndexName)); err != nil {
+		t.Fatal(err)
+	}
+	s = openPackStore(t, te.Root())
+	checkPackStore(t, "after compaction and rebuilding the index", s, want)
+
+	// Compacting everything that can be leaves the store holding only the
+	// live blocks.
+	if _, err := s.Compact(1.1); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	checkPackStore(t, "after full compaction", s, want)
+	if n := len(s.index.Tombs); n != 0 {
+		t.Errorf("%v tombstones left after full compaction", n)
+	}
+
+	index := s.index
+	s.Close()
+	s = openPackStore(t, te.Root())
+	defer s.Close()
+	if !reflect.DeepEqual(s.index.Blocks, index.Blocks) {
+		t.Errorf("saved index doesn't match the one that was in use")
+	}
+}
+
+// TestPackStoreTombstones checks that compaction keeps a tombstone for as
+// long as any pack holds an older version of its block, not just the one it
+// deleted.
+func TestPackStoreTombstones(t *testing.T) {
+	te := testutil.NewTestEnv("pack", t)
+	defer te.Teardown()
+
+	s, err := OpenPackStore(te.Root(), PackOptions{})
+	if err != nil {
+		t.Fatalf("open pack store: %v", err)
+	}
+
+	big := string(make([]byte, 1000))
+	step := func(f func() error) {
+		if err := f(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotate := func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.rotate()
+	}
+
+	// Pack 0 is mostly live, but has the first version of key.
+	step(func() error { return s.Put("key", []byte("version 1")) })
+	step(func() error { return s.Put("filler", []byte(big)) })
+	step(rotate)
+
+	// Pack 1 has the second version, which is deleted in pack 2. Pack 2 is
+	// mostly a block replaced in pack 3.
+	step(func() error { return s.Put("key", []byte("version 2")) })
+	step(rotate)
+	step(func() error { return s.Delete("key") })
+	step(func() error { return s.Put("junk", []byte(big)) })
+	step(rotate)
+	step(func() error { return s.Put("junk", []byte("small")) })
+
+	stats, err := s.Compact(0.5)
+	if err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if stats.Packs != 2 {
+		t.Errorf("compaction removed %v packs, want 2", stats.Packs)
+	}
+	s.Close()
+
+	if err := os.Remove(filepath.Join(te.Root(), packIndexName)); err != nil {
+		t.Fatal(err)
+	}
+	s = openPackStore(t, te.Root())
+	defer s.Close()
+
+	checkPackStore(t, "after rebuilding the index", s, map[string]string{"filler": big, "junk": "small"})
+}
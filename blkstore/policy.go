@@ -0,0 +1,337 @@
+package blkstore
+
+import (
+	"container/heap"
+	"container/list"
+)
+
+// Policy decides which block a cache evicts next. The cache tells it about
+// every block that comes and goes, and every hit. Policies don't need to be
+// safe for concurrent use; the cache serializes calls to them.
+type Policy interface {
+	// Add records that a block that isn't in the cache was put in it.
+	Add(key string, size int64)
+
+	// Access records a hit on a block in the cache.
+	Access(key string)
+
+	// Remove records that a block was removed from the cache for some
+	// reason other than being chosen by Evict.
+	Remove(key string)
+
+	// Evict picks a block to evict, forgets it, and returns its key. It
+	// is only called when the cache has at least one block in it.
+	Evict() string
+}
+
+// lruList is a list of keys in order of use, most recent first, that can
+// find any key in constant time. The LRU, ARC and 2Q policies are all built
+// from these.
+type lruList struct {
+	l     *list.List
+	elems map[string]*list.Element
+}
+
+func newLRUList() *lruList {
+	return &lruList{list.New(), make(map[string]*list.Element)}
+}
+
+func (l *lruList) len() int {
+	return l.l.Len()
+}
+
+func (l *lruList) has(key string) bool {
+	_, ok := l.elems[key]
+	return ok
+}
+
+func (l *lruList) pushFront(key string) {
+	l.elems[key] = l.l.PushFront(key)
+}
+
+func (l *lruList) moveToFront(key string) {
+	l.l.MoveToFront(l.elems[key])
+}
+
+func (l *lruList) remove(key string) bool {
+	el, ok := l.elems[key]
+	if ok {
+		l.l.Remove(el)
+		delete(l.elems, key)
+	}
+	return ok
+}
+
+// popBack removes and returns the least recently used key.
+func (l *lruList) popBack() string {
+	key := l.l.Back().Value.(string)
+	l.remove(key)
+	return key
+}
+
+// NewLRU returns a policy that evicts the least recently used block.
+func NewLRU() Policy {
+	return &lru{newLRUList()}
+}
+
+type lru struct {
+	list *lruList
+}
+
+func (p *lru) Add(key string, size int64) { p.list.pushFront(key) }
+func (p *lru) Access(key string)          { p.list.moveToFront(key) }
+func (p *lru) Remove(key string)          { p.list.remove(key) }
+func (p *lru) Evict() string              { return p.list.popBack() }
+
+// NewLFU returns a policy that evicts the least frequently used block,
+// breaking ties by evicting the least recently used one.
+func NewLFU() Policy {
+	return &lfu{index: make(map[string]*lfuEntry)}
+}
+
+type lfuEntry struct {
+	key   string
+	uses  int
+	last  uint64
+	index int
+}
+
+// lfu keeps its blocks in a heap ordered by use count, then by the time of
+// the last use.
+type lfu struct {
+	entries []*lfuEntry
+	index   map[string]*lfuEntry
+	clock   uint64
+}
+
+func (p *lfu) Len() int { return len(p.entries) }
+
+func (p *lfu) Less(i, j int) bool {
+	a, b := p.entries[i], p.entries[j]
+	if a.uses != b.uses {
+		return a.uses < b.uses
+	}
+	return a.last < b.last
+}
+
+func (p *lfu) Swap(i, j int) {
+	p.entries[i], p.entries[j] = p.entries[j], p.entries[i]
+	p.entries[i].index = i
+	p.entries[j].index = j
+}
+
+func (p *lfu) Push(x interface{}) {
+	e := x.(*lfuEntry)
+	e.index = len(p.entries)
+	p.entries = append(p.entries, e)
+}
+
+func (p *lfu) Pop() interface{} {
+	e := p.entries[len(p.entries)-1]
+	p.entries = p.entries[:len(p.entries)-1]
+	return e
+}
+
+func (p *lfu) Add(key string, size int64) {
+	p.clock++
+	e := &lfuEntry{key: key, uses: 1, last: p.clock}
+	p.index[key] = e
+	heap.Push(p, e)
+}
+
+func (p *lfu) Access(key string) {
+	p.clock++
+	e := p.index[key]
+	e.uses++
+	e.last = p.clock
+	heap.Fix(p, e.index)
+}
+
+func (p *lfu) Remove(key string) {
+	if e, ok := p.index[key]; ok {
+		heap.Remove(p, e.index)
+		delete(p.index, key)
+	}
+}
+
+func (p *lfu) Evict() string {
+	e := heap.Pop(p).(*lfuEntry)
+	delete(p.index, e.key)
+	return e.key
+}
+
+// NewARC returns an adaptive replacement cache policy. Blocks seen once and
+// blocks seen more than once are kept in separate lists, and the split
+// between them adapts to the workload using the recently evicted keys of
+// each, so a long scan can't push out a frequently used set of blocks.
+//
+// The policy counts blocks rather than bytes, so it works best when blocks
+// are of similar sizes.
+func NewARC() Policy {
+	return &arc{
+		t1: newLRUList(),
+		t2: newLRUList(),
+		b1: newLRUList(),
+		b2: newLRUList(),
+	}
+}
+
+// arc follows the names in Megiddo and Modha's paper: t1 and t2 hold the
+// blocks in the cache seen once and more than once, b1 and b2 the keys
+// recently evicted from each, and p is the target size of t1.
+type arc struct {
+	t1, t2, b1, b2 *lruList
+	p              int
+}
+
+// capacity is the number of blocks in the cache, which bounds the history
+// kept of evicted ones.
+func (a *arc) capacity() int {
+	if c := a.t1.len() + a.t2.len(); c > 0 {
+		return c
+	}
+	return 1
+}
+
+func (a *arc) Add(key string, size int64) {
+	c := a.capacity()
+
+	switch {
+	case a.b1.remove(key):
+		// It was evicted from t1 too soon, so t1 should be bigger.
+		delta := 1
+		if a.b1.len() > 0 && a.b2.len() > a.b1.len() {
+			delta = a.b2.len() / a.b1.len()
+		}
+		if a.p += delta; a.p > c {
+			a.p = c
+		}
+		a.t2.pushFront(key)
+	case a.b2.remove(key):
+		delta := 1
+		if a.b2.len() > 0 && a.b1.len() > a.b2.len() {
+			delta = a.b1.len() / a.b2.len()
+		}
+		if a.p -= delta; a.p < 0 {
+			a.p = 0
+		}
+		a.t2.pushFront(key)
+	default:
+		a.t1.pushFront(key)
+	}
+}
+
+func (a *arc) Access(key string) {
+	if a.t1.remove(key) {
+		a.t2.pushFront(key)
+	} else {
+		a.t2.moveToFront(key)
+	}
+}
+
+func (a *arc) Remove(key string) {
+	a.t1.remove(key)
+	a.t2.remove(key)
+	a.b1.remove(key)
+	a.b2.remove(key)
+}
+
+func (a *arc) Evict() string {
+	var key string
+	if a.t1.len() > 0 && (a.t1.len() > a.p || a.t2.len() == 0) {
+		key = a.t1.popBack()
+		a.b1.pushFront(key)
+	} else {
+		key = a.t2.popBack()
+		a.b2.pushFront(key)
+	}
+
+	c := a.capacity()
+	for a.b1.len() > c {
+		a.b1.popBack()
+	}
+	for a.b2.len() > c {
+		a.b2.popBack()
+	}
+
+	return key
+}
+
+// New2Q returns a 2Q policy. New blocks go into a FIFO queue holding about a
+// quarter of the cache. Blocks evicted from it are remembered for a while,
+// and only those that are used again in that time make it into the main LRU
+// list, so blocks read once by a scan never displace the hot set.
+func New2Q() Policy {
+	return &twoQ{
+		in:    newLRUList(),
+		out:   newLRUList(),
+		main:  newLRUList(),
+		sizes: make(map[string]int64),
+	}
+}
+
+// twoQ uses the names from Johnson and Shasha's paper: in is the A1in FIFO,
+// out the A1out history of keys, and main the Am LRU list.
+type twoQ struct {
+	in, out, main *lruList
+	sizes         map[string]int64
+	inSize        int64
+	total         int64
+}
+
+func (q *twoQ) Add(key string, size int64) {
+	q.sizes[key] = size
+	q.total += size
+
+	if q.out.remove(key) {
+		q.main.pushFront(key)
+		return
+	}
+
+	q.in.pushFront(key)
+	q.inSize += size
+}
+
+func (q *twoQ) Access(key string) {
+	// Hits in the FIFO don't count; a scan often touches a block a few
+	// times in quick succession.
+	if q.main.has(key) {
+		q.main.moveToFront(key)
+	}
+}
+
+func (q *twoQ) forget(key string) {
+	size := q.sizes[key]
+	if q.in.remove(key) {
+		q.inSize -= size
+	} else {
+		q.main.remove(key)
+	}
+
+	delete(q.sizes, key)
+	q.total -= size
+}
+
+func (q *twoQ) Remove(key string) {
+	q.forget(key)
+	q.out.remove(key)
+}
+
+func (q *twoQ) Evict() string {
+	if q.in.len() > 0 && (q.inSize > q.total/4 || q.main.len() == 0) {
+		key := q.in.l.Back().Value.(string)
+		q.forget(key)
+
+		// Remember about half the cache's worth of evicted keys.
+		q.out.pushFront(key)
+		for limit := (q.in.len() + q.main.len() + 1) / 2; q.out.len() > limit && q.out.len() > 1; {
+			q.out.popBack()
+		}
+
+		return key
+	}
+
+	key := q.main.l.Back().Value.(string)
+	q.forget(key)
+	return key
+}
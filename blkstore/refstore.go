@@ -0,0 +1,328 @@
+package blkstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrNoRefs is returned when a reference is dropped from a block that has
+// none left.
+var ErrNoRefs = errors.New("block has no references")
+
+// RefOptions controls when a RefStore reclaims blocks.
+type RefOptions struct {
+	// GracePeriod is how long a block is kept after its last reference is
+	// dropped, so that a writer that is about to reference it again has
+	// time to do so.
+	GracePeriod time.Duration
+
+	// SweepInterval is how often the background sweeper runs. If it is 0
+	// there is no background sweeper, and Sweep has to be called directly.
+	SweepInterval time.Duration
+}
+
+// RefStore counts references to the blocks in a store, so that blocks
+// shared by many files are only deleted once nothing uses them. Put and Ref
+// add a reference, and Delete drops one. Blocks with no references left are
+// reclaimed by Sweep once they have been unreferenced for the grace period.
+//
+// The counts are kept in a second store, one small record per block, so
+// every change to a count is a single Put. A block is always written before
+// its count is raised and deleted after its count is gone, so a crash can
+// at worst leave a block without a count; Sweep treats those as unreferenced.
+type RefStore struct {
+	data  ExtBlkStore
+	refs  ExtBlkStore
+	opts  RefOptions
+	locks stripedLock
+	now   func() time.Time
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// refRecord is the persisted reference count of a block. ZeroSince is when
+// the count last dropped to zero.
+type refRecord struct {
+	Count     uint64
+	ZeroSince time.Time
+}
+
+const refRecordSize = 16
+
+func (r refRecord) encode() []byte {
+	b := make([]byte, refRecordSize)
+	binary.BigEndian.PutUint64(b, r.Count)
+	if r.Count == 0 {
+		binary.BigEndian.PutUint64(b[8:], uint64(r.ZeroSince.UnixNano()))
+	}
+	return b
+}
+
+func decodeRefRecord(b []byte) (refRecord, error) {
+	if len(b) != refRecordSize {
+		return refRecord{}, fmt.Errorf("reference record has size %v, want %v", len(b), refRecordSize)
+	}
+
+	r := refRecord{Count: binary.BigEndian.Uint64(b)}
+	if r.Count == 0 {
+		r.ZeroSince = time.Unix(0, int64(binary.BigEndian.Uint64(b[8:])))
+	}
+
+	return r, nil
+}
+
+// NewRefStore returns a RefStore keeping blocks in data and their reference
+// counts in refs. If opts.SweepInterval is set, a background sweeper runs
+// until Close is called.
+func NewRefStore(data, refs ExtBlkStore, opts RefOptions) *RefStore {
+	s := &RefStore{
+		data: data,
+		refs: refs,
+		opts: opts,
+		now:  time.Now,
+		done: make(chan struct{}),
+	}
+
+	if opts.SweepInterval > 0 {
+		s.wg.Add(1)
+		go s.sweeper()
+	}
+
+	return s
+}
+
+// Close stops the background sweeper.
+func (s *RefStore) Close() {
+	close(s.done)
+	s.wg.Wait()
+}
+
+func (s *RefStore) sweeper() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.opts.SweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if _, err := s.Sweep(false); err != nil {
+				log.Println("blkstore: sweep:", err)
+			}
+		}
+	}
+}
+
+// record returns the reference record for key, and whether there is one.
+// The key's stripe must be held.
+func (s *RefStore) record(key string) (refRecord, bool, error) {
+	has, err := s.refs.Has(key)
+	if err != nil || !has {
+		return refRecord{}, false, err
+	}
+
+	b, err := s.refs.Get(key)
+	if err != nil {
+		return refRecord{}, false, err
+	}
+
+	r, err := decodeRefRecord(b)
+	return r, true, err
+}
+
+func (s *RefStore) Get(key string) ([]byte, error) {
+	return s.data.Get(key)
+}
+
+// Put stores blk under key, unless it is already there, and adds a
+// reference to it.
+func (s *RefStore) Put(key string, blk []byte) error {
+	l := s.locks.get(key)
+	l.Lock()
+	defer l.Unlock()
+
+	has, err := s.data.Has(key)
+	if err != nil {
+		return err
+	}
+
+	if !has {
+		if err := s.data.Put(key, blk); err != nil {
+			return err
+		}
+	}
+
+	return s.addRef(key)
+}
+
+// Ref adds a reference to a block that is already stored, including one
+// whose references were all dropped but that hasn't been swept yet.
+func (s *RefStore) Ref(key string) error {
+	l := s.locks.get(key)
+	l.Lock()
+	defer l.Unlock()
+
+	if has, err := s.data.Has(key); err != nil {
+		return err
+	} else if !has {
+		return notExist(key)
+	}
+
+	return s.addRef(key)
+}
+
+func (s *RefStore) addRef(key string) error {
+	r, _, err := s.record(key)
+	if err != nil {
+		return err
+	}
+
+	r.Count++
+	return s.refs.Put(key, r.encode())
+}
+
+// Delete drops a reference to the block stored under key. The block itself
+// stays until a sweep finds it unreferenced for the grace period.
+func (s *RefStore) Delete(key string) error {
+	l := s.locks.get(key)
+	l.Lock()
+	defer l.Unlock()
+
+	r, ok, err := s.record(key)
+	if err != nil {
+		return err
+	}
+
+	if !ok || r.Count == 0 {
+		return fmt.Errorf("block %v: %w", key, ErrNoRefs)
+	}
+
+	r.Count--
+	if r.Count == 0 {
+		r.ZeroSince = s.now()
+	}
+
+	return s.refs.Put(key, r.encode())
+}
+
+// Refs returns the number of references to the block stored under key.
+func (s *RefStore) Refs(key string) (uint64, error) {
+	l := s.locks.get(key)
+	l.RLock()
+	defer l.RUnlock()
+
+	r, _, err := s.record(key)
+	return r.Count, err
+}
+
+// SweepStats describes the blocks a sweep reclaimed, or would have.
+type SweepStats struct {
+	Blocks int
+	Bytes  int64
+}
+
+// Sweep deletes the blocks that have had no references for at least the
+// grace period. With dryRun set, nothing is deleted, and the stats say what
+// would have been. Blocks that have no reference record at all, which a crash
+// during Put can leave behind, are given one so that they are reclaimed once
+// the grace period has passed.
+func (s *RefStore) Sweep(dryRun bool) (SweepStats, error) {
+	var stats SweepStats
+
+	keys, err := s.data.Keys("")
+	if err != nil {
+		return stats, err
+	}
+
+	for _, key := range keys {
+		if err := s.sweepKey(key, dryRun, &stats); err != nil {
+			return stats, err
+		}
+	}
+
+	// Records can outlive their blocks if a sweep was interrupted.
+	recKeys, err := s.refs.Keys("")
+	if err != nil {
+		return stats, err
+	}
+
+	for _, key := range recKeys {
+		if err := s.sweepRecord(key, dryRun); err != nil {
+			return stats, err
+		}
+	}
+
+	return stats, nil
+}
+
+func (s *RefStore) sweepKey(key string, dryRun bool, stats *SweepStats) error {
+	l := s.locks.get(key)
+	l.Lock()
+	defer l.Unlock()
+
+	r, ok, err := s.record(key)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		if dryRun {
+			return nil
+		}
+
+		return s.refs.Put(key, refRecord{ZeroSince: s.now()}.encode())
+	}
+
+	if r.Count > 0 || s.now().Sub(r.ZeroSince) < s.opts.GracePeriod {
+		return nil
+	}
+
+	size, err := s.data.Size(key)
+	if err != nil {
+		return err
+	}
+
+	if !dryRun {
+		if err := s.data.Delete(key); err != nil {
+			return err
+		}
+		if err := s.refs.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	stats.Blocks++
+	stats.Bytes += size
+
+	return nil
+}
+
+// sweepRecord removes the record for key if it is unreferenced and its block
+// is already gone.
+func (s *RefStore) sweepRecord(key string, dryRun bool) error {
+	l := s.locks.get(key)
+	l.Lock()
+	defer l.Unlock()
+
+	r, ok, err := s.record(key)
+	if err != nil || !ok || r.Count > 0 {
+		return err
+	}
+
+	if has, err := s.data.Has(key); err != nil || has {
+		return err
+	}
+
+	if dryRun {
+		return nil
+	}
+
+	return s.refs.Delete(key)
+}
@@ -0,0 +1,139 @@
+package blkstore
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+// fakeClock lets tests move time forward past the grace period.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func TestRefStore(t *testing.T) {
+	te := testutil.NewTestEnv("refstore", t)
+	defer te.Teardown()
+
+	const grace = time.Hour
+
+	os.Mkdir(te.PathFor("data"), 0755)
+	os.Mkdir(te.PathFor("refs"), 0755)
+	data := NewDiskStore(te.PathFor("data"))
+	refs := NewDiskStore(te.PathFor("refs"))
+	clock := &fakeClock{time.Now()}
+
+	s := NewRefStore(data, refs, RefOptions{GracePeriod: grace})
+	s.now = clock.now
+
+	for _, key := range []string{"shared", "shared", "single"} {
+		if err := s.Put(key, []byte(key+" block")); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+
+	if n, err := s.Refs("shared"); err != nil || n != 2 {
+		t.Errorf("shared has %v, %v references, want 2", n, err)
+	}
+
+	// Counts are persisted, so they survive reopening the store.
+	s = NewRefStore(data, refs, RefOptions{GracePeriod: grace})
+	s.now = clock.now
+
+	if n, err := s.Refs("shared"); err != nil || n != 2 {
+		t.Errorf("shared has %v, %v references after reopening, want 2", n, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.Delete("shared"); err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+	}
+	if err := s.Delete("shared"); !errors.Is(err, ErrNoRefs) {
+		t.Errorf("delete with no references left got %v, want ErrNoRefs", err)
+	}
+
+	// Nothing is reclaimable until the grace period is over.
+	if stats, err := s.Sweep(true); err != nil || stats.Blocks != 0 {
+		t.Errorf("dry run within the grace period got %+v, %v", stats, err)
+	}
+
+	clock.t = clock.t.Add(grace)
+
+	stats, err := s.Sweep(true)
+	if err != nil || stats.Blocks != 1 || stats.Bytes != int64(len("shared block")) {
+		t.Errorf("dry run got %+v, %v, want one block of %v bytes", stats, err, len("shared block"))
+	}
+	if has, _ := data.Has("shared"); !has {
+		t.Errorf("dry run deleted a block")
+	}
+
+	if stats, err := s.Sweep(false); err != nil || stats.Blocks != 1 {
+		t.Errorf("sweep got %+v, %v, want one block deleted", stats, err)
+	}
+	if has, _ := data.Has("shared"); has {
+		t.Errorf("unreferenced block survived the sweep")
+	}
+	if has, _ := data.Has("single"); !has {
+		t.Errorf("referenced block was swept")
+	}
+
+	// A block referenced again within the grace period is kept.
+	s.Delete("single")
+	if err := s.Ref("single"); err != nil {
+		t.Fatalf("ref: %v", err)
+	}
+	clock.t = clock.t.Add(2 * grace)
+	s.Sweep(false)
+	if has, _ := data.Has("single"); !has {
+		t.Errorf("block referenced again was swept")
+	}
+
+	if err := s.Ref("missing"); err == nil {
+		t.Errorf("ref of a missing block succeeded")
+	}
+
+	// A block left without a count, as a crash during Put would, gets a
+	// grace period of its own before being reclaimed.
+	data.Put("orphan", []byte("orphan"))
+	s.Sweep(false)
+	if has, _ := data.Has("orphan"); !has {
+		t.Errorf("orphan was swept before its grace period")
+	}
+	clock.t = clock.t.Add(grace)
+	s.Sweep(false)
+	if has, _ := data.Has("orphan"); has {
+		t.Errorf("orphan wasn't swept after its grace period")
+	}
+
+	if keys, _ := refs.Keys(""); len(keys) != 1 || keys[0] != "single" {
+		t.Errorf("got records for %v, want only single", keys)
+	}
+}
+
+func TestRefStoreSweeper(t *testing.T) {
+	data := NewMemStore()
+	s := NewRefStore(data, NewMemStore(), RefOptions{SweepInterval: 10 * time.Millisecond})
+	defer s.Close()
+
+	s.Put("key", []byte("value"))
+	s.Delete("key")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if has, _ := data.Has("key"); !has {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("background sweeper didn't delete the block")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
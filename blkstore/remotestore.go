@@ -5,11 +5,18 @@ import (
 	anet "github.com/shaladdle/goaaw/net"
 )
 
-func NewRemoteStore(d anet.Dialer) (BlkStore, error) {
+func NewRemoteStore(d anet.Dialer) (ExtBlkStore, error) {
+	return NewRemoteStoreWithLayout(d, Layout{})
+}
+
+// NewRemoteStoreWithLayout returns a store that keeps its blocks on a remote
+// filestore server using the given layout. Whether writes are atomic and
+// synced is up to the std.Options the server was started with.
+func NewRemoteStoreWithLayout(d anet.Dialer, layout Layout) (ExtBlkStore, error) {
 	cli, err := remote.NewClient(d)
 	if err != nil {
 		return nil, err
 	}
 
-	return &diskstore{cli}, nil
+	return &diskstore{disk: cli, layout: layout}, nil
 }
@@ -0,0 +1,73 @@
+package blkstore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+)
+
+// StreamBlkStore is a BlkStore that can read and write blocks as streams, so
+// that large blocks never have to be held in memory all at once.
+type StreamBlkStore interface {
+	BlkStore
+
+	// GetReader returns a reader for the block stored under key.
+	GetReader(key string) (io.ReadCloser, error)
+
+	// PutReader stores everything read from r under key, and returns the
+	// size of the block. If reading r fails, nothing is stored.
+	PutReader(key string, r io.Reader) (int64, error)
+}
+
+// GetReader returns a reader for the block stored under key in bs, streaming
+// it if bs is a StreamBlkStore.
+func GetReader(bs BlkStore, key string) (io.ReadCloser, error) {
+	if sbs, ok := bs.(StreamBlkStore); ok {
+		return sbs.GetReader(key)
+	}
+
+	blk, err := bs.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(blk)), nil
+}
+
+// PutReader stores everything read from r under key in bs, streaming it if bs
+// is a StreamBlkStore.
+func PutReader(bs BlkStore, key string, r io.Reader) (int64, error) {
+	if sbs, ok := bs.(StreamBlkStore); ok {
+		return sbs.PutReader(key, r)
+	}
+
+	blk, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(blk)), bs.Put(key, blk)
+}
+
+// aborter is implemented by writers that can throw away what has been
+// written to them instead of committing it, like the ones returned by
+// std.FileSystem and remote.Client.
+type aborter interface {
+	Abort() error
+}
+
+// writeStream copies r into w and closes it, aborting w instead if reading
+// r fails.
+func writeStream(w io.WriteCloser, r io.Reader) (int64, error) {
+	n, err := io.Copy(w, r)
+	if err != nil {
+		if a, ok := w.(aborter); ok {
+			a.Abort()
+		} else {
+			w.Close()
+		}
+		return n, err
+	}
+
+	return n, w.Close()
+}
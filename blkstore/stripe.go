@@ -0,0 +1,57 @@
+package blkstore
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+const numStripes = 64
+
+// stripedLock is a fixed set of locks that keys are hashed onto, so that
+// operations on the same key are serialized while ones on different keys
+// usually aren't, without keeping a lock around for every key.
+type stripedLock [numStripes]sync.RWMutex
+
+func stripeIndex(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % numStripes)
+}
+
+func (l *stripedLock) get(key string) *sync.RWMutex {
+	return &l[stripeIndex(key)]
+}
+
+// lockAll locks the stripes of all of keys, for writing if write is set, and
+// returns a function that unlocks them again. The stripes are always locked
+// in the same order so that two batches can't deadlock.
+func (l *stripedLock) lockAll(keys []string, write bool) (unlock func()) {
+	seen := make(map[int]bool)
+	var idxs []int
+	for _, key := range keys {
+		if i := stripeIndex(key); !seen[i] {
+			seen[i] = true
+			idxs = append(idxs, i)
+		}
+	}
+	sort.Ints(idxs)
+
+	for _, i := range idxs {
+		if write {
+			l[i].Lock()
+		} else {
+			l[i].RLock()
+		}
+	}
+
+	return func() {
+		for _, i := range idxs {
+			if write {
+				l[i].Unlock()
+			} else {
+				l[i].RUnlock()
+			}
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package blkstore_test
+
+import (
+	"testing"
+
+	"github.com/shaladdle/goaaw/blkstore"
+)
+
+// TestMemStoreUsage checks that a memstore reports what it holds through
+// UsageBlkStore.
+func TestMemStoreUsage(t *testing.T) {
+	bs, ok := blkstore.NewMemStore().(blkstore.UsageBlkStore)
+	if !ok {
+		t.Fatalf("memstore doesn't implement UsageBlkStore")
+	}
+
+	if err := bs.PutMany([]string{"a", "b"}, [][]byte{make([]byte, 3), make([]byte, 4)}); err != nil {
+		t.Fatalf("put many: %v", err)
+	}
+	if used := bs.Usage(); used != 7 {
+		t.Errorf("store holds %v bytes, want 7", used)
+	}
+
+	if err := bs.Delete("a"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if used := bs.Usage(); used != 4 {
+		t.Errorf("store holds %v bytes after delete, want 4", used)
+	}
+}
@@ -49,6 +49,10 @@ func (fs *cloudFileSystem) SetDebug(debug bool) {
 	fs.debug = debug
 }
 
+// Metadata, extended attributes included, lives on the files in the meta
+// tree and is handled by its loopback file system. File contents go to a
+// BlkStore, so none of it goes through filestore.AttrFileStore.
+
 func (fs *cloudFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
 	return fs.meta.GetAttr(name, context)
 }
@@ -1,27 +1,78 @@
 package kvstore
 
 import (
+	"fmt"
+	"io"
+	"log"
 	"os"
+	"path/filepath"
 	"reflect"
 )
 
+// kvstore keeps every pair in memory, and makes changes durable with a
+// write-ahead log that is checkpointed into the data file at p.path once it
+// grows past opts.CheckpointSize. See log.go for how the files fit together.
+//
+// The pairs belong to the director goroutine, which everything else sends
+// messages to. It never waits for the disk itself: changes are handed to the
+// log appender, and only applied once they are logged, in the order they
+// were logged, and checkpoints write a copy of the pairs in the background.
+// So reads are answered straight away, even while writes wait for a sync.
 type kvstore struct {
 	path    string
 	cache   map[interface{}]interface{}
 	coder   Coder
 	keyType reflect.Type
 	valType reflect.Type
+	opts    Options
+	log     *walog
+
+	msgs   chan interface{}
+	closed chan struct{}
+
+	// fail, if it is set, is called after each step of a checkpoint, which
+	// stops there if it returns an error. Tests use it to crash in the
+	// middle of one.
+	fail func(step string) error
 }
 
-func newKVStore(fpath string, key, value interface{}, coder Coder) (KVStore, error) {
+func newKVStore(fpath string, key, value interface{}, coder Coder, opts Options) (*kvstore, error) {
+	if opts.CheckpointSize == 0 {
+		opts.CheckpointSize = DefaultCheckpointSize
+	}
+
 	p := &kvstore{
 		path:    fpath,
 		cache:   make(map[interface{}]interface{}),
 		coder:   coder,
 		keyType: reflect.TypeOf(key),
 		valType: reflect.TypeOf(value),
+		opts:    opts,
+	}
+
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+
+	// A checkpoint that crashed before it was renamed into place didn't
+	// get anywhere.
+	if err := os.Remove(p.tempPath()); err != nil && !os.IsNotExist(err) {
+		return nil, err
 	}
-	p.load()
+
+	gen, oldLogs, err := p.recover()
+	if err != nil {
+		return nil, err
+	}
+
+	var logSize int64
+	if p.log, logSize, err = p.openLog(gen); err != nil {
+		return nil, err
+	}
+
+	p.msgs = make(chan interface{})
+	p.closed = make(chan struct{})
+	go p.director(logSize, oldLogs)
 
 	return p, nil
 }
@@ -31,95 +82,337 @@ type kvpair struct {
 	value interface{}
 }
 
-type putMsg struct{
-    key interface{}
-    value interface{}
-    ack chan bool
+func (p *kvstore) tempPath() string {
+	return p.path + ".tmp"
+}
+
+// load reads the data file, if there is one.
+func (p *kvstore) load() error {
+	f, err := os.Open(p.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := p.coder.NewDecoder(f)
+	for {
+		key := reflect.New(p.keyType).Elem()
+		value := reflect.New(p.valType).Elem()
+		if err := dec.DecodeValue(key); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%v: %v", p.path, err)
+		}
+		if err := dec.DecodeValue(value); err != nil {
+			return fmt.Errorf("%v: %v", p.path, err)
+		}
+
+		p.cache[key.Interface()] = value.Interface()
+	}
+}
+
+// recover replays the log files on top of the data file, and returns the
+// generation of the newest one, which is where appending carries on, and
+// whether there are older ones. A record torn by a crash can only be at the
+// end of the newest one, since a log is synced before the next one is
+// started, and it is cut off.
+func (p *kvstore) recover() (uint64, bool, error) {
+	gens, err := p.logGens()
+	if err != nil {
+		return 0, false, err
+	}
+	if len(gens) == 0 {
+		return 1, false, nil
+	}
+
+	for i, gen := range gens {
+		fpath := p.logFilePath(gen)
+
+		size, torn, err := p.replayLog(fpath, p.applyEntry)
+		if err != nil {
+			return 0, false, err
+		}
+
+		switch {
+		case torn && i < len(gens)-1:
+			return 0, false, fmt.Errorf("%v is damaged at offset %v", fpath, size)
+		case torn:
+			log.Printf("kvstore: cutting off a torn record at offset %v of %v", size, fpath)
+			if err := os.Truncate(fpath, size); err != nil {
+				return 0, false, err
+			}
+		}
+	}
+
+	return gens[len(gens)-1], len(gens) > 1, nil
+}
+
+func (p *kvstore) applyEntry(e logEntry) {
+	switch e.op {
+	case opPut:
+		p.cache[e.data.key] = e.data.value
+	case opDel:
+		delete(p.cache, e.data.key)
+	}
 }
 
-type getMsg struct{
-    key interface{}
-    value chan interface{}
+type getMsg struct {
+	key   interface{}
+	value chan interface{}
 }
 
-type delMsg struct{
-    key interface{}
-    ack chan bool
+// updateMsg is a put or a del.
+type updateMsg struct {
+	entry logEntry
+	ack   chan error
 }
 
-func (p *kvstore) director() {
-    for {
-        switch msg := (<-p.msgs).(type) {
-        case getMsg:
-        case putMsg:
-        case delMsg:
-        }
-    }
+// checkpointMsg asks for a checkpoint. Unless force is set, there isn't one
+// if nothing has been logged since the last.
+type checkpointMsg struct {
+	force bool
+	done  chan error
 }
 
-func (p *kvstore) decodeStream(dec Decoder) <-chan interface{} {
-	ch := make(chan interface{})
-	go func() {
-		for {
-			key := reflect.New(p.keyType).Elem()
-			value := reflect.New(p.valType).Elem()
-			if err := dec.DecodeValue(key); err != nil {
-				ch <- err
-				close(ch)
-				break
+type closeMsg chan error
+
+func (p *kvstore) director(logSize int64, oldLogs bool) {
+	var (
+		// queue holds messages for the log appender that it hasn't
+		// taken yet, and logging the updates that haven't been logged
+		// yet, in the order they were queued.
+		queue   []interface{}
+		logging []updateMsg
+
+		logged       = make(chan appDone)
+		rotated      = make(chan appRotated)
+		checkpointed = make(chan error)
+
+		// A checkpoint is running if checkpointing is set. Those
+		// waiting for it are in cpWaiters, and those who asked for a
+		// checkpoint after it started are in nextWaiters, since it
+		// might not include all of their changes.
+		checkpointing bool
+		cpWaiters     []chan error
+		nextWaiters   []chan error
+
+		closing closeMsg
+	)
+
+	startCheckpoint := func() {
+		checkpointing = true
+		queue = append(queue, appRotate(rotated))
+	}
+
+	finishCheckpoint := func(err error) {
+		if err == nil {
+			oldLogs = false
+		} else if len(cpWaiters) == 0 {
+			log.Printf("kvstore: checkpoint of %v: %v", p.path, err)
+		}
+
+		for _, w := range cpWaiters {
+			w <- err
+		}
+
+		checkpointing, cpWaiters = false, nil
+		if len(nextWaiters) > 0 {
+			cpWaiters, nextWaiters = nextWaiters, nil
+			startCheckpoint()
+		}
+	}
+
+	for {
+		if closing != nil && len(queue) == 0 && len(logging) == 0 && !checkpointing {
+			closing <- p.log.shutdown()
+			close(p.closed)
+			return
+		}
+
+		var (
+			out  chan interface{}
+			next interface{}
+		)
+		if len(queue) > 0 {
+			out, next = p.log.msgs, queue[0]
+		}
+
+		select {
+		case out <- next:
+			queue = queue[1:]
+		case res := <-logged:
+			u := logging[0]
+			logging = logging[1:]
+
+			if res.err == nil {
+				p.applyEntry(u.entry)
+				logSize = res.size
 			}
-			if err := dec.DecodeValue(value); err != nil {
-				ch <- err
-				close(ch)
-				break
+			u.ack <- res.err
+
+			if logSize >= p.opts.CheckpointSize && !checkpointing {
+				startCheckpoint()
+			}
+		case res := <-rotated:
+			if res.err != nil {
+				finishCheckpoint(res.err)
+				continue
+			}
+
+			// Everything in the old log files has been applied, and
+			// nothing after them, so a copy of the pairs now is what
+			// replaying them would give.
+			logSize, oldLogs = 0, true
+			pairs := make(map[interface{}]interface{}, len(p.cache))
+			for k, v := range p.cache {
+				pairs[k] = v
 			}
 
-			ch <- kvpair{
-				key.Interface(),
-				value.Interface(),
+			go func() {
+				checkpointed <- p.checkpoint(pairs, res.gen)
+			}()
+		case err := <-checkpointed:
+			finishCheckpoint(err)
+		case msg := <-p.msgs:
+			switch msg := msg.(type) {
+			case getMsg:
+				msg.value <- p.cache[msg.key]
+			case updateMsg:
+				queue = append(queue, appWrite{msg.entry, logged})
+				logging = append(logging, msg)
+			case checkpointMsg:
+				switch {
+				case checkpointing:
+					nextWaiters = append(nextWaiters, msg.done)
+				case msg.force || logSize > 0 || oldLogs:
+					cpWaiters = append(cpWaiters, msg.done)
+					startCheckpoint()
+				default:
+					msg.done <- nil
+				}
+			case closeMsg:
+				closing = msg
 			}
 		}
-	}()
-	return ch
+	}
 }
 
-func (p *kvstore) load() error {
-	f, err := os.Open(p.path)
-	if err != nil {
+// send hands msg to the director, unless the store is closed.
+func (p *kvstore) send(msg interface{}) error {
+	select {
+	case p.msgs <- msg:
+		return nil
+	case <-p.closed:
+		return ErrClosed
+	}
+}
+
+// update has the director log a change and then make it. Once the change is
+// logged it has happened, so if that leads to a checkpoint that fails, the
+// failure is only logged, and the checkpoint tried again after the next
+// change.
+func (p *kvstore) update(e logEntry) error {
+	if t := reflect.TypeOf(e.data.key); t != p.keyType {
+		return fmt.Errorf("kvstore: key is a %v, not a %v", t, p.keyType)
+	}
+	if t := reflect.TypeOf(e.data.value); e.op == opPut && t != p.valType {
+		return fmt.Errorf("kvstore: value is a %v, not a %v", t, p.valType)
+	}
+
+	ack := make(chan error, 1)
+	if err := p.send(updateMsg{e, ack}); err != nil {
+		return err
+	}
+
+	return <-ack
+}
+
+// checkpoint writes pairs into the data file, after which the log files up to
+// generation gen aren't needed any more.
+func (p *kvstore) checkpoint(pairs map[interface{}]interface{}, gen uint64) error {
+	if err := p.step("rotated"); err != nil {
 		return err
 	}
-	defer f.Close()
 
-	for ret := range p.decodeStream(p.coder.NewDecoder(f)) {
-		switch ret := ret.(type) {
-		case kvpair:
-			p.cache[ret.key] = ret.value
-		case error:
+	if err := p.store(pairs); err != nil {
+		return err
+	}
+
+	gens, err := p.logGens()
+	if err != nil {
+		return err
+	}
+	for _, g := range gens {
+		if g > gen {
+			break
+		}
+		if err := os.Remove(p.logFilePath(g)); err != nil {
+			return err
+		}
+		if err := p.step("removed"); err != nil {
 			return err
-		default:
-			panic("invalid case")
 		}
 	}
 
 	return nil
 }
 
-func (p *kvstore) store() error {
-	f, err := os.Create(p.path)
+// requestCheckpoint asks the director for a checkpoint, and waits for it.
+func (p *kvstore) requestCheckpoint(force bool) error {
+	done := make(chan error, 1)
+	if err := p.send(checkpointMsg{force, done}); err != nil {
+		return err
+	}
+
+	return <-done
+}
+
+func (p *kvstore) step(name string) error {
+	if p.fail == nil {
+		return nil
+	}
+
+	return p.fail(name)
+}
+
+// store writes pairs into a new data file, which replaces the old one once
+// it is safely on disk.
+func (p *kvstore) store(pairs map[interface{}]interface{}) error {
+	f, err := os.Create(p.tempPath())
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
 	enc := p.coder.NewEncoder(f)
-	for k, v := range p.cache {
-		if err := enc.EncodeValue(reflect.ValueOf(k)); err != nil {
-			return err
+	for k, v := range pairs {
+		if err = enc.EncodeValue(reflect.ValueOf(k)); err != nil {
+			break
 		}
-		if err := enc.EncodeValue(reflect.ValueOf(v)); err != nil {
-			return err
+		if err = enc.EncodeValue(reflect.ValueOf(v)); err != nil {
+			break
 		}
 	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = p.step("written")
+	}
+	if err != nil {
+		return err
+	}
 
-	return nil
+	if err := os.Rename(p.tempPath(), p.path); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(p.path)); err != nil {
+		return err
+	}
+
+	return p.step("renamed")
 }
@@ -1,11 +1,36 @@
 package kvstore
 
+import "errors"
+
+// ErrClosed is returned by the methods of a store that has been closed.
+var ErrClosed = errors.New("kvstore: store is closed")
+
+// DefaultCheckpointSize is the CheckpointSize used if none is given.
+const DefaultCheckpointSize = 4 << 20
+
+// Options controls how often a store is checkpointed.
+type Options struct {
+	// CheckpointSize is how many bytes the write-ahead log may grow to
+	// before its changes are written into the data file and it is started
+	// over. If it is 0, DefaultCheckpointSize is used.
+	CheckpointSize int64
+}
+
 func NewGobKVStore(fpath string, key, value interface{}) (KVStore, error) {
 	return NewKVStore(fpath, key, value, gobCoder{})
 }
 
 func NewKVStore(fpath string, key, value interface{}, coder Coder) (KVStore, error) {
-	p, err := newKVStore(fpath, key, value, coder)
+	return NewKVStoreWithOptions(fpath, key, value, coder, Options{})
+}
+
+// NewKVStoreWithOptions opens the store kept in fpath and the write-ahead log
+// files next to it, replaying any changes that the last user of the store
+// logged but didn't get to checkpoint. Keys and values must have the same
+// types as key and value. The store is safe for concurrent use, and must be
+// closed once it is no longer needed.
+func NewKVStoreWithOptions(fpath string, key, value interface{}, coder Coder, opts Options) (KVStore, error) {
+	p, err := newKVStore(fpath, key, value, coder, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -13,16 +38,45 @@ func NewKVStore(fpath string, key, value interface{}, coder Coder) (KVStore, err
 	return p, nil
 }
 
+// Get returns the value stored under key, or nil if there is none. It doesn't
+// wait for changes being logged, so it only sees them once Put or Del has
+// returned.
 func (p *kvstore) Get(key interface{}) (interface{}, error) {
-	return p.cache[key], nil
+	value := make(chan interface{}, 1)
+	if err := p.send(getMsg{key, value}); err != nil {
+		return nil, err
+	}
+
+	return <-value, nil
 }
 
+// Put returns once the change is in the write-ahead log on disk.
 func (p *kvstore) Put(key, value interface{}) error {
-	p.cache[key] = value
-	return p.store()
+	return p.update(logEntry{opPut, kvpair{key, value}})
 }
 
+// Del returns once the change is in the write-ahead log on disk.
 func (p *kvstore) Del(key interface{}) error {
-	delete(p.cache, key)
-	return p.store()
+	return p.update(logEntry{opDel, kvpair{key: key}})
+}
+
+// Close writes any changes still only in the log into the data file, waiting
+// for those that are being logged, and stops the store. If the checkpoint
+// fails, the changes are still in the log for the next time the store is
+// opened, and the store is closed all the same.
+func (p *kvstore) Close() error {
+	cerr := p.requestCheckpoint(false)
+	if cerr == ErrClosed {
+		return cerr
+	}
+
+	done := make(closeMsg, 1)
+	if err := p.send(done); err != nil {
+		return err
+	}
+
+	if err := <-done; err != nil {
+		return err
+	}
+	return cerr
 }
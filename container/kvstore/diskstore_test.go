@@ -1,14 +1,21 @@
 package kvstore
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
-	"path"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestDiskstore(t *testing.T) {
-	fpath := path.Join(os.TempDir(), "diskstore-tmp.kvstore")
-	defer os.RemoveAll(fpath)
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	fpath := filepath.Join(dir, "diskstore-tmp.kvstore")
 	s, e := NewGobKVStore(fpath, "", "")
 	if e != nil {
 		t.Fatal(e)
@@ -29,10 +36,15 @@ func TestDiskstore(t *testing.T) {
 		t.Errorf("got %v, want %v", gotVal, wantVal)
 	}
 
+	if err := s.Close(); err != nil {
+		t.Errorf("error closing: %v", err)
+	}
+
 	s1, e := NewGobKVStore(fpath, "", "")
 	if e != nil {
 		t.Fatal(e)
 	}
+	defer s1.Close()
 
 	if gotVal, err := s1.Get(wantKey); err != nil {
 		t.Errorf("error getting %v", err)
@@ -40,3 +52,387 @@ func TestDiskstore(t *testing.T) {
 		t.Errorf("got %v, want %v", gotVal, wantVal)
 	}
 }
+
+var errCrash = errors.New("crash")
+
+// tempDir makes a directory for a test's files, and returns a function that
+// removes it.
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func openStore(t *testing.T, fpath string, opts Options) *kvstore {
+	s, err := newKVStore(fpath, "", 0, gobCoder{}, opts)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	return s
+}
+
+// crash drops a store, as a crash would, by closing it with a checkpoint
+// that fails before it writes anything. No checkpoints may be running.
+func (p *kvstore) crash() {
+	p.fail = func(string) error { return errCrash }
+	p.Close()
+}
+
+// size returns how many pairs p holds. Nothing may be changing them, and the
+// Get makes sure that the director's last changes are seen.
+func (p *kvstore) size() int {
+	p.Get("")
+	return len(p.cache)
+}
+
+// checkStore checks that p holds exactly the pairs in want.
+func checkStore(t *testing.T, when string, p *kvstore, want map[string]int) {
+	if n := p.size(); n != len(want) {
+		t.Errorf("%v: store has %v pairs, want %v", when, n, len(want))
+	}
+
+	for k, v := range want {
+		if got, err := p.Get(k); err != nil || got != v {
+			t.Errorf("%v: %v is %v, %v, want %v", when, k, got, err, v)
+		}
+	}
+}
+
+// fill puts and deletes enough pairs to span a few checkpoints, if they are
+// small.
+func fill(t *testing.T, p *kvstore, want map[string]int) {
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprint("key ", i%40)
+		want[k] = i
+		if err := p.Put(k, i); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+	for i := 0; i < 40; i += 3 {
+		k := fmt.Sprint("key ", i)
+		delete(want, k)
+		if err := p.Del(k); err != nil {
+			t.Fatalf("del: %v", err)
+		}
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	fpath := filepath.Join(dir, "store")
+	want := make(map[string]int)
+
+	p := openStore(t, fpath, Options{})
+	fill(t, p, want)
+	p.crash()
+
+	// Nothing was checkpointed, so it all comes from the log.
+	if _, err := os.Stat(fpath); !os.IsNotExist(err) {
+		t.Errorf("data file was written without a checkpoint: %v", err)
+	}
+	p = openStore(t, fpath, Options{})
+	checkStore(t, "after a crash", p, want)
+	p.crash()
+
+	// A record torn by a crash is cut off.
+	gens, err := p.logGens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(p.logFilePath(gens[len(gens)-1]), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := encodeEntry(gobCoder{}, logEntry{opPut, kvpair{"torn", 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(rec[:len(rec)-1])
+	f.Close()
+
+	p = openStore(t, fpath, Options{})
+	checkStore(t, "after a torn write", p, want)
+	if err := p.Put("new", 1); err != nil {
+		t.Fatalf("put after a torn write: %v", err)
+	}
+	want["new"] = 1
+	p.crash()
+
+	p = openStore(t, fpath, Options{})
+	checkStore(t, "after writing past a torn record", p, want)
+	p.crash()
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	fpath := filepath.Join(dir, "store")
+	want := make(map[string]int)
+
+	p := openStore(t, fpath, Options{CheckpointSize: 256})
+	fill(t, p, want)
+	checkStore(t, "before reopening", p, want)
+
+	// Wait for any checkpoint that is still running.
+	if err := p.requestCheckpoint(true); err != nil {
+		t.Fatalf("checkpoint: %v", err)
+	}
+	gens, err := p.logGens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The log outgrew CheckpointSize at least once before the forced
+	// checkpoint, so the log started at generation 1 has been rotated at
+	// least twice. How many more times depends on how quickly checkpoints
+	// finish.
+	if len(gens) != 1 || gens[0] < 3 {
+		t.Errorf("log generations %v left, want one after several checkpoints", gens)
+	}
+	p.crash()
+
+	p = openStore(t, fpath, Options{CheckpointSize: 256})
+	checkStore(t, "after reopening", p, want)
+	if err := p.Close(); err != nil {
+		t.Errorf("close: %v", err)
+	}
+
+	// Closing checkpoints the store, and doesn't again if nothing changed.
+	p = openStore(t, fpath, Options{CheckpointSize: 256})
+	p.fail = func(string) error { return errCrash }
+	if err := p.Close(); err != nil {
+		t.Errorf("close without changes: %v", err)
+	}
+	if err := p.Put("closed", 1); err != ErrClosed {
+		t.Errorf("put after close got %v, want ErrClosed", err)
+	}
+}
+
+// TestCheckpointCrash crashes after each step of a checkpoint, and checks that
+// nothing is lost.
+func TestCheckpointCrash(t *testing.T) {
+	for _, step := range []string{"rotated", "written", "renamed", "removed"} {
+		dir, cleanup := tempDir(t)
+
+		fpath := filepath.Join(dir, "store")
+		want := make(map[string]int)
+
+		// A checkpoint has happened before, so that there is an old data
+		// file to replace.
+		p := openStore(t, fpath, Options{})
+		fill(t, p, want)
+		if err := p.requestCheckpoint(true); err != nil {
+			t.Fatalf("%v: checkpoint: %v", step, err)
+		}
+		for i := 0; i < 10; i++ {
+			k := fmt.Sprint("after ", i)
+			want[k] = i
+			if err := p.Put(k, i); err != nil {
+				t.Fatalf("%v: put: %v", step, err)
+			}
+		}
+
+		p.fail = func(s string) error {
+			if s == step {
+				return errCrash
+			}
+			return nil
+		}
+		if err := p.requestCheckpoint(true); err != errCrash {
+			t.Errorf("%v: checkpoint got %v, want it to crash", step, err)
+		}
+		p.crash()
+
+		p = openStore(t, fpath, Options{})
+		checkStore(t, "after crashing when "+step, p, want)
+
+		// It carries on normally, and the next checkpoint cleans up.
+		if err := p.Put("new", 1); err != nil {
+			t.Fatalf("%v: put after a crash: %v", step, err)
+		}
+		want["new"] = 1
+		if err := p.requestCheckpoint(true); err != nil {
+			t.Fatalf("%v: checkpoint after a crash: %v", step, err)
+		}
+		if gens, err := p.logGens(); err != nil || len(gens) != 1 {
+			t.Errorf("%v: log generations %v, %v after a checkpoint, want one", step, gens, err)
+		}
+		if _, err := os.Stat(p.tempPath()); !os.IsNotExist(err) {
+			t.Errorf("%v: temporary data file was left behind: %v", step, err)
+		}
+		p.crash()
+
+		p = openStore(t, fpath, Options{})
+		checkStore(t, "after the crash was cleaned up when "+step, p, want)
+		p.crash()
+
+		cleanup()
+	}
+}
+
+// TestGroupCommit checks that appends which are waiting when the appender gets
+// to them are written with a single sync. Every append in a batch reports the
+// same log size.
+func TestGroupCommit(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	fpath := filepath.Join(dir, "store")
+	p := openStore(t, fpath, Options{})
+
+	// The appender is stuck until the reply to this is taken, so the
+	// appends all queue up behind it. The director is idle, so they can go
+	// straight to the appender.
+	stuck := make(chan appRotated)
+	p.log.msgs <- appRotate(stuck)
+
+	const n = 100
+	done := make(chan appDone, n)
+	for i := 0; i < n; i++ {
+		p.log.msgs <- appWrite{logEntry{opPut, kvpair{fmt.Sprint(i), i}}, done}
+	}
+
+	if res := <-stuck; res.err != nil {
+		t.Fatalf("rotate: %v", res.err)
+	}
+
+	batches := make(map[int64]bool)
+	for i := 0; i < n; i++ {
+		res := <-done
+		if res.err != nil {
+			t.Errorf("append: %v", res.err)
+		}
+		batches[res.size] = true
+	}
+	if len(batches) != 1 {
+		t.Errorf("%v appends took %v syncs, want 1", n, len(batches))
+	}
+	p.crash()
+
+	p = openStore(t, fpath, Options{})
+	if got := p.size(); got != n {
+		t.Errorf("%v pairs after replaying the log, want %v", got, n)
+	}
+	p.crash()
+}
+
+// TestConcurrent has goroutines change their own keys while others read them,
+// with checkpoints happening all along.
+func TestConcurrent(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	fpath := filepath.Join(dir, "store")
+	p := openStore(t, fpath, Options{CheckpointSize: 1024})
+
+	const (
+		writers = 8
+		n       = 50
+	)
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < n; i++ {
+				k := fmt.Sprint(w, " ", i%10)
+				if err := p.Put(k, i); err != nil {
+					t.Errorf("put: %v", err)
+				}
+				if got, err := p.Get(k); err != nil || got != i {
+					t.Errorf("get after put got %v, %v, want %v", got, err, i)
+				}
+				if i%7 == 0 {
+					if err := p.Del(k); err != nil {
+						t.Errorf("del: %v", err)
+					}
+				}
+			}
+		}(w)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < n; i++ {
+				if _, err := p.Get(fmt.Sprint(w, " ", i%10)); err != nil {
+					t.Errorf("get: %v", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	want := make(map[string]int)
+	for w := 0; w < writers; w++ {
+		for i := 0; i < n; i++ {
+			k := fmt.Sprint(w, " ", i%10)
+			want[k] = i
+			if i%7 == 0 {
+				delete(want, k)
+			}
+		}
+	}
+	checkStore(t, "after concurrent changes", p, want)
+
+	if err := p.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	p = openStore(t, fpath, Options{})
+	checkStore(t, "after reopening", p, want)
+	p.Close()
+}
+
+// TestReadDuringWrite checks that reads are answered while a write waits for
+// the log.
+func TestReadDuringWrite(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	p := openStore(t, filepath.Join(dir, "store"), Options{})
+	defer p.Close()
+
+	if err := p.Put("a", 1); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	// The appender is stuck until the reply to this is taken.
+	stuck := make(chan appRotated)
+	p.log.msgs <- appRotate(stuck)
+
+	put := make(chan error)
+	go func() { put <- p.Put("a", 2) }()
+
+	select {
+	case err := <-put:
+		t.Fatalf("put returned %v while the log was stuck", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	got := make(chan interface{})
+	go func() {
+		v, _ := p.Get("a")
+		got <- v
+	}()
+
+	select {
+	case v := <-got:
+		if v != 1 {
+			t.Errorf("get during a put got %v, want the old value 1", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("get was blocked behind a put")
+	}
+
+	<-stuck
+	if err := <-put; err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if v, err := p.Get("a"); err != nil || v != 2 {
+		t.Errorf("get after the put got %v, %v, want 2", v, err)
+	}
+}
@@ -1,9 +0,0 @@
-package kvstore
-
-import (
-	"encoding/gob"
-)
-
-func init() {
-	gob.Register(logEntry{})
-}
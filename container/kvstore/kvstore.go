@@ -22,4 +22,5 @@ type KVStore interface {
 	Put(key, value interface{}) error
 	Get(key interface{}) (interface{}, error)
 	Del(key interface{}) error
+	Close() error
 }
@@ -1,147 +1,376 @@
 package kvstore
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
-	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 )
 
-type walog struct {
-}
+// The write-ahead log is a series of files named "<path>-log.<gen>". Every
+// change is appended to the newest one before it is applied, and a
+// checkpoint starts a new one, then writes everything into the data file and
+// removes the older ones. Opening a store replays whatever logs are left on
+// top of the data file. Replaying a log whose changes already made it into
+// the data file does no harm, since each record sets or deletes a key
+// outright.
+//
+// A record is
+//
+//	length  uint32, of op and payload
+//	crc     uint32, of op and payload
+//	op      byte
+//	payload the key, then for puts the value, each encoded with the coder
+//
+// with the integers in big endian order. Each payload gets its own encoder,
+// so that records don't depend on each other.
+
+const (
+	opPut = byte(iota + 1)
+	opDel
+)
+
+const (
+	recHeaderSize = 8
+
+	// maxRecordSize keeps a damaged length from making replay allocate
+	// something huge.
+	maxRecordSize = 1 << 30
 
+	// maxBatch is how many records are written with a single sync.
+	maxBatch = 256
+)
+
+// logEntry is a change to the store.
 type logEntry struct {
-    id uint64
-    data kvpair
+	op   byte
+	data kvpair
 }
 
-func (p *kvstore) logFilePath() string {
-	return path.Join(p.path, "-log")
-}
+func encodeEntry(coder Coder, e logEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, recHeaderSize))
+	buf.WriteByte(e.op)
 
-func (p *kvstore) loadLog() (*walog, error) {
-	f, err := os.Open(p.logFilePath())
-	if err != nil {
+	enc := coder.NewEncoder(&buf)
+	if err := enc.EncodeValue(reflect.ValueOf(e.data.key)); err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	if e.op == opPut {
+		if err := enc.EncodeValue(reflect.ValueOf(e.data.value)); err != nil {
+			return nil, err
+		}
+	}
 
-    return nil, nil
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b[0:], uint32(len(b)-recHeaderSize))
+	binary.BigEndian.PutUint32(b[4:], crc32.ChecksumIEEE(b[recHeaderSize:]))
+	return b, nil
 }
 
-type logManWrite kvpair
-type logManAppended uint64
-type logManShutdown chan bool
-
-type appWrite logManWrite
-type appShutdown chan uint64
-type appDone uint64
+func (p *kvstore) decodeEntry(body []byte) (logEntry, error) {
+	e := logEntry{op: body[0]}
+	if e.op != opPut && e.op != opDel {
+		return e, fmt.Errorf("unknown log operation %v", e.op)
+	}
 
-type cmtSetLimit uint64
-type cmtCommitDone struct {}
-type cmtShutdown chan bool
+	dec := p.coder.NewDecoder(bytes.NewReader(body[1:]))
 
-func (p *kvstore) logCommitter(msgs chan interface{}) {
-    commit := func(limit uint64, done chan<- interface{}) {
-        // commit should write logEntries to the actual data file up until the
-        // limit transaction id
-        done <- cmtCommitDone{}
-    }
+	key := reflect.New(p.keyType).Elem()
+	if err := dec.DecodeValue(key); err != nil {
+		return e, err
+	}
+	e.data.key = key.Interface()
 
-    var last, limit uint64
-    committing := false
-	for {
-		switch msg := (<-msgs).(type) {
-        case cmtSetLimit:
-            limit = uint64(msg)
-            if limit > last && !committing {
-                go commit(limit, msgs)
-            }
-        case cmtCommitDone:
-            if limit > last {
-                go commit(limit, msgs)
-            }
+	if e.op == opPut {
+		value := reflect.New(p.valType).Elem()
+		if err := dec.DecodeValue(value); err != nil {
+			return e, err
 		}
+		e.data.value = value.Interface()
 	}
+
+	return e, nil
 }
 
-func (p *kvstore) logAppender(msgs chan interface{}, manMsgs chan<- interface{}) {
-    appender := func(pairs []kvpair, amsgs chan<- interface{}) {
-        // append the pairs to the end of the file along with their id
-        amsgs <- 0
-    }
+func (p *kvstore) logFilePath(gen uint64) string {
+	return p.path + "-log." + strconv.FormatUint(gen, 10)
+}
 
-    f, err := os.Open(p.logFilePath())
-    if err != nil {
-        panic(err)
-    }
-    defer f.Close()
+// logGens returns the generations of the log files there are, oldest first.
+func (p *kvstore) logGens() ([]uint64, error) {
+	dir, base := filepath.Split(p.path)
+	if dir == "" {
+		dir = "."
+	}
 
-    var last uint64
-    // Walk the file until we get to the end, keeping track of what the last
-    // sequence number is. Set last here.
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var gens []uint64
+	for _, name := range names {
+		if !strings.HasPrefix(name, base+"-log.") {
+			continue
+		}
+
+		gen, err := strconv.ParseUint(name[len(base+"-log."):], 10, 64)
+		if err != nil {
+			continue
+		}
+		gens = append(gens, gen)
+	}
+
+	sort.Slice(gens, func(i, j int) bool { return gens[i] < gens[j] })
+	return gens, nil
+}
 
-    pendingWrites := []kvpair{}
-    appending := false
+// replayLog applies the records in a log file. It returns the size of the
+// records it applied, and whether it stopped early at a record that was torn
+// or damaged, as a crash in the middle of a write leaves.
+func (p *kvstore) replayLog(fpath string, apply func(logEntry)) (int64, bool, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+
+	r := &countingReader{r: bufio.NewReader(f)}
+	var (
+		good int64
+		hdr  [recHeaderSize]byte
+	)
 	for {
-		switch msg := (<-msgs).(type) {
-        case appWrite:
-            if appending {
-                pendingWrites = append(pendingWrites, kvpair(msg))
-            } else {
-                go appender(append(pendingWrites, kvpair(msg)), msgs)
-                appending = true
-
-                if len(pendingWrites) > 0 {
-                    pendingWrites = []kvpair{}
-                }
-            }
-        case appDone:
-            last = uint64(msg)
-
-            // have to do this async or there's a deadlock
-            go func () { manMsgs <- logManAppended(last) } ()
-
-            if len(pendingWrites) > 0 {
-                go appender(pendingWrites, msgs)
-                pendingWrites = []kvpair{}
-            } else {
-                appending = false
-            }
-        case appShutdown:
-            if appending {
-                // wait for appender to finish
-                msg <- (<-msgs).(uint64)
-            }
+		if _, err := io.ReadFull(r, hdr[:]); err == io.EOF {
+			return good, false, nil
+		} else if err == io.ErrUnexpectedEOF {
+			return good, true, nil
+		} else if err != nil {
+			return good, false, err
+		}
+
+		size := binary.BigEndian.Uint32(hdr[0:])
+		if size == 0 || size > maxRecordSize {
+			return good, true, nil
+		}
+
+		body := make([]byte, size)
+		if _, err := io.ReadFull(r, body); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return good, true, nil
+		} else if err != nil {
+			return good, false, err
+		}
+
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(hdr[4:]) {
+			return good, true, nil
 		}
+
+		e, err := p.decodeEntry(body)
+		if err != nil {
+			return good, false, fmt.Errorf("%v at offset %v: %v", fpath, good, err)
+		}
+
+		apply(e)
+		good = r.n
 	}
 }
 
-func (p *kvstore) logManager(msgs chan interface{}) {
-	_, err := p.loadLog()
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// walog appends records to the newest log file. Appends are handed to the
+// appender goroutine, which writes everything that is waiting at once and
+// syncs it with a single fsync, so that concurrent writers share the cost of
+// a sync. Up to a batch of messages can wait in msgs while it is busy.
+// Replies to appends and rotations come back in the order they were sent.
+type walog struct {
+	msgs chan interface{}
+}
+
+type appWrite struct {
+	entry logEntry
+	done  chan<- appDone
+}
+
+// appDone is the result of an append: the size of the current log file
+// after it, or why it failed.
+type appDone struct {
+	size int64
+	err  error
+}
+
+// appRotate asks the appender to start a new log file. It replies with the
+// generation of the old one.
+type appRotate chan<- appRotated
+
+type appRotated struct {
+	gen uint64
+	err error
+}
+
+type appShutdown chan error
+
+// openLog starts appending to the log file of generation gen, which is
+// created if it doesn't exist and otherwise must end with a whole record. It
+// returns the size the log file already has.
+func (p *kvstore) openLog(gen uint64) (*walog, int64, error) {
+	f, err := os.OpenFile(p.logFilePath(gen), os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
-		panic(err)
+		return nil, 0, err
 	}
 
-    appender := func(manMsgs chan<- interface{}) {
-        // append new data to the end of the log
-        manMsgs <- logManAppended(100)
-    }
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
 
-    appending := false
-    committing := false
+	l := &walog{msgs: make(chan interface{}, maxBatch)}
+	go p.logAppender(l.msgs, f, gen, size)
+
+	return l, size, nil
+}
 
+func (l *walog) shutdown() error {
+	done := make(appShutdown, 1)
+	l.msgs <- done
+
+	return <-done
+}
+
+func (p *kvstore) logAppender(msgs chan interface{}, f *os.File, gen uint64, size int64) {
+	// broken is set once the log file can't be trusted any more, after
+	// which every append fails.
+	var broken error
+
+	// write writes a batch of records, or none of them, and replies to
+	// each write in the order they came in.
+	write := func(batch []appWrite) {
+		var (
+			buf     []byte
+			results = make([]appDone, len(batch))
+		)
+		for i, w := range batch {
+			rec, err := encodeEntry(p.coder, w.entry)
+			if err != nil {
+				results[i].err = err
+				continue
+			}
+			buf = append(buf, rec...)
+		}
+
+		err := broken
+		if err == nil && len(buf) > 0 {
+			if _, err = f.Write(buf); err == nil {
+				err = f.Sync()
+			}
+
+			if err == nil {
+				size += int64(len(buf))
+			} else if terr := f.Truncate(size); terr != nil {
+				// Whatever part of the batch made it has to be cut
+				// off, or later records would be stuck behind a
+				// torn one.
+				broken = terr
+			} else if _, serr := f.Seek(size, io.SeekStart); serr != nil {
+				broken = serr
+			}
+		}
+
+		for i, w := range batch {
+			if results[i].err == nil {
+				results[i] = appDone{size, err}
+			}
+			w.done <- results[i]
+		}
+	}
+
+	var pending interface{}
 	for {
-		switch msg := (<-msgs).(type) {
-        case logManAppended:
-            // also need to notify kvstore at large that it's ok to insert
-            // this into the in-mem cache?
-		case logManShutdown:
-            break
+		msg := pending
+		if msg == nil {
+			msg = <-msgs
+		}
+		pending = nil
+
+		switch msg := msg.(type) {
+		case appWrite:
+			batch := []appWrite{msg}
+
+			// Take whatever else is waiting, which is everything that
+			// arrived while the last batch was being synced.
+		drain:
+			for len(batch) < maxBatch {
+				select {
+				case next := <-msgs:
+					w, ok := next.(appWrite)
+					if !ok {
+						pending = next
+						break drain
+					}
+					batch = append(batch, w)
+				default:
+					break drain
+				}
+			}
+
+			write(batch)
+		case appRotate:
+			if broken != nil {
+				msg <- appRotated{err: broken}
+				continue
+			}
+
+			nf, err := os.OpenFile(p.logFilePath(gen+1), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+			if err != nil {
+				msg <- appRotated{err: err}
+				continue
+			}
+			if err := syncDir(filepath.Dir(p.path)); err != nil {
+				nf.Close()
+				msg <- appRotated{err: err}
+				continue
+			}
+
+			f.Close()
+			f, size = nf, 0
+			msg <- appRotated{gen: gen}
+			gen++
+		case appShutdown:
+			msg <- f.Close()
+			return
 		}
 	}
 }
 
-func (p *kvstore) startLogManager() chan<- interface{} {
-	msgs := make(chan interface{})
-	go p.logManager(msgs)
-	return msgs
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
 }
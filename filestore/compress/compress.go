@@ -0,0 +1,339 @@
+// Package compress provides a FileStore that transparently compresses the
+// files written to another FileStore.
+//
+// Each stored file begins with a short header naming the algorithm it was
+// compressed with, so files written with different algorithms can be read
+// back by the same FileStore. It ends with a trailer holding the uncompressed
+// size, so that Stat and GetFiles can report it without decompressing
+// anything, and so that reads can check that nothing went missing.
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/shaladdle/goaaw/filestore"
+)
+
+var magic = []byte("AAWZ")
+
+// trailerSize is the size of the trailer, which holds the uncompressed size
+// as a big endian uint64.
+const trailerSize = 8
+
+// Algorithm is a compression algorithm that can be used by FileStore.
+type Algorithm interface {
+	// ID is stored in the header of compressed data to identify the
+	// algorithm. It must be unique among registered algorithms.
+	ID() byte
+	Name() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var algorithms = make(map[byte]Algorithm)
+
+// Register makes an algorithm available for decompression. The algorithms
+// defined in this package are registered automatically.
+func Register(alg Algorithm) {
+	if old, ok := algorithms[alg.ID()]; ok {
+		panic(fmt.Sprintf("compress: algorithm id %v is used by both %v and %v", alg.ID(), old.Name(), alg.Name()))
+	}
+
+	algorithms[alg.ID()] = alg
+}
+
+var (
+	None  Algorithm = noneAlg{}
+	Gzip  Algorithm = gzipAlg{}
+	Flate Algorithm = flateAlg{}
+	Zlib  Algorithm = zlibAlg{}
+)
+
+func init() {
+	Register(None)
+	Register(Gzip)
+	Register(Flate)
+	Register(Zlib)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type noneAlg struct{}
+
+func (noneAlg) ID() byte     { return 0 }
+func (noneAlg) Name() string { return "none" }
+
+func (noneAlg) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (noneAlg) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+type gzipAlg struct{}
+
+func (gzipAlg) ID() byte     { return 1 }
+func (gzipAlg) Name() string { return "gzip" }
+
+func (gzipAlg) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipAlg) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type flateAlg struct{}
+
+func (flateAlg) ID() byte     { return 2 }
+func (flateAlg) Name() string { return "flate" }
+
+func (flateAlg) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, flate.DefaultCompression)
+}
+
+func (flateAlg) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+type zlibAlg struct{}
+
+func (zlibAlg) ID() byte     { return 3 }
+func (zlibAlg) Name() string { return "zlib" }
+
+func (zlibAlg) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zlib.NewWriter(w), nil
+}
+
+func (zlibAlg) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return zlib.NewReader(r)
+}
+
+// NewWriter writes a header for alg to w, and returns a writer that
+// compresses everything written to it into w. Closing the returned writer
+// flushes the compressed stream and writes the trailer, but does not close w.
+func NewWriter(w io.Writer, alg Algorithm) (io.WriteCloser, error) {
+	return newWriter(w, alg)
+}
+
+func newWriter(w io.Writer, alg Algorithm) (*writer, error) {
+	header := append(append([]byte{}, magic...), alg.ID())
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	zw, err := alg.NewWriter(w)
+	if err != nil {
+		return nil, err
+	}
+
+	return &writer{zw: zw, w: w}, nil
+}
+
+// writer counts what is compressed, so that the count can go in the
+// trailer.
+type writer struct {
+	zw   io.WriteCloser
+	w    io.Writer
+	size int64
+}
+
+func (w *writer) Write(b []byte) (int, error) {
+	n, err := w.zw.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *writer) Close() error {
+	if err := w.zw.Close(); err != nil {
+		return err
+	}
+
+	var trailer [trailerSize]byte
+	binary.BigEndian.PutUint64(trailer[:], uint64(w.size))
+	_, err := w.w.Write(trailer[:])
+
+	return err
+}
+
+// readHeader reads the header written by NewWriter from r, and returns the
+// algorithm it names.
+func readHeader(r io.Reader) (Algorithm, error) {
+	header := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("compress: reading header: %v", err)
+	}
+
+	if !bytes.Equal(header[:len(magic)], magic) {
+		return nil, fmt.Errorf("compress: data is missing the compression header")
+	}
+
+	alg, ok := algorithms[header[len(magic)]]
+	if !ok {
+		return nil, fmt.Errorf("compress: unknown algorithm id %v", header[len(magic)])
+	}
+
+	return alg, nil
+}
+
+// NewReader reads the header written by NewWriter from r, and returns a
+// reader for the decompressed data. The reader fails at the end of the data if
+// its size doesn't match the one in the trailer.
+func NewReader(r io.Reader) (io.ReadCloser, error) {
+	alg, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := &trailerReader{r: r}
+	zr, err := alg.NewReader(tr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &reader{zr: zr, tr: tr}, nil
+}
+
+type reader struct {
+	zr   io.ReadCloser
+	tr   *trailerReader
+	size int64
+}
+
+func (r *reader) Read(b []byte) (int, error) {
+	n, err := r.zr.Read(b)
+	r.size += int64(n)
+	if err != io.EOF {
+		return n, err
+	}
+
+	// Some algorithms know where their stream ends without reading up to
+	// the trailer.
+	if _, err := io.Copy(ioutil.Discard, r.tr); err != nil {
+		return n, err
+	}
+
+	size, err := r.tr.size()
+	if err != nil {
+		return n, err
+	}
+	if size != r.size {
+		return n, fmt.Errorf("compress: decompressed %v bytes, but %v were written: %w", r.size, size, fs.ErrIntegrity)
+	}
+
+	return n, io.EOF
+}
+
+func (r *reader) Close() error {
+	return r.zr.Close()
+}
+
+// trailerReader passes on everything read from r except the trailer at the
+// end, which it holds on to.
+type trailerReader struct {
+	r   io.Reader
+	buf []byte
+	eof bool
+}
+
+func (t *trailerReader) Read(b []byte) (int, error) {
+	// Whatever is in buf could be the trailer until there is more than a
+	// trailer's worth of it.
+	for !t.eof && len(t.buf) <= trailerSize {
+		chunk := make([]byte, len(b)+trailerSize)
+		n, err := t.r.Read(chunk)
+		t.buf = append(t.buf, chunk[:n]...)
+		if err == io.EOF {
+			t.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	if len(t.buf) <= trailerSize {
+		return 0, io.EOF
+	}
+
+	n := copy(b, t.buf[:len(t.buf)-trailerSize])
+	t.buf = t.buf[n:]
+
+	return n, nil
+}
+
+// size returns the size in the trailer, once everything before it has been
+// read.
+func (t *trailerReader) size() (int64, error) {
+	if len(t.buf) != trailerSize {
+		return 0, fmt.Errorf("compress: data is missing its trailer: %w", fs.ErrIntegrity)
+	}
+
+	return int64(binary.BigEndian.Uint64(t.buf)), nil
+}
+
+// Size returns the uncompressed size of data written by NewWriter, which r
+// reads from the start. The data isn't decompressed, but unless r can seek,
+// it is read through to get to the trailer. FileStore avoids this where it
+// can by also recording the size in an extended attribute.
+func Size(r io.Reader) (int64, error) {
+	if _, err := readHeader(r); err != nil {
+		return 0, err
+	}
+
+	if s, ok := r.(io.Seeker); ok {
+		if _, err := s.Seek(-trailerSize, io.SeekEnd); err != nil {
+			return 0, err
+		}
+	}
+
+	tr := &trailerReader{r: r}
+	if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+		return 0, err
+	}
+
+	return tr.size()
+}
+
+// Compress compresses b into a new slice using alg.
+func Compress(b []byte, alg Algorithm) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	w, err := NewWriter(buf, alg)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decompress reverses Compress.
+func Decompress(b []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
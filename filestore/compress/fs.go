@@ -0,0 +1,231 @@
+package compress
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/shaladdle/goaaw/filestore"
+	"github.com/shaladdle/goaaw/filestore/util"
+)
+
+// childPath joins a directory and the name of a file in it. The result is
+// kept relative, since some stores reject absolute paths other than "/".
+func childPath(dpath, name string) string {
+	return strings.TrimPrefix(path.Join(dpath, name), "/")
+}
+
+// sizeXattr holds the uncompressed size of a file, followed by the size and
+// modification time of the stored file when it was written. If either has
+// changed since, the record is ignored and the size is read from the trailer.
+const sizeXattr = "user.goaaw.size"
+
+const sizeRecordSize = 8 + 8 + 8
+
+func sizeRecord(size int64, info os.FileInfo) []byte {
+	b := make([]byte, 0, sizeRecordSize)
+	b = binary.BigEndian.AppendUint64(b, uint64(size))
+	b = binary.BigEndian.AppendUint64(b, uint64(info.Size()))
+	b = binary.BigEndian.AppendUint64(b, uint64(info.ModTime().UnixNano()))
+	return b
+}
+
+// FileStore compresses files on their way into the underlying store and
+// decompresses them on the way out.
+type FileStore struct {
+	store fs.FileStore
+	alg   Algorithm
+}
+
+// New returns a FileStore that compresses new files with alg before storing
+// them in store.
+func New(store fs.FileStore, alg Algorithm) *FileStore {
+	return &FileStore{store, alg}
+}
+
+func (cfs *FileStore) Open(fpath string) (io.ReadCloser, error) {
+	f, err := cfs.store.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &fileReader{r, f}, nil
+}
+
+type fileReader struct {
+	io.ReadCloser
+	f io.Closer
+}
+
+func (r *fileReader) Close() error {
+	err := r.ReadCloser.Close()
+	if ferr := r.f.Close(); err == nil {
+		err = ferr
+	}
+
+	return err
+}
+
+func (cfs *FileStore) Create(fpath string) (io.WriteCloser, error) {
+	f, err := cfs.store.Create(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := newWriter(f, cfs.alg)
+	if err != nil {
+		abort(f)
+		return nil, err
+	}
+
+	return &fileWriter{w, f, cfs, fpath}, nil
+}
+
+type fileWriter struct {
+	*writer
+	f     io.WriteCloser
+	cfs   *FileStore
+	fpath string
+}
+
+func (w *fileWriter) Close() error {
+	if err := w.writer.Close(); err != nil {
+		abort(w.f)
+		return err
+	}
+
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+
+	w.cfs.saveSize(w.fpath, w.writer.size)
+	return nil
+}
+
+// Abort gives up on the file, if the underlying store's writer can.
+func (w *fileWriter) Abort() error {
+	return abort(w.f)
+}
+
+type aborter interface {
+	Abort() error
+}
+
+// abort throws away what was written to w, or just closes it if it can't.
+func abort(w io.WriteCloser) error {
+	if a, ok := w.(aborter); ok {
+		return a.Abort()
+	}
+
+	return w.Close()
+}
+
+// saveSize records size as the uncompressed size of fpath, if the underlying
+// store supports extended attributes. Failing to isn't an error; Stat just
+// has to read the trailer instead.
+func (cfs *FileStore) saveSize(fpath string, size int64) {
+	as, ok := cfs.store.(fs.AttrFileStore)
+	if !ok {
+		return
+	}
+
+	info, err := as.Stat(fpath)
+	if err != nil {
+		return
+	}
+
+	as.SetXattr(fpath, sizeXattr, sizeRecord(size, info))
+}
+
+// storedSize returns the uncompressed size recorded for fpath, if there is
+// one and it is still current.
+func (cfs *FileStore) storedSize(fpath string, info os.FileInfo) (int64, bool) {
+	as, ok := cfs.store.(fs.AttrFileStore)
+	if !ok {
+		return 0, false
+	}
+
+	b, err := as.GetXattr(fpath, sizeXattr)
+	if err != nil || len(b) != sizeRecordSize {
+		return 0, false
+	}
+
+	size := int64(binary.BigEndian.Uint64(b))
+	if !bytes.Equal(b, sizeRecord(size, info)) {
+		return 0, false
+	}
+
+	return size, true
+}
+
+func (cfs *FileStore) Mkdir(dpath string) error {
+	return cfs.store.Mkdir(dpath)
+}
+
+func (cfs *FileStore) Stat(fpath string) (os.FileInfo, error) {
+	info, err := cfs.store.Stat(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.Mode().IsRegular() {
+		return info, nil
+	}
+
+	return cfs.logicalInfo(fpath, info)
+}
+
+func (cfs *FileStore) logicalInfo(fpath string, info os.FileInfo) (os.FileInfo, error) {
+	size, ok := cfs.storedSize(fpath, info)
+	if !ok {
+		f, err := cfs.store.Open(fpath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		size, err = Size(f)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ret := util.FromOSInfo(info)
+	ret.I_Size = size
+
+	return ret, nil
+}
+
+func (cfs *FileStore) Remove(fpath string) error {
+	return cfs.store.Remove(fpath)
+}
+
+func (cfs *FileStore) GetFiles(dpath string) ([]os.FileInfo, error) {
+	infos, err := cfs.store.GetFiles(dpath)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []os.FileInfo{}
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			info, err = cfs.logicalInfo(childPath(dpath, info.Name()), info)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		ret = append(ret, info)
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,384 @@
+// Package crypt provides a FileStore that encrypts everything written to
+// another FileStore, for use with storage that isn't trusted.
+//
+// Data is split into chunks which are each sealed with AES-GCM, so large files
+// can be streamed without holding them in memory. The chunk number and a flag
+// marking the final chunk are part of every nonce, so reordering, dropping or
+// truncating chunks is detected in the same way as modifying them: the read
+// fails with ErrTampered. Data can also be bound to where it is kept, such as
+// a file's path, so that moving it somewhere else is detected too.
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/shaladdle/goaaw/filestore"
+)
+
+var (
+	// ErrTampered is returned when encrypted data fails authentication. This
+	// happens if the data was modified, truncated or reordered, and also if
+	// it is read with the wrong key. It is also an fs.ErrIntegrity.
+	ErrTampered = fmt.Errorf("crypt: data failed authentication: %w", fs.ErrIntegrity)
+
+	errBadHeader = errors.New("crypt: data is missing the encryption header")
+)
+
+const (
+	// KeySize is the size of a Key in bytes.
+	KeySize = 32
+
+	// DefaultChunkSize is the amount of plaintext sealed in each chunk when
+	// no chunk size is given.
+	DefaultChunkSize = 64 * 1024
+
+	version      = 1
+	saltSize     = 16
+	headerSize   = 4 + 1 + 4 + saltSize
+	gcmOverhead  = 16
+	maxChunkSize = 64 * 1024 * 1024
+
+	// pbkdf2Iterations is the work factor used by KeyFromPassphrase.
+	pbkdf2Iterations = 200000
+)
+
+var magic = []byte("AAWE")
+
+// Key is the master key all other keys are derived from.
+type Key [KeySize]byte
+
+// NewSalt returns random bytes suitable as a salt for KeyFromPassphrase. The
+// salt isn't secret, but the same salt must be used every time the key is
+// derived.
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	return salt, nil
+}
+
+// KeyFromPassphrase derives a key from a passphrase using PBKDF2 with
+// SHA-256.
+func KeyFromPassphrase(passphrase string, salt []byte) (Key, error) {
+	var key Key
+
+	b, err := pbkdf2.Key(sha256.New, passphrase, salt, pbkdf2Iterations, KeySize)
+	if err != nil {
+		return key, err
+	}
+
+	copy(key[:], b)
+	return key, nil
+}
+
+// subKey derives an independent key for a particular purpose from key.
+func subKey(key []byte, purpose string, extra []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	mac.Write(extra)
+	return mac.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce builds the nonce for a chunk out of its index and whether it is
+// the last one in the stream.
+func chunkNonce(nonce []byte, index uint64, last bool) {
+	binary.BigEndian.PutUint64(nonce, index)
+	nonce[len(nonce)-1] = 0
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+}
+
+// readHeader reads the header of an encrypted stream from r, and returns it
+// along with the chunk size the stream was written with.
+func readHeader(r io.Reader) ([]byte, int, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, 0, ErrTampered
+		}
+		return nil, 0, err
+	}
+
+	if !bytes.Equal(header[:len(magic)], magic) || header[len(magic)] != version {
+		return nil, 0, errBadHeader
+	}
+
+	// The header isn't authenticated until the first chunk is opened, so
+	// don't trust the chunk size enough to allocate something enormous.
+	chunkSize := binary.BigEndian.Uint32(header[len(magic)+1:])
+	if chunkSize == 0 || chunkSize > maxChunkSize {
+		return nil, 0, ErrTampered
+	}
+
+	return header, int(chunkSize), nil
+}
+
+// plainSize works out how much plaintext is in an encrypted stream of the
+// given size, which was written with chunkSize.
+func plainSize(size int64, chunkSize int) int64 {
+	body := size - headerSize
+	if body < gcmOverhead {
+		return 0
+	}
+
+	// Every chunk but the last is full, and even an empty stream has one
+	// chunk.
+	full := int64(chunkSize) + gcmOverhead
+	n := (body + full - 1) / full
+
+	return body - n*gcmOverhead
+}
+
+// writer encrypts a stream of data. Nothing is authenticated until Close is
+// called, which writes the final chunk.
+type writer struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	ad    []byte
+	nonce []byte
+	buf   []byte
+	out   []byte
+	chunk int
+	index uint64
+}
+
+// NewWriter returns a writer that encrypts everything written to it into w
+// with the given chunk size. The data is bound to ad, which isn't stored, and
+// has to be given again to decrypt it. Closing the returned writer writes the
+// final chunk, but does not close w.
+func NewWriter(w io.Writer, key Key, chunkSize int, ad []byte) (io.WriteCloser, error) {
+	if chunkSize <= 0 || chunkSize > maxChunkSize {
+		chunkSize = DefaultChunkSize
+	}
+
+	salt, err := NewSalt()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, headerSize)
+	header = append(header, magic...)
+	header = append(header, version)
+	header = binary.BigEndian.AppendUint32(header, uint32(chunkSize))
+	header = append(header, salt...)
+
+	aead, err := newGCM(subKey(subKey(key[:], "content", nil), "file", salt))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &writer{
+		w:     w,
+		aead:  aead,
+		ad:    append(header, ad...),
+		nonce: make([]byte, aead.NonceSize()),
+		buf:   make([]byte, 0, chunkSize+1),
+		chunk: chunkSize,
+	}, nil
+}
+
+func (w *writer) seal(b []byte, last bool) error {
+	chunkNonce(w.nonce, w.index, last)
+	w.index++
+
+	w.out = w.aead.Seal(w.out[:0], w.nonce, b, w.ad)
+	_, err := w.w.Write(w.out)
+	return err
+}
+
+func (w *writer) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		// A chunk is only sealed once we know more data follows it, since
+		// the last chunk has to be marked as such.
+		if len(w.buf) == w.chunk {
+			if err := w.seal(w.buf, false); err != nil {
+				return written, err
+			}
+			w.buf = w.buf[:0]
+		}
+
+		n := w.chunk - len(w.buf)
+		if n > len(b) {
+			n = len(b)
+		}
+
+		w.buf = append(w.buf, b[:n]...)
+		b = b[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+func (w *writer) Close() error {
+	return w.seal(w.buf, true)
+}
+
+type reader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	ad    []byte
+	nonce []byte
+	chunk []byte
+	plain []byte
+	index uint64
+	done  bool
+	err   error
+}
+
+// NewReader reads the header written by NewWriter and returns a reader for
+// the decrypted stream, which must have been bound to ad. The first chunk is
+// decrypted right away, so a wrong key, the wrong ad or modified data is
+// usually reported here rather than by Read.
+func NewReader(r io.Reader, key Key, ad []byte) (io.Reader, error) {
+	br := bufio.NewReader(r)
+
+	header, chunkSize, err := readHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	salt := header[len(magic)+5:]
+
+	aead, err := newGCM(subKey(subKey(key[:], "content", nil), "file", salt))
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &reader{
+		r:     br,
+		aead:  aead,
+		ad:    append(header, ad...),
+		nonce: make([]byte, aead.NonceSize()),
+		chunk: make([]byte, chunkSize+aead.Overhead()),
+	}
+
+	if err := ret.next(); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// next decrypts the next chunk into r.plain.
+func (r *reader) next() error {
+	n, err := io.ReadFull(r.r, r.chunk)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			// The stream ended before a chunk marked as last was seen.
+			return ErrTampered
+		}
+		return err
+	}
+
+	// A short chunk has to be the last one. A full one is only the last if
+	// nothing comes after it.
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		if _, err := r.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	chunkNonce(r.nonce, r.index, last)
+	r.index++
+
+	plain, err := r.aead.Open(r.plain[:0], r.nonce, r.chunk[:n], r.ad)
+	if err != nil {
+		return ErrTampered
+	}
+
+	r.plain = plain
+	r.done = last
+
+	return nil
+}
+
+func (r *reader) Read(b []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		if r.done {
+			return 0, io.EOF
+		}
+
+		if err := r.next(); err != nil {
+			r.err = err
+			return 0, err
+		}
+	}
+
+	n := copy(b, r.plain)
+	r.plain = r.plain[n:]
+
+	return n, nil
+}
+
+// Encrypt encrypts b in one piece, bound to ad, using the same format as
+// NewWriter.
+func Encrypt(b []byte, key Key, ad []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	w, err := NewWriter(buf, key, len(b), ad)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decrypt reverses Encrypt. It returns ErrTampered if b was modified, or
+// wasn't bound to ad.
+func Decrypt(b []byte, key Key, ad []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(b), key, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
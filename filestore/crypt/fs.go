@@ -0,0 +1,253 @@
+package crypt
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/shaladdle/goaaw/filestore"
+	"github.com/shaladdle/goaaw/filestore/util"
+)
+
+// Options controls how a FileStore encrypts files.
+type Options struct {
+	// ChunkSize is the amount of plaintext sealed at a time. Larger chunks
+	// have less overhead, but more has to be buffered while streaming.
+	// Defaults to DefaultChunkSize.
+	ChunkSize int
+
+	// EncryptNames causes every component of a path to be encrypted as well
+	// as the file contents. Names are encrypted deterministically, so the
+	// same name always maps to the same stored name, and equal names can be
+	// spotted by someone looking at the store.
+	EncryptNames bool
+}
+
+// FileStore encrypts files on their way into the underlying store and
+// decrypts them on the way out. The contents of each file are bound to its
+// path, so a file can't be passed off as another one. Stat and GetFiles
+// report the size of the plaintext, which is worked out from the size of the
+// stored file and the chunk size in its header.
+type FileStore struct {
+	store    fs.FileStore
+	key      Key
+	opts     Options
+	nameAEAD cipher.AEAD
+	nameKey  []byte
+}
+
+// New returns a FileStore that encrypts everything it stores in store with
+// key.
+func New(store fs.FileStore, key Key, opts Options) (*FileStore, error) {
+	if opts.ChunkSize <= 0 || opts.ChunkSize > maxChunkSize {
+		opts.ChunkSize = DefaultChunkSize
+	}
+
+	nameKey := subKey(key[:], "names", nil)
+	nameAEAD, err := newGCM(subKey(nameKey, "seal", nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileStore{
+		store:    store,
+		key:      key,
+		opts:     opts,
+		nameAEAD: nameAEAD,
+		nameKey:  subKey(nameKey, "nonce", nil),
+	}, nil
+}
+
+var nameEncoding = base64.RawURLEncoding
+
+// encryptName encrypts a single path component. The nonce is derived from the
+// name itself, which makes the encryption deterministic while still letting
+// tampering be detected.
+func (efs *FileStore) encryptName(name string) string {
+	mac := hmac.New(sha256.New, efs.nameKey)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:efs.nameAEAD.NonceSize()]
+
+	sealed := efs.nameAEAD.Seal(append([]byte{}, nonce...), nonce, []byte(name), nil)
+	return nameEncoding.EncodeToString(sealed)
+}
+
+func (efs *FileStore) decryptName(name string) (string, error) {
+	b, err := nameEncoding.DecodeString(name)
+	if err != nil || len(b) < efs.nameAEAD.NonceSize() {
+		return "", ErrTampered
+	}
+
+	nonce, sealed := b[:efs.nameAEAD.NonceSize()], b[efs.nameAEAD.NonceSize():]
+	plain, err := efs.nameAEAD.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", ErrTampered
+	}
+
+	return string(plain), nil
+}
+
+// boundPath returns the form of fpath that a file's contents are bound to,
+// which is the same however the path is spelled.
+func boundPath(fpath string) []byte {
+	return []byte(path.Clean("/" + fpath))
+}
+
+// storePath maps a path to the path it is stored under.
+func (efs *FileStore) storePath(fpath string) string {
+	if !efs.opts.EncryptNames {
+		return fpath
+	}
+
+	// Keep a leading '/' so that paths naming the root still work.
+	prefix := ""
+	if strings.HasPrefix(fpath, "/") {
+		prefix = "/"
+	}
+
+	tokens := []string{}
+	for _, tok := range strings.Split(path.Clean(fpath), "/") {
+		if tok == "" || tok == "." {
+			continue
+		}
+		tokens = append(tokens, efs.encryptName(tok))
+	}
+
+	return prefix + strings.Join(tokens, "/")
+}
+
+func (efs *FileStore) Open(fpath string) (io.ReadCloser, error) {
+	f, err := efs.store.Open(efs.storePath(fpath))
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := NewReader(f, efs.key, boundPath(fpath))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &readCloser{r, f}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (efs *FileStore) Create(fpath string) (io.WriteCloser, error) {
+	f, err := efs.store.Create(efs.storePath(fpath))
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := NewWriter(f, efs.key, efs.opts.ChunkSize, boundPath(fpath))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &writeCloser{w, f}, nil
+}
+
+type writeCloser struct {
+	w io.WriteCloser
+	f io.WriteCloser
+}
+
+func (w *writeCloser) Write(b []byte) (int, error) {
+	return w.w.Write(b)
+}
+
+func (w *writeCloser) Close() error {
+	if err := w.w.Close(); err != nil {
+		w.f.Close()
+		return err
+	}
+
+	return w.f.Close()
+}
+
+func (efs *FileStore) Mkdir(dpath string) error {
+	return efs.store.Mkdir(efs.storePath(dpath))
+}
+
+// plainInfo converts the info of the file stored at spath into the info of
+// the file as seen through efs. The file may have been written with any chunk
+// size, so the one in its header is used.
+func (efs *FileStore) plainInfo(info os.FileInfo, spath, name string) (os.FileInfo, error) {
+	ret := util.FromOSInfo(info)
+	ret.I_Name = name
+
+	if !info.Mode().IsRegular() {
+		return ret, nil
+	}
+
+	f, err := efs.store.Open(spath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	_, chunkSize, err := readHeader(f)
+	if err != nil {
+		return nil, err
+	}
+	ret.I_Size = plainSize(info.Size(), chunkSize)
+
+	return ret, nil
+}
+
+func (efs *FileStore) Stat(fpath string) (os.FileInfo, error) {
+	spath := efs.storePath(fpath)
+	info, err := efs.store.Stat(spath)
+	if err != nil {
+		return nil, err
+	}
+
+	name := info.Name()
+	if efs.opts.EncryptNames {
+		name = path.Base(fpath)
+	}
+
+	return efs.plainInfo(info, spath, name)
+}
+
+func (efs *FileStore) Remove(fpath string) error {
+	return efs.store.Remove(efs.storePath(fpath))
+}
+
+func (efs *FileStore) GetFiles(dpath string) ([]os.FileInfo, error) {
+	sdir := efs.storePath(dpath)
+	infos, err := efs.store.GetFiles(sdir)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []os.FileInfo{}
+	for _, info := range infos {
+		name := info.Name()
+		if efs.opts.EncryptNames {
+			if name, err = efs.decryptName(name); err != nil {
+				return nil, err
+			}
+		}
+
+		// Keep the path relative, since some stores reject absolute
+		// paths other than "/".
+		spath := strings.TrimPrefix(path.Join(sdir, info.Name()), "/")
+		if info, err = efs.plainInfo(info, spath, name); err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, info)
+	}
+
+	return ret, nil
+}
@@ -2,8 +2,32 @@
 package fs
 
 import (
+	"errors"
 	"io"
 	"os"
+	"syscall"
+	"time"
+)
+
+// Errors returned by file and block stores. Stores wrap them with the path
+// or key, so test for them with errors.Is. The remote stores send them
+// across intact.
+var (
+	ErrNotExist   = os.ErrNotExist
+	ErrExist      = os.ErrExist
+	ErrPermission = os.ErrPermission
+
+	// ErrNotDir is the same error the os package wraps, so that errors.Is
+	// works on errors from the standard filestore too.
+	ErrNotDir error = syscall.ENOTDIR
+
+	// ErrIntegrity is returned when the contents of a file or block don't
+	// match the checksum recorded for it, because it was damaged or a
+	// transfer was cut short.
+	ErrIntegrity = errors.New("contents do not match their checksum")
+
+	// ErrFull is returned when a store has no room for a write.
+	ErrFull = errors.New("out of space")
 )
 
 // FileSystem defines the basic interface of a file store. This is meant to be
@@ -32,6 +56,57 @@ type FileStore interface {
 	// Delete file.
 	Remove(path string) error
 
-	// Get a list of all files in the directory at path.
+	// Get a list of all files in the directory at path. Subdirectories are
+	// left out.
 	GetFiles(path string) ([]os.FileInfo, error)
 }
+
+// AttrFileStore is implemented by file stores that can also change the
+// metadata of the files they hold. Callers should type assert a FileStore to
+// find out whether it is supported.
+type AttrFileStore interface {
+	FileStore
+
+	// Change the permission bits of a file.
+	Chmod(path string, mode os.FileMode) error
+
+	// Change the owner and group of a file.
+	Chown(path string, uid, gid int) error
+
+	// Change the access and modification times of a file.
+	Chtimes(path string, atime, mtime time.Time) error
+
+	// Get the value of the extended attribute attr.
+	GetXattr(path, attr string) ([]byte, error)
+
+	// Set the extended attribute attr to data, creating it if necessary.
+	SetXattr(path, attr string, data []byte) error
+
+	// Get the names of all extended attributes set on a file.
+	ListXattr(path string) ([]string, error)
+
+	// Delete the extended attribute attr.
+	RemoveXattr(path, attr string) error
+}
+
+// HashFileStore is implemented by file stores that keep a checksum of every
+// file. Stores that implement it also verify files against their checksums
+// as they are read, and report a mismatch with ErrIntegrity.
+type HashFileStore interface {
+	FileStore
+
+	// Get the SHA-256 hash of a file's contents. The hash is computed
+	// wherever the file is stored, so it is cheap to call even on a remote
+	// store.
+	Hash(path string) ([]byte, error)
+}
+
+// DirFileStore is implemented by file stores that can list the directories in
+// a directory, which GetFiles leaves out.
+type DirFileStore interface {
+	FileStore
+
+	// Get a list of every entry in the directory at path, subdirectories
+	// included.
+	ReadDir(path string) ([]os.FileInfo, error)
+}
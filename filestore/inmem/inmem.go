@@ -1,21 +1,27 @@
 // Package inmem provides an in memory file system.
-// NOTE: This package is not yet working. Wait for it to pass the tests in
-// aaw/fs before using it.
 package inmem
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	filestore "github.com/shaladdle/goaaw/filestore"
 )
 
 const (
 	rootName = "root"
 	dirSep   = "/"
+
+	fileMode = os.FileMode(0644)
+	dirMode  = os.ModeDir | 0755
 )
 
 func split(s string) []string {
@@ -31,7 +37,7 @@ func (readCloserWrapper) Close() error {
 }
 
 func errFileNotFound(fpath string) error {
-	return fmt.Errorf("file '%v' not found", fpath)
+	return fmt.Errorf("file '%v': %w", fpath, filestore.ErrNotExist)
 }
 
 type fileInfo struct {
@@ -41,8 +47,12 @@ type fileInfo struct {
 	modTime time.Time
 }
 
-func (fileInfo) Mode() os.FileMode {
-	panic("Not implemented")
+func (info fileInfo) Mode() os.FileMode {
+	if info.isDir {
+		return dirMode
+	}
+
+	return fileMode
 }
 
 func (info fileInfo) Name() string {
@@ -74,15 +84,40 @@ func (d *dirNode) String() string {
 	return fmt.Sprintf("('%s' %s)", d.Name(), d.children)
 }
 
+// setChild adds info to the directory, replacing any child with the same
+// name.
+func (d *dirNode) setChild(info os.FileInfo) {
+	for i, c := range d.children {
+		if c.Name() == info.Name() {
+			d.children[i] = info
+			return
+		}
+	}
+
+	d.children = append(d.children, info)
+}
+
+func (d *dirNode) removeChild(name string) {
+	for i, c := range d.children {
+		if c.Name() == name {
+			d.children = append(d.children[:i], d.children[i+1:]...)
+			return
+		}
+	}
+}
+
 type node interface {
 	os.FileInfo
 	//Parent() node
 }
 
+// InMemFileSystem is safe for concurrent use.
 type InMemFileSystem struct {
-	data  map[string][]byte
-	nodes map[string]node
-	root  *dirNode
+	lock     sync.Mutex
+	data     map[string][]byte
+	nodes    map[string]node
+	root     *dirNode
+	watchers map[*watcher]bool
 }
 
 func New() *InMemFileSystem {
@@ -91,20 +126,31 @@ func New() *InMemFileSystem {
 	}
 
 	return &InMemFileSystem{
-		data:  make(map[string][]byte),
-		nodes: map[string]node{rootName: rootNode},
-		root:  rootNode,
+		data:     make(map[string][]byte),
+		nodes:    map[string]node{rootName: rootNode},
+		root:     rootNode,
+		watchers: make(map[*watcher]bool),
 	}
 }
 
 // normPath normalizes the path passed in by prepending a '/' character and
-// then executing path.Join.
+// then executing path.Join. The result is the key used for the path in
+// fs.nodes and fs.data.
 func (fs *InMemFileSystem) normPath(tokens ...string) string {
-	return path.Join(append([]string{rootName}, tokens...)...)
+	return path.Join(rootName, path.Clean(dirSep+path.Join(tokens...)))
+}
+
+// storePath converts a key from fs.nodes back into the form that is passed to
+// the FileStore methods.
+func storePath(norm string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(norm, rootName), dirSep)
 }
 
 func (fs *InMemFileSystem) Open(fpath string) (io.ReadCloser, error) {
-	buf, ok := fs.data[fpath]
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	buf, ok := fs.data[fs.normPath(fpath)]
 	if !ok {
 		return nil, errFileNotFound(fpath)
 	}
@@ -112,6 +158,21 @@ func (fs *InMemFileSystem) Open(fpath string) (io.ReadCloser, error) {
 	return readCloserWrapper{bytes.NewReader(buf)}, nil
 }
 
+// Hash returns the SHA-256 hash of a file. Nothing in memory can be damaged
+// behind the file system's back, so files aren't verified when read.
+func (fs *InMemFileSystem) Hash(fpath string) ([]byte, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	buf, ok := fs.data[fs.normPath(fpath)]
+	if !ok {
+		return nil, errFileNotFound(fpath)
+	}
+
+	sum := sha256.Sum256(buf)
+	return sum[:], nil
+}
+
 type file struct {
 	*bytes.Buffer
 	fs    *InMemFileSystem
@@ -123,75 +184,101 @@ func (fs *InMemFileSystem) newFile(fpath string) *file {
 }
 
 func (f *file) Close() error {
-	b := f.Buffer.Bytes()
-	info := fileInfo{
-		name:    path.Base(f.fpath),
-		size:    int64(len(b)),
-		modTime: time.Now(),
-		isDir:   false,
-	}
+	fs := f.fs
+	norm := fs.normPath(f.fpath)
 
-	dpath := f.fs.normPath(path.Dir(f.fpath))
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
 
 	// To make things simple, just call mkdir so we know the directory is
 	// set up.
-	err := f.fs.mkdir(f.fs.root, split(dpath))
+	dir, created, err := fs.mkdir(path.Dir(norm))
 	if err != nil {
 		return err
 	}
 
-	dchildren := f.fs.nodes[dpath].(*dirNode).children
-	dchildren = append(dchildren, info)
+	if old, ok := fs.nodes[norm]; ok && old.IsDir() {
+		return fmt.Errorf("'%s' already exists as a directory: %w", f.fpath, filestore.ErrExist)
+	}
 
-	f.fs.data[f.fpath] = b
-	f.fs.nodes[f.fpath] = info
+	op := filestore.EventModify
+	if _, ok := fs.data[norm]; !ok {
+		op = filestore.EventCreate
+	}
+
+	b := f.Buffer.Bytes()
+	info := fileInfo{
+		name:    path.Base(norm),
+		size:    int64(len(b)),
+		modTime: time.Now(),
+		isDir:   false,
+	}
+
+	fs.data[norm] = b
+	fs.nodes[norm] = info
+	dir.setChild(info)
+
+	fs.notify(append(created, filestore.Event{Op: op, Path: storePath(norm)}))
 
 	return nil
 }
 
-func (fs *InMemFileSystem) mkdir(n *dirNode, dirs []string) error {
-	// TODO: Is this necessary? Not sure if we should be 'normalizing' things
-	// or not.
-	if n.Name() == rootName {
-		dirs = dirs[1:]
-	}
+// mkdir creates the directory with key norm, along with any missing parents.
+// It returns the directory and Create events for every directory that had to
+// be made. The caller must hold fs.lock.
+func (fs *InMemFileSystem) mkdir(norm string) (*dirNode, []filestore.Event, error) {
+	n := fs.root
+	events := []filestore.Event{}
+
+	dirs := split(norm)[1:]
+	for i, name := range dirs {
+		if name == "" {
+			continue
+		}
 
-	for _, c := range n.children {
-		if c.Name() == dirs[0] {
-			if c.IsDir() {
-				if len(dirs[1:]) == 0 {
-					return nil
-				}
+		cpath := path.Join(append([]string{rootName}, dirs[:i+1]...)...)
 
-				return fs.mkdir(c.(*dirNode), dirs[1:])
-			} else {
-				return fmt.Errorf("'%s' already exists as a regular file")
-			}
+		switch c := fs.nodes[cpath].(type) {
+		case *dirNode:
+			n = c
+			continue
+		case nil:
+		default:
+			return nil, nil, fmt.Errorf("'%s' already exists as a regular file: %w", storePath(cpath), filestore.ErrNotDir)
 		}
-	}
-
-	c := &dirNode{
-		fileInfo: fileInfo{
-			name:  dirs[0],
-			size:  0,
-			isDir: true,
-		},
-		children: []os.FileInfo{},
-	}
 
-	n.children = append(n.children, c)
+		c := &dirNode{
+			fileInfo: fileInfo{
+				name:    name,
+				size:    0,
+				isDir:   true,
+				modTime: time.Now(),
+			},
+			children: []os.FileInfo{},
+		}
 
-	fs.nodes[fs.normPath(dirs...)] = c
+		n.setChild(c)
+		fs.nodes[cpath] = c
+		events = append(events, filestore.Event{Op: filestore.EventCreate, Path: storePath(cpath)})
 
-	if len(dirs) > 1 {
-		return fs.mkdir(c, dirs[1:])
+		n = c
 	}
 
-	return nil
+	return n, events, nil
 }
 
 func (fs *InMemFileSystem) Mkdir(dpath string) error {
-	return fs.mkdir(fs.root, split(dpath))
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	_, events, err := fs.mkdir(fs.normPath(dpath))
+	if err != nil {
+		return err
+	}
+
+	fs.notify(events)
+
+	return nil
 }
 
 func (fs *InMemFileSystem) Create(fpath string) (io.WriteCloser, error) {
@@ -199,43 +286,79 @@ func (fs *InMemFileSystem) Create(fpath string) (io.WriteCloser, error) {
 }
 
 func (fs *InMemFileSystem) Stat(fpath string) (os.FileInfo, error) {
-	var traverse func(*dirNode, []string) (os.FileInfo, error)
-	traverse = func(n *dirNode, tokens []string) (os.FileInfo, error) {
-		for _, c := range n.children {
-			if c.Name() == tokens[0] {
-				if len(tokens) == 1 {
-					// If we are at the last token, just return the fileInfo we
-					// found.
-					switch c := c.(type) {
-					case *dirNode:
-						return c.fileInfo, nil
-					case fileInfo:
-						return c, nil
-					default:
-						panic("child of a node was not fileInfo and als not *dirNode")
-					}
-				} else if c.IsDir() {
-					// If this is not the last token, and this child is a
-					// directory, go deeper.
-					return traverse(c.(*dirNode), tokens[1:])
-				} else {
-					// If it's not a directory, and we haven't exhausted our
-					// tokens, now we give up.
-					return nil, errFileNotFound(fpath)
-				}
-			}
-		}
-
-		return nil, errFileNotFound(fpath)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	switch n := fs.nodes[fs.normPath(fpath)].(type) {
+	case *dirNode:
+		return n.fileInfo, nil
+	case fileInfo:
+		return n, nil
 	}
 
-	return traverse(fs.root, split(fpath))
+	return nil, errFileNotFound(fpath)
 }
 
 func (fs *InMemFileSystem) Remove(fpath string) error {
-	return errFileNotFound(fpath)
+	norm := fs.normPath(fpath)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	n, ok := fs.nodes[norm]
+	if !ok || norm == rootName {
+		return errFileNotFound(fpath)
+	}
+
+	// Report it the same way as os.Remove, so callers can check for
+	// syscall.ENOTEMPTY whichever store they use.
+	if d, ok := n.(*dirNode); ok && len(d.children) > 0 {
+		return &os.PathError{Op: "remove", Path: fpath, Err: syscall.ENOTEMPTY}
+	}
+
+	fs.nodes[path.Dir(norm)].(*dirNode).removeChild(n.Name())
+	delete(fs.nodes, norm)
+	delete(fs.data, norm)
+
+	fs.notify([]filestore.Event{{Op: filestore.EventRemove, Path: storePath(norm)}})
+
+	return nil
 }
 
 func (fs *InMemFileSystem) GetFiles(fpath string) ([]os.FileInfo, error) {
-	return nil, errFileNotFound(fpath)
+	return fs.list(fpath, false)
+}
+
+// ReadDir is like GetFiles, but lists subdirectories too.
+func (fs *InMemFileSystem) ReadDir(dpath string) ([]os.FileInfo, error) {
+	return fs.list(dpath, true)
+}
+
+func (fs *InMemFileSystem) list(fpath string, dirs bool) ([]os.FileInfo, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	n, ok := fs.nodes[fs.normPath(fpath)]
+	if !ok {
+		return nil, errFileNotFound(fpath)
+	}
+
+	d, ok := n.(*dirNode)
+	if !ok {
+		return nil, fmt.Errorf("%v: %w", fpath, filestore.ErrNotDir)
+	}
+
+	ret := []os.FileInfo{}
+	for _, c := range d.children {
+		switch c := c.(type) {
+		case *dirNode:
+			if dirs {
+				ret = append(ret, c.fileInfo)
+			}
+		default:
+			ret = append(ret, c)
+		}
+	}
+
+	return ret, nil
 }
@@ -0,0 +1,110 @@
+package inmem
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+
+	filestore "github.com/shaladdle/goaaw/filestore"
+)
+
+type watcher struct {
+	fs     *InMemFileSystem
+	dpath  string
+	in     chan filestore.Event
+	events chan filestore.Event
+	done   chan bool
+}
+
+func (w *watcher) Events() <-chan filestore.Event {
+	return w.events
+}
+
+func (w *watcher) Close() error {
+	w.fs.lock.Lock()
+	defer w.fs.lock.Unlock()
+
+	if !w.fs.watchers[w] {
+		return nil
+	}
+
+	delete(w.fs.watchers, w)
+	close(w.done)
+
+	return nil
+}
+
+// covers returns true if fpath is inside the directory being watched.
+func (w *watcher) covers(fpath string) bool {
+	return w.dpath == "" || fpath == w.dpath || strings.HasPrefix(fpath, w.dpath+dirSep)
+}
+
+// director queues up events until the consumer is ready for them, so that
+// writers to the file system never wait on a slow watcher.
+func (w *watcher) director() {
+	defer close(w.events)
+
+	pending := list.New()
+	for {
+		var (
+			out  chan filestore.Event
+			next filestore.Event
+		)
+
+		if pending.Len() > 0 {
+			out = w.events
+			next = pending.Front().Value.(filestore.Event)
+		}
+
+		select {
+		case ev := <-w.in:
+			pending.PushBack(ev)
+		case out <- next:
+			pending.Remove(pending.Front())
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Watch reports changes made through this InMemFileSystem to anything under
+// dpath.
+func (fs *InMemFileSystem) Watch(dpath string) (filestore.Watcher, error) {
+	norm := fs.normPath(dpath)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	n, ok := fs.nodes[norm]
+	if !ok {
+		return nil, errFileNotFound(dpath)
+	}
+	if !n.IsDir() {
+		return nil, fmt.Errorf("%v: %w", dpath, filestore.ErrNotDir)
+	}
+
+	w := &watcher{
+		fs:     fs,
+		dpath:  storePath(norm),
+		in:     make(chan filestore.Event),
+		events: make(chan filestore.Event),
+		done:   make(chan bool),
+	}
+	fs.watchers[w] = true
+
+	go w.director()
+
+	return w, nil
+}
+
+// notify hands events to every interested watcher. The caller must hold
+// fs.lock.
+func (fs *InMemFileSystem) notify(events []filestore.Event) {
+	for _, ev := range events {
+		for w := range fs.watchers {
+			if w.covers(ev.Path) {
+				w.in <- ev
+			}
+		}
+	}
+}
@@ -0,0 +1,634 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/shaladdle/goaaw/filestore"
+	"github.com/shaladdle/goaaw/filestore/util"
+)
+
+var shardMagic = []byte("AAWR")
+
+// Every shard starts with the magic, its index, the version of the file it
+// belongs to, the size of the whole file and a checksum of the shard data.
+const shardHeaderSize = 4 + 1 + 8 + 8 + 4
+
+var errBadShard = errors.New("mirror: shard is corrupt")
+
+type shardHeader struct {
+	index   int
+	version int64
+	size    int64
+	sum     uint32
+}
+
+func (h shardHeader) marshal() []byte {
+	b := make([]byte, 0, shardHeaderSize)
+	b = append(b, shardMagic...)
+	b = append(b, byte(h.index))
+	b = binary.BigEndian.AppendUint64(b, uint64(h.version))
+	b = binary.BigEndian.AppendUint64(b, uint64(h.size))
+	b = binary.BigEndian.AppendUint32(b, h.sum)
+	return b
+}
+
+func readShardHeader(r io.Reader) (shardHeader, error) {
+	b := make([]byte, shardHeaderSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return shardHeader{}, errBadShard
+	}
+
+	if !bytes.Equal(b[:len(shardMagic)], shardMagic) {
+		return shardHeader{}, errBadShard
+	}
+	b = b[len(shardMagic):]
+
+	return shardHeader{
+		index:   int(b[0]),
+		version: int64(binary.BigEndian.Uint64(b[1:])),
+		size:    int64(binary.BigEndian.Uint64(b[9:])),
+		sum:     binary.BigEndian.Uint32(b[17:]),
+	}, nil
+}
+
+// ErasureFileStore splits every file into data shards plus parity shards and
+// stores one shard on each backend. A file can be read as long as any data
+// shards' worth of backends still have it.
+//
+// Files are encoded in memory, so ErasureFileStore is meant for blobs of a
+// modest size rather than for streaming huge files.
+type ErasureFileStore struct {
+	*health
+
+	stores []fs.FileStore
+	rs     *reedSolomon
+	quorum int
+
+	lock        sync.Mutex
+	lastVersion int64
+}
+
+// NewErasure returns an ErasureFileStore that splits files into dataShards
+// pieces and stores them, along with len(stores)-dataShards parity shards,
+// across stores. Writes have to reach at least one more backend than there
+// are data shards, unless there are no parity shards at all.
+func NewErasure(stores []fs.FileStore, dataShards int) (*ErasureFileStore, error) {
+	if dataShards > len(stores) {
+		return nil, fmt.Errorf("mirror: %v data shards need at least as many backends, got %v", dataShards, len(stores))
+	}
+
+	rs, err := newReedSolomon(dataShards, len(stores)-dataShards)
+	if err != nil {
+		return nil, err
+	}
+
+	quorum := dataShards + 1
+	if quorum > len(stores) {
+		quorum = len(stores)
+	}
+
+	return &ErasureFileStore{
+		health: newHealth(len(stores)),
+		stores: stores,
+		rs:     rs,
+		quorum: quorum,
+	}, nil
+}
+
+// newVersion returns a version number greater than any handed out before.
+func (e *ErasureFileStore) newVersion() int64 {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	v := time.Now().UnixNano()
+	if v <= e.lastVersion {
+		v = e.lastVersion + 1
+	}
+	e.lastVersion = v
+
+	return v
+}
+
+type shard struct {
+	shardHeader
+	data []byte
+}
+
+func (e *ErasureFileStore) readShard(i int, fpath string) (*shard, error) {
+	f, err := e.stores[i].Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h, err := readShardHeader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.index != i || crc32.ChecksumIEEE(data) != h.sum {
+		return nil, errBadShard
+	}
+
+	return &shard{h, data}, nil
+}
+
+// decoded is a file rebuilt from its shards.
+type decoded struct {
+	version int64
+	data    []byte
+
+	// shards holds every shard of the file, and current records which
+	// backends already had the right one.
+	shards  [][]byte
+	current []bool
+}
+
+// decode reads the shards of fpath from every backend and rebuilds the
+// newest version of the file that has enough shards left.
+func (e *ErasureFileStore) decode(fpath string) (*decoded, error) {
+	shards := make([]*shard, len(e.stores))
+	counts := make(map[int64]int)
+
+	var firstErr error
+	for i := range e.stores {
+		s, err := e.readShard(i, fpath)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		shards[i] = s
+		counts[s.version]++
+	}
+
+	var version int64 = -1
+	for v, n := range counts {
+		if n >= e.rs.data && v > version {
+			version = v
+		}
+	}
+
+	if version < 0 {
+		if len(counts) == 0 {
+			return nil, firstErr
+		}
+		return nil, fmt.Errorf("%v: %v", fpath, errTooFewShards)
+	}
+
+	ret := &decoded{
+		version: version,
+		shards:  make([][]byte, len(e.stores)),
+		current: make([]bool, len(e.stores)),
+	}
+
+	var size int64
+	for i, s := range shards {
+		if s != nil && s.version == version {
+			ret.shards[i] = s.data
+			ret.current[i] = true
+			size = s.size
+		}
+	}
+
+	if err := e.rs.reconstruct(ret.shards); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, size)
+	for _, s := range ret.shards[:e.rs.data] {
+		data = append(data, s...)
+	}
+	if int64(len(data)) < size {
+		return nil, errBadShard
+	}
+	ret.data = data[:size]
+
+	return ret, nil
+}
+
+// encode splits b into shards, including the parity shards.
+func (e *ErasureFileStore) encode(b []byte) [][]byte {
+	shardSize := (len(b) + e.rs.data - 1) / e.rs.data
+
+	shards := make([][]byte, len(e.stores))
+	for i := range shards {
+		shards[i] = make([]byte, shardSize)
+		if i < e.rs.data && i*shardSize < len(b) {
+			copy(shards[i], b[i*shardSize:])
+		}
+	}
+
+	e.rs.encode(shards)
+
+	return shards
+}
+
+func (e *ErasureFileStore) writeShard(i int, fpath string, version, size int64, data []byte) error {
+	h := shardHeader{
+		index:   i,
+		version: version,
+		size:    size,
+		sum:     crc32.ChecksumIEEE(data),
+	}
+
+	w, err := e.stores[i].Create(fpath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(h.marshal()); err != nil {
+		w.Close()
+		return err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+func (e *ErasureFileStore) put(fpath string, b []byte) error {
+	shards := e.encode(b)
+	version := e.newVersion()
+
+	ok := 0
+	var firstErr error
+	for i := range e.stores {
+		if err := e.writeShard(i, fpath, version, int64(len(b)), shards[i]); err != nil {
+			e.setDown(i, true)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		ok++
+	}
+
+	if ok < e.quorum {
+		return noQuorum(ok, len(e.stores), firstErr)
+	}
+
+	return nil
+}
+
+func (e *ErasureFileStore) Open(fpath string) (io.ReadCloser, error) {
+	d, err := e.decode(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(d.data)), nil
+}
+
+func (e *ErasureFileStore) Create(fpath string) (io.WriteCloser, error) {
+	return &erasureWriter{e: e, fpath: fpath}, nil
+}
+
+// erasureWriter collects a whole file so it can be encoded when closed.
+type erasureWriter struct {
+	bytes.Buffer
+	e     *ErasureFileStore
+	fpath string
+}
+
+func (w *erasureWriter) Close() error {
+	return w.e.put(w.fpath, w.Bytes())
+}
+
+func (e *ErasureFileStore) Mkdir(dpath string) error {
+	ok := 0
+	var firstErr error
+	for i, store := range e.stores {
+		if err := store.Mkdir(dpath); err != nil {
+			e.setDown(i, true)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		ok++
+	}
+
+	if ok < e.quorum {
+		return noQuorum(ok, len(e.stores), firstErr)
+	}
+
+	return nil
+}
+
+func (e *ErasureFileStore) Stat(fpath string) (os.FileInfo, error) {
+	var firstErr error
+	for _, i := range e.order() {
+		info, err := e.stores[i].Stat(fpath)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		if info.IsDir() {
+			return info, nil
+		}
+
+		size, err := e.size(fpath)
+		if err != nil {
+			return nil, err
+		}
+
+		ret := util.FromOSInfo(info)
+		ret.I_Size = size
+
+		return ret, nil
+	}
+
+	return nil, firstErr
+}
+
+// size returns the size of the newest version of fpath that has enough shards
+// to be read. Only the headers of the shards are read, so shards whose data
+// is damaged still count.
+func (e *ErasureFileStore) size(fpath string) (int64, error) {
+	counts := make(map[int64]int)
+	sizes := make(map[int64]int64)
+
+	var firstErr error
+	for i, store := range e.stores {
+		f, err := store.Open(fpath)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		h, err := readShardHeader(f)
+		f.Close()
+		if err != nil || h.index != i {
+			if firstErr == nil {
+				firstErr = errBadShard
+			}
+			continue
+		}
+
+		counts[h.version]++
+		sizes[h.version] = h.size
+	}
+
+	var version int64 = -1
+	for v, n := range counts {
+		if n >= e.rs.data && v > version {
+			version = v
+		}
+	}
+
+	if version < 0 {
+		if len(counts) == 0 {
+			return 0, firstErr
+		}
+		return 0, fmt.Errorf("%v: %v", fpath, errTooFewShards)
+	}
+
+	return sizes[version], nil
+}
+
+func (e *ErasureFileStore) Remove(fpath string) error {
+	ok := 0
+	removed := false
+	var firstErr error
+	for i, store := range e.stores {
+		err := store.Remove(fpath)
+		if err == nil {
+			removed = true
+			ok++
+			continue
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+
+		if _, serr := store.Stat(fpath); serr != nil {
+			ok++
+			continue
+		}
+
+		e.setDown(i, true)
+	}
+
+	if !removed {
+		return firstErr
+	}
+
+	if ok < e.quorum {
+		return noQuorum(ok, len(e.stores), firstErr)
+	}
+
+	return nil
+}
+
+// names returns the names of the files in dpath on any backend, along with
+// which backends could be listed.
+func (e *ErasureFileStore) names(dpath string) ([]string, []bool, error) {
+	reachable := make([]bool, len(e.stores))
+	seen := make(map[string]bool)
+	var names []string
+
+	var firstErr error
+	for i, store := range e.stores {
+		infos, err := store.GetFiles(dpath)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		reachable[i] = true
+		for _, info := range infos {
+			if info != nil && !seen[info.Name()] {
+				seen[info.Name()] = true
+				names = append(names, info.Name())
+			}
+		}
+	}
+
+	for _, r := range reachable {
+		if r {
+			return names, reachable, nil
+		}
+	}
+
+	return nil, nil, firstErr
+}
+
+// GetFiles lists the files in dpath. Files that no longer have enough shards
+// to be read are left out.
+func (e *ErasureFileStore) GetFiles(dpath string) ([]os.FileInfo, error) {
+	names, _, err := e.names(dpath)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []os.FileInfo{}
+	for _, name := range names {
+		info, err := e.Stat(childPath(dpath, name))
+		if err != nil {
+			continue
+		}
+
+		ret = append(ret, info)
+	}
+
+	return ret, nil
+}
+
+// leftover reports whether fpath only exists on backends that are down,
+// which happens when it was removed while they were unreachable.
+func (e *ErasureFileStore) leftover(fpath string) bool {
+	found := false
+	for i, store := range e.stores {
+		if _, err := store.Stat(fpath); err != nil {
+			continue
+		}
+
+		if !e.isDown(i) {
+			return false
+		}
+		found = true
+	}
+
+	return found
+}
+
+func (e *ErasureFileStore) removeLeftover(fpath string, r *repair) {
+	for i, store := range e.stores {
+		if _, err := store.Stat(fpath); err != nil {
+			continue
+		}
+
+		if err := store.Remove(fpath); err != nil {
+			r.fail(i, err)
+		}
+	}
+}
+
+// Repair rebuilds the shards of the files in the tree at dpath that are
+// missing, corrupt or out of date on any backend. Backends are marked as up
+// once the whole tree could be repaired on them. Files that don't have enough
+// shards left to be rebuilt are reported in the returned error, unless only
+// backends that were down still have them, in which case they are leftovers
+// of a Remove and are deleted. The same goes for directories.
+func (e *ErasureFileStore) Repair(dpath string) error {
+	r := newRepair(len(e.stores))
+	e.repairDir(dpath, r)
+
+	return r.finish(e.health)
+}
+
+func (e *ErasureFileStore) repairDir(dpath string, r *repair) {
+	names, reachable, err := e.names(dpath)
+	if err != nil {
+		r.failAll(err)
+		return
+	}
+
+	for i, store := range e.stores {
+		if !reachable[i] {
+			if err := store.Mkdir(dpath); err != nil {
+				r.fail(i, err)
+			}
+		}
+	}
+
+	for _, name := range names {
+		fpath := childPath(dpath, name)
+
+		d, err := e.decode(fpath)
+		if err != nil {
+			if e.leftover(fpath) {
+				e.removeLeftover(fpath, r)
+				continue
+			}
+
+			r.note(err)
+			continue
+		}
+
+		for i := range e.stores {
+			if d.current[i] || r.failed[i] {
+				continue
+			}
+
+			if err := e.writeShard(i, fpath, d.version, int64(len(d.data)), d.shards[i]); err != nil {
+				r.fail(i, err)
+			}
+		}
+	}
+
+	// Every backend has its own idea of what directories there are, and
+	// the ones only backends that are down have were removed.
+	have := make(map[string][]int)
+	var dirs []string
+	for i, store := range e.stores {
+		if !reachable[i] {
+			continue
+		}
+
+		names, err := subdirs(store, dpath)
+		if err != nil {
+			r.fail(i, err)
+			continue
+		}
+
+		for _, name := range names {
+			if have[name] == nil {
+				dirs = append(dirs, name)
+			}
+			have[name] = append(have[name], i)
+		}
+	}
+
+	for _, name := range dirs {
+		dir := childPath(dpath, name)
+
+		leftover := true
+		for _, i := range have[name] {
+			if !e.isDown(i) {
+				leftover = false
+			}
+		}
+
+		if !leftover {
+			e.repairDir(dir, r)
+			continue
+		}
+
+		for _, i := range have[name] {
+			if err := removeTree(e.stores[i], dir); err != nil {
+				r.fail(i, err)
+			}
+		}
+	}
+}
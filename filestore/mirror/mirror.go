@@ -0,0 +1,606 @@
+// Package mirror provides FileStores that spread files over several backing
+// stores, so that losing one of them doesn't lose any data.
+//
+// FileStore keeps a full copy of every file on each backend. ErasureFileStore
+// instead splits each file into shards with Reed-Solomon coding, which needs
+// much less space for the same number of backends that can be lost, at the
+// cost of having to read from several backends for every file.
+//
+// A backend that fails a write is marked as down and is only read from as a
+// last resort, since it may be missing files. Once it is reachable again,
+// Repair copies over whatever it missed and marks it as up. Repair finds
+// subdirectories with ReadDir, so backends should implement fs.DirFileStore.
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/shaladdle/goaaw/filestore"
+)
+
+// ErrNoQuorum is returned when an operation succeeded on too few backends.
+var ErrNoQuorum = errors.New("mirror: too few backends succeeded")
+
+// childPath joins a directory and the name of a file in it. The result is
+// kept relative, since some stores reject absolute paths other than "/".
+func childPath(dpath, name string) string {
+	return strings.TrimPrefix(path.Join(dpath, name), "/")
+}
+
+// health tracks which backends are known to be up to date.
+type health struct {
+	lock sync.Mutex
+	down []bool
+}
+
+func newHealth(n int) *health {
+	return &health{down: make([]bool, n)}
+}
+
+func (h *health) setDown(i int, down bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.down[i] = down
+}
+
+func (h *health) isDown(i int) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.down[i]
+}
+
+// order returns the indexes of the backends with the healthy ones first.
+func (h *health) order() []int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var up, down []int
+	for i, d := range h.down {
+		if d {
+			down = append(down, i)
+		} else {
+			up = append(up, i)
+		}
+	}
+
+	return append(up, down...)
+}
+
+// Down returns the indexes of the backends that are currently marked as down.
+func (h *health) Down() []int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var ret []int
+	for i, d := range h.down {
+		if d {
+			ret = append(ret, i)
+		}
+	}
+
+	return ret
+}
+
+func noQuorum(ok, total int, err error) error {
+	return fmt.Errorf("%w (%v of %v): %v", ErrNoQuorum, ok, total, err)
+}
+
+// aborter is implemented by writers that can throw away what has been
+// written to them instead of committing it, like the ones returned by
+// std.FileSystem and remote.Client.
+type aborter interface {
+	Abort() error
+}
+
+// abort throws away what was written to w, or just closes it if it can't.
+func abort(w io.WriteCloser) error {
+	if a, ok := w.(aborter); ok {
+		return a.Abort()
+	}
+
+	return w.Close()
+}
+
+var errNoReadDir = errors.New("mirror: backend can't list directories")
+
+// subdirs returns the names of the directories in dpath on store.
+func subdirs(store fs.FileStore, dpath string) ([]string, error) {
+	ds, ok := store.(fs.DirFileStore)
+	if !ok {
+		return nil, errNoReadDir
+	}
+
+	infos, err := ds.ReadDir(dpath)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []string
+	for _, info := range infos {
+		if info != nil && info.IsDir() {
+			ret = append(ret, info.Name())
+		}
+	}
+
+	return ret, nil
+}
+
+// removeTree removes dpath and everything below it from store.
+func removeTree(store fs.FileStore, dpath string) error {
+	dirs, err := subdirs(store, dpath)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range dirs {
+		if err := removeTree(store, childPath(dpath, name)); err != nil {
+			return err
+		}
+	}
+
+	infos, err := store.GetFiles(dpath)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if err := store.Remove(childPath(dpath, info.Name())); err != nil {
+			return err
+		}
+	}
+
+	return store.Remove(dpath)
+}
+
+// repair collects what went wrong while repairing a tree. A backend is only
+// marked as up if nothing failed on it anywhere in the tree.
+type repair struct {
+	failed []bool
+	err    error
+}
+
+func newRepair(n int) *repair {
+	return &repair{failed: make([]bool, n)}
+}
+
+// fail records that backend i couldn't be repaired.
+func (r *repair) fail(i int, err error) {
+	r.failed[i] = true
+	r.note(err)
+}
+
+// failAll records that no backend could be repaired.
+func (r *repair) failAll(err error) {
+	for i := range r.failed {
+		r.fail(i, err)
+	}
+}
+
+// note records an error that isn't the fault of any one backend.
+func (r *repair) note(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// finish marks the backends that were repaired as up.
+func (r *repair) finish(h *health) error {
+	for i, failed := range r.failed {
+		if !failed {
+			h.setDown(i, false)
+		}
+	}
+
+	return r.err
+}
+
+// Options controls the behavior of a FileStore.
+type Options struct {
+	// Quorum is the number of backends a write has to succeed on. Defaults
+	// to a majority of the backends.
+	Quorum int
+}
+
+// FileStore writes every file to all of its backends and reads from the
+// first healthy one that has it.
+type FileStore struct {
+	*health
+
+	stores []fs.FileStore
+	quorum int
+}
+
+// New returns a FileStore that mirrors files across stores.
+func New(stores []fs.FileStore, opts Options) (*FileStore, error) {
+	if len(stores) == 0 {
+		return nil, errors.New("mirror: no backends")
+	}
+
+	if opts.Quorum <= 0 {
+		opts.Quorum = len(stores)/2 + 1
+	}
+
+	if opts.Quorum > len(stores) {
+		return nil, fmt.Errorf("mirror: quorum of %v is more than the %v backends", opts.Quorum, len(stores))
+	}
+
+	return &FileStore{newHealth(len(stores)), stores, opts.Quorum}, nil
+}
+
+// read calls f on each backend, healthy ones first, until it succeeds. A
+// healthy backend has every change, so if it says a file doesn't exist, that
+// is the answer. Backends that are down might still have a file that was
+// removed since, so they are only tried when the healthy ones fail some other
+// way.
+func (m *FileStore) read(f func(fs.FileStore) error) error {
+	var firstErr error
+	for _, i := range m.order() {
+		err := f(m.stores[i])
+		if err == nil {
+			return nil
+		}
+
+		if errors.Is(err, fs.ErrNotExist) && !m.isDown(i) {
+			return err
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// write calls f on every backend, marking the ones it fails on as down.
+func (m *FileStore) write(f func(fs.FileStore) error) error {
+	ok := 0
+	var firstErr error
+	for i, store := range m.stores {
+		if err := f(store); err != nil {
+			m.setDown(i, true)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		ok++
+	}
+
+	if ok < m.quorum {
+		return noQuorum(ok, len(m.stores), firstErr)
+	}
+
+	return nil
+}
+
+func (m *FileStore) Open(fpath string) (io.ReadCloser, error) {
+	var ret io.ReadCloser
+	err := m.read(func(store fs.FileStore) (err error) {
+		ret, err = store.Open(fpath)
+		return
+	})
+
+	return ret, err
+}
+
+func (m *FileStore) Create(fpath string) (io.WriteCloser, error) {
+	w := &writer{m: m}
+
+	var firstErr error
+	for i, store := range m.stores {
+		f, err := store.Create(fpath)
+		if err != nil {
+			m.setDown(i, true)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		w.ws = append(w.ws, f)
+		w.idx = append(w.idx, i)
+	}
+
+	if len(w.ws) < m.quorum {
+		w.Abort()
+		return nil, noQuorum(len(w.ws), len(m.stores), firstErr)
+	}
+
+	return w, nil
+}
+
+// writer writes to every backend that hasn't failed yet.
+type writer struct {
+	m   *FileStore
+	ws  []io.WriteCloser
+	idx []int
+	err error
+}
+
+// drop stops writing to the i'th writer and marks its backend as down.
+func (w *writer) drop(i int, err error) {
+	abort(w.ws[i])
+	w.m.setDown(w.idx[i], true)
+
+	if w.err == nil {
+		w.err = err
+	}
+
+	w.ws = append(w.ws[:i], w.ws[i+1:]...)
+	w.idx = append(w.idx[:i], w.idx[i+1:]...)
+}
+
+func (w *writer) Write(b []byte) (int, error) {
+	for i := 0; i < len(w.ws); {
+		if _, err := w.ws[i].Write(b); err != nil {
+			w.drop(i, err)
+			continue
+		}
+		i++
+	}
+
+	if len(w.ws) < w.m.quorum {
+		return 0, noQuorum(len(w.ws), len(w.m.stores), w.err)
+	}
+
+	return len(b), nil
+}
+
+func (w *writer) Close() error {
+	ok := 0
+	for i, f := range w.ws {
+		if err := f.Close(); err != nil {
+			w.m.setDown(w.idx[i], true)
+			if w.err == nil {
+				w.err = err
+			}
+			continue
+		}
+
+		ok++
+	}
+
+	if ok < w.m.quorum {
+		return noQuorum(ok, len(w.m.stores), w.err)
+	}
+
+	return nil
+}
+
+// Abort throws away what was written on every backend, where they support it.
+func (w *writer) Abort() error {
+	var firstErr error
+	for _, f := range w.ws {
+		if err := abort(f); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+func (m *FileStore) Mkdir(dpath string) error {
+	return m.write(func(store fs.FileStore) error {
+		return store.Mkdir(dpath)
+	})
+}
+
+func (m *FileStore) Stat(fpath string) (os.FileInfo, error) {
+	var ret os.FileInfo
+	err := m.read(func(store fs.FileStore) (err error) {
+		ret, err = store.Stat(fpath)
+		return
+	})
+
+	return ret, err
+}
+
+func (m *FileStore) Remove(fpath string) error {
+	var firstErr error
+	removed := false
+
+	err := m.write(func(store fs.FileStore) error {
+		err := store.Remove(fpath)
+		if err == nil {
+			removed = true
+			return nil
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+
+		// A backend that never had the file is as good as one that
+		// removed it.
+		if _, serr := store.Stat(fpath); serr != nil {
+			return nil
+		}
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if !removed {
+		return firstErr
+	}
+
+	return nil
+}
+
+func (m *FileStore) GetFiles(dpath string) ([]os.FileInfo, error) {
+	var ret []os.FileInfo
+	err := m.read(func(store fs.FileStore) (err error) {
+		ret, err = store.GetFiles(dpath)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	infos := []os.FileInfo{}
+	for _, info := range ret {
+		if info != nil {
+			infos = append(infos, info)
+		}
+	}
+
+	return infos, nil
+}
+
+// Repair brings the tree at dpath back in sync on every backend. Files
+// missing from a backend, or that changed while it was down, are copied from
+// a healthy backend, and files and directories that were removed while it was
+// down are removed from it. Backends are marked as up once the whole tree
+// could be repaired on them.
+func (m *FileStore) Repair(dpath string) error {
+	r := newRepair(len(m.stores))
+	m.repairDir(dpath, r)
+
+	return r.finish(m.health)
+}
+
+func (m *FileStore) repairDir(dpath string, r *repair) {
+	listings := make([]map[string]os.FileInfo, len(m.stores))
+	reachable := make([]bool, len(m.stores))
+
+	for i, store := range m.stores {
+		infos, err := store.GetFiles(dpath)
+		if err != nil {
+			continue
+		}
+
+		reachable[i] = true
+		listings[i] = make(map[string]os.FileInfo)
+		for _, info := range infos {
+			if info != nil {
+				listings[i][info.Name()] = info
+			}
+		}
+	}
+
+	// The healthy backends that were reached define what the directory
+	// should contain.
+	src := -1
+	for _, i := range m.order() {
+		if reachable[i] && !m.isDown(i) {
+			src = i
+			break
+		}
+	}
+	if src < 0 {
+		r.failAll(fmt.Errorf("mirror: no healthy backend to repair %v from", dpath))
+		return
+	}
+
+	for i, store := range m.stores {
+		if !reachable[i] {
+			if err := store.Mkdir(dpath); err != nil {
+				r.fail(i, err)
+				continue
+			}
+			reachable[i] = true
+			listings[i] = make(map[string]os.FileInfo)
+		}
+
+		if i == src {
+			continue
+		}
+
+		for name, want := range listings[src] {
+			got, ok := listings[i][name]
+			if ok && got.Size() == want.Size() && (!m.isDown(i) || !got.ModTime().Before(want.ModTime())) {
+				continue
+			}
+
+			if err := copyFile(m.stores[src], store, childPath(dpath, name)); err != nil {
+				r.fail(i, err)
+			}
+		}
+
+		if !m.isDown(i) {
+			continue
+		}
+
+		for name := range listings[i] {
+			if _, ok := listings[src][name]; ok {
+				continue
+			}
+
+			if err := store.Remove(childPath(dpath, name)); err != nil {
+				r.fail(i, err)
+			}
+		}
+	}
+
+	dirs, err := subdirs(m.stores[src], dpath)
+	if err != nil {
+		// Without knowing what is below dpath, none of the backends
+		// that are down can be known to be repaired.
+		for i := range m.stores {
+			if m.isDown(i) {
+				r.fail(i, err)
+			}
+		}
+		return
+	}
+
+	want := make(map[string]bool)
+	for _, name := range dirs {
+		want[name] = true
+		m.repairDir(childPath(dpath, name), r)
+	}
+
+	for i, store := range m.stores {
+		if i == src || !m.isDown(i) || r.failed[i] {
+			continue
+		}
+
+		have, err := subdirs(store, dpath)
+		if err != nil {
+			r.fail(i, err)
+			continue
+		}
+
+		for _, name := range have {
+			if want[name] {
+				continue
+			}
+
+			if err := removeTree(store, childPath(dpath, name)); err != nil {
+				r.fail(i, err)
+			}
+		}
+	}
+}
+
+func copyFile(from, to fs.FileStore, fpath string) error {
+	r, err := from.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := to.Create(fpath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		abort(w)
+		return err
+	}
+
+	return w.Close()
+}
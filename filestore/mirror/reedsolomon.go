@@ -0,0 +1,232 @@
+package mirror
+
+import (
+	"errors"
+)
+
+// This file implements Reed-Solomon erasure coding over GF(2^8). The encoding
+// matrix is systematic: the first rows are the identity, so data shards are
+// stored as they are and only the parity shards need computing. Any k rows
+// of the matrix, where k is the number of data shards, form an invertible
+// matrix, so any k shards are enough to rebuild the rest.
+
+var errTooFewShards = errors.New("mirror: too few shards to reconstruct")
+
+var (
+	gfExp [512]byte
+	gfLog [256]byte
+)
+
+func init() {
+	// Generator 2 with the primitive polynomial x^8+x^4+x^3+x^2+1.
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+func gfPow(a byte, n int) byte {
+	ret := byte(1)
+	for i := 0; i < n; i++ {
+		ret = gfMul(ret, a)
+	}
+
+	return ret
+}
+
+type matrix [][]byte
+
+func newMatrix(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for i := range m {
+		m[i] = make([]byte, cols)
+	}
+
+	return m
+}
+
+func (m matrix) mul(o matrix) matrix {
+	ret := newMatrix(len(m), len(o[0]))
+	for r := range ret {
+		for c := range ret[r] {
+			var v byte
+			for i := range o {
+				v ^= gfMul(m[r][i], o[i][c])
+			}
+			ret[r][c] = v
+		}
+	}
+
+	return ret
+}
+
+// invert returns the inverse of a square matrix using Gauss-Jordan
+// elimination.
+func (m matrix) invert() (matrix, error) {
+	n := len(m)
+
+	work := newMatrix(n, 2*n)
+	for r := range m {
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+
+	for c := 0; c < n; c++ {
+		pivot := -1
+		for r := c; r < n; r++ {
+			if work[r][c] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errors.New("mirror: matrix is singular")
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+
+		scale := gfInv(work[c][c])
+		for i := range work[c] {
+			work[c][i] = gfMul(work[c][i], scale)
+		}
+
+		for r := 0; r < n; r++ {
+			if r == c || work[r][c] == 0 {
+				continue
+			}
+
+			f := work[r][c]
+			for i := range work[r] {
+				work[r][i] ^= gfMul(f, work[c][i])
+			}
+		}
+	}
+
+	ret := newMatrix(n, n)
+	for r := range ret {
+		copy(ret[r], work[r][n:])
+	}
+
+	return ret, nil
+}
+
+type reedSolomon struct {
+	data, parity int
+	enc          matrix
+}
+
+func newReedSolomon(data, parity int) (*reedSolomon, error) {
+	if data <= 0 || parity < 0 || data+parity > 256 {
+		return nil, errors.New("mirror: invalid number of shards")
+	}
+
+	vm := newMatrix(data+parity, data)
+	for r := range vm {
+		for c := range vm[r] {
+			vm[r][c] = gfPow(byte(r), c)
+		}
+	}
+
+	top, err := matrix(vm[:data]).invert()
+	if err != nil {
+		return nil, err
+	}
+
+	return &reedSolomon{data, parity, vm.mul(top)}, nil
+}
+
+// mulRow sets out to the combination of the shards given by coeffs.
+func mulRow(coeffs []byte, shards [][]byte, out []byte) {
+	for i := range out {
+		out[i] = 0
+	}
+
+	for i, c := range coeffs {
+		if c == 0 {
+			continue
+		}
+
+		for j, b := range shards[i] {
+			out[j] ^= gfMul(c, b)
+		}
+	}
+}
+
+// encode fills in the parity shards from the data shards. All shards must
+// have the same length.
+func (rs *reedSolomon) encode(shards [][]byte) {
+	for i := rs.data; i < len(shards); i++ {
+		mulRow(rs.enc[i], shards[:rs.data], shards[i])
+	}
+}
+
+// reconstruct rebuilds the shards that are nil from any rs.data of the
+// others. Rebuilt shards are newly allocated.
+func (rs *reedSolomon) reconstruct(shards [][]byte) error {
+	var rows []int
+	size := 0
+	for i, s := range shards {
+		if s != nil && len(rows) < rs.data {
+			rows = append(rows, i)
+			size = len(s)
+		}
+	}
+
+	if len(rows) < rs.data {
+		return errTooFewShards
+	}
+
+	sub := newMatrix(rs.data, rs.data)
+	have := make([][]byte, rs.data)
+	for i, r := range rows {
+		copy(sub[i], rs.enc[r])
+		have[i] = shards[r]
+	}
+
+	dec, err := sub.invert()
+	if err != nil {
+		return err
+	}
+
+	data := make([][]byte, rs.data)
+	for i := range data {
+		if shards[i] != nil {
+			data[i] = shards[i]
+			continue
+		}
+
+		data[i] = make([]byte, size)
+		mulRow(dec[i], have, data[i])
+		shards[i] = data[i]
+	}
+
+	for i := rs.data; i < len(shards); i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+			mulRow(rs.enc[i], data, shards[i])
+		}
+	}
+
+	return nil
+}
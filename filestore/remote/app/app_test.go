@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shaladdle/goaaw/filestore/remote"
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func writeLocal(t *testing.T, fpath, contents string) {
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fpath, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCopyMirror copies a local tree to a server and back, then changes it
+// and checks that mirror only sends what changed.
+func TestCopyMirror(t *testing.T) {
+	te := testutil.NewTestEnv("testcase-cli", t)
+	defer te.Teardown()
+
+	for _, d := range []string{"server", "local", "back"} {
+		if err := os.Mkdir(te.PathFor(d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cli, srv, err := remote.NewPipeCliSrv(te.PathFor("server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	client = cli
+	defer func() { client = nil }()
+
+	writeLocal(t, te.PathFor("local/tree/a"), "a")
+	writeLocal(t, te.PathFor("local/tree/sub/b"), "b")
+	writeLocal(t, te.PathFor("local/tree/sub/c"), "c")
+
+	if err := runCp([]string{"-r", te.PathFor("local/tree"), ":"}); err != nil {
+		t.Fatalf("cp -r to server: %v", err)
+	}
+	if err := runCp([]string{"-r", ":tree", te.PathFor("back")}); err != nil {
+		t.Fatalf("cp -r from server: %v", err)
+	}
+	for _, f := range []string{"a", "sub/b", "sub/c"} {
+		got, err := ioutil.ReadFile(te.PathFor("back/tree/" + f))
+		if err != nil || string(got) != filepath.Base(f) {
+			t.Errorf("copied back %v got %q, %v", f, got, err)
+		}
+	}
+
+	if err := runCp([]string{te.PathFor("local/tree"), ":copy"}); err == nil {
+		t.Errorf("cp of a directory without -r succeeded")
+	}
+
+	size, err := diskUsage(cli, "tree", nil)
+	if err != nil || size != 3 {
+		t.Errorf("du got %v, %v, want 3", size, err)
+	}
+
+	writeLocal(t, te.PathFor("local/tree/a"), "changed")
+	writeLocal(t, te.PathFor("local/tree/new/d"), "d")
+	os.Remove(te.PathFor("local/tree/sub/c"))
+
+	src, _ := parseLocation(te.PathFor("local/tree"))
+	dst, _ := parseLocation(":tree")
+
+	var out bytes.Buffer
+	m := &mirrorer{out: &out}
+	if err := m.mirror(src, dst); err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+
+	want := "+ :tree/a\n+ :tree/new/\n+ :tree/new/d\n- :tree/sub/c\n"
+	if out.String() != want {
+		t.Errorf("mirror did\n%v\nwant\n%v", out.String(), want)
+	}
+	if _, err := cli.Stat("tree/sub/c"); err == nil {
+		t.Errorf("mirror didn't remove tree/sub/c")
+	}
+
+	// Everything is up to date now, so mirroring again does nothing.
+	out.Reset()
+	if err := m.mirror(src, dst); err != nil {
+		t.Fatalf("second mirror: %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("second mirror did\n%v", out.String())
+	}
+
+	if err := removeTree(cli, "tree"); err != nil {
+		t.Fatalf("rm -r: %v", err)
+	}
+	if _, err := cli.Stat("tree"); err == nil {
+		t.Errorf("tree still exists after rm -r")
+	}
+}
+
+// failingReader returns some data and then an error.
+type failingReader struct {
+	data []byte
+}
+
+func (f *failingReader) Read(b []byte) (int, error) {
+	if len(f.data) == 0 {
+		return 0, errors.New("read failed")
+	}
+	n := copy(b, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+func (f *failingReader) Close() error {
+	return nil
+}
+
+// TestCopyStreamAbort checks that a copy to the server that fails part way
+// doesn't leave a partial file behind.
+func TestCopyStreamAbort(t *testing.T) {
+	te := testutil.NewTestEnv("testcase-cli-abort", t)
+	defer te.Teardown()
+
+	cli, srv, err := remote.NewPipeCliSrv(te.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	w, err := cli.Create("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := copyStream(w, &failingReader{[]byte("partial")}); err == nil {
+		t.Fatalf("copy from a failing reader succeeded")
+	}
+
+	if got, err := ioutil.ReadFile(te.PathFor("file")); err == nil {
+		t.Errorf("failed copy left a file with %q", got)
+	}
+}
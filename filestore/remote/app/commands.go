@@ -0,0 +1,387 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/shaladdle/goaaw/rpc"
+)
+
+// remotePath cleans a path given on the command line for a command that only
+// works on the server. The leading ':' used by cp and mirror is allowed but
+// not required.
+func remotePath(arg string) string {
+	return path.Clean(strings.TrimPrefix(arg, ":"))
+}
+
+// sortInfos sorts directory entries by name.
+func sortInfos(infos []os.FileInfo) {
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+}
+
+func runLs(args []string) error {
+	fset := newFlagSet("ls")
+	long := fset.Bool("l", false, "show mode, size and modification time")
+	if err := parseFlags(fset, args); err != nil {
+		return err
+	}
+
+	paths := fset.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	cli, err := connect()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	defer tw.Flush()
+
+	for i, arg := range paths {
+		p := remotePath(arg)
+
+		info, err := cli.Stat(p)
+		if err != nil {
+			return err
+		}
+
+		infos := []os.FileInfo{info}
+		if info.IsDir() {
+			if infos, err = cli.ReadDir(p); err != nil {
+				return err
+			}
+			sortInfos(infos)
+
+			if len(paths) > 1 {
+				if i > 0 {
+					fmt.Fprintln(tw)
+				}
+				fmt.Fprintf(tw, "%v:\n", arg)
+			}
+		}
+
+		for _, info := range infos {
+			name := info.Name()
+			if info.IsDir() {
+				name += "/"
+			}
+
+			if *long {
+				fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", info.Mode(), info.Size(), info.ModTime().Format(time.Stamp), name)
+			} else {
+				fmt.Fprintln(tw, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+func runStat(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	cli, err := connect()
+	if err != nil {
+		return err
+	}
+
+	for _, arg := range args {
+		p := remotePath(arg)
+
+		info, err := cli.Stat(p)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("path:     %v\n", p)
+		fmt.Printf("size:     %v\n", info.Size())
+		fmt.Printf("mode:     %v\n", info.Mode())
+		fmt.Printf("modified: %v\n", info.ModTime().Format(time.RFC3339))
+
+		if info.Mode().IsRegular() {
+			sum, err := cli.Hash(p)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("sha256:   %x\n", sum)
+		}
+	}
+
+	return nil
+}
+
+// copyStream copies r to w and closes both, reporting the first error. The
+// error from closing w matters, since that's when remote writes are
+// acknowledged. If the copy fails, w is aborted instead, so that a partial
+// file doesn't replace the destination.
+func copyStream(w io.WriteCloser, r io.ReadCloser) error {
+	_, err := io.Copy(w, r)
+	r.Close()
+
+	if err != nil {
+		if a, ok := w.(rpc.Aborter); ok {
+			a.Abort()
+		} else {
+			w.Close()
+		}
+		return err
+	}
+
+	return w.Close()
+}
+
+// nopWriteCloser lets stdout be used as the destination of get without
+// closing it.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func runGet(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+
+	src := remotePath(args[0])
+	dst := path.Base(src)
+	if len(args) == 2 {
+		dst = args[1]
+	}
+
+	cli, err := connect()
+	if err != nil {
+		return err
+	}
+
+	r, err := cli.Open(src)
+	if err != nil {
+		return err
+	}
+
+	var w io.WriteCloser = nopWriteCloser{os.Stdout}
+	if dst != "-" {
+		if w, err = os.Create(dst); err != nil {
+			r.Close()
+			return err
+		}
+	}
+
+	if err := copyStream(w, r); err != nil {
+		if dst != "-" {
+			os.Remove(dst)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func runPut(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+
+	src := args[0]
+	dst := path.Base(src)
+	if len(args) == 2 {
+		dst = remotePath(args[1])
+	} else if src == "-" {
+		return errUsage
+	}
+
+	var r io.ReadCloser = os.Stdin
+	if src != "-" {
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		r = f
+	}
+
+	cli, err := connect()
+	if err != nil {
+		r.Close()
+		return err
+	}
+
+	w, err := cli.Create(dst)
+	if err != nil {
+		r.Close()
+		return err
+	}
+
+	return copyStream(w, r)
+}
+
+func runRm(args []string) error {
+	fset := newFlagSet("rm")
+	recursive := fset.Bool("r", false, "remove directories and their contents")
+	if err := parseFlags(fset, args); err != nil {
+		return err
+	}
+	if fset.NArg() == 0 {
+		return errUsage
+	}
+
+	cli, err := connect()
+	if err != nil {
+		return err
+	}
+
+	for _, arg := range fset.Args() {
+		p := remotePath(arg)
+
+		if *recursive {
+			err = removeTree(cli, p)
+		} else {
+			err = cli.Remove(p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func runMkdir(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	cli, err := connect()
+	if err != nil {
+		return err
+	}
+
+	for _, arg := range args {
+		if err := cli.Mkdir(remotePath(arg)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func runDu(args []string) error {
+	fset := newFlagSet("du")
+	var (
+		summary = fset.Bool("s", false, "only show the total for each argument")
+		human   = fset.Bool("h", false, "show sizes in KB, MB and so on")
+	)
+	if err := parseFlags(fset, args); err != nil {
+		return err
+	}
+
+	paths := fset.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	cli, err := connect()
+	if err != nil {
+		return err
+	}
+
+	show := func(p string, size int64) {
+		if *human {
+			fmt.Printf("%v\t%v\n", humanSize(size), p)
+		} else {
+			fmt.Printf("%v\t%v\n", size, p)
+		}
+	}
+
+	for _, arg := range paths {
+		p := remotePath(arg)
+
+		var visit func(dpath string, size int64)
+		if !*summary {
+			visit = show
+		}
+
+		total, err := diskUsage(cli, p, visit)
+		if err != nil {
+			return err
+		}
+
+		if *summary {
+			show(p, total)
+		}
+	}
+
+	return nil
+}
+
+// diskUsage returns the total size of the files under p. If visit isn't nil,
+// it is called with the total for p and for every directory under it, deepest
+// first.
+func diskUsage(store dirStore, p string, visit func(dpath string, size int64)) (int64, error) {
+	info, err := store.Stat(p)
+	if err != nil {
+		return 0, err
+	}
+
+	if !info.IsDir() {
+		if visit != nil {
+			visit(p, info.Size())
+		}
+		return info.Size(), nil
+	}
+
+	infos, err := store.ReadDir(p)
+	if err != nil {
+		return 0, err
+	}
+	sortInfos(infos)
+
+	var total int64
+	for _, info := range infos {
+		if !info.IsDir() {
+			total += info.Size()
+			continue
+		}
+
+		size, err := diskUsage(store, path.Join(p, info.Name()), visit)
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+
+	if visit != nil {
+		visit(p, total)
+	}
+
+	return total, nil
+}
+
+func humanSize(n int64) string {
+	const units = "KMGTPE"
+
+	if n < 1024 {
+		return fmt.Sprintf("%vB", n)
+	}
+
+	size, i := float64(n)/1024, 0
+	for size >= 1024 && i < len(units)-1 {
+		size /= 1024
+		i++
+	}
+
+	return fmt.Sprintf("%.1f%c", size, units[i])
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/shaladdle/goaaw/filestore"
+	"github.com/shaladdle/goaaw/filestore/std"
+)
+
+// dirStore is a FileStore that can list directories, which cp -r, mirror and
+// du need to walk a tree. Both std.FileSystem and remote.Client are
+// dirStores.
+type dirStore interface {
+	fs.FileStore
+	ReadDir(dpath string) ([]os.FileInfo, error)
+}
+
+// location is a file or directory given to cp or mirror, either on the
+// server or on the local machine.
+type location struct {
+	store  dirStore
+	path   string
+	remote bool
+}
+
+// parseLocation interprets an argument to cp or mirror. Paths starting with
+// ':' are on the server, and anything else is a local path.
+func parseLocation(arg string) (location, error) {
+	if strings.HasPrefix(arg, ":") {
+		cli, err := connect()
+		if err != nil {
+			return location{}, err
+		}
+
+		return location{cli, remotePath(arg), true}, nil
+	}
+
+	abs, err := filepath.Abs(arg)
+	if err != nil {
+		return location{}, err
+	}
+
+	// std.FileSystem only accepts paths relative to its root, so local
+	// paths are made absolute and served from "/".
+	return location{std.New("/"), strings.TrimPrefix(filepath.ToSlash(abs), "/"), false}, nil
+}
+
+func (l location) join(name string) location {
+	l.path = path.Join(l.path, name)
+	return l
+}
+
+func (l location) String() string {
+	if l.remote {
+		return ":" + l.path
+	}
+
+	return "/" + l.path
+}
+
+// copyFile copies a single file from src to dst.
+func copyFile(src, dst location) error {
+	r, err := src.store.Open(src.path)
+	if err != nil {
+		return err
+	}
+
+	w, err := dst.store.Create(dst.path)
+	if err != nil {
+		r.Close()
+		return err
+	}
+
+	if err := copyStream(w, r); err != nil {
+		return fmt.Errorf("copying %v to %v: %v", src, dst, err)
+	}
+
+	return nil
+}
+
+// copyTree copies src to dst, along with everything under it if it is a
+// directory.
+func copyTree(src, dst location) error {
+	info, err := src.store.Stat(src.path)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return copyFile(src, dst)
+	}
+
+	if err := dst.store.Mkdir(dst.path); err != nil {
+		return err
+	}
+
+	infos, err := src.store.ReadDir(src.path)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if err := copyTree(src.join(info.Name()), dst.join(info.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeTree removes p from store, along with everything under it if it is a
+// directory.
+func removeTree(store dirStore, p string) error {
+	info, err := store.Stat(p)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		infos, err := store.ReadDir(p)
+		if err != nil {
+			return err
+		}
+
+		for _, info := range infos {
+			if err := removeTree(store, path.Join(p, info.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return store.Remove(p)
+}
+
+func runCp(args []string) error {
+	fset := newFlagSet("cp")
+	recursive := fset.Bool("r", false, "copy directories and their contents")
+	if err := parseFlags(fset, args); err != nil {
+		return err
+	}
+	if fset.NArg() != 2 {
+		return errUsage
+	}
+
+	src, err := parseLocation(fset.Arg(0))
+	if err != nil {
+		return err
+	}
+	dst, err := parseLocation(fset.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	info, err := src.store.Stat(src.path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() && !*recursive {
+		return fmt.Errorf("%v is a directory (use cp -r)", src)
+	}
+
+	// Like cp, copying into an existing directory puts the copy inside it.
+	if dinfo, err := dst.store.Stat(dst.path); err == nil && dinfo.IsDir() {
+		dst = dst.join(path.Base(src.path))
+	}
+
+	return copyTree(src, dst)
+}
+
+// mirrorer makes one tree match another, copying only the files that differ.
+type mirrorer struct {
+	dryRun bool
+	out    io.Writer
+}
+
+// mirror makes dst an exact copy of src. Files that are already the same on
+// both sides are left alone, and anything in dst that isn't in src is
+// removed.
+func (m *mirrorer) mirror(src, dst location) error {
+	sinfo, err := src.store.Stat(src.path)
+	if err != nil {
+		return err
+	}
+
+	// A failed Stat is taken to mean dst doesn't exist yet; if it's
+	// something worse, creating it will fail too.
+	dinfo, err := dst.store.Stat(dst.path)
+	if err != nil {
+		dinfo = nil
+	}
+
+	return m.sync(src, dst, sinfo, dinfo)
+}
+
+// sync brings dst up to date with src, given their infos. dinfo is nil if
+// dst doesn't exist.
+func (m *mirrorer) sync(src, dst location, sinfo, dinfo os.FileInfo) error {
+	if dinfo != nil && dinfo.IsDir() != sinfo.IsDir() {
+		if err := m.remove(dst); err != nil {
+			return err
+		}
+		dinfo = nil
+	}
+
+	if !sinfo.IsDir() {
+		if dinfo != nil {
+			if same, err := sameFile(src, dst, sinfo, dinfo); err != nil || same {
+				return err
+			}
+		}
+
+		fmt.Fprintf(m.out, "+ %v\n", dst)
+		if m.dryRun {
+			return nil
+		}
+
+		return copyFile(src, dst)
+	}
+
+	dinfos := make(map[string]os.FileInfo)
+	if dinfo == nil {
+		fmt.Fprintf(m.out, "+ %v/\n", dst)
+		if !m.dryRun {
+			if err := dst.store.Mkdir(dst.path); err != nil {
+				return err
+			}
+		}
+	} else {
+		infos, err := dst.store.ReadDir(dst.path)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			dinfos[info.Name()] = info
+		}
+	}
+
+	sinfos, err := src.store.ReadDir(src.path)
+	if err != nil {
+		return err
+	}
+	sortInfos(sinfos)
+
+	inSrc := make(map[string]bool)
+	for _, info := range sinfos {
+		inSrc[info.Name()] = true
+	}
+
+	for name := range dinfos {
+		if !inSrc[name] {
+			if err := m.remove(dst.join(name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, info := range sinfos {
+		name := info.Name()
+		if err := m.sync(src.join(name), dst.join(name), info, dinfos[name]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *mirrorer) remove(l location) error {
+	fmt.Fprintf(m.out, "- %v\n", l)
+	if m.dryRun {
+		return nil
+	}
+
+	return removeTree(l.store, l.path)
+}
+
+// sameFile reports whether two files have the same contents, going by their
+// sizes and hashes.
+func sameFile(src, dst location, sinfo, dinfo os.FileInfo) (bool, error) {
+	if sinfo.Size() != dinfo.Size() {
+		return false, nil
+	}
+
+	shfs, ok1 := src.store.(fs.HashFileStore)
+	dhfs, ok2 := dst.store.(fs.HashFileStore)
+	if !ok1 || !ok2 {
+		return false, nil
+	}
+
+	ssum, err := shfs.Hash(src.path)
+	if err != nil {
+		return false, err
+	}
+	dsum, err := dhfs.Hash(dst.path)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(ssum, dsum), nil
+}
+
+func runMirror(args []string) error {
+	fset := newFlagSet("mirror")
+	dryRun := fset.Bool("n", false, "only print what would be changed")
+	if err := parseFlags(fset, args); err != nil {
+		return err
+	}
+	if fset.NArg() != 2 {
+		return errUsage
+	}
+
+	src, err := parseLocation(fset.Arg(0))
+	if err != nil {
+		return err
+	}
+	dst, err := parseLocation(fset.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	if src.remote == dst.remote && src.path == dst.path {
+		return errors.New("can't mirror a tree onto itself")
+	}
+
+	m := &mirrorer{dryRun: *dryRun, out: os.Stdout}
+	return m.mirror(src, dst)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/shaladdle/goaaw/filestore/remote"
+)
+
+var (
+	addr     = flag.String("addr", "localhost:9000", "address of the server")
+	useTLS   = flag.Bool("tls", false, "connect to the server using TLS")
+	caFile   = flag.String("ca", "", "PEM file of certificates to trust for the server (implies -tls)")
+	insecure = flag.Bool("insecure", false, "don't verify the server's certificate (implies -tls)")
+)
+
+// command is a subcommand of the tool. Each one parses its own flags from
+// args.
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"ls":     {"ls [-l] [path...]", runLs},
+	"stat":   {"stat path...", runStat},
+	"get":    {"get remote [local]", runGet},
+	"put":    {"put local [remote]", runPut},
+	"rm":     {"rm [-r] path...", runRm},
+	"mkdir":  {"mkdir path...", runMkdir},
+	"cp":     {"cp [-r] src dst", runCp},
+	"mirror": {"mirror [-n] src dst", runMirror},
+	"du":     {"du [-s] [-h] [path...]", runDu},
+	"serve":  {"serve [-root dir] [-addr hostport] [-cert file -key file] [-readonly] [-quota bytes] [-atomic] [-sync]", runServe},
+}
+
+var errUsage = errors.New("bad usage")
+
+func usage() {
+	name := filepath.Base(os.Args[0])
+
+	fmt.Fprintf(os.Stderr, "usage: %v [flags] command [args]\n\n", name)
+	fmt.Fprintln(os.Stderr, "Commands:")
+
+	var names []string
+	for n := range commands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		fmt.Fprintf(os.Stderr, "  %v\n", commands[n].usage)
+	}
+
+	fmt.Fprintln(os.Stderr, "\ncp and mirror take local paths, or remote paths written with a leading ':'.")
+	fmt.Fprintln(os.Stderr, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(flag.Args()[1:]); err != nil {
+		if err == errUsage {
+			fmt.Fprintf(os.Stderr, "usage: %v\n", cmd.usage)
+			os.Exit(2)
+		}
+
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+// newFlagSet returns a flag set for a subcommand that reports bad flags
+// through errUsage.
+func newFlagSet(name string) *flag.FlagSet {
+	fset := flag.NewFlagSet(name, flag.ContinueOnError)
+	fset.Usage = func() {}
+	return fset
+}
+
+func parseFlags(fset *flag.FlagSet, args []string) error {
+	if err := fset.Parse(args); err != nil {
+		return errUsage
+	}
+
+	return nil
+}
+
+var client *remote.Client
+
+// connect returns a client for the server named by the global flags,
+// connecting the first time it is called.
+func connect() (*remote.Client, error) {
+	if client != nil {
+		return client, nil
+	}
+
+	var err error
+	if *useTLS || *caFile != "" || *insecure {
+		var config *tls.Config
+		config, err = clientTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		client, err = remote.NewTLSClient(*addr, config)
+	} else {
+		client, err = remote.NewTCPClient(*addr)
+	}
+
+	return client, err
+}
+
+func clientTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: *insecure}
+
+	if *caFile != "" {
+		pem, err := ioutil.ReadFile(*caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", *caFile)
+		}
+	}
+
+	return config, nil
+}
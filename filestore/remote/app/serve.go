@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/shaladdle/goaaw/filestore/remote"
+	"github.com/shaladdle/goaaw/filestore/std"
+)
+
+func runServe(args []string) error {
+	fset := newFlagSet("serve")
+	var (
+		root     = fset.String("root", ".", "directory to serve")
+		listen   = fset.String("addr", *addr, "address to listen on")
+		certFile = fset.String("cert", "", "PEM certificate file; serve over TLS if set")
+		keyFile  = fset.String("key", "", "PEM private key file for -cert")
+		readOnly = fset.Bool("readonly", false, "refuse writes")
+		quota    = fset.Int64("quota", 0, "maximum number of bytes stored, 0 for no limit")
+		atomic   = fset.Bool("atomic", false, "write files to a temporary file and rename them into place")
+		sync     = fset.Bool("sync", false, "flush written files to stable storage before acknowledging them")
+	)
+	if err := parseFlags(fset, args); err != nil {
+		return err
+	}
+	if fset.NArg() != 0 {
+		return errUsage
+	}
+
+	if info, err := os.Stat(*root); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return errors.New(*root + " is not a directory")
+	}
+
+	opts := std.Options{ReadOnly: *readOnly, Quota: *quota, Atomic: *atomic, Sync: *sync}
+
+	var (
+		srv *remote.Server
+		err error
+	)
+	switch {
+	case *certFile == "" && *keyFile == "":
+		srv, err = remote.NewTCPServerWithOptions(*root, *listen, opts)
+	case *certFile == "" || *keyFile == "":
+		return errors.New("-cert and -key must be given together")
+	default:
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			return err
+		}
+
+		config := &tls.Config{Certificates: []tls.Certificate{cert}}
+		srv, err = remote.NewTLSServerWithOptions(*root, *listen, config, opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("serving %v on %v", *root, *listen)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	<-sig
+
+	srv.Close()
+	return nil
+}
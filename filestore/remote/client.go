@@ -1,9 +1,13 @@
 package remote
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
 	"fmt"
+	"hash"
 	"io"
 	"os"
+	"time"
 
 	"github.com/shaladdle/goaaw/filestore/util"
 	anet "github.com/shaladdle/goaaw/net"
@@ -32,6 +36,12 @@ func NewClient(d anet.Dialer) (*Client, error) {
 	return &Client{cli}, nil
 }
 
+// NewTLSClient connects to a server listening for TLS connections at
+// hostport.
+func NewTLSClient(hostport string, config *tls.Config) (*Client, error) {
+	return NewClient(anet.TLSDialer{HostPort: hostport, Config: config})
+}
+
 func NewTCPClient(hostport string) (*Client, error) {
 	cli, err := rpc.NewClient(anet.TCPDialer(hostport))
 	if err != nil {
@@ -53,13 +63,47 @@ func (fs *Client) Create(fpath string) (io.WriteCloser, error) {
 		return nil, cErr
 	}
 
-	return f, nil
+	return &hashWriter{f, sha256.New()}, nil
+}
+
+// hashWriter hashes a file as it is uploaded, and closes the stream with the
+// hash, so that the server can check it against what it received before
+// committing the file.
+type hashWriter struct {
+	w io.WriteCloser
+	h hash.Hash
+}
+
+func (w *hashWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.h.Write(b[:n])
+	return n, err
+}
+
+func (w *hashWriter) Close() error {
+	if dc, ok := w.w.(rpc.DigestCloser); ok {
+		return dc.CloseDigest(w.h.Sum(nil))
+	}
+
+	return w.w.Close()
+}
+
+// Abort gives up on the upload, and the server removes the partial file.
+func (w *hashWriter) Abort() error {
+	if a, ok := w.w.(rpc.Aborter); ok {
+		return a.Abort()
+	}
+
+	return w.w.Close()
 }
 
 func (fs *Client) Open(fpath string) (io.ReadCloser, error) {
-	var cErr rpc.StrError
+	var (
+		cErr rpc.StrError
+		sum  []byte
+	)
 
-	f, err := fs.rpc.CallRead("RemoteFS.Open", fpath, &cErr)
+	f, err := fs.rpc.CallRead("RemoteFS.OpenVerified", fpath, &sum, &cErr)
 	if err != nil {
 		return nil, fmt.Errorf("rpc error: %v", err)
 	}
@@ -68,7 +112,37 @@ func (fs *Client) Open(fpath string) (io.ReadCloser, error) {
 		return nil, cErr
 	}
 
-	return closeWrapper{f}, nil
+	rc, ok := f.(io.ReadCloser)
+	if !ok {
+		rc = closeWrapper{f}
+	}
+
+	// A download that is cut short looks just like the end of the file, so
+	// check it against the server's hash when there is one.
+	if len(sum) > 0 {
+		return util.NewVerifyingReader(rc, sum, fpath), nil
+	}
+
+	return rc, nil
+}
+
+// Hash returns the hash of a file, computed by the server.
+func (fs *Client) Hash(fpath string) ([]byte, error) {
+	var (
+		cErr rpc.StrError
+		sum  []byte
+	)
+
+	err := fs.rpc.Call("RemoteFS.Hash", fpath, &sum, &cErr)
+	if err != nil {
+		return nil, fmt.Errorf("rpc error: %v", err)
+	}
+
+	if !cErr.IsNil() {
+		return nil, cErr
+	}
+
+	return sum, nil
 }
 
 func (fs *Client) Stat(fpath string) (os.FileInfo, error) {
@@ -142,4 +216,236 @@ func (fs *Client) GetFiles(fpath string) ([]os.FileInfo, error) {
 	return ret, nil
 }
 
+// ReadDir lists every entry in a directory, including subdirectories, which
+// GetFiles leaves out.
+func (fs *Client) ReadDir(dpath string) ([]os.FileInfo, error) {
+	var (
+		cErr  rpc.StrError
+		infos []util.FileInfo
+	)
+
+	err := fs.rpc.Call("RemoteFS.ReadDir", dpath, &infos, &cErr)
+	if err != nil {
+		return nil, fmt.Errorf("rpc error: %v", err)
+	}
+
+	if !cErr.IsNil() {
+		return nil, cErr
+	}
+
+	ret := make([]os.FileInfo, len(infos))
+	for i, info := range infos {
+		ret[i] = info
+	}
+
+	return ret, nil
+}
+
+// ReadFiles, WriteFiles, RemoveFiles, StatFiles and ListFiles are like the
+// std.FileSystem methods of the same names, and do the whole batch in a
+// single round trip.
+
+func (fs *Client) ReadFiles(paths []string) ([][]byte, error) {
+	var (
+		cErr rpc.StrError
+		data [][]byte
+	)
+
+	err := fs.rpc.Call("RemoteFS.ReadFiles", paths, &data, &cErr)
+	if err != nil {
+		return nil, fmt.Errorf("rpc error: %v", err)
+	}
+
+	if !cErr.IsNil() {
+		return nil, cErr
+	}
+
+	return data, nil
+}
+
+func (fs *Client) WriteFiles(paths []string, data [][]byte) error {
+	var cErr rpc.StrError
+
+	err := fs.rpc.Call("RemoteFS.WriteFiles", paths, data, &cErr)
+	if err != nil {
+		return fmt.Errorf("rpc error: %v", err)
+	}
+
+	if !cErr.IsNil() {
+		return cErr
+	}
+
+	return nil
+}
+
+func (fs *Client) RemoveFiles(paths []string) error {
+	var cErr rpc.StrError
+
+	err := fs.rpc.Call("RemoteFS.RemoveFiles", paths, &cErr)
+	if err != nil {
+		return fmt.Errorf("rpc error: %v", err)
+	}
+
+	if !cErr.IsNil() {
+		return cErr
+	}
+
+	return nil
+}
+
+func (fs *Client) StatFiles(paths []string) ([]os.FileInfo, error) {
+	var (
+		cErr  rpc.StrError
+		infos []util.FileInfo
+		found []bool
+	)
+
+	err := fs.rpc.Call("RemoteFS.StatFiles", paths, &infos, &found, &cErr)
+	if err != nil {
+		return nil, fmt.Errorf("rpc error: %v", err)
+	}
+
+	if !cErr.IsNil() {
+		return nil, cErr
+	}
+
+	ret := make([]os.FileInfo, len(infos))
+	for i, info := range infos {
+		if found[i] {
+			ret[i] = info
+		}
+	}
+
+	return ret, nil
+}
+
+func (fs *Client) ListFiles(dpath string) ([]string, error) {
+	var (
+		cErr  rpc.StrError
+		paths []string
+	)
+
+	err := fs.rpc.Call("RemoteFS.ListFiles", dpath, &paths, &cErr)
+	if err != nil {
+		return nil, fmt.Errorf("rpc error: %v", err)
+	}
+
+	if !cErr.IsNil() {
+		return nil, cErr
+	}
+
+	return paths, nil
+}
+
+func (fs *Client) Chmod(fpath string, mode os.FileMode) error {
+	var cErr rpc.StrError
+
+	err := fs.rpc.Call("RemoteFS.Chmod", fpath, mode, &cErr)
+	if err != nil {
+		return fmt.Errorf("rpc error: %v", err)
+	}
+
+	if !cErr.IsNil() {
+		return cErr
+	}
+
+	return nil
+}
+
+func (fs *Client) Chown(fpath string, uid, gid int) error {
+	var cErr rpc.StrError
+
+	err := fs.rpc.Call("RemoteFS.Chown", fpath, uid, gid, &cErr)
+	if err != nil {
+		return fmt.Errorf("rpc error: %v", err)
+	}
+
+	if !cErr.IsNil() {
+		return cErr
+	}
+
+	return nil
+}
+
+func (fs *Client) Chtimes(fpath string, atime, mtime time.Time) error {
+	var cErr rpc.StrError
+
+	err := fs.rpc.Call("RemoteFS.Chtimes", fpath, atime, mtime, &cErr)
+	if err != nil {
+		return fmt.Errorf("rpc error: %v", err)
+	}
+
+	if !cErr.IsNil() {
+		return cErr
+	}
+
+	return nil
+}
+
+func (fs *Client) GetXattr(fpath, attr string) ([]byte, error) {
+	var (
+		cErr rpc.StrError
+		data []byte
+	)
+
+	err := fs.rpc.Call("RemoteFS.GetXattr", fpath, attr, &data, &cErr)
+	if err != nil {
+		return nil, fmt.Errorf("rpc error: %v", err)
+	}
+
+	if !cErr.IsNil() {
+		return nil, cErr
+	}
+
+	return data, nil
+}
+
+func (fs *Client) SetXattr(fpath, attr string, data []byte) error {
+	var cErr rpc.StrError
+
+	err := fs.rpc.Call("RemoteFS.SetXattr", fpath, attr, data, &cErr)
+	if err != nil {
+		return fmt.Errorf("rpc error: %v", err)
+	}
+
+	if !cErr.IsNil() {
+		return cErr
+	}
+
+	return nil
+}
+
+func (fs *Client) ListXattr(fpath string) ([]string, error) {
+	var (
+		cErr  rpc.StrError
+		attrs []string
+	)
+
+	err := fs.rpc.Call("RemoteFS.ListXattr", fpath, &attrs, &cErr)
+	if err != nil {
+		return nil, fmt.Errorf("rpc error: %v", err)
+	}
+
+	if !cErr.IsNil() {
+		return nil, cErr
+	}
+
+	return attrs, nil
+}
+
+func (fs *Client) RemoveXattr(fpath, attr string) error {
+	var cErr rpc.StrError
+
+	err := fs.rpc.Call("RemoteFS.RemoveXattr", fpath, attr, &cErr)
+	if err != nil {
+		return fmt.Errorf("rpc error: %v", err)
+	}
+
+	if !cErr.IsNil() {
+		return cErr
+	}
+
+	return nil
+}
+
 func (fs *Client) Close() {}
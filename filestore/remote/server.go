@@ -1,15 +1,37 @@
 package remote
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/gob"
+	"fmt"
+	"hash"
 	"io"
 	"net"
+	"os"
+	"time"
 
+	filestore "github.com/shaladdle/goaaw/filestore"
 	"github.com/shaladdle/goaaw/filestore/std"
 	"github.com/shaladdle/goaaw/filestore/util"
 	anet "github.com/shaladdle/goaaw/net"
 	"github.com/shaladdle/goaaw/rpc"
 )
 
+func init() {
+	// Arguments to rpcs are sent as interface values, so any types that
+	// aren't built into gob need to be registered.
+	gob.Register(os.FileMode(0))
+	gob.Register(time.Time{})
+	gob.Register([][]byte(nil))
+
+	// The sentinel errors from the os package are registered by rpc.
+	rpc.RegisterError("not-dir", filestore.ErrNotDir)
+	rpc.RegisterError("integrity", filestore.ErrIntegrity)
+	rpc.RegisterError("full", filestore.ErrFull)
+}
+
 type Server struct {
 	stdfs  std.FileSystem
 	rpcSrv *rpc.Server
@@ -32,9 +54,17 @@ func NewPipeCliSrv(root string) (*Client, *Server, error) {
 	return cli, srv, nil
 }
 
+// NewServer serves the directory at root to clients connecting through l.
+// Clients are confined to root; see std.FileSystem for details.
 func NewServer(root string, l net.Listener) (*Server, error) {
+	return NewServerWithOptions(root, l, std.Options{})
+}
+
+// NewServerWithOptions is like NewServer, but allows the served directory to
+// be made read only or given a quota.
+func NewServerWithOptions(root string, l net.Listener, opts std.Options) (*Server, error) {
 	srv := &Server{
-		stdfs:  std.New(root),
+		stdfs:  std.NewWithOptions(root, opts),
 		rpcSrv: rpc.NewServer(),
 	}
 
@@ -45,39 +75,114 @@ func NewServer(root string, l net.Listener) (*Server, error) {
 }
 
 func NewTCPServer(root, hostport string) (*Server, error) {
+	return NewTCPServerWithOptions(root, hostport, std.Options{})
+}
+
+func NewTCPServerWithOptions(root, hostport string, opts std.Options) (*Server, error) {
 	srv := &Server{
-		stdfs:  std.New(root),
+		stdfs:  std.NewWithOptions(root, opts),
 		rpcSrv: rpc.NewServer(),
 	}
 
 	srv.rpcSrv.Register("RemoteFS", srv)
-	srv.rpcSrv.TCPListen(hostport)
+	if err := srv.rpcSrv.TCPListen(hostport); err != nil {
+		return nil, err
+	}
 
 	return srv, nil
 }
 
+// NewTLSServerWithOptions is like NewTCPServerWithOptions, but only accepts
+// connections that complete a TLS handshake using config.
+func NewTLSServerWithOptions(root, hostport string, config *tls.Config, opts std.Options) (*Server, error) {
+	l, err := tls.Listen("tcp", hostport, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewServerWithOptions(root, l, opts)
+}
+
 func (s *Server) RPCWrite_Create(fpath string) (io.WriteCloser, rpc.StrError) {
 	f, err := s.stdfs.Create(fpath)
 	if err != nil {
-		return nil, rpc.StrError(err.Error())
+		return nil, rpc.NewError(err)
 	}
 
-	return f, rpc.ErrNil
+	return &sumWriter{f, sha256.New(), fpath}, rpc.ErrNil
+}
+
+// sumWriter hashes what is written to a file, and checks it against the
+// client's hash before the file is committed, so that nothing lost on the way
+// replaces what was there before.
+type sumWriter struct {
+	w     io.WriteCloser
+	h     hash.Hash
+	fpath string
+}
+
+func (w *sumWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.h.Write(b[:n])
+	return n, err
+}
+
+func (w *sumWriter) Close() error {
+	return w.w.Close()
+}
+
+func (w *sumWriter) Abort() error {
+	if a, ok := w.w.(rpc.Aborter); ok {
+		return a.Abort()
+	}
+
+	return w.w.Close()
+}
+
+func (w *sumWriter) Verify(digest []byte) error {
+	if !bytes.Equal(digest, w.h.Sum(nil)) {
+		return fmt.Errorf("%v: %w", w.fpath, filestore.ErrIntegrity)
+	}
+
+	return nil
 }
 
 func (s *Server) RPCRead_Open(fpath string) (io.Reader, rpc.StrError) {
 	f, err := s.stdfs.Open(fpath)
 	if err != nil {
-		return nil, rpc.StrError(err.Error())
+		return nil, rpc.NewError(err)
 	}
 
 	return f, rpc.ErrNil
 }
 
+// RPCRead_OpenVerified is like RPCRead_Open, but also returns the hash
+// recorded for the file, if it has a current one, so that the client can
+// check what it receives.
+func (s *Server) RPCRead_OpenVerified(fpath string) (io.Reader, []byte, rpc.StrError) {
+	sum, _ := s.stdfs.StoredHash(fpath)
+
+	f, err := s.stdfs.Open(fpath)
+	if err != nil {
+		return nil, nil, rpc.NewError(err)
+	}
+
+	return f, sum, rpc.ErrNil
+}
+
+func (s *Server) RPCNorm_Hash(fpath string) ([]byte, rpc.StrError) {
+	sum, err := s.stdfs.Hash(fpath)
+	if err != nil {
+		return nil, rpc.NewError(err)
+	}
+
+	return sum, rpc.ErrNil
+}
+
 func (s *Server) RPCNorm_Stat(fpath string) (util.FileInfo, rpc.StrError) {
 	info, err := s.stdfs.Stat(fpath)
 	if err != nil {
-		return util.FileInfo{}, rpc.StrError(err.Error())
+		return util.FileInfo{}, rpc.NewError(err)
 	}
 
 	return util.FromOSInfo(info), rpc.ErrNil
@@ -85,7 +190,7 @@ func (s *Server) RPCNorm_Stat(fpath string) (util.FileInfo, rpc.StrError) {
 
 func (s *Server) RPCNorm_Mkdir(fpath string) rpc.StrError {
 	if err := s.stdfs.Mkdir(fpath); err != nil {
-		return rpc.StrError(err.Error())
+		return rpc.NewError(err)
 	}
 
 	return rpc.ErrNil
@@ -93,7 +198,7 @@ func (s *Server) RPCNorm_Mkdir(fpath string) rpc.StrError {
 
 func (s *Server) RPCNorm_Remove(fpath string) rpc.StrError {
 	if err := s.stdfs.Remove(fpath); err != nil {
-		return rpc.StrError(err.Error())
+		return rpc.NewError(err)
 	}
 
 	return rpc.ErrNil
@@ -102,15 +207,142 @@ func (s *Server) RPCNorm_Remove(fpath string) rpc.StrError {
 func (s *Server) RPCNorm_GetFiles(fpath string) ([]util.FileInfo, rpc.StrError) {
 	infos, err := s.stdfs.GetFiles(fpath)
 	if err != nil {
-		return nil, rpc.StrError(err.Error())
+		return nil, rpc.NewError(err)
+	}
+
+	return toUtilInfos(infos), rpc.ErrNil
+}
+
+func (s *Server) RPCNorm_ReadDir(dpath string) ([]util.FileInfo, rpc.StrError) {
+	infos, err := s.stdfs.ReadDir(dpath)
+	if err != nil {
+		return nil, rpc.NewError(err)
+	}
+
+	return toUtilInfos(infos), rpc.ErrNil
+}
+
+func (s *Server) RPCNorm_ReadFiles(paths []string) ([][]byte, rpc.StrError) {
+	data, err := s.stdfs.ReadFiles(paths)
+	if err != nil {
+		return nil, rpc.NewError(err)
+	}
+
+	return data, rpc.ErrNil
+}
+
+func (s *Server) RPCNorm_WriteFiles(paths []string, data [][]byte) rpc.StrError {
+	if err := s.stdfs.WriteFiles(paths, data); err != nil {
+		return rpc.NewError(err)
+	}
+
+	return rpc.ErrNil
+}
+
+func (s *Server) RPCNorm_RemoveFiles(paths []string) rpc.StrError {
+	if err := s.stdfs.RemoveFiles(paths); err != nil {
+		return rpc.NewError(err)
+	}
+
+	return rpc.ErrNil
+}
+
+// RPCNorm_StatFiles can't send the nil infos std.FileSystem uses for missing
+// files, so it also returns which of the files were found.
+func (s *Server) RPCNorm_StatFiles(paths []string) ([]util.FileInfo, []bool, rpc.StrError) {
+	infos, err := s.stdfs.StatFiles(paths)
+	if err != nil {
+		return nil, nil, rpc.NewError(err)
 	}
 
 	ret := make([]util.FileInfo, len(infos))
+	found := make([]bool, len(infos))
 	for i, info := range infos {
-		ret[i] = util.FromOSInfo(info)
+		if info != nil {
+			ret[i], found[i] = util.FromOSInfo(info), true
+		}
+	}
+
+	return ret, found, rpc.ErrNil
+}
+
+func (s *Server) RPCNorm_ListFiles(dpath string) ([]string, rpc.StrError) {
+	paths, err := s.stdfs.ListFiles(dpath)
+	if err != nil {
+		return nil, rpc.NewError(err)
+	}
+
+	return paths, rpc.ErrNil
+}
+
+// toUtilInfos converts infos into a form that can be sent to the client,
+// skipping the nil entries std.FileSystem uses for things that aren't
+// regular files.
+func toUtilInfos(infos []os.FileInfo) []util.FileInfo {
+	ret := make([]util.FileInfo, 0, len(infos))
+	for _, info := range infos {
+		ret = append(ret, util.FromOSInfo(info))
+	}
+
+	return ret
+}
+
+func (s *Server) RPCNorm_Chmod(fpath string, mode os.FileMode) rpc.StrError {
+	if err := s.stdfs.Chmod(fpath, mode); err != nil {
+		return rpc.NewError(err)
+	}
+
+	return rpc.ErrNil
+}
+
+func (s *Server) RPCNorm_Chown(fpath string, uid, gid int) rpc.StrError {
+	if err := s.stdfs.Chown(fpath, uid, gid); err != nil {
+		return rpc.NewError(err)
+	}
+
+	return rpc.ErrNil
+}
+
+func (s *Server) RPCNorm_Chtimes(fpath string, atime, mtime time.Time) rpc.StrError {
+	if err := s.stdfs.Chtimes(fpath, atime, mtime); err != nil {
+		return rpc.NewError(err)
+	}
+
+	return rpc.ErrNil
+}
+
+func (s *Server) RPCNorm_GetXattr(fpath, attr string) ([]byte, rpc.StrError) {
+	data, err := s.stdfs.GetXattr(fpath, attr)
+	if err != nil {
+		return nil, rpc.NewError(err)
 	}
 
-	return ret, rpc.ErrNil
+	return data, rpc.ErrNil
+}
+
+func (s *Server) RPCNorm_SetXattr(fpath, attr string, data []byte) rpc.StrError {
+	if err := s.stdfs.SetXattr(fpath, attr, data); err != nil {
+		return rpc.NewError(err)
+	}
+
+	return rpc.ErrNil
+}
+
+func (s *Server) RPCNorm_ListXattr(fpath string) ([]string, rpc.StrError) {
+	attrs, err := s.stdfs.ListXattr(fpath)
+	if err != nil {
+		return nil, rpc.NewError(err)
+	}
+
+	return attrs, rpc.ErrNil
+}
+
+func (s *Server) RPCNorm_RemoveXattr(fpath, attr string) rpc.StrError {
+	if err := s.stdfs.RemoveXattr(fpath, attr); err != nil {
+		return rpc.NewError(err)
+	}
+
+	return rpc.ErrNil
 }
 
 func (s *Server) Close() {
@@ -0,0 +1,111 @@
+package remote
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sync"
+
+	filestore "github.com/shaladdle/goaaw/filestore"
+	"github.com/shaladdle/goaaw/rpc"
+)
+
+// RPCRead_Watch streams the events for dpath back to the client as a series of
+// gob encoded filestore.Events. The watch is stopped when the client closes
+// the stream, which the rpc server notices even if there are no events.
+func (s *Server) RPCRead_Watch(dpath string) (io.Reader, rpc.StrError) {
+	w, err := s.stdfs.Watch(dpath)
+	if err != nil {
+		return nil, rpc.NewError(err)
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		defer w.Close()
+
+		enc := gob.NewEncoder(pw)
+		for ev := range w.Events() {
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+		}
+
+		pw.Close()
+	}()
+
+	return watchStream{pr, w}, rpc.ErrNil
+}
+
+// watchStream is the server's end of a watch. The rpc server closes it once
+// the client goes away, which stops the watch.
+type watchStream struct {
+	*io.PipeReader
+	w filestore.Watcher
+}
+
+func (s watchStream) Close() error {
+	s.w.Close()
+	return s.PipeReader.Close()
+}
+
+type watcher struct {
+	conn   io.ReadCloser
+	events chan filestore.Event
+	done   chan bool
+	once   sync.Once
+}
+
+func (w *watcher) Events() <-chan filestore.Event {
+	return w.events
+}
+
+func (w *watcher) Close() error {
+	w.once.Do(func() { close(w.done) })
+	return w.conn.Close()
+}
+
+func (w *watcher) run() {
+	defer close(w.events)
+
+	dec := gob.NewDecoder(w.conn)
+	for {
+		var ev filestore.Event
+		if err := dec.Decode(&ev); err != nil {
+			return
+		}
+
+		select {
+		case w.events <- ev:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (fs *Client) Watch(dpath string) (filestore.Watcher, error) {
+	var cErr rpc.StrError
+
+	r, err := fs.rpc.CallRead("RemoteFS.Watch", dpath, &cErr)
+	if err != nil {
+		return nil, fmt.Errorf("rpc error: %v", err)
+	}
+
+	conn, ok := r.(io.ReadCloser)
+	if !ok {
+		return nil, fmt.Errorf("rpc error: watch stream is a %T, which can't be closed", r)
+	}
+	if !cErr.IsNil() {
+		conn.Close()
+		return nil, cErr
+	}
+
+	w := &watcher{
+		conn:   conn,
+		events: make(chan filestore.Event),
+		done:   make(chan bool),
+	}
+	go w.run()
+
+	return w, nil
+}
@@ -0,0 +1,128 @@
+package std
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	filestore "github.com/shaladdle/goaaw/filestore"
+)
+
+func (fs FileSystem) Chmod(fpath string, mode os.FileMode) error {
+	if fs.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	full, err := fs.resolve(fpath)
+	if err != nil {
+		return err
+	}
+
+	return os.Chmod(full, mode)
+}
+
+func (fs FileSystem) Chown(fpath string, uid, gid int) error {
+	if fs.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	full, err := fs.resolve(fpath)
+	if err != nil {
+		return err
+	}
+
+	return os.Chown(full, uid, gid)
+}
+
+func (fs FileSystem) Chtimes(fpath string, atime, mtime time.Time) error {
+	if fs.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	full, err := fs.resolve(fpath)
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(full, atime, mtime)
+}
+
+// checkXattr keeps callers away from the extended attributes that
+// FileSystem uses for its own bookkeeping.
+func checkXattr(fpath, attr string) error {
+	if attr == hashXattr {
+		return fmt.Errorf("%v: extended attribute %v is reserved: %w", fpath, attr, filestore.ErrPermission)
+	}
+
+	return nil
+}
+
+func (fs FileSystem) GetXattr(fpath, attr string) ([]byte, error) {
+	if err := checkXattr(fpath, attr); err != nil {
+		return nil, err
+	}
+
+	full, err := fs.resolve(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	return getxattr(full, attr)
+}
+
+func (fs FileSystem) SetXattr(fpath, attr string, data []byte) error {
+	if fs.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if err := checkXattr(fpath, attr); err != nil {
+		return err
+	}
+
+	full, err := fs.resolve(fpath)
+	if err != nil {
+		return err
+	}
+
+	return setxattr(full, attr, data)
+}
+
+func (fs FileSystem) ListXattr(fpath string) ([]string, error) {
+	full, err := fs.resolve(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := listxattr(full)
+	if err != nil {
+		return nil, err
+	}
+
+	// The checksum is bookkeeping for FileSystem, not something the caller
+	// set.
+	ret := []string{}
+	for _, name := range names {
+		if name != hashXattr {
+			ret = append(ret, name)
+		}
+	}
+
+	return ret, nil
+}
+
+func (fs FileSystem) RemoveXattr(fpath, attr string) error {
+	if fs.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if err := checkXattr(fpath, attr); err != nil {
+		return err
+	}
+
+	full, err := fs.resolve(fpath)
+	if err != nil {
+		return err
+	}
+
+	return removexattr(full, attr)
+}
@@ -0,0 +1,125 @@
+package std
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+)
+
+// The methods in this file work on many whole files at once. Locally they
+// are just loops, but the remote server exposes them so that a client can do
+// a whole batch in one round trip.
+
+var errMismatch = errors.New("number of paths and contents differ")
+
+// ReadFiles returns the contents of each of the files in paths.
+func (fs FileSystem) ReadFiles(paths []string) ([][]byte, error) {
+	ret := make([][]byte, len(paths))
+	for i, fpath := range paths {
+		f, err := fs.Open(fpath)
+		if err != nil {
+			return nil, err
+		}
+
+		ret[i], err = ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+// WriteFiles replaces the contents of each file in paths with the matching
+// entry of data, creating the files if necessary.
+func (fs FileSystem) WriteFiles(paths []string, data [][]byte) error {
+	if len(paths) != len(data) {
+		return errMismatch
+	}
+
+	for i, fpath := range paths {
+		f, err := fs.Create(fpath)
+		if err != nil {
+			return err
+		}
+
+		_, err = f.Write(data[i])
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RemoveFiles removes each of the files in paths. It carries on past files
+// that can't be removed, and returns the first error it ran into.
+func (fs FileSystem) RemoveFiles(paths []string) error {
+	var first error
+	for _, fpath := range paths {
+		if err := fs.Remove(fpath); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// StatFiles returns the info for each of the files in paths, or nil for the
+// ones that don't exist.
+func (fs FileSystem) StatFiles(paths []string) ([]os.FileInfo, error) {
+	ret := make([]os.FileInfo, len(paths))
+	for i, fpath := range paths {
+		info, err := fs.Stat(fpath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		ret[i] = info
+	}
+
+	return ret, nil
+}
+
+// ListFiles returns the paths, relative to dpath and in sorted order, of all
+// of the regular files under dpath.
+func (fs FileSystem) ListFiles(dpath string) ([]string, error) {
+	var ret []string
+
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		infos, err := fs.ReadDir(path.Join(dpath, rel))
+		if err != nil {
+			return err
+		}
+
+		for _, info := range infos {
+			name := path.Join(rel, info.Name())
+			switch {
+			case info.IsDir():
+				if err := walk(name); err != nil {
+					return err
+				}
+			case info.Mode().IsRegular():
+				ret = append(ret, name)
+			}
+		}
+
+		return nil
+	}
+
+	if err := walk(""); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(ret)
+	return ret, nil
+}
@@ -0,0 +1,142 @@
+package std
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tempPrefix starts the names of the temporary files that atomic writes go
+// to. They are left out of directory listings, so readers never see a file
+// that is still being written.
+const tempPrefix = ".goaaw-tmp-"
+
+func isTemp(name string) bool {
+	return strings.HasPrefix(name, tempPrefix)
+}
+
+// fileWriter is a file opened for writing by Create. Abort throws away what
+// was written instead of committing it.
+type fileWriter interface {
+	io.WriteCloser
+	Abort() error
+}
+
+// createFile opens the file at full for writing, according to the sync and
+// atomicity options.
+func (fs FileSystem) createFile(full string) (fileWriter, error) {
+	if !fs.opts.Atomic {
+		f, err := os.Create(full)
+		if err != nil {
+			return nil, err
+		}
+
+		return &plainFile{f, full, fs.opts.Sync}, nil
+	}
+
+	f, err := createTemp(full)
+	if err != nil {
+		return nil, err
+	}
+
+	return &atomicFile{f, full, fs.opts.Sync}, nil
+}
+
+// plainFile writes straight to the file at full.
+type plainFile struct {
+	*os.File
+	full string
+	sync bool
+}
+
+func (f *plainFile) Close() error {
+	if f.sync {
+		if err := f.File.Sync(); err != nil {
+			f.File.Close()
+			return err
+		}
+	}
+
+	return f.File.Close()
+}
+
+func (f *plainFile) Abort() error {
+	f.File.Close()
+	return os.Remove(f.full)
+}
+
+// atomicFile writes to a temporary file next to full, and renames it over
+// full when closed, so the file at full is always either the old contents or
+// the new ones.
+type atomicFile struct {
+	*os.File
+	full string
+	sync bool
+}
+
+func (f *atomicFile) Close() error {
+	tmp := f.File.Name()
+
+	if f.sync {
+		if err := f.File.Sync(); err != nil {
+			f.Abort()
+			return err
+		}
+	}
+
+	if err := f.File.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, f.full); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if f.sync {
+		// Make the rename itself durable.
+		return syncDir(filepath.Dir(f.full))
+	}
+
+	return nil
+}
+
+func (f *atomicFile) Abort() error {
+	f.File.Close()
+	return os.Remove(f.File.Name())
+}
+
+// createTemp creates a new temporary file next to full. It is opened the same
+// way os.Create would, so it ends up with the same permissions.
+func createTemp(full string) (*os.File, error) {
+	dir, base := filepath.Split(full)
+
+	for {
+		var b [8]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, err
+		}
+
+		name := filepath.Join(dir, tempPrefix+base+"-"+hex.EncodeToString(b[:]))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			continue
+		}
+
+		return f, err
+	}
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
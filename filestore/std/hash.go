@@ -0,0 +1,173 @@
+package std
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/shaladdle/goaaw/filestore/util"
+)
+
+// hashXattr holds the SHA-256 hash of a file, followed by the size and
+// modification time the file had when it was hashed. If either has changed
+// since, the file was modified by something other than FileSystem and the
+// hash is ignored.
+const hashXattr = "user.goaaw.sha256"
+
+const hashRecordSize = sha256.Size + 8 + 8
+
+func hashRecord(sum []byte, info os.FileInfo) []byte {
+	b := make([]byte, 0, hashRecordSize)
+	b = append(b, sum...)
+	b = binary.BigEndian.AppendUint64(b, uint64(info.Size()))
+	b = binary.BigEndian.AppendUint64(b, uint64(info.ModTime().UnixNano()))
+	return b
+}
+
+// storedHash returns the hash recorded for the file at full, if there is one
+// and it is still current.
+func storedHash(full string, info os.FileInfo) ([]byte, bool) {
+	b, err := getxattr(full, hashXattr)
+	if err != nil || len(b) != hashRecordSize {
+		return nil, false
+	}
+
+	sum := b[:sha256.Size]
+	if !bytes.Equal(b, hashRecord(sum, info)) {
+		return nil, false
+	}
+
+	return sum, true
+}
+
+// saveHash records sum as the hash of the file at full. Not every file system
+// supports extended attributes, so failing to save the hash isn't an error;
+// it just has to be computed again next time.
+func saveHash(full string, sum []byte) {
+	info, err := os.Stat(full)
+	if err != nil {
+		return
+	}
+
+	setxattr(full, hashXattr, hashRecord(sum, info))
+}
+
+// Hash returns the SHA-256 hash of a file. The hash recorded when the file was
+// written is used if the file hasn't changed since, otherwise the file is
+// read to compute it.
+func (fs FileSystem) Hash(fpath string) ([]byte, error) {
+	full, err := fs.resolve(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(full)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%v is not a regular file", fpath)
+	}
+
+	if sum, ok := storedHash(full, info); ok {
+		return sum, nil
+	}
+
+	f, err := os.Open(full)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sum, err := util.HashReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fs.opts.ReadOnly {
+		// Only keep the hash if the file didn't change while reading it.
+		if after, err := os.Stat(full); err == nil && bytes.Equal(hashRecord(sum, info), hashRecord(sum, after)) {
+			saveHash(full, sum)
+		}
+	}
+
+	return sum, nil
+}
+
+// StoredHash returns the hash recorded for a file, without computing it if
+// there isn't a current one. The remote server uses it to let clients verify
+// downloads without paying for a second read of the file.
+func (fs FileSystem) StoredHash(fpath string) ([]byte, bool) {
+	full, err := fs.resolve(fpath)
+	if err != nil {
+		return nil, false
+	}
+
+	info, err := os.Stat(full)
+	if err != nil {
+		return nil, false
+	}
+
+	return storedHash(full, info)
+}
+
+// hashWriter hashes a file as it is written, and records the hash when it is
+// closed.
+type hashWriter struct {
+	w    fileWriter
+	h    hash.Hash
+	full string
+}
+
+func newHashWriter(w fileWriter, full string) *hashWriter {
+	return &hashWriter{w, sha256.New(), full}
+}
+
+func (w *hashWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.h.Write(b[:n])
+	return n, err
+}
+
+func (w *hashWriter) Close() error {
+	if err := w.w.Close(); err != nil {
+		return err
+	}
+
+	saveHash(w.full, w.h.Sum(nil))
+	return nil
+}
+
+// Abort throws the file away, so that a write that was cut off doesn't leave
+// a partial file behind. With Options.Atomic, the old contents of the file
+// are left alone.
+func (w *hashWriter) Abort() error {
+	return w.w.Abort()
+}
+
+// openVerified opens the file at full, checking it against its recorded hash
+// as it is read if it has one.
+func openVerified(full, fpath string) (io.ReadCloser, error) {
+	f, err := os.Open(full)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	sum, ok := storedHash(full, info)
+	if !ok {
+		return f, nil
+	}
+
+	return util.NewVerifyingReader(f, sum, fpath), nil
+}
@@ -7,58 +7,462 @@ import (
 	"io"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	filestore "github.com/shaladdle/goaaw/filestore"
+)
+
+var (
+	// ErrEscape is returned when a path would resolve to a location outside
+	// of the file system's root, either through '..' components, an absolute
+	// path, or a symlink that points outside of the root. It is also a
+	// filestore.ErrPermission.
+	ErrEscape = fmt.Errorf("path escapes the file system root: %w", filestore.ErrPermission)
+
+	// ErrReadOnly is returned by operations that would modify a read only
+	// file system. It is also a filestore.ErrPermission.
+	ErrReadOnly = fmt.Errorf("file system is read only: %w", filestore.ErrPermission)
+
+	// ErrQuotaExceeded is returned when a write would push the total size of
+	// the files under root past the configured quota. It is also a
+	// filestore.ErrFull.
+	ErrQuotaExceeded = fmt.Errorf("file system quota exceeded: %w", filestore.ErrFull)
 )
 
+// Options controls the restrictions placed on a FileSystem.
+type Options struct {
+	// ReadOnly causes Create, Mkdir and Remove to fail with ErrReadOnly.
+	ReadOnly bool
+
+	// Quota is the maximum number of bytes that may be stored in regular
+	// files under root. A Quota of 0 means there is no limit. What is
+	// under root is counted once, and the count is then kept up to date as
+	// files are written and removed, so changes made behind the
+	// FileSystem's back aren't noticed.
+	Quota int64
+
+	// Atomic makes Create write to a temporary file that replaces the
+	// real one when it is closed, so that a crash or an aborted write
+	// never leaves a half written file behind.
+	Atomic bool
+
+	// Sync makes closing a file from Create flush it, and with Atomic the
+	// rename too, to stable storage before returning.
+	Sync bool
+}
+
 // FileSystem uses the os file operations to emulate a file system mounted
-// at root.
+// at root. All paths are interpreted relative to root, and any path that
+// would resolve outside of root is rejected with ErrEscape. The root itself
+// can be named by "", "." or "/"; any other absolute path is rejected.
 type FileSystem struct {
-	root string
+	root  string
+	opts  Options
+	quota *quota
 }
 
 func New(root string) FileSystem {
-	return FileSystem{root}
+	return NewWithOptions(root, Options{})
+}
+
+func NewWithOptions(root string, opts Options) FileSystem {
+	fs := FileSystem{root: root, opts: opts}
+	if opts.Quota > 0 {
+		fs.quota = &quota{root: root, limit: opts.Quota}
+	}
+
+	return fs
+}
+
+// resolve maps fpath to a location on disk, making sure that the result is
+// confined to fs.root.
+func (fs FileSystem) resolve(fpath string) (string, error) {
+	if fpath == "/" {
+		fpath = ""
+	}
+
+	if path.IsAbs(fpath) {
+		return "", ErrEscape
+	}
+
+	clean := path.Clean(fpath)
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", ErrEscape
+	}
+
+	full := filepath.Join(fs.root, filepath.FromSlash(clean))
+	if err := fs.checkLinks(full); err != nil {
+		return "", err
+	}
+
+	return full, nil
+}
+
+// checkLinks makes sure that the deepest existing ancestor of full (or full
+// itself) does not resolve through a symlink to somewhere outside of root.
+func (fs FileSystem) checkLinks(full string) error {
+	realRoot, err := filepath.EvalSymlinks(fs.root)
+	if err != nil {
+		// If the root doesn't exist yet, nothing underneath it can be a
+		// symlink.
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	p := full
+	for {
+		if _, err := os.Lstat(p); err == nil {
+			break
+		}
+
+		parent := filepath.Dir(p)
+		if parent == p {
+			return nil
+		}
+		p = parent
+	}
+
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		// A dangling symlink could point anywhere, so don't follow it.
+		return ErrEscape
+	}
+
+	rel, err := filepath.Rel(realRoot, real)
+	if err != nil {
+		return ErrEscape
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ErrEscape
+	}
+
+	return nil
 }
 
 func (fs FileSystem) Open(fpath string) (io.ReadCloser, error) {
-	return os.Open(path.Join(fs.root, fpath))
+	full, err := fs.resolve(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	return openVerified(full, fpath)
 }
+
 func (fs FileSystem) Create(fpath string) (io.WriteCloser, error) {
-	return os.Create(path.Join(fs.root, fpath))
+	if fs.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
+	full, err := fs.resolve(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	if fs.quota == nil {
+		f, err := fs.createFile(full)
+		if err != nil {
+			return nil, err
+		}
+
+		return newHashWriter(f, full), nil
+	}
+
+	// The current contents of the file are about to be replaced, so they
+	// don't count against the quota: they are released as soon as the file
+	// is truncated, or for an atomic write once it commits.
+	old := regularSize(full)
+	if err := fs.quota.check(old); err != nil {
+		return nil, err
+	}
+
+	f, err := fs.createFile(full)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fs.opts.Atomic {
+		fs.quota.release(old)
+	}
+
+	return newHashWriter(&quotaWriter{f: f, q: fs.quota, full: full, atomic: fs.opts.Atomic}, full), nil
 }
-func (fs FileSystem) Mkdir(dpath string) error { return os.MkdirAll(path.Join(fs.root, dpath), 0777) }
+
+func (fs FileSystem) Mkdir(dpath string) error {
+	if fs.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	full, err := fs.resolve(dpath)
+	if err != nil {
+		return err
+	}
+
+	return os.MkdirAll(full, 0777)
+}
+
 func (fs FileSystem) Stat(fpath string) (os.FileInfo, error) {
-	return os.Stat(path.Join(fs.root, fpath))
+	full, err := fs.resolve(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Stat(full)
+}
+
+func (fs FileSystem) Remove(fpath string) error {
+	if fs.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	full, err := fs.resolve(fpath)
+	if err != nil {
+		return err
+	}
+
+	// Never let the root itself be removed.
+	if full == filepath.Clean(fs.root) {
+		return ErrEscape
+	}
+
+	if fs.quota == nil {
+		return os.Remove(full)
+	}
+
+	size := regularSize(full)
+	if err := os.Remove(full); err != nil {
+		return err
+	}
+	fs.quota.release(size)
+
+	return nil
 }
-func (fs FileSystem) Remove(fpath string) error { return os.Remove(path.Join(fs.root, fpath)) }
 
 func (fs FileSystem) GetFiles(fpath string) ([]os.FileInfo, error) {
-	fspath := path.Join(fs.root, fpath)
+	fspath, err := fs.resolve(fpath)
+	if err != nil {
+		return nil, err
+	}
+
 	info, err := os.Stat(fspath)
 	if err != nil {
 		return nil, err
 	}
 
 	if !info.IsDir() {
-		return nil, fmt.Errorf("%v is not a directory", fspath)
+		return nil, fmt.Errorf("%v: %w", fpath, filestore.ErrNotDir)
 	}
 
 	d, err := os.Open(fspath)
 	if err != nil {
 		return nil, err
 	}
+	defer d.Close()
 
 	fi, err := d.Readdir(-1)
 	if err != nil {
 		return nil, err
 	}
 
-	ret := make([]os.FileInfo, len(fi))
+	ret := make([]os.FileInfo, 0, len(fi))
+
+	for _, fi := range fi {
+		if isTemp(fi.Name()) {
+			continue
+		}
 
-	for i, fi := range fi {
 		if fi.Mode().IsRegular() {
-			ret[i] = fi
+			ret = append(ret, fi)
 		}
 	}
 
 	return ret, nil
 }
+
+// ReadDir is like GetFiles, but lists every entry in the directory,
+// including subdirectories.
+func (fs FileSystem) ReadDir(dpath string) ([]os.FileInfo, error) {
+	full, err := fs.resolve(dpath)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := os.Open(full)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	infos, err := d.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := infos[:0]
+	for _, info := range infos {
+		if !isTemp(info.Name()) {
+			ret = append(ret, info)
+		}
+	}
+
+	return ret, nil
+}
+
+// quota counts the bytes in regular files under root against Options.Quota.
+// It is shared by every copy of a FileSystem, and only learns about changes
+// made through them, so the tree is walked once, the first time the count is
+// needed.
+type quota struct {
+	root  string
+	limit int64
+
+	lock    sync.Mutex
+	counted bool
+	used    int64
+}
+
+// load counts the bytes under root, unless that has been done already. The
+// caller must hold q.lock.
+func (q *quota) load() error {
+	if q.counted {
+		return nil
+	}
+
+	used, err := usage(q.root)
+	if err != nil {
+		return err
+	}
+
+	q.used, q.counted = used, true
+	return nil
+}
+
+// check returns ErrQuotaExceeded if there is no room left, not counting the
+// freed bytes that are about to be released.
+func (q *quota) check(freed int64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if err := q.load(); err != nil {
+		return err
+	}
+
+	if q.used-freed >= q.limit {
+		return ErrQuotaExceeded
+	}
+
+	return nil
+}
+
+// charge adds n bytes to the count, unless that would go past the quota.
+func (q *quota) charge(n int64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if err := q.load(); err != nil {
+		return err
+	}
+
+	if q.used+n > q.limit {
+		return ErrQuotaExceeded
+	}
+
+	q.used += n
+	return nil
+}
+
+// release takes n bytes off the count. Before the first count there is
+// nothing to take them off, since the walk will see that they are gone.
+func (q *quota) release(n int64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if !q.counted {
+		return
+	}
+
+	q.used -= n
+	if q.used < 0 {
+		q.used = 0
+	}
+}
+
+// usage returns the total size of all regular files under root.
+func usage(root string) (int64, error) {
+	var sum int64
+
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			sum += info.Size()
+		}
+
+		return nil
+	})
+
+	return sum, err
+}
+
+// regularSize returns the size of the file at full, or 0 if it isn't a
+// regular file.
+func regularSize(full string) int64 {
+	info, err := os.Lstat(full)
+	if err != nil || !info.Mode().IsRegular() {
+		return 0
+	}
+
+	return info.Size()
+}
+
+// quotaWriter charges what is written to the quota as it is written, and
+// refuses writes that would go past it. Whatever it charged is released if
+// the file is thrown away.
+type quotaWriter struct {
+	f       fileWriter
+	q       *quota
+	full    string
+	atomic  bool
+	charged int64
+}
+
+func (w *quotaWriter) Write(b []byte) (int, error) {
+	if err := w.q.charge(int64(len(b))); err != nil {
+		return 0, err
+	}
+
+	n, err := w.f.Write(b)
+	w.q.release(int64(len(b) - n))
+	w.charged += int64(n)
+
+	return n, err
+}
+
+func (w *quotaWriter) Close() error {
+	if !w.atomic {
+		return w.f.Close()
+	}
+
+	// The file being replaced is gone once the new one is renamed over
+	// it, and the new one is gone if it isn't.
+	old := regularSize(w.full)
+	if err := w.f.Close(); err != nil {
+		w.q.release(w.charged)
+		return err
+	}
+
+	w.q.release(old)
+	return nil
+}
+
+func (w *quotaWriter) Abort() error {
+	err := w.f.Abort()
+	w.q.release(w.charged)
+
+	return err
+}
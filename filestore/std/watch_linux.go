@@ -0,0 +1,276 @@
+package std
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	filestore "github.com/shaladdle/goaaw/filestore"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// inotifyWatcher watches a directory tree using inotify. Since inotify only
+// reports changes to the immediate children of a watched directory, a watch
+// is added for every directory in the tree, including ones that are created
+// after the watcher is started.
+type inotifyWatcher struct {
+	f      *os.File
+	fd     int
+	events chan filestore.Event
+	done   chan bool
+	once   sync.Once
+
+	lock sync.Mutex
+	wds  map[int32]watchDir
+}
+
+// errWatchClosed stops addTree when the watcher is closed while it is
+// reporting what it finds.
+var errWatchClosed = errors.New("watcher closed")
+
+// watchDir records where a watched directory is, both on disk and relative
+// to the root of the file system.
+type watchDir struct {
+	full  string
+	fpath string
+}
+
+func (fs FileSystem) Watch(dpath string) (filestore.Watcher, error) {
+	full, err := fs.resolve(dpath)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(full)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &os.PathError{Op: "watch", Path: dpath, Err: syscall.ENOTDIR}
+	}
+
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	w := &inotifyWatcher{
+		// The descriptor is non-blocking, so wrapping it in an os.File lets
+		// the runtime poller wake up a pending Read when Close is called.
+		f:      os.NewFile(uintptr(fd), "inotify"),
+		fd:     fd,
+		events: make(chan filestore.Event),
+		done:   make(chan bool),
+		wds:    make(map[int32]watchDir),
+	}
+
+	if err := w.addTree(full, path.Clean("/" + dpath)[1:], false); err != nil {
+		w.f.Close()
+		return nil, err
+	}
+
+	go w.run()
+
+	return w, nil
+}
+
+// addTree adds a watch for the directory at full and every directory below
+// it. fpath is the store path corresponding to full.
+//
+// If report is set, the directory is new to the watcher, so anything that was
+// put in it before its watch was added would never show up. A Create event is
+// sent for everything found below it instead. Each directory is watched before
+// it is read, so nothing is missed, although something can be reported twice.
+func (w *inotifyWatcher) addTree(full, fpath string, report bool) error {
+	return filepath.Walk(full, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			// The directory might have been removed out from under us.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		rel, err := filepath.Rel(full, p)
+		if err != nil {
+			return err
+		}
+		relPath := path.Join(fpath, filepath.ToSlash(rel))
+
+		if info.IsDir() {
+			wd, err := syscall.InotifyAddWatch(w.fd, p, watchMask)
+			if err != nil {
+				return os.NewSyscallError("inotify_add_watch", err)
+			}
+
+			w.lock.Lock()
+			w.wds[int32(wd)] = watchDir{p, relPath}
+			w.lock.Unlock()
+		}
+
+		if !report || p == full || isTemp(info.Name()) {
+			return nil
+		}
+		if !w.send(filestore.Event{Op: filestore.EventCreate, Path: relPath}) {
+			return errWatchClosed
+		}
+
+		return nil
+	})
+}
+
+func (w *inotifyWatcher) Events() <-chan filestore.Event {
+	return w.events
+}
+
+func (w *inotifyWatcher) Close() error {
+	var err error
+	w.once.Do(func() {
+		close(w.done)
+		err = w.f.Close()
+	})
+
+	return err
+}
+
+func (w *inotifyWatcher) send(ev filestore.Event) bool {
+	select {
+	case w.events <- ev:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+func (w *inotifyWatcher) run() {
+	defer close(w.events)
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			return
+		}
+
+		if !w.handle(buf[:n]) {
+			return
+		}
+	}
+}
+
+// handle converts one batch of raw inotify events and sends them along. It
+// returns false if the watcher has been closed.
+func (w *inotifyWatcher) handle(buf []byte) bool {
+	// Renames show up as a IN_MOVED_FROM/IN_MOVED_TO pair with the same
+	// cookie. A move with only one half happened across the boundary of the
+	// watched tree, so it is reported as a remove or a create.
+	movedFrom := make(map[uint32]string)
+	var moveOrder []uint32
+
+	for off := 0; off+syscall.SizeofInotifyEvent <= len(buf); {
+		raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+		nameBytes := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(raw.Len)]
+		off += syscall.SizeofInotifyEvent + int(raw.Len)
+
+		if raw.Mask&syscall.IN_Q_OVERFLOW != 0 {
+			if !w.send(filestore.Event{Op: filestore.EventOverflow}) {
+				return false
+			}
+			continue
+		}
+
+		w.lock.Lock()
+		dir, ok := w.wds[raw.Wd]
+		if raw.Mask&syscall.IN_IGNORED != 0 {
+			delete(w.wds, raw.Wd)
+		}
+		w.lock.Unlock()
+
+		if !ok || raw.Len == 0 {
+			continue
+		}
+
+		name := string(nameBytes)
+		for i, c := range nameBytes {
+			if c == 0 {
+				name = string(nameBytes[:i])
+				break
+			}
+		}
+		fpath := path.Join(dir.fpath, name)
+
+		// The temporary files of atomic writes aren't reported, except
+		// that one being renamed into place is the write finishing.
+		if isTemp(name) && raw.Mask&syscall.IN_MOVED_FROM == 0 {
+			continue
+		}
+
+		// newDir is set if a directory was created or moved into the
+		// tree from outside, and so needs to be watched, with everything
+		// already in it reported.
+		var (
+			ev     filestore.Event
+			newDir bool
+		)
+		switch {
+		case raw.Mask&syscall.IN_CREATE != 0:
+			newDir = raw.Mask&syscall.IN_ISDIR != 0
+			ev = filestore.Event{Op: filestore.EventCreate, Path: fpath}
+		case raw.Mask&syscall.IN_CLOSE_WRITE != 0:
+			ev = filestore.Event{Op: filestore.EventModify, Path: fpath}
+		case raw.Mask&syscall.IN_DELETE != 0:
+			ev = filestore.Event{Op: filestore.EventRemove, Path: fpath}
+		case raw.Mask&syscall.IN_MOVED_FROM != 0:
+			movedFrom[raw.Cookie] = fpath
+			moveOrder = append(moveOrder, raw.Cookie)
+			continue
+		case raw.Mask&syscall.IN_MOVED_TO != 0:
+			if old, ok := movedFrom[raw.Cookie]; ok {
+				if raw.Mask&syscall.IN_ISDIR != 0 {
+					// The directory's contents were already
+					// reported where it came from.
+					w.addTree(filepath.Join(dir.full, name), fpath, false)
+				}
+				delete(movedFrom, raw.Cookie)
+				if isTemp(path.Base(old)) {
+					// The file at fpath was replaced by a new
+					// one with all of its contents.
+					if !w.send(filestore.Event{Op: filestore.EventCreate, Path: fpath}) {
+						return false
+					}
+					ev = filestore.Event{Op: filestore.EventModify, Path: fpath}
+				} else {
+					ev = filestore.Event{Op: filestore.EventRename, Path: fpath, OldPath: old}
+				}
+			} else {
+				newDir = raw.Mask&syscall.IN_ISDIR != 0
+				ev = filestore.Event{Op: filestore.EventCreate, Path: fpath}
+			}
+		default:
+			continue
+		}
+
+		if !w.send(ev) {
+			return false
+		}
+		if newDir && w.addTree(filepath.Join(dir.full, name), fpath, true) == errWatchClosed {
+			return false
+		}
+	}
+
+	for _, cookie := range moveOrder {
+		if old, ok := movedFrom[cookie]; ok && !isTemp(path.Base(old)) {
+			if !w.send(filestore.Event{Op: filestore.EventRemove, Path: old}) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package std
+
+import (
+	"errors"
+
+	filestore "github.com/shaladdle/goaaw/filestore"
+)
+
+var errNoWatch = errors.New("watching is not supported on this platform")
+
+func (fs FileSystem) Watch(dpath string) (filestore.Watcher, error) {
+	return nil, errNoWatch
+}
@@ -0,0 +1,79 @@
+package std
+
+import (
+	"os"
+	"strings"
+	"syscall"
+)
+
+func getxattr(fpath, attr string) ([]byte, error) {
+	// Ask for the size first, then fetch the value. The value can grow in
+	// between, in which case the fetch fails with ERANGE and we start over.
+	for {
+		size, err := syscall.Getxattr(fpath, attr, nil)
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: fpath, Err: err}
+		}
+
+		buf := make([]byte, size)
+		n, err := syscall.Getxattr(fpath, attr, buf)
+		if err == syscall.ERANGE {
+			continue
+		} else if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: fpath, Err: err}
+		}
+
+		return buf[:n], nil
+	}
+}
+
+func setxattr(fpath, attr string, data []byte) error {
+	if err := syscall.Setxattr(fpath, attr, data, 0); err != nil {
+		return &os.PathError{Op: "setxattr", Path: fpath, Err: err}
+	}
+
+	return nil
+}
+
+func listxattr(fpath string) ([]string, error) {
+	// As with getxattr, the list can grow between asking for its size and
+	// fetching it.
+	var (
+		buf []byte
+		n   int
+	)
+	for {
+		size, err := syscall.Listxattr(fpath, nil)
+		if err != nil {
+			return nil, &os.PathError{Op: "listxattr", Path: fpath, Err: err}
+		}
+
+		buf = make([]byte, size)
+		n, err = syscall.Listxattr(fpath, buf)
+		if err == syscall.ERANGE {
+			continue
+		} else if err != nil {
+			return nil, &os.PathError{Op: "listxattr", Path: fpath, Err: err}
+		}
+
+		break
+	}
+
+	// The names come back as a list of null terminated strings.
+	ret := []string{}
+	for _, name := range strings.Split(string(buf[:n]), "\x00") {
+		if name != "" {
+			ret = append(ret, name)
+		}
+	}
+
+	return ret, nil
+}
+
+func removexattr(fpath, attr string) error {
+	if err := syscall.Removexattr(fpath, attr); err != nil {
+		return &os.PathError{Op: "removexattr", Path: fpath, Err: err}
+	}
+
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package std
+
+import (
+	"errors"
+)
+
+var errNoXattr = errors.New("extended attributes are not supported on this platform")
+
+func getxattr(fpath, attr string) ([]byte, error)    { return nil, errNoXattr }
+func setxattr(fpath, attr string, data []byte) error { return errNoXattr }
+func listxattr(fpath string) ([]string, error)       { return nil, errNoXattr }
+func removexattr(fpath, attr string) error           { return errNoXattr }
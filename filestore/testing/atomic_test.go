@@ -0,0 +1,62 @@
+package testing
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/shaladdle/goaaw/filestore/std"
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+// TestAtomicWrites checks that with Options.Atomic, a file keeps its old
+// contents until a write to it is closed, and keeps them if the write is
+// aborted.
+func TestAtomicWrites(t *testing.T) {
+	te := testutil.NewTestEnv("testcase-atomic", t)
+	defer te.Teardown()
+
+	stdfs := std.NewWithOptions(te.Root(), std.Options{Atomic: true})
+	writeBytes(t, stdfs, "file", []byte("old"))
+
+	w, err := stdfs.Create("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("new contents"))
+
+	if got := readBytes(t, stdfs, "file"); string(got) != "old" {
+		t.Errorf("file got %q while being written, want %q", got, "old")
+	}
+	if infos, err := stdfs.ReadDir(""); err != nil || len(infos) != 1 {
+		t.Errorf("got %v entries while writing, want only the file (%v)", len(infos), err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readBytes(t, stdfs, "file"); string(got) != "new contents" {
+		t.Errorf("file got %q after closing, want %q", got, "new contents")
+	}
+
+	w, err = stdfs.Create("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("unwanted"))
+	if err := w.(interface{ Abort() error }).Abort(); err != nil {
+		t.Fatalf("abort: %v", err)
+	}
+
+	if got := readBytes(t, stdfs, "file"); string(got) != "new contents" {
+		t.Errorf("file got %q after an aborted write, want %q", got, "new contents")
+	}
+
+	// No temporary files are left behind.
+	entries, err := ioutil.ReadDir(te.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %v files in the root, want 1", len(entries))
+	}
+}
@@ -0,0 +1,107 @@
+package testing
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/shaladdle/goaaw/filestore"
+	"github.com/shaladdle/goaaw/filestore/util"
+)
+
+// TestAttrs changes the mode, times, owner and extended attributes of a file
+// and makes sure the changes show up when the file is inspected again.
+func TestAttrs(t *testing.T) {
+	const fname = "attrs"
+
+	testBody := func(i int, ti testInfo) {
+		store, cleanup, err := ti.setup(t)
+		defer cleanup()
+		if err != nil {
+			t.Errorf("test %v: test initialization: %v", ti.name, err)
+			return
+		}
+
+		// Metadata support is optional.
+		afs, ok := store.(fs.AttrFileStore)
+		if !ok {
+			return
+		}
+
+		f, err := afs.Create(fname)
+		if err != nil {
+			t.Errorf("test %v: create: %v", ti.name, err)
+			return
+		}
+		f.Close()
+
+		const wantMode = os.FileMode(0600)
+		if err := afs.Chmod(fname, wantMode); err != nil {
+			t.Errorf("test %v: chmod: %v", ti.name, err)
+		}
+
+		wantMtime := time.Date(2010, 1, 2, 3, 4, 5, 0, time.UTC)
+		wantAtime := wantMtime.Add(time.Hour)
+		if err := afs.Chtimes(fname, wantAtime, wantMtime); err != nil {
+			t.Errorf("test %v: chtimes: %v", ti.name, err)
+		}
+
+		uid, gid := os.Getuid(), os.Getgid()
+		if err := afs.Chown(fname, uid, gid); err != nil {
+			t.Errorf("test %v: chown: %v", ti.name, err)
+		}
+
+		info, err := afs.Stat(fname)
+		if err != nil {
+			t.Errorf("test %v: stat: %v", ti.name, err)
+			return
+		}
+
+		got := util.FromOSInfo(info)
+		if got.Mode().Perm() != wantMode {
+			t.Errorf("test %v: got mode %v, want %v", ti.name, got.Mode().Perm(), wantMode)
+		}
+		if !got.ModTime().Equal(wantMtime) {
+			t.Errorf("test %v: got mtime %v, want %v", ti.name, got.ModTime(), wantMtime)
+		}
+		if !got.AccessTime().Equal(wantAtime) {
+			t.Errorf("test %v: got atime %v, want %v", ti.name, got.AccessTime(), wantAtime)
+		}
+		if got.Uid() != uid || got.Gid() != gid {
+			t.Errorf("test %v: got owner %v:%v, want %v:%v", ti.name, got.Uid(), got.Gid(), uid, gid)
+		}
+
+		const attr = "user.test"
+		want := []byte("attribute value")
+		if err := afs.SetXattr(fname, attr, want); err != nil {
+			// Not every file system under the test directory supports
+			// extended attributes.
+			t.Logf("test %v: skipping xattrs: %v", ti.name, err)
+			return
+		}
+
+		if got, err := afs.GetXattr(fname, attr); err != nil {
+			t.Errorf("test %v: getxattr: %v", ti.name, err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("test %v: got xattr %q, want %q", ti.name, got, want)
+		}
+
+		if names, err := afs.ListXattr(fname); err != nil {
+			t.Errorf("test %v: listxattr: %v", ti.name, err)
+		} else if len(names) != 1 || names[0] != attr {
+			t.Errorf("test %v: got xattrs %v, want [%v]", ti.name, names, attr)
+		}
+
+		if err := afs.RemoveXattr(fname, attr); err != nil {
+			t.Errorf("test %v: removexattr: %v", ti.name, err)
+		}
+		if _, err := afs.GetXattr(fname, attr); err == nil {
+			t.Errorf("test %v: getxattr after remove should fail", ti.name)
+		}
+	}
+
+	for i, ti := range tests {
+		testBody(i, ti)
+	}
+}
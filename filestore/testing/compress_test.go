@@ -0,0 +1,173 @@
+package testing
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/shaladdle/goaaw/filestore"
+	"github.com/shaladdle/goaaw/filestore/compress"
+	"github.com/shaladdle/goaaw/filestore/inmem"
+	"github.com/shaladdle/goaaw/filestore/remote"
+	"github.com/shaladdle/goaaw/filestore/std"
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+// TestCompressSize writes a very compressible file and checks that less is
+// stored than was written, while Stat and GetFiles still report the
+// uncompressed size.
+func TestCompressSize(t *testing.T) {
+	want := []byte(strings.Repeat("compress me ", 1000))
+
+	for _, alg := range []compress.Algorithm{compress.Gzip, compress.Flate, compress.Zlib} {
+		store := inmem.New()
+		cfs := compress.New(store, alg)
+
+		w, err := cfs.Create("dir/file")
+		if err != nil {
+			t.Fatalf("%v: create: %v", alg.Name(), err)
+		}
+		w.Write(want)
+		if err := w.Close(); err != nil {
+			t.Fatalf("%v: close: %v", alg.Name(), err)
+		}
+
+		if info, err := store.Stat("dir/file"); err != nil {
+			t.Errorf("%v: stat of underlying file: %v", alg.Name(), err)
+		} else if info.Size() >= int64(len(want)) {
+			t.Errorf("%v: stored %v bytes, which is not less than %v", alg.Name(), info.Size(), len(want))
+		}
+
+		// The size is kept in the file itself.
+		if infos, err := store.GetFiles("dir"); err != nil || len(infos) != 1 {
+			t.Errorf("%v: underlying GetFiles got %v, %v, want only the file", alg.Name(), infos, err)
+		}
+
+		if info, err := cfs.Stat("dir/file"); err != nil {
+			t.Errorf("%v: stat: %v", alg.Name(), err)
+		} else if info.Size() != int64(len(want)) {
+			t.Errorf("%v: stat got size %v, want %v", alg.Name(), info.Size(), len(want))
+		}
+
+		if infos, err := cfs.GetFiles("dir"); err != nil {
+			t.Errorf("%v: GetFiles: %v", alg.Name(), err)
+		} else if len(infos) != 1 || infos[0].Size() != int64(len(want)) {
+			t.Errorf("%v: GetFiles got %v, want one file of size %v", alg.Name(), infos, len(want))
+		}
+
+		// A store configured with a different algorithm can still read the
+		// file.
+		r, err := compress.New(store, compress.None).Open("dir/file")
+		if err != nil {
+			t.Fatalf("%v: open: %v", alg.Name(), err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Errorf("%v: read: %v", alg.Name(), err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("%v: contents did not match", alg.Name())
+		}
+	}
+}
+
+// openCounter counts the files opened in the store it wraps.
+type openCounter struct {
+	fs.AttrFileStore
+	opens int
+}
+
+func (c *openCounter) Open(fpath string) (io.ReadCloser, error) {
+	c.opens++
+	return c.AttrFileStore.Open(fpath)
+}
+
+// TestCompressStatNoRead checks that Stat and GetFiles get the uncompressed
+// size without opening the file when the underlying store keeps extended
+// attributes, even when its files can't be seeked, and that they notice when
+// the file was changed behind their back.
+func TestCompressStatNoRead(t *testing.T) {
+	te := testutil.NewTestEnv("testcase-compress-stat", t)
+	defer te.Teardown()
+
+	cli, srv, err := remote.NewPipeCliSrv(te.PathFor("remote"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	stores := map[string]fs.AttrFileStore{
+		"std":    std.New(te.PathFor("std")),
+		"remote": cli,
+	}
+	for name, store := range stores {
+		store.Mkdir("dir")
+
+		oc := &openCounter{AttrFileStore: store}
+		cfs := compress.New(oc, compress.Gzip)
+		want := []byte(strings.Repeat("compress me ", 1000))
+		writeBytes(t, cfs, "dir/file", want)
+
+		if info, err := cfs.Stat("dir/file"); err != nil || info.Size() != int64(len(want)) {
+			t.Errorf("%v: stat got %v, %v, want size %v", name, info, err, len(want))
+		}
+		if infos, err := cfs.GetFiles("dir"); err != nil || len(infos) != 1 || infos[0].Size() != int64(len(want)) {
+			t.Errorf("%v: GetFiles got %v, %v, want one file of size %v", name, infos, err, len(want))
+		}
+		if oc.opens != 0 {
+			t.Errorf("%v: Stat and GetFiles opened the file %v times", name, oc.opens)
+		}
+
+		// Rewriting the file without the compressing store leaves a stale
+		// record, which is ignored.
+		b, err := compress.Compress([]byte("short"), compress.None)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeBytes(t, store, "dir/file", b)
+
+		if info, err := cfs.Stat("dir/file"); err != nil || info.Size() != 5 {
+			t.Errorf("%v: stat after rewriting got %v, %v, want size 5", name, info, err)
+		}
+	}
+}
+
+// TestCompressTruncated checks that reading compressed data that was cut off
+// fails, even with an algorithm that can't tell by itself.
+func TestCompressTruncated(t *testing.T) {
+	b, err := compress.Compress([]byte("some data"), compress.None)
+	if err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+
+	for _, cut := range []int{1, 3, 9} {
+		if got, err := compress.Decompress(b[:len(b)-cut]); err == nil {
+			t.Errorf("cutting off %v bytes: got %q, want an error", cut, got)
+		}
+	}
+}
+
+// TestCompressAbort checks that aborting a compressed write aborts the write
+// to the underlying store, so the old contents are kept.
+func TestCompressAbort(t *testing.T) {
+	te := testutil.NewTestEnv("testcase-compress-abort", t)
+	defer te.Teardown()
+
+	cfs := compress.New(std.NewWithOptions(te.Root(), std.Options{Atomic: true}), compress.Gzip)
+	writeBytes(t, cfs, "file", []byte("old"))
+
+	w, err := cfs.Create("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("unwanted"))
+	if err := w.(interface{ Abort() error }).Abort(); err != nil {
+		t.Fatalf("abort: %v", err)
+	}
+
+	if got := readBytes(t, cfs, "file"); string(got) != "old" {
+		t.Errorf("file got %q after an aborted write, want %q", got, "old")
+	}
+}
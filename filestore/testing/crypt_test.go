@@ -0,0 +1,194 @@
+package testing
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/shaladdle/goaaw/filestore/crypt"
+	"github.com/shaladdle/goaaw/filestore/inmem"
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func newCryptTestKey(t *testing.T, passphrase string) crypt.Key {
+	salt := []byte("0123456789abcdef")
+	key, err := crypt.KeyFromPassphrase(passphrase, salt)
+	if err != nil {
+		t.Fatalf("key derivation: %v", err)
+	}
+
+	return key
+}
+
+func writeFile(t *testing.T, w io.WriteCloser, err error, b []byte) {
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := w.Write(b); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+}
+
+func readFile(r io.ReadCloser, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// TestCryptRoundTrip writes a file spanning several chunks and reads it back,
+// checking that neither the contents nor the name are visible in the
+// underlying store.
+func TestCryptRoundTrip(t *testing.T) {
+	const chunkSize = 100
+
+	store := inmem.New()
+	efs, err := crypt.New(store, newCryptTestKey(t, "secret"), crypt.Options{
+		ChunkSize:    chunkSize,
+		EncryptNames: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Exercise an empty file, an exact multiple of the chunk size and a
+	// partial final chunk.
+	for _, size := range []int64{0, chunkSize, 3*chunkSize + 7} {
+		buf := &bytes.Buffer{}
+		if err := testutil.WriteRandFile(buf, size); err != nil {
+			t.Fatal(err)
+		}
+		want := buf.Bytes()
+
+		w, err := efs.Create("dir/plain-name")
+		writeFile(t, w, err, want)
+
+		got, err := readFile(efs.Open("dir/plain-name"))
+		if err != nil {
+			t.Errorf("size %v: read: %v", size, err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("size %v: contents did not match", size)
+		}
+
+		if info, err := efs.Stat("dir/plain-name"); err != nil {
+			t.Errorf("size %v: stat: %v", size, err)
+		} else if info.Size() != size || info.Name() != "plain-name" {
+			t.Errorf("size %v: stat got %v with size %v", size, info.Name(), info.Size())
+		}
+	}
+
+	if _, err := store.Stat("dir"); err == nil {
+		t.Errorf("directory name was stored in the clear")
+	}
+
+	infos, err := efs.GetFiles("dir")
+	if err != nil {
+		t.Fatalf("GetFiles: %v", err)
+	}
+	if len(infos) != 1 || infos[0].Name() != "plain-name" {
+		t.Errorf("GetFiles got %v, want [plain-name]", infos)
+	}
+}
+
+// TestCryptTamper modifies, truncates and reads with the wrong key, all of
+// which should fail with ErrTampered.
+func TestCryptTamper(t *testing.T) {
+	const chunkSize = 64
+
+	key := newCryptTestKey(t, "secret")
+	want := []byte(strings.Repeat("x", 5*chunkSize))
+
+	setup := func() (*inmem.InMemFileSystem, []byte) {
+		store := inmem.New()
+		efs, err := crypt.New(store, key, crypt.Options{ChunkSize: chunkSize})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w, err := efs.Create("file")
+		writeFile(t, w, err, want)
+
+		stored, err := readFile(store.Open("file"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return store, stored
+	}
+
+	tests := []struct {
+		name   string
+		key    crypt.Key
+		mangle func([]byte) []byte
+	}{
+		{"flip first chunk", key, func(b []byte) []byte { b[40] ^= 1; return b }},
+		{"flip last chunk", key, func(b []byte) []byte { b[len(b)-1] ^= 1; return b }},
+		{"truncate mid chunk", key, func(b []byte) []byte { return b[:len(b)-10] }},
+		{"truncate at chunk", key, func(b []byte) []byte { return b[:len(b)-(chunkSize+16)] }},
+		{"wrong key", newCryptTestKey(t, "wrong"), func(b []byte) []byte { return b }},
+	}
+
+	for _, test := range tests {
+		store, stored := setup()
+
+		w, err := store.Create("file")
+		writeFile(t, w, err, test.mangle(stored))
+
+		efs, err := crypt.New(store, test.key, crypt.Options{ChunkSize: chunkSize})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := readFile(efs.Open("file")); err != crypt.ErrTampered {
+			t.Errorf("%v: got error %v, want %v", test.name, err, crypt.ErrTampered)
+		}
+	}
+}
+
+// TestCryptMoved checks that a file's contents can't be passed off as another
+// file's, and that sizes are right for files written with another chunk size.
+func TestCryptMoved(t *testing.T) {
+	key := newCryptTestKey(t, "secret")
+	store := inmem.New()
+
+	efs, err := crypt.New(store, key, crypt.Options{ChunkSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte(strings.Repeat("x", 1000))
+	w, err := efs.Create("a")
+	writeFile(t, w, err, want)
+	w, err = efs.Create("b")
+	writeFile(t, w, err, []byte("b"))
+
+	// Reading it through a store with another chunk size still works.
+	other, err := crypt.New(store, key, crypt.Options{ChunkSize: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := other.Stat("a"); err != nil || info.Size() != int64(len(want)) {
+		t.Errorf("stat with another chunk size got %v, %v, want size %v", info, err, len(want))
+	}
+	if got, err := readFile(other.Open("/a")); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("read with another chunk size got %v, want the contents", err)
+	}
+
+	stored, err := readFile(store.Open("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err = store.Create("b")
+	writeFile(t, w, err, stored)
+
+	if _, err := readFile(efs.Open("b")); err != crypt.ErrTampered {
+		t.Errorf("moved file: got error %v, want %v", err, crypt.ErrTampered)
+	}
+}
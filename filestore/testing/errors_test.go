@@ -0,0 +1,140 @@
+package testing
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/shaladdle/goaaw/blkstore"
+	"github.com/shaladdle/goaaw/filestore"
+	"github.com/shaladdle/goaaw/filestore/compress"
+	"github.com/shaladdle/goaaw/filestore/inmem"
+	"github.com/shaladdle/goaaw/filestore/std"
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+// TestErrors checks that every store reports missing files and files used as
+// directories with the sentinel errors, including across the network.
+func TestErrors(t *testing.T) {
+	for _, ti := range tests {
+		store, cleanup, err := ti.setup(t)
+		if err != nil {
+			t.Errorf("test %v: test initialization: %v", ti.name, err)
+			cleanup()
+			continue
+		}
+
+		if _, err := store.Open("missing"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("test %v: open of a missing file got %v, want ErrNotExist", ti.name, err)
+		}
+		if _, err := store.Stat("missing"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("test %v: stat of a missing file got %v, want ErrNotExist", ti.name, err)
+		}
+		if err := store.Remove("missing"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("test %v: remove of a missing file got %v, want ErrNotExist", ti.name, err)
+		}
+
+		w, err := store.Create("file")
+		if err != nil {
+			t.Errorf("test %v: create: %v", ti.name, err)
+			cleanup()
+			continue
+		}
+		w.Write([]byte("contents"))
+		if err := w.Close(); err != nil {
+			t.Errorf("test %v: close: %v", ti.name, err)
+		}
+
+		if _, err := store.GetFiles("file"); !errors.Is(err, fs.ErrNotDir) {
+			t.Errorf("test %v: listing a file got %v, want ErrNotDir", ti.name, err)
+		}
+
+		cleanup()
+	}
+}
+
+// TestRemoveNotEmpty checks that the local stores agree on how they refuse
+// to remove a directory that still has files in it.
+func TestRemoveNotEmpty(t *testing.T) {
+	te := testutil.NewTestEnv("testcase-remove-not-empty", t)
+	defer te.Teardown()
+
+	for _, store := range []fs.FileStore{std.New(te.Root()), inmem.New()} {
+		store.Mkdir("dir")
+		writeBytes(t, store, "dir/file", []byte("contents"))
+
+		err := store.Remove("dir")
+		if !errors.Is(err, syscall.ENOTEMPTY) {
+			t.Errorf("%T: removing a non-empty directory got %v, want ENOTEMPTY", store, err)
+		}
+		if _, ok := err.(*os.PathError); !ok {
+			t.Errorf("%T: got a %T, want an *os.PathError", store, err)
+		}
+	}
+}
+
+// TestIntegrityErrors damages data under the encrypting and compressing
+// wrappers, and checks that reading it fails with an error that is both
+// fs.ErrIntegrity and blkstore.ErrCorrupted.
+func TestIntegrityErrors(t *testing.T) {
+	// damage changes the block stored under key in mem.
+	damage := func(mem blkstore.BlkStore, key string, f func([]byte) []byte) {
+		b, err := mem.Get(key)
+		if err != nil {
+			t.Fatalf("get %v: %v", key, err)
+		}
+		if err := mem.Put(key, f(b)); err != nil {
+			t.Fatalf("put %v: %v", key, err)
+		}
+	}
+	flip := func(b []byte) []byte { b[len(b)-1] ^= 1; return b }
+	cut := func(b []byte) []byte { return b[:len(b)-1] }
+
+	stores := []struct {
+		name   string
+		wrap   func(blkstore.BlkStore) blkstore.BlkStore
+		damage func([]byte) []byte
+	}{
+		{"encrypted", func(bs blkstore.BlkStore) blkstore.BlkStore {
+			return blkstore.NewEncryptedStore(bs, newCryptTestKey(t, "passphrase"))
+		}, flip},
+		{"compressed", func(bs blkstore.BlkStore) blkstore.BlkStore {
+			return blkstore.NewCompressedStore(bs, compress.None)
+		}, cut},
+		{"compressed gzip", func(bs blkstore.BlkStore) blkstore.BlkStore {
+			return blkstore.NewCompressedStore(bs, compress.Gzip)
+		}, flip},
+	}
+
+	for _, st := range stores {
+		mem := blkstore.NewMemStore()
+		bs := st.wrap(mem)
+		if err := bs.Put("key", []byte("block contents")); err != nil {
+			t.Fatalf("%v: put: %v", st.name, err)
+		}
+		damage(mem, "key", st.damage)
+
+		_, err := bs.Get("key")
+		if !errors.Is(err, fs.ErrIntegrity) || !errors.Is(err, blkstore.ErrCorrupted) {
+			t.Errorf("%v: get of a damaged block got %v, want ErrCorrupted", st.name, err)
+		}
+	}
+
+	// The compressing FileStore reports a cut off file the same way.
+	store := inmem.New()
+	cfs := compress.New(store, compress.None)
+	writeBytes(t, cfs, "file", []byte("file contents"))
+	b := readBytes(t, store, "file")
+	writeBytes(t, store, "file", b[:len(b)-3])
+
+	r, err := cfs.Open("file")
+	if err == nil {
+		_, err = ioutil.ReadAll(r)
+		r.Close()
+	}
+	if !errors.Is(err, fs.ErrIntegrity) {
+		t.Errorf("compressed file: reading a cut off file got %v, want ErrIntegrity", err)
+	}
+}
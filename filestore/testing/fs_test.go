@@ -9,9 +9,15 @@ import (
 	"testing"
 
 	"github.com/shaladdle/goaaw/filestore"
+	"github.com/shaladdle/goaaw/filestore/compress"
+	"github.com/shaladdle/goaaw/filestore/crypt"
+	"github.com/shaladdle/goaaw/filestore/inmem"
+	"github.com/shaladdle/goaaw/filestore/mirror"
 	"github.com/shaladdle/goaaw/filestore/remote"
 	"github.com/shaladdle/goaaw/filestore/std"
+	"github.com/shaladdle/goaaw/filestore/tiered"
 	"github.com/shaladdle/goaaw/filestore/util"
+	"github.com/shaladdle/goaaw/filestore/versioned"
 	"github.com/shaladdle/goaaw/testutil"
 )
 
@@ -25,6 +31,47 @@ var tests = []testInfo{
 		te := testutil.NewTestEnv("testcase-stdfs", t)
 		return std.New(te.Root()), func() { te.Teardown() }, nil
 	}},
+	{"std-atomic", func(t *testing.T) (fs.FileStore, func(), error) {
+		te := testutil.NewTestEnv("testcase-stdfs-atomic", t)
+		return std.NewWithOptions(te.Root(), std.Options{Atomic: true, Sync: true}), func() { te.Teardown() }, nil
+	}},
+	{"inmem", func(t *testing.T) (fs.FileStore, func(), error) {
+		return inmem.New(), func() {}, nil
+	}},
+	{"compress", func(t *testing.T) (fs.FileStore, func(), error) {
+		te := testutil.NewTestEnv("testcase-compressfs", t)
+		return compress.New(std.New(te.Root()), compress.Gzip), func() { te.Teardown() }, nil
+	}},
+	{"crypt", func(t *testing.T) (fs.FileStore, func(), error) {
+		var key crypt.Key
+		efs, err := crypt.New(inmem.New(), key, crypt.Options{EncryptNames: true})
+		return efs, func() {}, err
+	}},
+	{"tiered", func(t *testing.T) (fs.FileStore, func(), error) {
+		te := testutil.NewTestEnv("testcase-tieredfs", t)
+		c := tiered.NewCache(std.New(te.Root()), inmem.New(), tiered.Options{
+			Policy:  tiered.WriteBack,
+			MaxSize: 64 * testutil.KB,
+		})
+		return c, func() { c.Close(); te.Teardown() }, nil
+	}},
+	{"overlay", func(t *testing.T) (fs.FileStore, func(), error) {
+		return tiered.NewOverlay(inmem.New(), inmem.New()), func() {}, nil
+	}},
+	{"mirror", func(t *testing.T) (fs.FileStore, func(), error) {
+		te := testutil.NewTestEnv("testcase-mirrorfs", t)
+		m, err := mirror.New([]fs.FileStore{std.New(te.Root()), inmem.New(), inmem.New()}, mirror.Options{})
+		return m, func() { te.Teardown() }, err
+	}},
+	{"erasure", func(t *testing.T) (fs.FileStore, func(), error) {
+		e, err := mirror.NewErasure([]fs.FileStore{inmem.New(), inmem.New(), inmem.New(), inmem.New()}, 2)
+		return e, func() {}, err
+	}},
+	{"versioned", func(t *testing.T) (fs.FileStore, func(), error) {
+		te := testutil.NewTestEnv("testcase-versionedfs", t)
+		vfs, err := versioned.New(std.New(te.Root()), versioned.Retention{MaxVersions: 2})
+		return vfs, func() { te.Teardown() }, err
+	}},
 	{"remote", func(t *testing.T) (fs.FileStore, func(), error) {
 		const hostport = "localhost:9000"
 
@@ -283,6 +330,37 @@ func TestGetFiles(t *testing.T) {
 	}
 }
 
+// TestGetFilesSkipsDirs checks that GetFiles leaves subdirectories out,
+// rather than listing them or leaving gaps for them.
+func TestGetFilesSkipsDirs(t *testing.T) {
+	for _, ti := range tests {
+		fs, cleanup, err := ti.setup(t)
+		if err != nil {
+			t.Errorf("test %v: test initialization: %v", ti.name, err)
+			cleanup()
+			continue
+		}
+
+		if err := fs.Mkdir("dir/sub"); err != nil {
+			t.Errorf("test %v: Mkdir: %v", ti.name, err)
+		}
+		if f, err := fs.Create("dir/file"); err != nil {
+			t.Errorf("test %v: Create: %v", ti.name, err)
+		} else {
+			f.Close()
+		}
+
+		infos, err := fs.GetFiles("dir")
+		if err != nil {
+			t.Errorf("test %v: GetFiles: %v", ti.name, err)
+		} else if len(infos) != 1 || infos[0] == nil || infos[0].Name() != "file" {
+			t.Errorf("test %v: GetFiles got %v, want only file", ti.name, infos)
+		}
+
+		cleanup()
+	}
+}
+
 // TestMkdir creates a directory and then stats it. If the os.FileInfo that is
 // returned does not indicate IsDir() == true, the test fails.
 func TestMkdir(t *testing.T) {
@@ -0,0 +1,159 @@
+package testing
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/shaladdle/goaaw/filestore"
+	"github.com/shaladdle/goaaw/filestore/remote"
+	"github.com/shaladdle/goaaw/filestore/std"
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+// TestHash checks that stores with checksums report the right hash for a
+// file, both when it was just written and when it has been overwritten.
+func TestHash(t *testing.T) {
+	for _, ti := range tests {
+		func() {
+			store, cleanup, err := ti.setup(t)
+			if err != nil {
+				t.Fatalf("test %v: setup: %v", ti.name, err)
+			}
+			defer cleanup()
+
+			hfs, ok := store.(fs.HashFileStore)
+			if !ok {
+				return
+			}
+
+			for _, contents := range []string{"first contents", "second"} {
+				writeBytes(t, hfs, "hashed", []byte(contents))
+
+				want := sha256.Sum256([]byte(contents))
+				got, err := hfs.Hash("hashed")
+				if err != nil {
+					t.Errorf("test %v: hash: %v", ti.name, err)
+				} else if !bytes.Equal(got, want[:]) {
+					t.Errorf("test %v: got hash %x, want %x", ti.name, got, want)
+				}
+			}
+
+			if _, err := hfs.Hash("missing"); err == nil {
+				t.Errorf("test %v: hash of a missing file succeeded", ti.name)
+			}
+		}()
+	}
+}
+
+// corrupt flips a byte of the file at fpath without changing its size or
+// modification time, like a bad disk would.
+func corrupt(t *testing.T, fpath string) {
+	info, err := os.Stat(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)/2] ^= 0xff
+
+	if err := ioutil.WriteFile(fpath, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(fpath, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestIntegrity corrupts files on disk and checks that reading them, locally
+// or through the remote server, fails with ErrIntegrity.
+func TestIntegrity(t *testing.T) {
+	te := testutil.NewTestEnv("testcase-integrity", t)
+	defer te.Teardown()
+
+	stdfs := std.New(te.Root())
+	cli, srv, err := remote.NewPipeCliSrv(te.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	want := []byte("some data that will be damaged")
+
+	for _, store := range []fs.FileStore{stdfs, cli} {
+		writeBytes(t, store, "file", want)
+
+		// Reads are fine until the file is damaged.
+		if got := readBytes(t, store, "file"); !bytes.Equal(got, want) {
+			t.Fatalf("%T: got %q, want %q", store, got, want)
+		}
+
+		corrupt(t, te.PathFor("file"))
+
+		r, err := store.Open("file")
+		if err != nil {
+			t.Fatalf("%T: open: %v", store, err)
+		}
+		_, err = ioutil.ReadAll(r)
+		r.Close()
+
+		if !errors.Is(err, fs.ErrIntegrity) {
+			t.Errorf("%T: reading a corrupt file got %v, want ErrIntegrity", store, err)
+		}
+	}
+
+	// A file changed on purpose, which changes its modification time, is
+	// hashed again rather than reported as corrupt.
+	if err := ioutil.WriteFile(te.PathFor("file"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := readBytes(t, cli, "file"); string(got) != "new" {
+		t.Errorf("got %q after changing the file, want %q", got, "new")
+	}
+	sum, err := cli.Hash("file")
+	if want := sha256.Sum256([]byte("new")); err != nil || !bytes.Equal(sum, want[:]) {
+		t.Errorf("remote hash got %x, %v, want %x", sum, err, want)
+	}
+}
+
+// TestHashXattrReserved checks that the extended attribute holding a file's
+// hash can't be read, changed or removed by callers, locally or through the
+// remote server.
+func TestHashXattrReserved(t *testing.T) {
+	const attr = "user.goaaw.sha256"
+
+	te := testutil.NewTestEnv("testcase-hash-xattr", t)
+	defer te.Teardown()
+
+	stdfs := std.New(te.Root())
+	cli, srv, err := remote.NewPipeCliSrv(te.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	want := []byte("hashed contents")
+	for _, store := range []fs.AttrFileStore{stdfs, cli} {
+		writeBytes(t, store, "file", want)
+
+		if _, err := store.GetXattr("file", attr); !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("%T: getxattr got %v, want ErrPermission", store, err)
+		}
+		if err := store.SetXattr("file", attr, []byte("forged")); !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("%T: setxattr got %v, want ErrPermission", store, err)
+		}
+		if err := store.RemoveXattr("file", attr); !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("%T: removexattr got %v, want ErrPermission", store, err)
+		}
+
+		if got := readBytes(t, store, "file"); !bytes.Equal(got, want) {
+			t.Errorf("%T: got %q, want %q", store, got, want)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package testing
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/shaladdle/goaaw/filestore"
+	"github.com/shaladdle/goaaw/filestore/inmem"
+	"github.com/shaladdle/goaaw/filestore/mirror"
+	"github.com/shaladdle/goaaw/filestore/std"
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+var errOffline = errors.New("backend is offline")
+
+// flakyStore wraps a FileStore and fails every operation while it is
+// offline, like a remote server that can't be reached.
+type flakyStore struct {
+	fs.FileStore
+	offline bool
+}
+
+func (f *flakyStore) Open(fpath string) (io.ReadCloser, error) {
+	if f.offline {
+		return nil, errOffline
+	}
+	return f.FileStore.Open(fpath)
+}
+
+func (f *flakyStore) Create(fpath string) (io.WriteCloser, error) {
+	if f.offline {
+		return nil, errOffline
+	}
+	return f.FileStore.Create(fpath)
+}
+
+func (f *flakyStore) Mkdir(dpath string) error {
+	if f.offline {
+		return errOffline
+	}
+	return f.FileStore.Mkdir(dpath)
+}
+
+func (f *flakyStore) Stat(fpath string) (os.FileInfo, error) {
+	if f.offline {
+		return nil, errOffline
+	}
+	return f.FileStore.Stat(fpath)
+}
+
+func (f *flakyStore) Remove(fpath string) error {
+	if f.offline {
+		return errOffline
+	}
+	return f.FileStore.Remove(fpath)
+}
+
+func (f *flakyStore) GetFiles(dpath string) ([]os.FileInfo, error) {
+	if f.offline {
+		return nil, errOffline
+	}
+	return f.FileStore.GetFiles(dpath)
+}
+
+func (f *flakyStore) ReadDir(dpath string) ([]os.FileInfo, error) {
+	if f.offline {
+		return nil, errOffline
+	}
+	return f.FileStore.(fs.DirFileStore).ReadDir(dpath)
+}
+
+// TestMirrorRepair takes a backend offline, makes changes, and checks that
+// Repair brings the backend back in sync.
+func TestMirrorRepair(t *testing.T) {
+	te := testutil.NewTestEnv("testcase-mirror-repair", t)
+	defer te.Teardown()
+
+	flaky := &flakyStore{FileStore: inmem.New()}
+	m, err := mirror.New([]fs.FileStore{std.New(te.Root()), inmem.New(), flaky}, mirror.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeBytes(t, m, "old", []byte("old"))
+	writeBytes(t, m, "changed", []byte("before"))
+
+	flaky.offline = true
+	writeBytes(t, m, "new", []byte("new"))
+	writeBytes(t, m, "changed", []byte("after"))
+	if err := m.Remove("old"); err != nil {
+		t.Fatalf("remove with a backend offline: %v", err)
+	}
+	if down := m.Down(); len(down) != 1 || down[0] != 2 {
+		t.Errorf("got down backends %v, want [2]", down)
+	}
+
+	if err := m.Repair("/"); err == nil {
+		t.Errorf("repair succeeded while a backend was still offline")
+	}
+
+	flaky.offline = false
+	if err := m.Repair("/"); err != nil {
+		t.Fatalf("repair: %v", err)
+	}
+	if down := m.Down(); len(down) != 0 {
+		t.Errorf("got down backends %v after repair, want none", down)
+	}
+
+	if got := readBytes(t, flaky, "new"); string(got) != "new" {
+		t.Errorf("new file got %q after repair", got)
+	}
+	if got := readBytes(t, flaky, "changed"); string(got) != "after" {
+		t.Errorf("changed file got %q after repair, want %q", got, "after")
+	}
+	if _, err := flaky.Stat("old"); err == nil {
+		t.Errorf("removed file is still on the repaired backend")
+	}
+}
+
+// TestMirrorStaleRead removes a file while a backend is down, and checks that
+// the down backend's stale copy isn't read before it is repaired.
+func TestMirrorStaleRead(t *testing.T) {
+	flaky := &flakyStore{FileStore: inmem.New()}
+	m, err := mirror.New([]fs.FileStore{inmem.New(), inmem.New(), flaky}, mirror.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeBytes(t, m, "file", []byte("stale"))
+
+	flaky.offline = true
+	if err := m.Remove("file"); err != nil {
+		t.Fatalf("remove with a backend offline: %v", err)
+	}
+	flaky.offline = false
+
+	if r, err := m.Open("file"); !errors.Is(err, fs.ErrNotExist) {
+		if err == nil {
+			r.Close()
+		}
+		t.Errorf("open of a removed file got %v, want ErrNotExist", err)
+	}
+	if _, err := m.Stat("file"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stat of a removed file got %v, want ErrNotExist", err)
+	}
+}
+
+// TestMirrorRepairTree checks that Repair fixes files below subdirectories,
+// and removes directories that were removed while a backend was offline.
+func TestMirrorRepairTree(t *testing.T) {
+	flaky := &flakyStore{FileStore: inmem.New()}
+	m, err := mirror.New([]fs.FileStore{inmem.New(), inmem.New(), flaky}, mirror.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{"a", "a/b", "gone"} {
+		if err := m.Mkdir(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeBytes(t, m, "gone/file", []byte("gone"))
+
+	flaky.offline = true
+	if err := m.Mkdir("a/b/c"); err != nil {
+		t.Fatal(err)
+	}
+	writeBytes(t, m, "a/b/c/deep", []byte("deep"))
+	writeBytes(t, m, "a/file", []byte("file"))
+	if err := m.Remove("gone/file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Remove("gone"); err != nil {
+		t.Fatal(err)
+	}
+
+	flaky.offline = false
+	if err := m.Repair("/"); err != nil {
+		t.Fatalf("repair: %v", err)
+	}
+	if down := m.Down(); len(down) != 0 {
+		t.Errorf("got down backends %v after repair, want none", down)
+	}
+
+	if got := readBytes(t, flaky, "a/b/c/deep"); string(got) != "deep" {
+		t.Errorf("deep file got %q after repair", got)
+	}
+	if got := readBytes(t, flaky, "a/file"); string(got) != "file" {
+		t.Errorf("nested file got %q after repair", got)
+	}
+	if _, err := flaky.Stat("gone"); err == nil {
+		t.Errorf("removed directory is still on the repaired backend")
+	}
+}
+
+// TestMirrorQuorum checks that writes fail once too few backends are left.
+func TestMirrorQuorum(t *testing.T) {
+	te := testutil.NewTestEnv("testcase-mirror-quorum", t)
+	defer te.Teardown()
+
+	a := &flakyStore{FileStore: inmem.New()}
+	b := &flakyStore{FileStore: inmem.New()}
+	c := std.New(te.Root())
+	m, err := mirror.New([]fs.FileStore{a, b, c}, mirror.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.offline = true
+	writeBytes(t, m, "file", []byte("data"))
+
+	b.offline = true
+	if _, err := m.Create("file2"); !errors.Is(err, mirror.ErrNoQuorum) {
+		t.Errorf("create with one of three backends got %v, want ErrNoQuorum", err)
+	}
+	if _, err := c.Stat("file2"); err == nil {
+		t.Errorf("create without a quorum left the file on the backend that was up")
+	}
+
+	// Reads still work from the one that's left.
+	if got := readBytes(t, m, "file"); string(got) != "data" {
+		t.Errorf("read got %q, want %q", got, "data")
+	}
+}
+
+// TestErasureLoss writes files with 3 data and 2 parity shards and checks
+// that they can be read with any two backends lost, and that Repair rebuilds
+// the lost shards.
+func TestErasureLoss(t *testing.T) {
+	var stores []*flakyStore
+	var backends []fs.FileStore
+	for i := 0; i < 5; i++ {
+		s := &flakyStore{FileStore: inmem.New()}
+		stores = append(stores, s)
+		backends = append(backends, s)
+	}
+
+	e, err := mirror.NewErasure(backends, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := testutil.WriteRandFile(buf, 10*testutil.KB+7); err != nil {
+		t.Fatal(err)
+	}
+	want := buf.Bytes()
+	writeBytes(t, e, "blob", want)
+	writeBytes(t, e, "empty", nil)
+
+	for i := range stores {
+		for j := i + 1; j < len(stores); j++ {
+			stores[i].offline, stores[j].offline = true, true
+
+			if got := readBytes(t, e, "blob"); !bytes.Equal(got, want) {
+				t.Errorf("backends %v and %v lost: blob read back incorrectly", i, j)
+			}
+			if got := readBytes(t, e, "empty"); len(got) != 0 {
+				t.Errorf("backends %v and %v lost: empty file read back %v bytes", i, j, len(got))
+			}
+
+			stores[i].offline, stores[j].offline = false, false
+		}
+	}
+
+	for _, i := range []int{0, 1, 2} {
+		stores[i].offline = true
+	}
+	if _, err := e.Open("blob"); err == nil {
+		t.Errorf("read succeeded with three of five backends lost")
+	}
+	for _, s := range stores {
+		s.offline = false
+	}
+
+	// Lose a shard completely, corrupt another, and have Repair fix both.
+	stores[1].FileStore.Remove("blob")
+	writeBytes(t, stores[3].FileStore, "blob", []byte("garbage"))
+
+	if err := e.Repair("/"); err != nil {
+		t.Fatalf("repair: %v", err)
+	}
+
+	for _, i := range []int{0, 2} {
+		stores[i].offline = true
+	}
+	if got := readBytes(t, e, "blob"); !bytes.Equal(got, want) {
+		t.Errorf("blob read back incorrectly from the repaired shards")
+	}
+}
+
+// TestErasureRepairTree checks that Repair rebuilds shards below
+// subdirectories, and that Stat gets sizes without needing every shard.
+func TestErasureRepairTree(t *testing.T) {
+	flaky := &flakyStore{FileStore: inmem.New()}
+	e, err := mirror.NewErasure([]fs.FileStore{flaky, inmem.New(), inmem.New(), inmem.New()}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Mkdir("dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	flaky.offline = true
+	if err := e.Mkdir("dir/sub"); err != nil {
+		t.Fatal(err)
+	}
+	writeBytes(t, e, "dir/sub/file", []byte("nested contents"))
+
+	if info, err := e.Stat("dir/sub/file"); err != nil {
+		t.Errorf("stat with a backend offline: %v", err)
+	} else if info.Size() != int64(len("nested contents")) {
+		t.Errorf("stat got size %v, want %v", info.Size(), len("nested contents"))
+	}
+
+	flaky.offline = false
+	if err := e.Repair("/"); err != nil {
+		t.Fatalf("repair: %v", err)
+	}
+	if down := e.Down(); len(down) != 0 {
+		t.Errorf("got down backends %v after repair, want none", down)
+	}
+	if _, err := flaky.Stat("dir/sub/file"); err != nil {
+		t.Errorf("nested shard wasn't rebuilt: %v", err)
+	}
+}
+
+// TestErasureStale overwrites a file while a backend is offline, and checks
+// that the stale shard isn't used.
+func TestErasureStale(t *testing.T) {
+	flaky := &flakyStore{FileStore: inmem.New()}
+	e, err := mirror.NewErasure([]fs.FileStore{flaky, inmem.New(), inmem.New(), inmem.New()}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeBytes(t, e, "file", []byte("first version"))
+
+	flaky.offline = true
+	writeBytes(t, e, "file", []byte("second version"))
+	flaky.offline = false
+
+	if got := readBytes(t, e, "file"); string(got) != "second version" {
+		t.Errorf("got %q, want %q", got, "second version")
+	}
+
+	if err := e.Repair("/"); err != nil {
+		t.Fatalf("repair: %v", err)
+	}
+	if len(e.Down()) != 0 {
+		t.Errorf("backends %v still down after repair", e.Down())
+	}
+}
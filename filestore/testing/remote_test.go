@@ -0,0 +1,99 @@
+package testing
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/shaladdle/goaaw/filestore/remote"
+	"github.com/shaladdle/goaaw/filestore/std"
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+// TestReadDir checks that ReadDir lists subdirectories as well as files,
+// locally and through the remote server.
+func TestReadDir(t *testing.T) {
+	te := testutil.NewTestEnv("testcase-readdir", t)
+	defer te.Teardown()
+
+	stdfs := std.New(te.Root())
+	cli, srv, err := remote.NewPipeCliSrv(te.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	stdfs.Mkdir("dir/sub")
+	writeBytes(t, stdfs, "dir/file", []byte("contents"))
+
+	for _, store := range []interface {
+		ReadDir(string) ([]os.FileInfo, error)
+	}{stdfs, cli} {
+		infos, err := store.ReadDir("dir")
+		if err != nil {
+			t.Fatalf("%T: %v", store, err)
+		}
+
+		sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+		if len(infos) != 2 || infos[0].Name() != "file" || infos[1].Name() != "sub" || !infos[1].IsDir() {
+			t.Errorf("%T: got %v, want file and sub/", store, infos)
+		}
+	}
+
+	// GetFiles still leaves the subdirectory out.
+	if infos, err := cli.GetFiles("dir"); err != nil || len(infos) != 1 {
+		t.Errorf("remote GetFiles got %v, %v, want one file", infos, err)
+	}
+}
+
+// TestRemoteTLS serves a directory over TLS and checks that a client that
+// trusts the server's certificate can use it.
+func TestRemoteTLS(t *testing.T) {
+	const hostport = "localhost:9001"
+
+	te := testutil.NewTestEnv("testcase-remote-tls", t)
+	defer te.Teardown()
+
+	certFile, keyFile := te.PathFor("cert.pem"), te.PathFor("key.pem")
+	if err := testutil.CreateCertKeyFiles(keyFile, certFile); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Mkdir(te.PathFor("root"), 0755)
+	srvConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv, err := remote.NewTLSServerWithOptions(te.PathFor("root"), hostport, srvConfig, std.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	pem, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pem)
+
+	cli, err := remote.NewTLSClient(hostport, &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeBytes(t, cli, "file", []byte("secret"))
+	if got := readBytes(t, cli, "file"); string(got) != "secret" {
+		t.Errorf("got %q, want %q", got, "secret")
+	}
+
+	// A client that doesn't trust the certificate is turned away.
+	if _, err := remote.NewTLSClient(hostport, &tls.Config{}); err == nil {
+		t.Errorf("client without the server's certificate connected")
+	}
+}
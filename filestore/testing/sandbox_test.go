@@ -0,0 +1,192 @@
+package testing
+
+import (
+	"errors"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/shaladdle/goaaw/filestore"
+	"github.com/shaladdle/goaaw/filestore/remote"
+	"github.com/shaladdle/goaaw/filestore/std"
+	anet "github.com/shaladdle/goaaw/net"
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+type sandboxInfo struct {
+	name  string
+	setup func(t *testing.T, root string, opts std.Options) (fs.FileStore, func())
+}
+
+var sandboxTests = []sandboxInfo{
+	{"std", func(t *testing.T, root string, opts std.Options) (fs.FileStore, func()) {
+		return std.NewWithOptions(root, opts), func() {}
+	}},
+	{"remote", func(t *testing.T, root string, opts std.Options) (fs.FileStore, func()) {
+		pnet := anet.NewPipeNet()
+
+		srv, err := remote.NewServerWithOptions(root, pnet, opts)
+		if err != nil {
+			t.Fatalf("server creation: %v", err)
+		}
+
+		cli, err := remote.NewClient(pnet)
+		if err != nil {
+			srv.Close()
+			t.Fatalf("client creation: %v", err)
+		}
+
+		return cli, func() {
+			cli.Close()
+			srv.Close()
+		}
+	}},
+}
+
+// TestSandboxEscape makes sure that paths which would leave the root are
+// rejected, whether that is through '..', an absolute path or a symlink.
+func TestSandboxEscape(t *testing.T) {
+	te := testutil.NewTestEnv("TestSandboxEscape", t)
+	defer te.Teardown()
+
+	root := te.PathFor("root")
+	outside := te.PathFor("outside")
+	for _, dir := range []string{root, outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := testutil.GenRandFile(path.Join(outside, "secret"), testutil.KB); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, path.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	badPaths := []string{
+		"../outside/secret",
+		"a/../../outside/secret",
+		"/etc/passwd",
+		"link/secret",
+	}
+
+	for _, st := range sandboxTests {
+		fs, cleanup := st.setup(t, root, std.Options{})
+
+		for _, p := range badPaths {
+			if r, err := fs.Open(p); err == nil {
+				r.Close()
+				t.Errorf("test %v: open of %v should have failed", st.name, p)
+			}
+			if _, err := fs.Stat(p); err == nil {
+				t.Errorf("test %v: stat of %v should have failed", st.name, p)
+			}
+			if err := fs.Remove(p); err == nil {
+				t.Errorf("test %v: remove of %v should have failed", st.name, p)
+			}
+		}
+
+		if _, err := fs.Create("../created"); err == nil {
+			t.Errorf("test %v: create outside of root should have failed", st.name)
+		}
+		if _, err := os.Stat(te.PathFor("created")); err == nil {
+			t.Errorf("test %v: file was created outside of root", st.name)
+		}
+
+		if _, err := os.Stat(path.Join(outside, "secret")); err != nil {
+			t.Errorf("test %v: file outside of root was touched: %v", st.name, err)
+		}
+
+		cleanup()
+	}
+}
+
+// TestSandboxReadOnly checks that a read only file system can be read, but
+// refuses any modification.
+func TestSandboxReadOnly(t *testing.T) {
+	te := testutil.NewTestEnv("TestSandboxReadOnly", t)
+	defer te.Teardown()
+
+	const fname = "file"
+	if err := testutil.GenRandFile(te.PathFor(fname), testutil.KB); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, st := range sandboxTests {
+		store, cleanup := st.setup(t, te.Root(), std.Options{ReadOnly: true})
+
+		if r, err := store.Open(fname); err != nil {
+			t.Errorf("test %v: open: %v", st.name, err)
+		} else {
+			r.Close()
+		}
+
+		if _, err := store.Create("new"); !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("test %v: create got %v, want a permission error", st.name, err)
+		}
+		if err := store.Mkdir("dir"); !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("test %v: mkdir got %v, want a permission error", st.name, err)
+		}
+		if err := store.Remove(fname); !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("test %v: remove got %v, want a permission error", st.name, err)
+		}
+
+		cleanup()
+	}
+}
+
+// TestSandboxQuota fills up a quota and checks that writing past it fails.
+func TestSandboxQuota(t *testing.T) {
+	te := testutil.NewTestEnv("TestSandboxQuota", t)
+	defer te.Teardown()
+
+	const quota = 4 * testutil.KB
+
+	fs := std.NewWithOptions(te.Root(), std.Options{Quota: quota})
+
+	w, err := fs.Create("a")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := testutil.WriteRandFile(w, quota); err != nil {
+		t.Errorf("write up to the quota: %v", err)
+	}
+	w.Close()
+
+	if _, err := fs.Create("b"); err != std.ErrQuotaExceeded {
+		t.Errorf("create past quota: got %v, want %v", err, std.ErrQuotaExceeded)
+	}
+
+	// Overwriting a file frees up its old contents.
+	w, err = fs.Create("a")
+	if err != nil {
+		t.Fatalf("create over existing file: %v", err)
+	}
+	if _, err := w.Write(make([]byte, quota+1)); err != std.ErrQuotaExceeded {
+		t.Errorf("write past quota: got %v, want %v", err, std.ErrQuotaExceeded)
+	}
+	w.Close()
+
+	// Removing a file frees up its contents, and writers that are open at
+	// the same time share what is left.
+	if err := fs.Remove("a"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	w1, err := fs.Create("b")
+	if err != nil {
+		t.Fatalf("create after remove: %v", err)
+	}
+	w2, err := fs.Create("c")
+	if err != nil {
+		t.Fatalf("create after remove: %v", err)
+	}
+	if _, err := w1.Write(make([]byte, quota)); err != nil {
+		t.Errorf("write up to the quota after remove: %v", err)
+	}
+	if _, err := w2.Write(make([]byte, 1)); err != std.ErrQuotaExceeded {
+		t.Errorf("second writer past quota: got %v, want %v", err, std.ErrQuotaExceeded)
+	}
+	w1.Close()
+	w2.Close()
+}
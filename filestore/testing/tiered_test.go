@@ -0,0 +1,407 @@
+package testing
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/shaladdle/goaaw/filestore"
+	"github.com/shaladdle/goaaw/filestore/inmem"
+	"github.com/shaladdle/goaaw/filestore/std"
+	"github.com/shaladdle/goaaw/filestore/tiered"
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func writeBytes(t *testing.T, store fs.FileStore, fpath string, b []byte) {
+	w, err := store.Create(fpath)
+	if err != nil {
+		t.Fatalf("create %v: %v", fpath, err)
+	}
+	w.Write(b)
+	if err := w.Close(); err != nil {
+		t.Fatalf("close %v: %v", fpath, err)
+	}
+}
+
+func readBytes(t *testing.T, store fs.FileStore, fpath string) []byte {
+	r, err := store.Open(fpath)
+	if err != nil {
+		t.Fatalf("open %v: %v", fpath, err)
+	}
+	defer r.Close()
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read %v: %v", fpath, err)
+	}
+
+	return b
+}
+
+// TestTieredPolicies checks when writes reach the backing store under each
+// policy.
+func TestTieredPolicies(t *testing.T) {
+	te := testutil.NewTestEnv("testcase-tiered-policies", t)
+	defer te.Teardown()
+
+	want := []byte("some data")
+
+	backing := inmem.New()
+	c := tiered.NewCache(std.New(te.Root()), backing, tiered.Options{Policy: tiered.WriteThrough})
+	writeBytes(t, c, "dir/through", want)
+	if got := readBytes(t, backing, "dir/through"); !bytes.Equal(got, want) {
+		t.Errorf("write through: backing store has %q, want %q", got, want)
+	}
+	c.Close()
+
+	backing = inmem.New()
+	c = tiered.NewCache(std.New(te.Root()), backing, tiered.Options{Policy: tiered.WriteBack})
+	writeBytes(t, c, "dir/back", want)
+	if _, err := backing.Stat("dir/back"); err == nil {
+		t.Errorf("write back: file reached the backing store before Flush")
+	}
+	if got := readBytes(t, c, "dir/back"); !bytes.Equal(got, want) {
+		t.Errorf("write back: read %q before flush, want %q", got, want)
+	}
+	if infos, err := c.GetFiles("dir"); err != nil || len(infos) != 1 {
+		t.Errorf("write back: GetFiles got %v, %v, want the dirty file", infos, err)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if got := readBytes(t, backing, "dir/back"); !bytes.Equal(got, want) {
+		t.Errorf("write back: backing store has %q after flush, want %q", got, want)
+	}
+	c.Close()
+}
+
+// TestTieredEviction fills the cache past its limit and checks that the least
+// recently used files are dropped from the cache store, and dirty ones are
+// written back first.
+func TestTieredEviction(t *testing.T) {
+	cache, backing := inmem.New(), inmem.New()
+	c := tiered.NewCache(cache, backing, tiered.Options{
+		Policy:  tiered.WriteBack,
+		MaxSize: 3 * testutil.KB,
+	})
+	defer c.Close()
+
+	data := bytes.Repeat([]byte("x"), int(testutil.KB))
+	for _, name := range []string{"a", "b", "c"} {
+		writeBytes(t, c, name, data)
+	}
+
+	// Touch a so that b is the least recently used.
+	readBytes(t, c, "a")
+	writeBytes(t, c, "d", data)
+
+	if _, err := cache.Stat("b"); err == nil {
+		t.Errorf("b is still in the cache store after eviction")
+	}
+	for _, name := range []string{"a", "c", "d"} {
+		if _, err := cache.Stat(name); err != nil {
+			t.Errorf("%v was evicted: %v", name, err)
+		}
+	}
+	if got := readBytes(t, backing, "b"); !bytes.Equal(got, data) {
+		t.Errorf("evicted dirty file wasn't written back")
+	}
+	if got := readBytes(t, c, "b"); !bytes.Equal(got, data) {
+		t.Errorf("evicted file read back incorrectly")
+	}
+}
+
+// TestTieredInvalidation changes a file behind the cache's back and checks
+// that the stale copy isn't served.
+func TestTieredInvalidation(t *testing.T) {
+	backing := inmem.New()
+	c := tiered.NewCache(inmem.New(), backing, tiered.Options{})
+	defer c.Close()
+
+	writeBytes(t, backing, "file", []byte("old"))
+	if got := readBytes(t, c, "file"); string(got) != "old" {
+		t.Fatalf("got %q, want %q", got, "old")
+	}
+
+	writeBytes(t, backing, "file", []byte("newer"))
+	if got := readBytes(t, c, "file"); string(got) != "newer" {
+		t.Errorf("got %q after backing store changed, want %q", got, "newer")
+	}
+
+	backing.Remove("file")
+	if _, err := c.Open("file"); err == nil {
+		t.Errorf("open succeeded after the file was removed from the backing store")
+	}
+}
+
+// gatedStore blocks Opens of one file until gate is closed, and sends on
+// entered when one starts.
+type gatedStore struct {
+	fs.FileStore
+	fpath   string
+	entered chan bool
+	gate    chan bool
+}
+
+func (g *gatedStore) Open(fpath string) (io.ReadCloser, error) {
+	if fpath == g.fpath {
+		g.entered <- true
+		<-g.gate
+	}
+	return g.FileStore.Open(fpath)
+}
+
+// TestTieredSlowFill checks that a file being copied into the cache doesn't
+// hold up Opens of other files.
+func TestTieredSlowFill(t *testing.T) {
+	backing := &gatedStore{
+		FileStore: inmem.New(),
+		fpath:     "slow",
+		entered:   make(chan bool),
+		gate:      make(chan bool),
+	}
+	c := tiered.NewCache(inmem.New(), backing, tiered.Options{})
+	defer c.Close()
+
+	writeBytes(t, backing, "slow", []byte("slow"))
+	writeBytes(t, backing, "fast", []byte("fast"))
+
+	done := make(chan []byte)
+	go func() {
+		r, err := c.Open("slow")
+		if err != nil {
+			t.Errorf("open slow: %v", err)
+			done <- nil
+			return
+		}
+		defer r.Close()
+
+		b, _ := ioutil.ReadAll(r)
+		done <- b
+	}()
+
+	<-backing.entered
+	if got := readBytes(t, c, "fast"); string(got) != "fast" {
+		t.Errorf("fast file got %q", got)
+	}
+
+	close(backing.gate)
+	if got := <-done; string(got) != "slow" {
+		t.Errorf("slow file got %q", got)
+	}
+}
+
+// gatedWriteStore blocks Creates of one file until gate is closed, and sends
+// on entered when one starts.
+type gatedWriteStore struct {
+	fs.FileStore
+	fpath   string
+	entered chan bool
+	gate    chan bool
+}
+
+func (g *gatedWriteStore) Create(fpath string) (io.WriteCloser, error) {
+	if fpath == g.fpath {
+		g.entered <- true
+		<-g.gate
+	}
+	return g.FileStore.Create(fpath)
+}
+
+// TestTieredSlowFlush checks that a file being written back doesn't hold up
+// the rest of the cache.
+func TestTieredSlowFlush(t *testing.T) {
+	backing := &gatedWriteStore{
+		FileStore: inmem.New(),
+		fpath:     "slow",
+		entered:   make(chan bool),
+		gate:      make(chan bool),
+	}
+	c := tiered.NewCache(inmem.New(), backing, tiered.Options{Policy: tiered.WriteBack})
+	defer c.Close()
+
+	writeBytes(t, backing.FileStore, "fast", []byte("fast"))
+	writeBytes(t, c, "slow", []byte("slow"))
+
+	done := make(chan error)
+	go func() {
+		done <- c.Flush()
+	}()
+
+	<-backing.entered
+	if got := readBytes(t, c, "fast"); string(got) != "fast" {
+		t.Errorf("fast file got %q", got)
+	}
+	if info, err := c.Stat("slow"); err != nil || info.Size() != 4 {
+		t.Errorf("stat of the file being written back got %v, %v", info, err)
+	}
+
+	close(backing.gate)
+	if err := <-done; err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if got := readBytes(t, backing, "slow"); string(got) != "slow" {
+		t.Errorf("backing store has %q after flush, want %q", got, "slow")
+	}
+}
+
+// brokenWriteStore hands out writers that fail to write while broken is set,
+// and records whether each was closed or aborted.
+type brokenWriteStore struct {
+	fs.FileStore
+	broken bool
+	ends   []string
+}
+
+type brokenWriter struct {
+	io.WriteCloser
+	s *brokenWriteStore
+}
+
+func (b *brokenWriteStore) Create(fpath string) (io.WriteCloser, error) {
+	w, err := b.FileStore.Create(fpath)
+	if err != nil {
+		return nil, err
+	}
+	return &brokenWriter{w, b}, nil
+}
+
+func (w *brokenWriter) Write(p []byte) (int, error) {
+	if w.s.broken {
+		return 0, errors.New("broken")
+	}
+	return w.WriteCloser.Write(p)
+}
+
+func (w *brokenWriter) Close() error {
+	w.s.ends = append(w.s.ends, "closed")
+	return w.WriteCloser.Close()
+}
+
+func (w *brokenWriter) Abort() error {
+	w.s.ends = append(w.s.ends, "aborted")
+	return nil
+}
+
+// TestTieredFailedWriteBack checks that a write back that fails part way is
+// aborted, and that the file stays dirty so the next Flush tries again.
+func TestTieredFailedWriteBack(t *testing.T) {
+	backing := &brokenWriteStore{FileStore: inmem.New(), broken: true}
+	c := tiered.NewCache(inmem.New(), backing, tiered.Options{Policy: tiered.WriteBack})
+	defer c.Close()
+
+	writeBytes(t, c, "file", []byte("data"))
+	if err := c.Flush(); err == nil {
+		t.Fatalf("flush to a broken store succeeded")
+	}
+	if len(backing.ends) != 1 || backing.ends[0] != "aborted" {
+		t.Errorf("failed write back got %v, want it aborted", backing.ends)
+	}
+
+	backing.broken = false
+	if err := c.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if got := readBytes(t, backing, "file"); string(got) != "data" {
+		t.Errorf("backing store has %q after the second flush, want %q", got, "data")
+	}
+}
+
+// TestTieredOpenWhileWriting opens a file that is being written with
+// WriteBack, and checks that the cached copy isn't clobbered by a fill.
+func TestTieredOpenWhileWriting(t *testing.T) {
+	te := testutil.NewTestEnv("testcase-tiered-writing", t)
+	defer te.Teardown()
+
+	backing := inmem.New()
+	c := tiered.NewCache(std.New(te.Root()), backing, tiered.Options{Policy: tiered.WriteBack})
+	defer c.Close()
+
+	writeBytes(t, backing, "file", []byte("old"))
+
+	w, err := c.Create("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("new"))
+
+	if got := readBytes(t, c, "file"); string(got) != "old" {
+		t.Errorf("open while writing got %q, want the written back %q", got, "old")
+	}
+
+	w.Write([]byte(" data"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readBytes(t, c, "file"); string(got) != "new data" {
+		t.Errorf("got %q after writing, want %q", got, "new data")
+	}
+}
+
+// TestOverlay checks that the lower layer shows through, is never written to,
+// and that removed lower files stay hidden.
+func TestOverlay(t *testing.T) {
+	upper, lower := inmem.New(), inmem.New()
+	writeBytes(t, lower, "dir/lower", []byte("lower"))
+	writeBytes(t, lower, "dir/shadowed", []byte("lower"))
+
+	o := tiered.NewOverlay(upper, lower)
+
+	if got := readBytes(t, o, "dir/lower"); string(got) != "lower" {
+		t.Errorf("read through to lower got %q", got)
+	}
+
+	writeBytes(t, o, "dir/shadowed", []byte("upper"))
+	if got := readBytes(t, o, "dir/shadowed"); string(got) != "upper" {
+		t.Errorf("shadowed file got %q, want %q", got, "upper")
+	}
+	if got := readBytes(t, lower, "dir/shadowed"); string(got) != "lower" {
+		t.Errorf("lower layer was modified, got %q", got)
+	}
+
+	if err := o.Remove("dir/lower"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := o.Stat("dir/lower"); err == nil {
+		t.Errorf("removed lower file is still visible")
+	}
+	if _, err := lower.Stat("dir/lower"); err != nil {
+		t.Errorf("lower file was removed from the lower layer: %v", err)
+	}
+
+	infos, err := o.GetFiles("dir")
+	if err != nil {
+		t.Fatalf("GetFiles: %v", err)
+	}
+	if len(infos) != 1 || infos[0].Name() != "shadowed" {
+		t.Errorf("GetFiles got %v, want only shadowed", infos)
+	}
+
+	writeBytes(t, o, "dir/lower", []byte("again"))
+	if got := readBytes(t, o, "dir/lower"); string(got) != "again" {
+		t.Errorf("recreated file got %q, want %q", got, "again")
+	}
+}
+
+// TestOverlayUpperError checks that errors from the upper layer other than a
+// missing file don't expose the lower layer's copy.
+func TestOverlayUpperError(t *testing.T) {
+	upper, lower := &flakyStore{FileStore: inmem.New()}, inmem.New()
+	writeBytes(t, lower, "file", []byte("lower"))
+
+	o := tiered.NewOverlay(upper, lower)
+	writeBytes(t, o, "file", []byte("upper"))
+
+	upper.offline = true
+	if r, err := o.Open("file"); err == nil {
+		b, _ := ioutil.ReadAll(r)
+		r.Close()
+		t.Errorf("open with the upper layer offline got %q, want an error", b)
+	}
+	if _, err := o.Stat("file"); err == nil {
+		t.Errorf("stat with the upper layer offline succeeded")
+	}
+}
@@ -0,0 +1,261 @@
+package testing
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/shaladdle/goaaw/filestore/inmem"
+	"github.com/shaladdle/goaaw/filestore/std"
+	"github.com/shaladdle/goaaw/filestore/versioned"
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+// TestVersions overwrites and removes a file, and checks that every old
+// version can be listed, read and restored.
+func TestVersions(t *testing.T) {
+	te := testutil.NewTestEnv("testcase-versions", t)
+	defer te.Teardown()
+
+	vfs, err := versioned.New(std.New(te.Root()), versioned.Retention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vfs.Mkdir("dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	contents := []string{"one", "two", "three"}
+	for _, c := range contents {
+		writeBytes(t, vfs, "dir/file", []byte(c))
+	}
+
+	vs, err := vfs.Versions("dir/file")
+	if err != nil {
+		t.Fatalf("versions: %v", err)
+	}
+	if len(vs) != 2 {
+		t.Fatalf("got %v versions, want 2", len(vs))
+	}
+
+	for i, v := range vs {
+		r, err := vfs.OpenVersion("dir/file", v.ID)
+		if err != nil {
+			t.Fatalf("open version %v: %v", v.ID, err)
+		}
+		got, _ := ioutil.ReadAll(r)
+		r.Close()
+
+		if string(got) != contents[i] {
+			t.Errorf("version %v got %q, want %q", i, got, contents[i])
+		}
+		if v.Size != int64(len(contents[i])) {
+			t.Errorf("version %v has size %v, want %v", i, v.Size, len(contents[i]))
+		}
+	}
+
+	if err := vfs.Remove("dir/file"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if vs, _ := vfs.Versions("dir/file"); len(vs) != 3 {
+		t.Errorf("got %v versions after remove, want 3", len(vs))
+	}
+
+	if err := vfs.Restore("dir/file", vs[0].ID); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if got := readBytes(t, vfs, "dir/file"); string(got) != "one" {
+		t.Errorf("restored file got %q, want %q", got, "one")
+	}
+
+	if _, err := vfs.OpenVersion("dir/file", "12345"); err != versioned.ErrNoVersion {
+		t.Errorf("open of missing version got %v, want ErrNoVersion", err)
+	}
+	if _, err := vfs.Open(".versions/dirs"); err != versioned.ErrReserved {
+		t.Errorf("open of version data got %v, want ErrReserved", err)
+	}
+
+	// History survives reopening the store.
+	vfs, err = versioned.New(std.New(te.Root()), versioned.Retention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vs, _ := vfs.Versions("dir/file"); len(vs) != 3 {
+		t.Errorf("got %v versions after reopening, want 3", len(vs))
+	}
+}
+
+// TestVersionRetention checks that old versions are pruned by count.
+func TestVersionRetention(t *testing.T) {
+	vfs, err := versioned.New(inmem.New(), versioned.Retention{MaxVersions: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []string{"1", "2", "3", "4", "5"} {
+		writeBytes(t, vfs, "file", []byte(c))
+	}
+
+	vs, err := vfs.Versions("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 2 {
+		t.Fatalf("got %v versions, want 2", len(vs))
+	}
+
+	r, err := vfs.OpenVersion("file", vs[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(got) != "3" {
+		t.Errorf("oldest kept version got %q, want %q", got, "3")
+	}
+}
+
+// TestSnapshots takes snapshots of a tree, changes it, and checks that the
+// snapshots still show the old tree and can be restored.
+func TestSnapshots(t *testing.T) {
+	te := testutil.NewTestEnv("testcase-snapshots", t)
+	defer te.Teardown()
+
+	vfs, err := versioned.New(std.New(te.Root()), versioned.Retention{MaxVersions: 1, MaxSnapshots: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vfs.Mkdir("tree/sub")
+	writeBytes(t, vfs, "tree/a", []byte("a1"))
+	writeBytes(t, vfs, "tree/sub/b", []byte("b1"))
+	writeBytes(t, vfs, "outside", []byte("outside"))
+
+	if err := vfs.Snapshot("first", "tree"); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if err := vfs.Snapshot("first", "tree"); err != versioned.ErrSnapshotExists {
+		t.Errorf("duplicate snapshot got %v, want ErrSnapshotExists", err)
+	}
+
+	// Enough changes that retention would have pruned the snapshot's
+	// versions if they weren't pinned.
+	for _, c := range []string{"a2", "a3", "a4"} {
+		writeBytes(t, vfs, "tree/a", []byte(c))
+	}
+	vfs.Remove("tree/sub/b")
+	writeBytes(t, vfs, "tree/c", []byte("c"))
+
+	snapFS, err := vfs.SnapshotFS("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readBytes(t, snapFS, "tree/a"); string(got) != "a1" {
+		t.Errorf("snapshot tree/a got %q, want %q", got, "a1")
+	}
+	if got := readBytes(t, snapFS, "tree/sub/b"); string(got) != "b1" {
+		t.Errorf("snapshot tree/sub/b got %q, want %q", got, "b1")
+	}
+	if _, err := snapFS.Stat("outside"); err == nil {
+		t.Errorf("file outside the tree is in the snapshot")
+	}
+	if infos, err := snapFS.GetFiles("tree"); err != nil || len(infos) != 1 {
+		t.Errorf("snapshot GetFiles(tree) got %v, %v, want one file", infos, err)
+	}
+	if _, err := snapFS.Create("tree/new"); err == nil {
+		t.Errorf("create in a snapshot succeeded")
+	}
+
+	if err := vfs.RestoreSnapshot("first"); err != nil {
+		t.Fatalf("restore snapshot: %v", err)
+	}
+	if got := readBytes(t, vfs, "tree/a"); string(got) != "a1" {
+		t.Errorf("restored tree/a got %q, want %q", got, "a1")
+	}
+	if got := readBytes(t, vfs, "tree/sub/b"); string(got) != "b1" {
+		t.Errorf("restored tree/sub/b got %q, want %q", got, "b1")
+	}
+	if _, err := vfs.Stat("tree/c"); err == nil {
+		t.Errorf("file created after the snapshot survived restoring it")
+	}
+
+	vfs.Snapshot("second", "tree")
+	vfs.Snapshot("third", "tree")
+
+	snaps := vfs.Snapshots()
+	if len(snaps) != 2 || snaps[0].Name != "second" || snaps[1].Name != "third" {
+		t.Errorf("got snapshots %v, want second and third", snaps)
+	}
+	if _, err := vfs.SnapshotFS("first"); err != versioned.ErrNoSnapshot {
+		t.Errorf("expired snapshot got %v, want ErrNoSnapshot", err)
+	}
+
+	// Snapshots are reloaded along with the rest of the history.
+	vfs, err = versioned.New(std.New(te.Root()), versioned.Retention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snaps := vfs.Snapshots(); len(snaps) != 2 {
+		t.Errorf("got %v snapshots after reopening, want 2", len(snaps))
+	}
+}
+
+// TestSnapshotSharing checks that snapshots of unchanged files share a
+// version, that directories made behind the FileStore's back are included,
+// and that odd file names survive saving the snapshot.
+func TestSnapshotSharing(t *testing.T) {
+	te := testutil.NewTestEnv("testcase-snapshot-sharing", t)
+	defer te.Teardown()
+
+	store := std.New(te.Root())
+	vfs, err := versioned.New(store, versioned.Retention{MaxVersions: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vfs.Mkdir("tree")
+	writeBytes(t, vfs, "tree/same", []byte("same"))
+	writeBytes(t, vfs, "tree/odd\nname", []byte("odd"))
+
+	// Made without going through vfs.
+	if err := store.Mkdir("tree/behind"); err != nil {
+		t.Fatal(err)
+	}
+	writeBytes(t, store, "tree/behind/file", []byte("behind"))
+
+	for _, name := range []string{"one", "two"} {
+		if err := vfs.Snapshot(name, "tree"); err != nil {
+			t.Fatalf("snapshot %v: %v", name, err)
+		}
+	}
+
+	if vs, err := vfs.Versions("tree/same"); err != nil || len(vs) != 1 {
+		t.Errorf("unchanged file got versions %v, %v, want one shared version", vs, err)
+	}
+
+	// Both snapshots still need the shared version after the file changes.
+	writeBytes(t, vfs, "tree/same", []byte("changed"))
+	writeBytes(t, vfs, "tree/same", []byte("changed again"))
+	if err := vfs.DeleteSnapshot("one"); err != nil {
+		t.Fatal(err)
+	}
+
+	vfs, err = versioned.New(std.New(te.Root()), versioned.Retention{MaxVersions: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapFS, err := vfs.SnapshotFS("two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for fpath, want := range map[string]string{
+		"tree/same":        "same",
+		"tree/odd\nname":   "odd",
+		"tree/behind/file": "behind",
+	} {
+		if got := readBytes(t, snapFS, fpath); string(got) != want {
+			t.Errorf("snapshot %q got %q, want %q", fpath, got, want)
+		}
+	}
+}
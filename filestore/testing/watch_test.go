@@ -0,0 +1,101 @@
+package testing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shaladdle/goaaw/filestore"
+)
+
+const watchTimeout = 5 * time.Second
+
+// waitForEvent reads events from w until one matching op and fpath arrives.
+func waitForEvent(t *testing.T, testName string, w fs.Watcher, op fs.EventOp, fpath string) {
+	timeout := time.After(watchTimeout)
+	for {
+		select {
+		case ev, ok := <-w.Events():
+			if !ok {
+				t.Errorf("test %v: watcher closed while waiting for %v %v", testName, op, fpath)
+				return
+			}
+			if ev.Op == op && ev.Path == fpath {
+				return
+			}
+		case <-timeout:
+			t.Errorf("test %v: timed out waiting for %v %v", testName, op, fpath)
+			return
+		}
+	}
+}
+
+// TestWatch checks that creating, writing and removing files shows up as
+// events on a watcher, including in directories made after the watch began.
+func TestWatch(t *testing.T) {
+	testBody := func(i int, ti testInfo) {
+		store, cleanup, err := ti.setup(t)
+		defer cleanup()
+		if err != nil {
+			t.Errorf("test %v: test initialization: %v", ti.name, err)
+			return
+		}
+
+		// Watching is optional.
+		wfs, ok := store.(fs.WatchFileStore)
+		if !ok {
+			return
+		}
+
+		w, err := wfs.Watch("/")
+		if err != nil {
+			t.Errorf("test %v: watch: %v", ti.name, err)
+			return
+		}
+		defer w.Close()
+
+		f, err := wfs.Create("file")
+		if err != nil {
+			t.Errorf("test %v: create: %v", ti.name, err)
+			return
+		}
+		f.Write([]byte("data"))
+		f.Close()
+		waitForEvent(t, ti.name, w, fs.EventCreate, "file")
+
+		if err := wfs.Mkdir("dir"); err != nil {
+			t.Errorf("test %v: mkdir: %v", ti.name, err)
+			return
+		}
+		waitForEvent(t, ti.name, w, fs.EventCreate, "dir")
+
+		f, err = wfs.Create("dir/nested")
+		if err != nil {
+			t.Errorf("test %v: create: %v", ti.name, err)
+			return
+		}
+		f.Close()
+		waitForEvent(t, ti.name, w, fs.EventCreate, "dir/nested")
+
+		// The inner directories are made before the outer ones can be
+		// watched, and still show up.
+		if err := wfs.Mkdir("deep/er/est"); err != nil {
+			t.Errorf("test %v: mkdir: %v", ti.name, err)
+			return
+		}
+		waitForEvent(t, ti.name, w, fs.EventCreate, "deep/er/est")
+
+		if err := wfs.Remove("file"); err != nil {
+			t.Errorf("test %v: remove: %v", ti.name, err)
+			return
+		}
+		waitForEvent(t, ti.name, w, fs.EventRemove, "file")
+
+		if err := w.Close(); err != nil {
+			t.Errorf("test %v: close: %v", ti.name, err)
+		}
+	}
+
+	for i, ti := range tests {
+		testBody(i, ti)
+	}
+}
@@ -0,0 +1,180 @@
+package tiered
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/shaladdle/goaaw/filestore"
+)
+
+const whiteoutPrefix = ".wh."
+
+// whiteoutPath returns the path of the marker that hides the lower layer's
+// copy of fpath.
+func whiteoutPath(fpath string) string {
+	dir, name := path.Split(fpath)
+	return normPath(path.Join(dir, whiteoutPrefix+name))
+}
+
+func isWhiteout(name string) bool {
+	return strings.HasPrefix(name, whiteoutPrefix)
+}
+
+// Overlay presents an upper store layered over a lower store, which is never
+// written to. Reads look in the upper store first and fall through to the
+// lower one. Writes always go to the upper store. Removing a file that exists
+// in the lower store leaves a hidden ".wh.name" marker in the upper store so
+// the lower copy stays hidden, much like a union mount.
+type Overlay struct {
+	upper fs.FileStore
+	lower fs.FileStore
+}
+
+// NewOverlay returns an Overlay with upper layered over lower.
+func NewOverlay(upper, lower fs.FileStore) *Overlay {
+	return &Overlay{upper, lower}
+}
+
+// whitedOut reports whether fpath, or any directory above it, has been
+// removed from the upper layer.
+func (o *Overlay) whitedOut(key string) bool {
+	for p := key; p != "" && p != "."; p = normPath(path.Dir(p)) {
+		if _, err := o.upper.Stat(whiteoutPath(p)); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (o *Overlay) Open(fpath string) (io.ReadCloser, error) {
+	key := normPath(fpath)
+
+	// Only a file that's missing from the upper layer may come from the
+	// lower one. Any other error would show a copy that was replaced.
+	f, err := o.upper.Open(key)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return f, err
+	}
+
+	if o.whitedOut(key) {
+		return nil, &os.PathError{Op: "open", Path: fpath, Err: os.ErrNotExist}
+	}
+
+	return o.lower.Open(key)
+}
+
+// clearWhiteout makes the lower layer's copy of key visible again before it
+// is replaced.
+func (o *Overlay) clearWhiteout(key string) {
+	o.upper.Remove(whiteoutPath(key))
+}
+
+func (o *Overlay) Create(fpath string) (io.WriteCloser, error) {
+	key := normPath(fpath)
+
+	if err := o.upper.Mkdir(path.Dir(key)); err != nil {
+		return nil, err
+	}
+
+	o.clearWhiteout(key)
+
+	return o.upper.Create(key)
+}
+
+func (o *Overlay) Mkdir(dpath string) error {
+	key := normPath(dpath)
+
+	o.clearWhiteout(key)
+
+	return o.upper.Mkdir(key)
+}
+
+func (o *Overlay) Stat(fpath string) (os.FileInfo, error) {
+	key := normPath(fpath)
+
+	info, err := o.upper.Stat(key)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return info, err
+	}
+
+	if o.whitedOut(key) {
+		return nil, &os.PathError{Op: "stat", Path: fpath, Err: os.ErrNotExist}
+	}
+
+	return o.lower.Stat(key)
+}
+
+func (o *Overlay) Remove(fpath string) error {
+	key := normPath(fpath)
+
+	_, uerr := o.upper.Stat(key)
+	_, lerr := o.lower.Stat(key)
+	inLower := lerr == nil && !o.whitedOut(key)
+
+	if uerr != nil && !inLower {
+		return &os.PathError{Op: "remove", Path: fpath, Err: os.ErrNotExist}
+	}
+
+	if uerr == nil {
+		if err := o.upper.Remove(key); err != nil {
+			return err
+		}
+	}
+
+	if !inLower {
+		return nil
+	}
+
+	if err := o.upper.Mkdir(path.Dir(key)); err != nil {
+		return err
+	}
+
+	w, err := o.upper.Create(whiteoutPath(key))
+	if err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+func (o *Overlay) GetFiles(dpath string) ([]os.FileInfo, error) {
+	key := normPath(dpath)
+
+	uinfos, uerr := o.upper.GetFiles(key)
+
+	var linfos []os.FileInfo
+	lerr := os.ErrNotExist
+	if !o.whitedOut(key) {
+		linfos, lerr = o.lower.GetFiles(key)
+	}
+
+	if uerr != nil && lerr != nil {
+		return nil, uerr
+	}
+
+	hidden := make(map[string]bool)
+	ret := []os.FileInfo{}
+	for _, info := range uinfos {
+		if isWhiteout(info.Name()) {
+			hidden[strings.TrimPrefix(info.Name(), whiteoutPrefix)] = true
+			continue
+		}
+
+		hidden[info.Name()] = true
+		ret = append(ret, info)
+	}
+
+	for _, info := range linfos {
+		if hidden[info.Name()] {
+			continue
+		}
+
+		ret = append(ret, info)
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,703 @@
+// Package tiered provides FileStores that layer one store on top of another:
+// a size bounded cache in front of a slower backing store, and an overlay
+// that sends writes to an upper store while reads fall through to a read only
+// lower store.
+package tiered
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shaladdle/goaaw/filestore"
+)
+
+// Policy decides when writes reach the backing store.
+type Policy int
+
+const (
+	// WriteThrough writes to the cache and the backing store at the same
+	// time. A file is in the backing store as soon as it is closed.
+	WriteThrough Policy = iota
+
+	// WriteBack writes only to the cache. Files are copied to the backing
+	// store by Flush, which is also run periodically if FlushInterval is
+	// set, and before a dirty file is evicted.
+	WriteBack
+)
+
+// Options controls the behavior of a Cache.
+type Options struct {
+	Policy Policy
+
+	// MaxSize is the number of bytes of file data the cache may hold. A
+	// MaxSize of 0 means there is no limit.
+	MaxSize int64
+
+	// FlushInterval is how often dirty files are written back when using
+	// WriteBack. If it is 0, files are only written back by Flush, Close,
+	// or when they are evicted.
+	FlushInterval time.Duration
+}
+
+// normPath turns fpath into the relative form used as a key for the cache,
+// and for talking to the underlying stores.
+func normPath(fpath string) string {
+	return strings.TrimPrefix(path.Clean("/"+fpath), "/")
+}
+
+type cacheEntry struct {
+	fpath string
+	size  int64
+
+	// The size and modification time of the file in the backing store when
+	// it was cached. If they no longer match, the cached copy is stale.
+	backingSize  int64
+	backingMtime time.Time
+
+	// dirty is set for files that haven't been written back yet.
+	dirty bool
+}
+
+// Cache keeps copies of recently used files from a backing store in a faster
+// cache store, evicting the least recently used ones when it gets too big.
+// Cache is safe for concurrent use.
+type Cache struct {
+	cache   fs.FileStore
+	backing fs.FileStore
+	opts    Options
+
+	lock    sync.Mutex
+	lruList *list.List
+	lruMap  map[string]*list.Element
+	curSize int64
+
+	// Copying a file can take a while, so it is done without holding lock.
+	// Instead, copies has a channel for every file that is being copied
+	// into the cache, written back or removed, which is closed once it is
+	// done, and writers counts the open cacheWriters for every file. Files
+	// that are busy either way are left alone by eviction and Flush.
+	copies  map[string]chan bool
+	writers map[string]int
+
+	done chan bool
+	wg   sync.WaitGroup
+}
+
+// NewCache returns a Cache that stores copies of files from backing in cache,
+// which is usually a std.FileSystem on local disk. The cache store should
+// not be used by anything else.
+func NewCache(cache, backing fs.FileStore, opts Options) *Cache {
+	c := &Cache{
+		cache:   cache,
+		backing: backing,
+		opts:    opts,
+		lruList: list.New(),
+		lruMap:  make(map[string]*list.Element),
+		copies:  make(map[string]chan bool),
+		writers: make(map[string]int),
+		done:    make(chan bool),
+	}
+
+	if opts.Policy == WriteBack && opts.FlushInterval > 0 {
+		c.wg.Add(1)
+		go c.flusher()
+	}
+
+	return c
+}
+
+func (c *Cache) flusher() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.Flush()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Close stops the background flusher and writes back any dirty files.
+func (c *Cache) Close() error {
+	close(c.done)
+	c.wg.Wait()
+
+	return c.Flush()
+}
+
+// lookup returns the entry for key and marks it as recently used. The caller
+// must hold c.lock.
+func (c *Cache) lookup(key string) (*cacheEntry, bool) {
+	el, ok := c.lruMap[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.lruList.MoveToFront(el)
+	return el.Value.(*cacheEntry), true
+}
+
+// add records a new entry, replacing any old one for the same file, and
+// evicts files until the cache fits in MaxSize again. The caller must hold
+// c.lock.
+func (c *Cache) add(ent *cacheEntry) error {
+	c.forget(ent.fpath)
+
+	c.lruMap[ent.fpath] = c.lruList.PushFront(ent)
+	c.curSize += ent.size
+
+	return c.evict()
+}
+
+// forget drops the entry for key without touching the cache store. The
+// caller must hold c.lock.
+func (c *Cache) forget(key string) {
+	if el, ok := c.lruMap[key]; ok {
+		c.curSize -= el.Value.(*cacheEntry).size
+		c.lruList.Remove(el)
+		delete(c.lruMap, key)
+	}
+}
+
+// busy reports whether key is being copied or written. The caller must hold
+// c.lock.
+func (c *Cache) busy(key string) bool {
+	_, copying := c.copies[key]
+	return copying || c.writers[key] > 0
+}
+
+// waitCopy waits until key isn't being copied. The caller must hold c.lock,
+// which is released while waiting.
+func (c *Cache) waitCopy(key string) {
+	for {
+		done, ok := c.copies[key]
+		if !ok {
+			return
+		}
+
+		c.lock.Unlock()
+		<-done
+		c.lock.Lock()
+	}
+}
+
+// claim marks key as being copied, so that nothing else touches it until
+// the returned function is called. The caller must hold c.lock both times.
+func (c *Cache) claim(key string) (release func()) {
+	done := make(chan bool)
+	c.copies[key] = done
+
+	return func() {
+		delete(c.copies, key)
+		close(done)
+	}
+}
+
+// evict removes the least recently used files until the cache is within its
+// size limit, writing back dirty files first. Busy files are skipped. The
+// caller must hold c.lock, which is released while writing back.
+func (c *Cache) evict() error {
+	if c.opts.MaxSize == 0 {
+		return nil
+	}
+
+	for c.curSize > c.opts.MaxSize {
+		var ent *cacheEntry
+		for el := c.lruList.Back(); el != nil; el = el.Prev() {
+			if e := el.Value.(*cacheEntry); !c.busy(e.fpath) {
+				ent = e
+				break
+			}
+		}
+
+		if ent == nil {
+			return nil
+		}
+
+		if ent.dirty {
+			if err := c.writeBack(ent); err != nil {
+				return err
+			}
+
+			// The list may have changed while writeBack released the
+			// lock, so look for the least recently used file again.
+			continue
+		}
+
+		c.forget(ent.fpath)
+		if err := c.cache.Remove(ent.fpath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeBack copies a dirty file from the cache to the backing store. The
+// caller must hold c.lock, which is released while the file is copied. The
+// file is claimed in the meantime, so the entry can't change under it.
+func (c *Cache) writeBack(ent *cacheEntry) error {
+	release := c.claim(ent.fpath)
+	c.lock.Unlock()
+
+	info, err := c.copyBack(ent.fpath)
+
+	c.lock.Lock()
+	release()
+
+	if err != nil {
+		return err
+	}
+
+	ent.dirty = false
+	ent.backingSize = info.Size()
+	ent.backingMtime = info.ModTime()
+
+	return nil
+}
+
+// copyBack copies key from the cache to the backing store, and returns what
+// the backing store has for it afterwards.
+func (c *Cache) copyBack(key string) (os.FileInfo, error) {
+	r, err := c.cache.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	if err := c.backing.Mkdir(path.Dir(key)); err != nil {
+		return nil, err
+	}
+
+	w, err := c.backing.Create(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Whatever made it to the backing store is thrown away, and the entry
+	// stays dirty so the file is written back again later.
+	if _, err := io.Copy(w, r); err != nil {
+		abort(w)
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return c.backing.Stat(key)
+}
+
+type aborter interface {
+	Abort() error
+}
+
+// abort throws away what was written to w, or just closes it if it can't.
+func abort(w io.WriteCloser) error {
+	if a, ok := w.(aborter); ok {
+		return a.Abort()
+	}
+
+	return w.Close()
+}
+
+// Flush writes every dirty file back to the backing store.
+func (c *Cache) Flush() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// writeBack releases the lock, so decide what to write back first.
+	var dirty []*cacheEntry
+	for el := c.lruList.Front(); el != nil; el = el.Next() {
+		if ent := el.Value.(*cacheEntry); ent.dirty {
+			dirty = append(dirty, ent)
+		}
+	}
+
+	for _, ent := range dirty {
+		// Skip files that were written back, removed or reopened for
+		// writing in the meantime.
+		el, ok := c.lruMap[ent.fpath]
+		if !ok || el.Value != ent || !ent.dirty || c.busy(ent.fpath) {
+			continue
+		}
+
+		if err := c.writeBack(ent); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fill copies fpath from the backing store into the cache. The caller must
+// have claimed key, and must not hold c.lock.
+func (c *Cache) fill(key string, info os.FileInfo) error {
+	r, err := c.backing.Open(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err := c.cache.Mkdir(path.Dir(key)); err != nil {
+		return err
+	}
+
+	w, err := c.cache.Create(key)
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(w, r)
+	if err != nil {
+		abort(w)
+		c.cache.Remove(key)
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		c.cache.Remove(key)
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.add(&cacheEntry{
+		fpath:        key,
+		size:         n,
+		backingSize:  info.Size(),
+		backingMtime: info.ModTime(),
+	})
+}
+
+// drop forgets about key and removes it from the cache store.
+func (c *Cache) drop(key string) {
+	c.lock.Lock()
+	c.forget(key)
+	c.lock.Unlock()
+
+	c.cache.Remove(key)
+}
+
+func (c *Cache) Open(fpath string) (io.ReadCloser, error) {
+	key := normPath(fpath)
+
+	c.lock.Lock()
+
+	// Only one Open at a time checks and fills a file, the others wait to
+	// use what it cached.
+	c.waitCopy(key)
+
+	// The cached copy is being rewritten, so it can't be read or filled
+	// until the writer is closed. The backing store has the last version
+	// that was written back.
+	if c.writers[key] > 0 {
+		c.lock.Unlock()
+		return c.backing.Open(key)
+	}
+
+	ent, cached := c.lookup(key)
+	if cached && ent.dirty {
+		defer c.lock.Unlock()
+		return c.cache.Open(key)
+	}
+
+	var have cacheEntry
+	if cached {
+		have = *ent
+	}
+
+	release := c.claim(key)
+	c.lock.Unlock()
+
+	defer func() {
+		c.lock.Lock()
+		release()
+		c.lock.Unlock()
+	}()
+
+	info, err := c.backing.Stat(key)
+	if err != nil {
+		if cached {
+			c.drop(key)
+		}
+		return nil, err
+	}
+
+	if cached && have.backingSize == info.Size() && have.backingMtime.Equal(info.ModTime()) {
+		return c.cache.Open(key)
+	}
+
+	// Files that could never fit are streamed straight from the backing
+	// store.
+	if c.opts.MaxSize > 0 && info.Size() > c.opts.MaxSize {
+		if cached {
+			c.drop(key)
+		}
+		return c.backing.Open(key)
+	}
+
+	if err := c.fill(key, info); err != nil {
+		return nil, err
+	}
+
+	return c.cache.Open(key)
+}
+
+// startWrite waits for any fill of key to finish, and then counts a new
+// writer for it, so that nothing else touches its cached copy.
+func (c *Cache) startWrite(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.waitCopy(key)
+	c.writers[key]++
+}
+
+// endWrite undoes startWrite. The caller must hold c.lock.
+func (c *Cache) endWrite(key string) {
+	if c.writers[key]--; c.writers[key] == 0 {
+		delete(c.writers, key)
+	}
+}
+
+func (c *Cache) Create(fpath string) (io.WriteCloser, error) {
+	key := normPath(fpath)
+
+	if err := c.cache.Mkdir(path.Dir(key)); err != nil {
+		return nil, err
+	}
+
+	c.startWrite(key)
+
+	cw, err := c.cache.Create(key)
+	if err != nil {
+		c.lock.Lock()
+		c.endWrite(key)
+		c.lock.Unlock()
+		return nil, err
+	}
+
+	w := &cacheWriter{c: c, key: key, cache: cw}
+
+	if c.opts.Policy == WriteThrough {
+		err := c.backing.Mkdir(path.Dir(key))
+
+		var bw io.WriteCloser
+		if err == nil {
+			bw, err = c.backing.Create(key)
+		}
+
+		if err != nil {
+			cw.Close()
+
+			// The cached copy was truncated.
+			c.lock.Lock()
+			c.endWrite(key)
+			c.forget(key)
+			c.lock.Unlock()
+			c.cache.Remove(key)
+
+			return nil, err
+		}
+		w.backing = bw
+	}
+
+	return w, nil
+}
+
+// cacheWriter writes a file to the cache, and to the backing store when
+// writing through.
+type cacheWriter struct {
+	c       *Cache
+	key     string
+	cache   io.WriteCloser
+	backing io.WriteCloser
+	size    int64
+}
+
+func (w *cacheWriter) Write(b []byte) (int, error) {
+	n, err := w.cache.Write(b)
+	w.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+
+	if w.backing != nil {
+		return w.backing.Write(b)
+	}
+
+	return n, nil
+}
+
+func (w *cacheWriter) Close() error {
+	cerr := w.cache.Close()
+
+	ent := &cacheEntry{fpath: w.key, size: w.size}
+
+	var berr error
+	if w.backing != nil {
+		berr = w.backing.Close()
+
+		var info os.FileInfo
+		if berr == nil {
+			info, berr = w.c.backing.Stat(w.key)
+		}
+
+		if berr == nil {
+			ent.backingSize = info.Size()
+			ent.backingMtime = info.ModTime()
+		}
+	} else {
+		ent.dirty = true
+	}
+
+	w.c.lock.Lock()
+	defer w.c.lock.Unlock()
+
+	w.c.endWrite(w.key)
+
+	if berr != nil {
+		// The cached copy doesn't match the backing store.
+		w.c.forget(w.key)
+		w.c.cache.Remove(w.key)
+		return berr
+	}
+
+	if cerr != nil {
+		// The backing store has the data when writing through, so the
+		// cache can just forget about the file.
+		w.c.forget(w.key)
+		w.c.cache.Remove(w.key)
+		if ent.dirty {
+			return cerr
+		}
+		return nil
+	}
+
+	return w.c.add(ent)
+}
+
+func (c *Cache) Mkdir(dpath string) error {
+	key := normPath(dpath)
+
+	if err := c.cache.Mkdir(key); err != nil {
+		return err
+	}
+
+	return c.backing.Mkdir(key)
+}
+
+func (c *Cache) Stat(fpath string) (os.FileInfo, error) {
+	key := normPath(fpath)
+
+	c.lock.Lock()
+	ent, cached := c.lruMap[key]
+	dirty := cached && ent.Value.(*cacheEntry).dirty
+	c.lock.Unlock()
+
+	if dirty {
+		return c.cache.Stat(key)
+	}
+
+	return c.backing.Stat(key)
+}
+
+func (c *Cache) Remove(fpath string) error {
+	key := normPath(fpath)
+
+	c.lock.Lock()
+	c.waitCopy(key)
+
+	el, cached := c.lruMap[key]
+	dirty := cached && el.Value.(*cacheEntry).dirty
+	c.forget(key)
+
+	release := c.claim(key)
+	c.lock.Unlock()
+
+	defer func() {
+		c.lock.Lock()
+		release()
+		c.lock.Unlock()
+	}()
+
+	if cached {
+		if err := c.cache.Remove(key); err != nil {
+			return err
+		}
+	}
+
+	err := c.backing.Remove(key)
+
+	// A dirty file might never have made it to the backing store.
+	if err != nil && dirty {
+		if _, serr := c.backing.Stat(key); serr != nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+func (c *Cache) GetFiles(dpath string) ([]os.FileInfo, error) {
+	key := normPath(dpath)
+
+	infos, err := c.backing.GetFiles(key)
+
+	// Files that haven't been written back yet won't show up in the backing
+	// store, so add them in from the cache.
+	c.lock.Lock()
+	if el, ok := c.lruMap[key]; ok && el.Value.(*cacheEntry).dirty {
+		// It's a file that the backing store doesn't know about yet.
+		c.lock.Unlock()
+		return nil, fmt.Errorf("%v: %w", dpath, fs.ErrNotDir)
+	}
+
+	var dirty []string
+	for el := c.lruList.Front(); el != nil; el = el.Next() {
+		ent := el.Value.(*cacheEntry)
+		if ent.dirty && normPath(path.Dir(ent.fpath)) == key {
+			dirty = append(dirty, ent.fpath)
+		}
+	}
+	c.lock.Unlock()
+
+	if err != nil && len(dirty) == 0 {
+		return nil, err
+	}
+
+	byName := make(map[string]int)
+	ret := []os.FileInfo{}
+	for _, info := range infos {
+		byName[info.Name()] = len(ret)
+		ret = append(ret, info)
+	}
+
+	for _, fpath := range dirty {
+		info, err := c.cache.Stat(fpath)
+		if err != nil {
+			return nil, fmt.Errorf("stat of dirty file %v: %v", fpath, err)
+		}
+
+		if i, ok := byName[info.Name()]; ok {
+			ret[i] = info
+		} else {
+			ret = append(ret, info)
+		}
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,13 @@
+//go:build darwin || freebsd || netbsd
+// +build darwin freebsd netbsd
+
+package util
+
+import (
+	"syscall"
+	"time"
+)
+
+func atime(st *syscall.Stat_t) time.Time {
+	return time.Unix(int64(st.Atimespec.Sec), int64(st.Atimespec.Nsec))
+}
@@ -17,21 +17,37 @@ type FileInfo struct {
 	I_Mode    os.FileMode // file mode bits
 	I_ModTime time.Time   // modification time
 	I_IsDir   bool        // abbreviation for Mode().IsDir()
+	I_Atime   time.Time   // access time, zero if unknown
+	I_Uid     int         // user id of the owner, -1 if unknown
+	I_Gid     int         // group id of the owner, -1 if unknown
 }
 
-func (info FileInfo) Name() string       { return info.I_Name }
-func (info FileInfo) Size() int64        { return info.I_Size }
-func (info FileInfo) Mode() os.FileMode  { return info.I_Mode }
-func (info FileInfo) ModTime() time.Time { return info.I_ModTime }
-func (info FileInfo) IsDir() bool        { return info.I_IsDir }
-func (info FileInfo) Sys() interface{}   { return nil }
+func (info FileInfo) Name() string          { return info.I_Name }
+func (info FileInfo) Size() int64           { return info.I_Size }
+func (info FileInfo) Mode() os.FileMode     { return info.I_Mode }
+func (info FileInfo) ModTime() time.Time    { return info.I_ModTime }
+func (info FileInfo) IsDir() bool           { return info.I_IsDir }
+func (info FileInfo) Sys() interface{}      { return nil }
+func (info FileInfo) AccessTime() time.Time { return info.I_Atime }
+func (info FileInfo) Uid() int              { return info.I_Uid }
+func (info FileInfo) Gid() int              { return info.I_Gid }
 
 func FromOSInfo(info os.FileInfo) FileInfo {
-	return FileInfo{
+	if info, ok := info.(FileInfo); ok {
+		return info
+	}
+
+	ret := FileInfo{
 		I_Name:    info.Name(),
 		I_Size:    info.Size(),
 		I_Mode:    info.Mode(),
 		I_ModTime: info.ModTime(),
 		I_IsDir:   info.IsDir(),
+		I_Uid:     -1,
+		I_Gid:     -1,
 	}
+
+	fillSysInfo(&ret, info)
+
+	return ret
 }
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !netbsd
+// +build !linux,!darwin,!freebsd,!netbsd
+
+package util
+
+import (
+	"os"
+)
+
+func fillSysInfo(ret *FileInfo, info os.FileInfo) {}
@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd || netbsd
+// +build linux darwin freebsd netbsd
+
+package util
+
+import (
+	"os"
+	"syscall"
+)
+
+// fillSysInfo copies the ownership and access time out of the system specific
+// part of an os.FileInfo.
+func fillSysInfo(ret *FileInfo, info os.FileInfo) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+
+	ret.I_Uid = int(st.Uid)
+	ret.I_Gid = int(st.Gid)
+	ret.I_Atime = atime(st)
+}
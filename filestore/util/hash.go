@@ -0,0 +1,52 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/shaladdle/goaaw/filestore"
+)
+
+// HashReader returns the SHA-256 hash of everything read from r.
+func HashReader(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// verifyingReader hashes a file as it is read, and checks the hash once the
+// end is reached.
+type verifyingReader struct {
+	r     io.ReadCloser
+	h     hash.Hash
+	want  []byte
+	fpath string
+}
+
+// NewVerifyingReader returns a reader that reads r and, when it gets to the
+// end, checks that what was read has the SHA-256 hash want. If not, Read
+// returns an error wrapping fs.ErrIntegrity instead of io.EOF.
+func NewVerifyingReader(r io.ReadCloser, want []byte, fpath string) io.ReadCloser {
+	return &verifyingReader{r, sha256.New(), want, fpath}
+}
+
+func (v *verifyingReader) Read(b []byte) (int, error) {
+	n, err := v.r.Read(b)
+	v.h.Write(b[:n])
+
+	if err == io.EOF && !bytes.Equal(v.h.Sum(nil), v.want) {
+		return n, fmt.Errorf("%v: %w", v.fpath, fs.ErrIntegrity)
+	}
+
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	return v.r.Close()
+}
@@ -0,0 +1,416 @@
+package versioned
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shaladdle/goaaw/filestore"
+	"github.com/shaladdle/goaaw/filestore/util"
+)
+
+// Snapshot is a point in time copy of a directory tree. The files in it are
+// kept as versions. A file that hasn't changed since its last version shares
+// it, so only files that changed are copied.
+type Snapshot struct {
+	Name string
+	Root string
+	Time time.Time
+
+	// files maps the path of each file in the snapshot to its version.
+	files map[string]string
+}
+
+func validSnapshotName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+func snapshotPath(name string) string {
+	return path.Join(snapshotsDir, name)
+}
+
+// manifest is how a snapshot is saved in the store.
+type manifest struct {
+	Time  int64
+	Root  string
+	Files map[string]string
+}
+
+func (snap *Snapshot) save(store fs.FileStore) error {
+	if err := store.Mkdir(snapshotsDir); err != nil {
+		return err
+	}
+
+	w, err := store.Create(snapshotPath(snap.Name))
+	if err != nil {
+		return err
+	}
+
+	m := manifest{snap.Time.UnixNano(), snap.Root, snap.files}
+	if err := gob.NewEncoder(w).Encode(m); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+func loadSnapshot(store fs.FileStore, name string) (*Snapshot, error) {
+	f, err := store.Open(snapshotPath(name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var m manifest
+	if err := gob.NewDecoder(f).Decode(&m); err != nil {
+		return nil, fmt.Errorf("versioned: bad snapshot %v: %v", name, err)
+	}
+
+	if m.Files == nil {
+		m.Files = make(map[string]string)
+	}
+
+	return &Snapshot{Name: name, Root: m.Root, Time: time.Unix(0, m.Time), files: m.Files}, nil
+}
+
+func (vfs *FileStore) loadSnapshots() error {
+	if _, err := vfs.store.Stat(snapshotsDir); err != nil {
+		return nil
+	}
+
+	infos, err := vfs.store.GetFiles(snapshotsDir)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		snap, err := loadSnapshot(vfs.store, info.Name())
+		if err != nil {
+			return err
+		}
+
+		vfs.snapshots[snap.Name] = snap
+		vfs.pin(snap, 1)
+	}
+
+	return nil
+}
+
+// Snapshot takes a snapshot of every file in the tree rooted at dpath, and
+// saves it under name. If the retention policy limits the number of
+// snapshots, the oldest ones are deleted to make room.
+func (vfs *FileStore) Snapshot(name, dpath string) error {
+	root := normPath(dpath)
+	if reserved(root) {
+		return ErrReserved
+	}
+
+	if !validSnapshotName(name) {
+		return fmt.Errorf("versioned: invalid snapshot name %q", name)
+	}
+
+	vfs.lock.Lock()
+	defer vfs.lock.Unlock()
+
+	if _, ok := vfs.snapshots[name]; ok {
+		return ErrSnapshotExists
+	}
+
+	snap := &Snapshot{
+		Name:  name,
+		Root:  root,
+		Time:  time.Now(),
+		files: make(map[string]string),
+	}
+
+	dirs, err := vfs.treeDirs(root)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range dirs {
+		infos, err := vfs.store.GetFiles(d)
+		if err != nil {
+			// Directories removed by someone else are just skipped.
+			continue
+		}
+
+		for _, info := range infos {
+			if !info.Mode().IsRegular() {
+				continue
+			}
+
+			key := normPath(path.Join(d, info.Name()))
+			if reserved(key) {
+				continue
+			}
+
+			id, err := vfs.latestVersion(key, info)
+			if err != nil {
+				return err
+			}
+
+			if id == "" {
+				if id, err = vfs.saveVersion(key); err != nil {
+					return err
+				}
+			}
+			snap.files[key] = id
+		}
+	}
+
+	if err := snap.save(vfs.store); err != nil {
+		return err
+	}
+	vfs.snapshots[name] = snap
+	vfs.pin(snap, 1)
+
+	return vfs.expireSnapshots()
+}
+
+// sortedSnapshots returns the snapshots oldest first. The caller must hold
+// vfs.lock.
+func (vfs *FileStore) sortedSnapshots() []*Snapshot {
+	ret := make([]*Snapshot, 0, len(vfs.snapshots))
+	for _, snap := range vfs.snapshots {
+		ret = append(ret, snap)
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Time.Before(ret[j].Time) })
+	return ret
+}
+
+// expireSnapshots deletes the oldest snapshots beyond the retention limit.
+// The caller must hold vfs.lock.
+func (vfs *FileStore) expireSnapshots() error {
+	if vfs.retention.MaxSnapshots == 0 {
+		return nil
+	}
+
+	snaps := vfs.sortedSnapshots()
+	for len(snaps) > vfs.retention.MaxSnapshots {
+		if err := vfs.deleteSnapshot(snaps[0].Name); err != nil {
+			return err
+		}
+		snaps = snaps[1:]
+	}
+
+	return nil
+}
+
+// Snapshots returns every snapshot, oldest first.
+func (vfs *FileStore) Snapshots() []Snapshot {
+	vfs.lock.Lock()
+	defer vfs.lock.Unlock()
+
+	ret := []Snapshot{}
+	for _, snap := range vfs.sortedSnapshots() {
+		ret = append(ret, Snapshot{Name: snap.Name, Root: snap.Root, Time: snap.Time})
+	}
+
+	return ret
+}
+
+// DeleteSnapshot deletes a snapshot. The versions it kept are then subject to
+// the retention policy like any others.
+func (vfs *FileStore) DeleteSnapshot(name string) error {
+	vfs.lock.Lock()
+	defer vfs.lock.Unlock()
+
+	return vfs.deleteSnapshot(name)
+}
+
+// deleteSnapshot is DeleteSnapshot without the locking. The caller must hold
+// vfs.lock.
+func (vfs *FileStore) deleteSnapshot(name string) error {
+	snap, ok := vfs.snapshots[name]
+	if !ok {
+		return ErrNoSnapshot
+	}
+
+	if err := vfs.store.Remove(snapshotPath(name)); err != nil {
+		return err
+	}
+	delete(vfs.snapshots, name)
+	vfs.pin(snap, -1)
+
+	for key := range snap.files {
+		if err := vfs.prune(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (vfs *FileStore) getSnapshot(name string) (*Snapshot, error) {
+	vfs.lock.Lock()
+	defer vfs.lock.Unlock()
+
+	snap, ok := vfs.snapshots[name]
+	if !ok {
+		return nil, ErrNoSnapshot
+	}
+
+	return snap, nil
+}
+
+// RestoreSnapshot puts the tree a snapshot was taken of back the way it was.
+// Files in the snapshot are restored, and files in the tree that weren't in
+// the snapshot are removed. Everything replaced or removed is kept as a
+// version, as usual.
+func (vfs *FileStore) RestoreSnapshot(name string) error {
+	snap, err := vfs.getSnapshot(name)
+	if err != nil {
+		return err
+	}
+
+	vfs.lock.Lock()
+	dirs, err := vfs.treeDirs(snap.Root)
+	vfs.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, d := range dirs {
+		infos, err := vfs.store.GetFiles(d)
+		if err != nil {
+			continue
+		}
+
+		for _, info := range infos {
+			if !info.Mode().IsRegular() {
+				continue
+			}
+
+			key := normPath(path.Join(d, info.Name()))
+			if _, ok := snap.files[key]; ok || reserved(key) {
+				continue
+			}
+
+			if err := vfs.Remove(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	for key, id := range snap.files {
+		if err := vfs.store.Mkdir(path.Dir(key)); err != nil {
+			return err
+		}
+
+		if err := vfs.Restore(key, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SnapshotFS returns a read only FileStore showing the files in a snapshot,
+// at the same paths they had when it was taken.
+func (vfs *FileStore) SnapshotFS(name string) (fs.FileStore, error) {
+	snap, err := vfs.getSnapshot(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &snapshotFS{vfs, snap}, nil
+}
+
+type snapshotFS struct {
+	vfs  *FileStore
+	snap *Snapshot
+}
+
+func (s *snapshotFS) Open(fpath string) (io.ReadCloser, error) {
+	key := normPath(fpath)
+
+	id, ok := s.snap.files[key]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: fpath, Err: os.ErrNotExist}
+	}
+
+	return s.vfs.store.Open(versionPath(key, id))
+}
+
+func (s *snapshotFS) Create(fpath string) (io.WriteCloser, error) {
+	return nil, ErrReadOnly
+}
+
+func (s *snapshotFS) Mkdir(dpath string) error {
+	return ErrReadOnly
+}
+
+func (s *snapshotFS) Remove(fpath string) error {
+	return ErrReadOnly
+}
+
+// isDir reports whether key is a directory holding files in the snapshot.
+func (s *snapshotFS) isDir(key string) bool {
+	for fkey := range s.snap.files {
+		if key == "" || strings.HasPrefix(fkey, key+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *snapshotFS) Stat(fpath string) (os.FileInfo, error) {
+	key := normPath(fpath)
+
+	if id, ok := s.snap.files[key]; ok {
+		info, err := s.vfs.store.Stat(versionPath(key, id))
+		if err != nil {
+			return nil, err
+		}
+
+		ret := util.FromOSInfo(info)
+		ret.I_Name = path.Base(key)
+		ret.I_ModTime = s.snap.Time
+		return ret, nil
+	}
+
+	if s.isDir(key) {
+		return util.FileInfo{
+			I_Name:    path.Base("/" + key),
+			I_Mode:    os.ModeDir | 0555,
+			I_ModTime: s.snap.Time,
+			I_IsDir:   true,
+			I_Uid:     -1,
+			I_Gid:     -1,
+		}, nil
+	}
+
+	return nil, &os.PathError{Op: "stat", Path: fpath, Err: os.ErrNotExist}
+}
+
+func (s *snapshotFS) GetFiles(dpath string) ([]os.FileInfo, error) {
+	key := normPath(dpath)
+
+	if !s.isDir(key) {
+		return nil, &os.PathError{Op: "readdir", Path: dpath, Err: os.ErrNotExist}
+	}
+
+	ret := []os.FileInfo{}
+	for fkey := range s.snap.files {
+		if dir := path.Dir(fkey); dir != key && !(key == "" && dir == ".") {
+			continue
+		}
+
+		info, err := s.Stat(fkey)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, info)
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,567 @@
+// Package versioned provides a FileStore that keeps the old contents of files
+// when they are overwritten or removed, and can take named snapshots of a
+// directory tree.
+//
+// Everything is kept in the underlying store under a hidden ".versions"
+// directory. Old versions of a file are stored next to each other as
+// "name@id", where the id is a timestamp, so they sort by age. Snapshots find
+// the files in a tree by listing its directories, so the underlying store has
+// to be an fs.DirFileStore.
+package versioned
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shaladdle/goaaw/filestore"
+)
+
+const (
+	metaDir      = ".versions"
+	filesDir     = metaDir + "/files"
+	snapshotsDir = metaDir + "/snapshots"
+	versionSep   = "@"
+)
+
+var (
+	// ErrReserved is returned for paths inside the hidden directory used
+	// to store versions.
+	ErrReserved = fmt.Errorf("versioned: path is reserved for version data: %w", fs.ErrPermission)
+
+	ErrNoVersion      = fmt.Errorf("versioned: no such version: %w", fs.ErrNotExist)
+	ErrNoSnapshot     = fmt.Errorf("versioned: no such snapshot: %w", fs.ErrNotExist)
+	ErrSnapshotExists = fmt.Errorf("versioned: snapshot: %w", fs.ErrExist)
+	ErrReadOnly       = fmt.Errorf("versioned: snapshots are read only: %w", fs.ErrPermission)
+
+	errNoReadDir = errors.New("versioned: store can't list directories")
+)
+
+// Version describes an old version of a file.
+type Version struct {
+	ID   string
+	Time time.Time
+	Size int64
+}
+
+// Retention limits how much history is kept. Zero values mean no limit.
+// Versions that belong to a snapshot are kept for as long as the snapshot
+// is, whatever the policy says.
+type Retention struct {
+	// MaxVersions is the number of old versions kept for each file.
+	MaxVersions int
+
+	// MaxAge is how long old versions are kept.
+	MaxAge time.Duration
+
+	// MaxSnapshots is the number of snapshots kept. Taking a new snapshot
+	// deletes the oldest ones beyond this.
+	MaxSnapshots int
+}
+
+func normPath(fpath string) string {
+	return strings.TrimPrefix(path.Clean("/"+fpath), "/")
+}
+
+func reserved(key string) bool {
+	return key == metaDir || strings.HasPrefix(key, metaDir+"/")
+}
+
+// versionDir returns the directory holding the old versions of the files in
+// the same directory as key.
+func versionDir(key string) string {
+	return path.Join(filesDir, path.Dir(key))
+}
+
+func versionPath(key, id string) string {
+	return path.Join(versionDir(key), path.Base(key)+versionSep+id)
+}
+
+// parseVersionName splits a stored version name into the file name and the
+// version id.
+func parseVersionName(name string) (string, string, bool) {
+	i := strings.LastIndex(name, versionSep)
+	if i < 0 {
+		return "", "", false
+	}
+
+	id := name[i+len(versionSep):]
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		return "", "", false
+	}
+
+	return name[:i], id, true
+}
+
+func idTime(id string) time.Time {
+	n, _ := strconv.ParseInt(id, 10, 64)
+	return time.Unix(0, n)
+}
+
+// FileStore keeps the previous contents of a file every time it is
+// overwritten with Create or deleted with Remove.
+type FileStore struct {
+	store     fs.DirFileStore
+	retention Retention
+
+	lock      sync.Mutex
+	snapshots map[string]*Snapshot
+	lastID    int64
+
+	// pins counts the snapshots each version belongs to, keyed by the
+	// version's path.
+	pins map[string]int
+}
+
+// New returns a FileStore that keeps versions of the files in store, loading
+// any history already there. The store must implement fs.DirFileStore.
+func New(store fs.FileStore, retention Retention) (*FileStore, error) {
+	ds, ok := store.(fs.DirFileStore)
+	if !ok {
+		return nil, errNoReadDir
+	}
+
+	vfs := &FileStore{
+		store:     ds,
+		retention: retention,
+		snapshots: make(map[string]*Snapshot),
+		pins:      make(map[string]int),
+	}
+
+	if err := vfs.loadSnapshots(); err != nil {
+		return nil, err
+	}
+
+	return vfs, nil
+}
+
+// newID returns a version id later than any handed out before. The caller
+// must hold vfs.lock.
+func (vfs *FileStore) newID() string {
+	n := time.Now().UnixNano()
+	if n <= vfs.lastID {
+		n = vfs.lastID + 1
+	}
+	vfs.lastID = n
+
+	return fmt.Sprintf("%019d", n)
+}
+
+func copyFile(store fs.FileStore, from, to string) error {
+	r, err := store.Open(from)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := store.Create(to)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+// sameContents reports whether the files at a and b hold the same data, using
+// the store's hashes if it keeps them.
+func sameContents(store fs.FileStore, a, b string) (bool, error) {
+	if hs, ok := store.(fs.HashFileStore); ok {
+		ha, err := hs.Hash(a)
+		if err != nil {
+			return false, err
+		}
+
+		hb, err := hs.Hash(b)
+		if err != nil {
+			return false, err
+		}
+
+		return bytes.Equal(ha, hb), nil
+	}
+
+	ra, err := store.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer ra.Close()
+
+	rb, err := store.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer rb.Close()
+
+	bufa, bufb := make([]byte, 32*1024), make([]byte, 32*1024)
+	for {
+		na, erra := io.ReadFull(ra, bufa)
+		nb, errb := io.ReadFull(rb, bufb)
+		if !bytes.Equal(bufa[:na], bufb[:nb]) {
+			return false, nil
+		}
+
+		aDone := erra == io.EOF || erra == io.ErrUnexpectedEOF
+		bDone := errb == io.EOF || errb == io.ErrUnexpectedEOF
+		if erra != nil && !aDone {
+			return false, erra
+		}
+		if errb != nil && !bDone {
+			return false, errb
+		}
+
+		if aDone || bDone {
+			return aDone == bDone, nil
+		}
+	}
+}
+
+// latestVersion returns the id of the newest version of key if it holds the
+// same contents as key does now, or "" if key has changed since. The caller
+// must hold vfs.lock.
+func (vfs *FileStore) latestVersion(key string, info os.FileInfo) (string, error) {
+	all, err := vfs.versions(path.Dir(key))
+	if err != nil {
+		return "", err
+	}
+
+	vs := all[path.Base(key)]
+	if len(vs) == 0 {
+		return "", nil
+	}
+
+	v := vs[len(vs)-1]
+	if v.Size != info.Size() {
+		return "", nil
+	}
+
+	same, err := sameContents(vfs.store, key, versionPath(key, v.ID))
+	if err != nil || !same {
+		return "", err
+	}
+
+	return v.ID, nil
+}
+
+// saveVersion copies the current contents of key into a new version, and
+// returns its id. The caller must hold vfs.lock.
+func (vfs *FileStore) saveVersion(key string) (string, error) {
+	if err := vfs.store.Mkdir(versionDir(key)); err != nil {
+		return "", err
+	}
+
+	id := vfs.newID()
+	if err := copyFile(vfs.store, key, versionPath(key, id)); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// preserve saves the current contents of key, if it is a file, before it is
+// replaced or removed. The caller must hold vfs.lock.
+func (vfs *FileStore) preserve(key string) error {
+	info, err := vfs.store.Stat(key)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+
+	if _, err := vfs.saveVersion(key); err != nil {
+		return err
+	}
+
+	return vfs.prune(key)
+}
+
+func (vfs *FileStore) Open(fpath string) (io.ReadCloser, error) {
+	key := normPath(fpath)
+	if reserved(key) {
+		return nil, ErrReserved
+	}
+
+	return vfs.store.Open(key)
+}
+
+func (vfs *FileStore) Create(fpath string) (io.WriteCloser, error) {
+	key := normPath(fpath)
+	if reserved(key) {
+		return nil, ErrReserved
+	}
+
+	vfs.lock.Lock()
+	defer vfs.lock.Unlock()
+
+	if err := vfs.preserve(key); err != nil {
+		return nil, err
+	}
+
+	return vfs.store.Create(key)
+}
+
+func (vfs *FileStore) Mkdir(dpath string) error {
+	key := normPath(dpath)
+	if reserved(key) {
+		return ErrReserved
+	}
+
+	return vfs.store.Mkdir(key)
+}
+
+func (vfs *FileStore) Stat(fpath string) (os.FileInfo, error) {
+	key := normPath(fpath)
+	if reserved(key) {
+		return nil, ErrReserved
+	}
+
+	return vfs.store.Stat(key)
+}
+
+func (vfs *FileStore) Remove(fpath string) error {
+	key := normPath(fpath)
+	if reserved(key) {
+		return ErrReserved
+	}
+
+	vfs.lock.Lock()
+	defer vfs.lock.Unlock()
+
+	if err := vfs.preserve(key); err != nil {
+		return err
+	}
+
+	return vfs.store.Remove(key)
+}
+
+func (vfs *FileStore) GetFiles(dpath string) ([]os.FileInfo, error) {
+	key := normPath(dpath)
+	if reserved(key) {
+		return nil, ErrReserved
+	}
+
+	return vfs.store.GetFiles(key)
+}
+
+// versions returns the old versions of every file in the directory dkey,
+// keyed by file name and sorted oldest first.
+func (vfs *FileStore) versions(dkey string) (map[string][]Version, error) {
+	vdir := path.Join(filesDir, dkey)
+	if _, err := vfs.store.Stat(vdir); err != nil {
+		return nil, nil
+	}
+
+	infos, err := vfs.store.GetFiles(vdir)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string][]Version)
+	for _, info := range infos {
+		name, id, ok := parseVersionName(info.Name())
+		if !ok {
+			continue
+		}
+
+		ret[name] = append(ret[name], Version{id, idTime(id), info.Size()})
+	}
+
+	for _, vs := range ret {
+		sort.Slice(vs, func(i, j int) bool { return vs[i].ID < vs[j].ID })
+	}
+
+	return ret, nil
+}
+
+// Versions lists the old versions of a file, oldest first. The current
+// contents of the file are not included.
+func (vfs *FileStore) Versions(fpath string) ([]Version, error) {
+	key := normPath(fpath)
+	if reserved(key) {
+		return nil, ErrReserved
+	}
+
+	vs, err := vfs.versions(path.Dir(key))
+	if err != nil {
+		return nil, err
+	}
+
+	return vs[path.Base(key)], nil
+}
+
+// OpenVersion opens an old version of a file.
+func (vfs *FileStore) OpenVersion(fpath, id string) (io.ReadCloser, error) {
+	key := normPath(fpath)
+	if reserved(key) {
+		return nil, ErrReserved
+	}
+
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		return nil, ErrNoVersion
+	}
+
+	f, err := vfs.store.Open(versionPath(key, id))
+	if err != nil {
+		return nil, ErrNoVersion
+	}
+
+	return f, nil
+}
+
+// Restore replaces the contents of a file with an old version. The contents
+// being replaced are saved as a new version first, so a restore can be
+// undone.
+func (vfs *FileStore) Restore(fpath, id string) error {
+	r, err := vfs.OpenVersion(fpath, id)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := vfs.Create(fpath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+// pin adds snap to the count of snapshots pinning each of its versions, or
+// takes it away if delta is negative. The caller must hold vfs.lock.
+func (vfs *FileStore) pin(snap *Snapshot, delta int) {
+	for key, id := range snap.files {
+		vpath := versionPath(key, id)
+
+		if vfs.pins[vpath] += delta; vfs.pins[vpath] <= 0 {
+			delete(vfs.pins, vpath)
+		}
+	}
+}
+
+// pruneVersions removes the versions of key that the retention policy no
+// longer allows. The caller must hold vfs.lock.
+func (vfs *FileStore) pruneVersions(key string, vs []Version) error {
+	var unpinned []Version
+	for _, v := range vs {
+		if vfs.pins[versionPath(key, v.ID)] == 0 {
+			unpinned = append(unpinned, v)
+		}
+	}
+
+	for i, v := range unpinned {
+		tooMany := vfs.retention.MaxVersions > 0 && i < len(unpinned)-vfs.retention.MaxVersions
+		tooOld := vfs.retention.MaxAge > 0 && time.Since(v.Time) > vfs.retention.MaxAge
+
+		if !tooMany && !tooOld {
+			continue
+		}
+
+		if err := vfs.store.Remove(versionPath(key, v.ID)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// prune applies the retention policy to the versions of key. The caller must
+// hold vfs.lock.
+func (vfs *FileStore) prune(key string) error {
+	if vfs.retention.MaxVersions == 0 && vfs.retention.MaxAge == 0 {
+		return nil
+	}
+
+	vs, err := vfs.versions(path.Dir(key))
+	if err != nil {
+		return err
+	}
+
+	return vfs.pruneVersions(key, vs[path.Base(key)])
+}
+
+// Prune applies the retention policy to every file. Versions are pruned
+// whenever a file gets a new one, but expiring versions by age needs Prune to
+// be called every so often.
+func (vfs *FileStore) Prune() error {
+	vfs.lock.Lock()
+	defer vfs.lock.Unlock()
+
+	if vfs.retention.MaxVersions == 0 && vfs.retention.MaxAge == 0 {
+		return nil
+	}
+
+	vdirs, err := vfs.treeDirs(filesDir)
+	if err != nil {
+		return err
+	}
+
+	for _, vdir := range vdirs {
+		d := normPath(strings.TrimPrefix(vdir, filesDir))
+
+		all, err := vfs.versions(d)
+		if err != nil {
+			return err
+		}
+
+		for name, vs := range all {
+			if err := vfs.pruneVersions(normPath(path.Join(d, name)), vs); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// treeDirs returns the directories in the tree rooted at root, including root
+// itself, in sorted order. The hidden version directory is left out unless
+// root is inside it. Directories that disappear while the tree is being
+// listed are skipped.
+func (vfs *FileStore) treeDirs(root string) ([]string, error) {
+	var ret []string
+
+	queue := []string{root}
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+
+		infos, err := vfs.store.ReadDir(d)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, d)
+
+		for _, info := range infos {
+			if info == nil || !info.IsDir() {
+				continue
+			}
+
+			sub := normPath(path.Join(d, info.Name()))
+			if reserved(sub) && !reserved(root) {
+				continue
+			}
+
+			queue = append(queue, sub)
+		}
+	}
+
+	sort.Strings(ret)
+	return ret, nil
+}
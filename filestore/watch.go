@@ -0,0 +1,65 @@
+package fs
+
+// EventOp describes the kind of change an Event reports.
+type EventOp int
+
+const (
+	// A file or directory was created.
+	EventCreate EventOp = iota
+
+	// The contents of a file were changed.
+	EventModify
+
+	// A file or directory was removed.
+	EventRemove
+
+	// A file or directory was moved from OldPath to Path.
+	EventRename
+
+	// Some events were lost, so the watcher's view of the tree might be out
+	// of date. Consumers should rescan the watched directory.
+	EventOverflow
+)
+
+func (op EventOp) String() string {
+	switch op {
+	case EventCreate:
+		return "create"
+	case EventModify:
+		return "modify"
+	case EventRemove:
+		return "remove"
+	case EventRename:
+		return "rename"
+	case EventOverflow:
+		return "overflow"
+	}
+
+	return "unknown"
+}
+
+// Event describes a single change to a watched directory tree. Paths are
+// relative to the root of the file store, in the same form that is passed to
+// the other FileStore methods.
+type Event struct {
+	Op      EventOp
+	Path    string
+	OldPath string // only set for EventRename
+}
+
+// Watcher delivers the events for a directory tree. The Events channel is
+// closed when the watcher stops, either because Close was called or because
+// of an unrecoverable error.
+type Watcher interface {
+	Events() <-chan Event
+	Close() error
+}
+
+// WatchFileStore is implemented by file stores that can report changes to
+// the files they hold, so consumers don't have to rescan to find them.
+type WatchFileStore interface {
+	FileStore
+
+	// Watch the directory at path, and everything underneath it, for changes.
+	Watch(path string) (Watcher, error)
+}
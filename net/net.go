@@ -1,6 +1,7 @@
 package net
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 )
@@ -18,6 +19,17 @@ func (d TCPDialer) Dial() (net.Conn, error) {
 	return net.Dial("tcp", string(d))
 }
 
+// TLSDialer dials HostPort over TCP and performs a TLS handshake using
+// Config.
+type TLSDialer struct {
+	HostPort string
+	Config   *tls.Config
+}
+
+func (d TLSDialer) Dial() (net.Conn, error) {
+	return tls.Dial("tcp", d.HostPort, d.Config)
+}
+
 type Addr struct {
 	network string
 	str     string
@@ -70,7 +70,12 @@ func (c *Client) CallWrite(methodName string, fnargs ...interface{}) (io.WriteCl
 		return nil, fmt.Errorf("wrong rpc type, is this a read or normal rpc?")
 	}
 
-	return c.call(methodName, fnargs)
+	conn, err := c.call(methodName, fnargs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamWriter{conn: conn, coder: c.coder}, nil
 }
 
 func (c *Client) call(methodName string, fnargs []interface{}) (net.Conn, error) {
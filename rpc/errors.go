@@ -0,0 +1,130 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+const ErrNil = StrError("")
+
+// StrError is how rpc methods return errors. Only the message of an error
+// can be sent, so errors are flattened into one with NewError. If the error
+// was one of the registered ones, the StrError remembers which, and
+// errors.Is reports it as that error on the client too.
+type StrError string
+
+// codeMark starts the name of a registered error inside a StrError. The
+// name is followed by another codeMark and then the message.
+const codeMark = "\x00"
+
+var (
+	registryMu sync.RWMutex
+	registry   []registeredError
+)
+
+type registeredError struct {
+	name string
+	err  error
+}
+
+func init() {
+	RegisterError("not-exist", os.ErrNotExist)
+	RegisterError("exist", os.ErrExist)
+	RegisterError("permission", os.ErrPermission)
+}
+
+// RegisterError makes err survive being sent over an rpc, as long as the
+// server and client both register it under name. Registering the same error
+// under the same name again does nothing, but it panics if either one is
+// already registered with something else.
+//
+// When an error matches more than one registered error, NewError picks the
+// one that was registered first.
+func RegisterError(name string, err error) {
+	if name == "" || strings.Contains(name, codeMark) {
+		panic(fmt.Sprintf("rpc: bad error name %q", name))
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	for _, r := range registry {
+		switch {
+		case r.name == name && r.err == err:
+			return
+		case r.name == name:
+			panic(fmt.Sprintf("rpc: error name %q registered twice", name))
+		case r.err == err:
+			panic(fmt.Sprintf("rpc: error %q registered as both %q and %q", err, r.name, name))
+		}
+	}
+
+	registry = append(registry, registeredError{name, err})
+}
+
+// NewError turns err into a StrError, remembering which registered error it
+// is, if any. A nil err becomes ErrNil.
+func NewError(err error) StrError {
+	if err == nil {
+		return ErrNil
+	}
+
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	for _, r := range registry {
+		if errors.Is(err, r.err) {
+			return StrError(codeMark + r.name + codeMark + err.Error())
+		}
+	}
+
+	return StrError(err.Error())
+}
+
+// split returns the name of the registered error s is, if any, and its
+// message.
+func (s StrError) split() (name, msg string) {
+	str := string(s)
+	if !strings.HasPrefix(str, codeMark) {
+		return "", str
+	}
+
+	i := strings.Index(str[len(codeMark):], codeMark)
+	if i < 0 {
+		return "", str
+	}
+
+	return str[len(codeMark) : len(codeMark)+i], str[2*len(codeMark)+i:]
+}
+
+func (s StrError) IsNil() bool {
+	return s == ""
+}
+
+func (s StrError) Error() string {
+	_, msg := s.split()
+	return msg
+}
+
+// Is reports whether s was made from target by NewError, or from an error
+// that wraps it.
+func (s StrError) Is(target error) bool {
+	name, _ := s.split()
+	if name == "" {
+		return false
+	}
+
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	for _, r := range registry {
+		if r.name == name {
+			return r.err == target
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,115 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+)
+
+var errTest = errors.New("test error")
+
+func init() {
+	RegisterError("test", errTest)
+}
+
+type errServer struct{}
+
+var serverErrors = map[string]error{
+	"not-exist":    fmt.Errorf("file a: %w", os.ErrNotExist),
+	"registered":   fmt.Errorf("wrapped: %w", errTest),
+	"unregistered": errors.New("something broke"),
+}
+
+func (errServer) RPCNorm_Fail(name string) StrError {
+	return NewError(serverErrors[name])
+}
+
+func (errServer) RPCWrite_Write(name string) (io.WriteCloser, StrError) {
+	return &failWriter{serverErrors[name]}, ErrNil
+}
+
+type failWriter struct {
+	err error
+}
+
+func (w *failWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *failWriter) Close() error {
+	return w.err
+}
+
+// TestErrorRoundTrip checks that registered errors can still be told apart
+// with errors.Is on the client, whether they come back from a call or from
+// closing a write stream.
+func TestErrorRoundTrip(t *testing.T) {
+	cli, _ := newTestCliSrv(t, errServer{})
+
+	tests := []struct {
+		name string
+		want error
+	}{
+		{"not-exist", os.ErrNotExist},
+		{"registered", errTest},
+		{"unregistered", nil},
+	}
+
+	for _, test := range tests {
+		var callErr StrError
+		if err := cli.Call(serverPrefix+".Fail", test.name, &callErr); err != nil {
+			t.Fatalf("%v: call error: %v", test.name, err)
+		}
+
+		w, err := cli.CallWrite(serverPrefix+".Write", test.name, new(StrError))
+		if err != nil {
+			t.Fatalf("%v: CallWrite error: %v", test.name, err)
+		}
+		w.Write([]byte("data"))
+
+		for _, err := range []error{callErr, w.Close()} {
+			if got, want := err.Error(), serverErrors[test.name].Error(); got != want {
+				t.Errorf("%v: got message %q, want %q", test.name, got, want)
+			}
+
+			if test.want != nil && !errors.Is(err, test.want) {
+				t.Errorf("%v: errors.Is(%v, %v) is false", test.name, err, test.want)
+			}
+			for _, other := range []error{os.ErrNotExist, os.ErrExist, errTest} {
+				if other != test.want && errors.Is(err, other) {
+					t.Errorf("%v: errors.Is(%v, %v) is true", test.name, err, other)
+				}
+			}
+		}
+	}
+}
+
+func TestRegisterError(t *testing.T) {
+	// Registering the same error again is fine.
+	RegisterError("test", errTest)
+
+	for _, reg := range []struct {
+		name string
+		err  error
+	}{
+		{"test", errors.New("another error")},
+		{"other", errTest},
+		{"bad\x00name", errors.New("another error")},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("registering %v as %q didn't panic", reg.err, reg.name)
+				}
+			}()
+
+			RegisterError(reg.name, reg.err)
+		}()
+	}
+
+	if err := NewError(nil); !err.IsNil() {
+		t.Errorf("NewError(nil) got %q, want ErrNil", err)
+	}
+}
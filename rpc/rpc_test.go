@@ -6,6 +6,7 @@ import (
 	"log"
 	"sync"
 	"testing"
+	"time"
 
 	anet "github.com/shaladdle/goaaw/net"
 )
@@ -230,6 +231,183 @@ func TestReadWriteRPC(t *testing.T) {
 	}
 }
 
+// ackServer hands out writers that record how they were finished.
+type ackServer struct {
+	closeErr error
+	done     chan string
+}
+
+type ackWriter struct {
+	bytes.Buffer
+	s *ackServer
+}
+
+func (w *ackWriter) Close() error {
+	w.s.done <- "closed " + w.String()
+	return w.s.closeErr
+}
+
+func (w *ackWriter) Abort() error {
+	w.s.done <- "aborted " + w.String()
+	return nil
+}
+
+// Verify accepts only the digest "sum of " followed by the data.
+func (w *ackWriter) Verify(digest []byte) error {
+	if string(digest) != "sum of "+w.String() {
+		return StrError("bad digest")
+	}
+	return nil
+}
+
+func (s *ackServer) RPCWrite_Write() (io.WriteCloser, StrError) {
+	return &ackWriter{s: s}, ErrNil
+}
+
+// TestWriteRPCAck checks that errors from closing the server's writer are
+// returned by Close on the client.
+func TestWriteRPCAck(t *testing.T) {
+	s := &ackServer{closeErr: StrError("disk full"), done: make(chan string, 1)}
+	cli, _ := newTestCliSrv(t, s)
+
+	var callErr StrError
+	w, err := cli.CallWrite(serverPrefix+".Write", &callErr)
+	if err != nil {
+		t.Fatalf("CallWrite error: %v", err)
+	}
+
+	w.Write([]byte("data"))
+	if err := w.Close(); err == nil || err.Error() != "disk full" {
+		t.Errorf("Close got %v, want the server's error", err)
+	}
+
+	if got := <-s.done; got != "closed data" {
+		t.Errorf("server writer got %q, want %q", got, "closed data")
+	}
+}
+
+// TestWriteRPCDigest checks that the server's writer is only committed when
+// the digest the client closes with checks out.
+func TestWriteRPCDigest(t *testing.T) {
+	s := &ackServer{done: make(chan string, 1)}
+	cli, _ := newTestCliSrv(t, s)
+
+	var callErr StrError
+	w, err := cli.CallWrite(serverPrefix+".Write", &callErr)
+	if err != nil {
+		t.Fatalf("CallWrite error: %v", err)
+	}
+
+	w.Write([]byte("data"))
+	if err := w.(DigestCloser).CloseDigest([]byte("sum of data")); err != nil {
+		t.Fatalf("CloseDigest error: %v", err)
+	}
+	if got := <-s.done; got != "closed data" {
+		t.Errorf("server writer got %q, want %q", got, "closed data")
+	}
+
+	w, err = cli.CallWrite(serverPrefix+".Write", &callErr)
+	if err != nil {
+		t.Fatalf("CallWrite error: %v", err)
+	}
+
+	w.Write([]byte("data"))
+	if err := w.(DigestCloser).CloseDigest([]byte("sum of other")); err == nil || err.Error() != "bad digest" {
+		t.Errorf("CloseDigest got %v, want the server's error", err)
+	}
+	if got := <-s.done; got != "aborted data" {
+		t.Errorf("server writer got %q, want %q", got, "aborted data")
+	}
+}
+
+// TestWriteRPCTruncated cuts off a write stream and checks that the server
+// aborts the writer instead of closing it.
+func TestWriteRPCTruncated(t *testing.T) {
+	s := &ackServer{done: make(chan string, 1)}
+	cli, _ := newTestCliSrv(t, s)
+
+	var callErr StrError
+	conn, err := cli.call(serverPrefix+".Write", []interface{}{&callErr})
+	if err != nil {
+		t.Fatalf("call error: %v", err)
+	}
+
+	w := &streamWriter{conn: conn, coder: cli.coder}
+	w.Write([]byte("partial"))
+	conn.Close()
+
+	if got := <-s.done; got != "aborted partial" {
+		t.Errorf("server writer got %q, want %q", got, "aborted partial")
+	}
+}
+
+// TestWriteRPCAbort checks that aborting a write stream from the client
+// aborts the server's writer before Abort returns.
+func TestWriteRPCAbort(t *testing.T) {
+	s := &ackServer{done: make(chan string, 1)}
+	cli, _ := newTestCliSrv(t, s)
+
+	var callErr StrError
+	w, err := cli.CallWrite(serverPrefix+".Write", &callErr)
+	if err != nil {
+		t.Fatalf("CallWrite error: %v", err)
+	}
+
+	w.Write([]byte("unwanted"))
+	if err := w.(Aborter).Abort(); err != nil {
+		t.Errorf("Abort error: %v", err)
+	}
+
+	select {
+	case got := <-s.done:
+		if got != "aborted unwanted" {
+			t.Errorf("server writer got %q, want %q", got, "aborted unwanted")
+		}
+	default:
+		t.Errorf("Abort returned before the server aborted its writer")
+	}
+}
+
+// idleServer hands out a stream that never has anything to send.
+type idleServer struct {
+	closed chan bool
+}
+
+type idleReader struct {
+	*io.PipeReader
+	s *idleServer
+}
+
+func (r idleReader) Close() error {
+	r.s.closed <- true
+	return r.PipeReader.Close()
+}
+
+func (s *idleServer) RPCRead_Idle() (io.Reader, StrError) {
+	r, _ := io.Pipe()
+	return idleReader{r, s}, ErrNil
+}
+
+// TestReadRPCDisconnect checks that the server closes a read stream once the
+// client goes away, even though the stream is still waiting for data.
+func TestReadRPCDisconnect(t *testing.T) {
+	s := &idleServer{closed: make(chan bool, 2)}
+	cli, _ := newTestCliSrv(t, s)
+
+	var callErr StrError
+	r, err := cli.CallRead(serverPrefix+".Idle", &callErr)
+	if err != nil {
+		t.Fatalf("CallRead error: %v", err)
+	}
+	r.(io.Closer).Close()
+
+	select {
+	case <-s.closed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("server didn't close the stream after the client went away")
+	}
+}
+
 // TODO: Add test case to make sure server can handle nil return values on a
 // streaming RPC.
 
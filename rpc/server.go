@@ -3,6 +3,7 @@ package rpc
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/rpc"
@@ -12,18 +13,6 @@ import (
 	anet "github.com/shaladdle/goaaw/net"
 )
 
-const ErrNil = StrError("")
-
-type StrError string
-
-func (s StrError) IsNil() bool {
-	return s == ""
-}
-
-func (s StrError) Error() string {
-	return string(s)
-}
-
 const (
 	tagRPC = byte(iota)
 	tagHandshake
@@ -92,7 +81,11 @@ func NewServerWithCoder(coder Coder) *Server {
 //  func RPCRead_methodNameHere(t1, t2, t3 ... , tn) (io.Reader, rt1, rt2 ... rtn)
 //  func RPCWrite_methodNameHere(t1, t2, t3 ... , tn) (io.Writer, rt1, rt2 ... rtn)
 //
-//TODO: Support io.ReadCloser instead of io.Reader
+// If the io.Reader returned by a read rpc is also an io.Closer, it is closed
+// once the stream is finished or the client goes away. The writer returned by
+// a write rpc is closed once the client closes its end, and the error from
+// Close is returned to the client. If the stream is cut off instead, the
+// writer is aborted; see Aborter.
 func (s *Server) Register(name string, rcvr interface{}) error {
 	const (
 		norm_prefix  = "RPCNorm_"
@@ -168,20 +161,31 @@ func (s *Server) Accept(lis net.Listener) {
 			return
 		case conn = <-conns:
 		}
-		var tag byte
 
-		if err := s.coder.Decode(conn, &tag); err != nil {
-			panic(err)
-		}
+		go s.serveConn(conn)
+	}
+}
 
-		switch tag {
-		case tagHandshake:
-			go s.handshake(conn)
-		case tagRPC:
-			go s.handleRPC(conn)
-		default:
-			panic("Unrecognized message")
-		}
+// serveConn reads the tag a connection starts with and hands it off. This
+// happens off the accept loop so that a client that is slow to send the tag,
+// or whose TLS handshake fails, doesn't hold up everyone else.
+func (s *Server) serveConn(conn net.Conn) {
+	var tag byte
+
+	if err := s.coder.Decode(conn, &tag); err != nil {
+		log.Println(err)
+		conn.Close()
+		return
+	}
+
+	switch tag {
+	case tagHandshake:
+		s.handshake(conn)
+	case tagRPC:
+		s.handleRPC(conn)
+	default:
+		log.Printf("unrecognized message tag %v", tag)
+		conn.Close()
 	}
 }
 
@@ -241,7 +245,21 @@ func (s *Server) handleRPC(conn net.Conn) {
 			return
 		}
 
-		if _, err := io.Copy(conn, outs[0].Interface().(io.Reader)); err != nil {
+		r := outs[0].Interface().(io.Reader)
+		if c, ok := r.(io.Closer); ok {
+			defer c.Close()
+
+			// The client doesn't send anything more, so reading from
+			// the connection only returns once it has gone away. A
+			// stream waiting for something to send is closed then,
+			// instead of when it next has something.
+			go func() {
+				io.Copy(ioutil.Discard, conn)
+				c.Close()
+			}()
+		}
+
+		if _, err := io.Copy(conn, r); err != nil {
 			log.Println(err)
 			return
 		}
@@ -250,12 +268,7 @@ func (s *Server) handleRPC(conn net.Conn) {
 			return
 		}
 
-		w := outs[0].Interface().(io.WriteCloser)
-		if _, err := io.Copy(w, conn); err != nil {
-			log.Println(err)
-			return
-		}
-		w.Close()
+		s.serveWrite(conn, outs[0].Interface().(io.WriteCloser))
 	}
 }
 
@@ -0,0 +1,225 @@
+package rpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+)
+
+// The data of a write rpc is sent as a series of frames, each a 4 byte length
+// followed by that many bytes. A frame of length 0 marks the end of the
+// stream. It is followed by the client's digest of the data, which may be
+// empty, after which the server checks the digest, closes its writer and
+// replies with the error it returned. This way the client finds out whether
+// the data really made it, and the server can tell a stream that was finished
+// apart from one that was cut off. A client that wants to give up on a stream
+// sends abortFrame instead, and the server aborts its writer before replying.
+
+const abortFrame = 1<<32 - 1
+
+// ErrTruncated is returned by the reader on the server side of a write rpc
+// when the connection ends before the client closes the stream.
+var ErrTruncated = errors.New("rpc: write stream was cut off")
+
+// Aborter is implemented by writers returned from write rpcs that need to
+// know when a stream was cut off, so that they can throw away what they got
+// instead of committing it. If the writer doesn't implement Aborter, it is
+// closed as usual.
+type Aborter interface {
+	Abort() error
+}
+
+// Verifier is implemented by writers returned from write rpcs that can check
+// what they were sent against the digest the client closed the stream with,
+// before committing it. If Verify fails, the writer is aborted instead of
+// closed, and the client gets the error. Streams closed without a digest
+// aren't checked.
+type Verifier interface {
+	Verify(digest []byte) error
+}
+
+// DigestCloser is implemented by the writers returned by CallWrite.
+// CloseDigest is like Close, but sends digest for the server's writer to
+// check before it commits the data; see Verifier.
+type DigestCloser interface {
+	CloseDigest(digest []byte) error
+}
+
+// streamWriter is the client side of a write rpc.
+type streamWriter struct {
+	conn  net.Conn
+	coder Coder
+	hdr   [4]byte
+}
+
+func (w *streamWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	binary.BigEndian.PutUint32(w.hdr[:], uint32(len(b)))
+	if _, err := w.conn.Write(w.hdr[:]); err != nil {
+		return 0, err
+	}
+
+	return w.conn.Write(b)
+}
+
+// Close ends the stream and waits for the server to report whether it was
+// able to commit the data.
+func (w *streamWriter) Close() error {
+	return w.CloseDigest(nil)
+}
+
+func (w *streamWriter) CloseDigest(digest []byte) error {
+	defer w.conn.Close()
+
+	binary.BigEndian.PutUint32(w.hdr[:], 0)
+	if _, err := w.conn.Write(w.hdr[:]); err != nil {
+		return err
+	}
+
+	if err := w.coder.Encode(w.conn, digest); err != nil {
+		return err
+	}
+
+	return w.waitAck()
+}
+
+// Abort tells the server to throw away what it has received instead of
+// committing it, and waits until it has.
+func (w *streamWriter) Abort() error {
+	defer w.conn.Close()
+
+	binary.BigEndian.PutUint32(w.hdr[:], abortFrame)
+	if _, err := w.conn.Write(w.hdr[:]); err != nil {
+		return err
+	}
+
+	return w.waitAck()
+}
+
+func (w *streamWriter) waitAck() error {
+	var ack StrError
+	if err := w.coder.Decode(w.conn, &ack); err != nil {
+		return err
+	}
+
+	if !ack.IsNil() {
+		return ack
+	}
+
+	return nil
+}
+
+// errAborted is returned by streamReader when the client aborts the stream.
+var errAborted = errors.New("rpc: write stream was aborted")
+
+// streamReader is the server side of a write rpc. It returns io.EOF once the
+// client has closed the stream, errAborted if the client aborts it, and
+// ErrTruncated if the connection ends first.
+type streamReader struct {
+	conn io.Reader
+	left uint32
+	done bool
+}
+
+func (r *streamReader) Read(b []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+
+	if r.left == 0 {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r.conn, hdr[:]); err != nil {
+			return 0, ErrTruncated
+		}
+
+		r.left = binary.BigEndian.Uint32(hdr[:])
+		switch r.left {
+		case 0:
+			r.done = true
+			return 0, io.EOF
+		case abortFrame:
+			r.left = 0
+			return 0, errAborted
+		}
+	}
+
+	if uint32(len(b)) > r.left {
+		b = b[:r.left]
+	}
+
+	n, err := r.conn.Read(b)
+	r.left -= uint32(n)
+	if err != nil && n == 0 {
+		return 0, ErrTruncated
+	}
+
+	return n, nil
+}
+
+// serveWrite copies a write rpc's stream into w, then acknowledges it.
+func (s *Server) serveWrite(conn net.Conn, w io.WriteCloser) {
+	defer conn.Close()
+
+	r := &streamReader{conn: conn}
+
+	_, err := io.Copy(w, r)
+	if err != nil && err != ErrTruncated && err != errAborted {
+		// The writer failed, but the client will keep sending until it
+		// closes the stream, so read the rest before replying.
+		if _, derr := io.Copy(ioutil.Discard, r); derr != nil {
+			err = derr
+		}
+	}
+
+	// A stream that was closed is followed by the client's digest.
+	var digest []byte
+	if r.done {
+		if derr := s.coder.Decode(conn, &digest); derr != nil {
+			err = ErrTruncated
+		}
+	}
+
+	switch err {
+	case nil:
+		err = commit(w, digest)
+	case ErrTruncated:
+		abort(w)
+		log.Println(err)
+		return
+	case errAborted:
+		err = abort(w)
+	default:
+		abort(w)
+	}
+
+	if err := s.coder.Encode(conn, NewError(err)); err != nil {
+		log.Println(err)
+	}
+}
+
+// commit closes w, unless it can check digest and finds that it doesn't
+// match, in which case it is aborted.
+func commit(w io.WriteCloser, digest []byte) error {
+	if v, ok := w.(Verifier); ok && len(digest) > 0 {
+		if err := v.Verify(digest); err != nil {
+			abort(w)
+			return err
+		}
+	}
+
+	return w.Close()
+}
+
+func abort(w io.WriteCloser) error {
+	if a, ok := w.(Aborter); ok {
+		return a.Abort()
+	}
+
+	return w.Close()
+}
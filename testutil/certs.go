@@ -14,7 +14,7 @@ import (
 )
 
 func CreateCertKeyFiles(keyFile, certFile string) error {
-	return createCertAndKey(keyFile, certFile, "localhost", true)
+	return createCertAndKey(certFile, keyFile, "localhost", true)
 }
 
 func createCertAndKey(certPath, keyPath, host string, ca bool) error {
@@ -77,14 +77,14 @@ func createCertAndKey(certPath, keyPath, host string, ca bool) error {
 		return err
 	}
 
-	certOut, err := os.Create("cert.pem")
+	certOut, err := os.Create(certPath)
 	if err != nil {
 		return err
 	}
 	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
 	certOut.Close()
 
-	keyOut, err := os.OpenFile("key.pem", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	keyOut, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}